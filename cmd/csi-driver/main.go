@@ -1,15 +1,26 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/admin"
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/admin/adminpb"
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/archive"
 	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/driver"
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/kms"
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/kube"
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/metrics"
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/seed"
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/volume"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc"
 	"k8s.io/klog/v2"
@@ -19,6 +30,39 @@ var (
 	endpoint = flag.String("endpoint", "unix:///var/lib/kubelet/plugins/ephemeral.csi.local/csi.sock", "CSI endpoint")
 	nodeID   = flag.String("nodeid", "", "Node ID")
 	basePath = flag.String("base-path", "/var/lib/ephemeral-csi", "Base path for volumes")
+
+	poolsConfig = flag.String("pools-config", "", "YAML or JSON file listing the storage pools volumes are created in and how they are placed, empty to create volumes in the base path")
+
+	retentionInterval = flag.Duration("retention-check-interval", time.Minute, "How often retained volumes are checked for expiry")
+
+	warmPoolCount      = flag.Int("warm-pool-count", 0, "Number of pre-created volumes to keep ready for new volumes, 0 to disable the warm pool")
+	warmPoolVolumeSize = flag.Int64("warm-pool-volume-size", 0, "Capacity in bytes of warm pool volumes, only requests for exactly this capacity are served from the pool (default 1GiB)")
+	warmPoolBackend    = flag.String("warm-pool-backend", "", "Backend warm pool volumes are prepared for: empty for plain directories, or overlay")
+	warmPoolPool       = flag.String("warm-pool-storage-pool", "", "Storage pool warm pool volumes are created in, empty for the first pool")
+
+	gcInterval    = flag.Duration("gc-interval", 10*time.Minute, "How often garbage collection runs in the background, 0 to only run it through the admin API")
+	idleVolumeTTL = flag.Duration("idle-volume-ttl", 0, "Delete unpublished volumes that were not accessed for this long, 0 to keep them")
+	gcDryRun      = flag.Bool("gc-dry-run", false, "Only log what garbage collection would do")
+
+	quotaPolicy = flag.String("quota-policy", "", "YAML or JSON file limiting the total capacity and number of volumes each namespace may have on the node, empty to disable quotas")
+
+	kmsKeyFile  = flag.String("kms-key-file", "", "File holding the 32 byte key that wraps the data keys of encrypted volumes")
+	kmsEndpoint = flag.String("kms-endpoint", "", "Endpoint of a KMS plugin that wraps the data keys of encrypted volumes, e.g. unix:///var/run/ephemeral-csi-kms/kms.sock")
+
+	cgroupRoot = flag.String("cgroup-root", volume.DefaultCgroupRoot, "Where the cgroup v2 hierarchy is mounted, used to apply the I/O limits of volumes to pods")
+	procRoot   = flag.String("proc-root", volume.DefaultProcRoot, "Where the proc filesystem of the host is mounted, used to discover the user namespaces of pods")
+
+	reaperWorkers = flag.Int("reaper-workers", 2, "Number of workers removing deleted volumes from the trash in the background")
+
+	archiveSink = flag.String("archive-sink", "", "Where volumes with archiveOnDelete are archived: a directory, file:///path or s3://bucket/prefix?endpoint=https://host")
+
+	seedLocalDir = flag.String("seed-local-dir", "", "Directory local seed archives, git repositories, bundles and OCI layouts must be in, empty to only allow HTTP(S) archives")
+
+	baseLayersDir = flag.String("base-layers-dir", "", "Directory the read-only base directories of copy-on-write volumes must be in, empty to disable overlay volumes")
+
+	metricsAddress = flag.String("metrics-address", "", "Address to serve Prometheus metrics on, e.g. :9809, empty to disable")
+
+	adminEndpoint = flag.String("admin-endpoint", "unix:///var/lib/kubelet/plugins/ephemeral.csi.local/admin.sock", "Admin API endpoint used by ephemeralctl, empty to disable")
 )
 
 func main() {
@@ -29,12 +73,115 @@ func main() {
 		klog.Fatal("Node ID is required")
 	}
 
+	opts := []driver.Option{driver.WithBaseLayerDir(*baseLayersDir)}
+	// Encrypted volumes need a key manager for their data keys
+	switch {
+	case *kmsKeyFile != "" && *kmsEndpoint != "":
+		klog.Fatal("--kms-key-file and --kms-endpoint are mutually exclusive")
+	case *kmsKeyFile != "":
+		keys, err := kms.NewLocalKeyFile(*kmsKeyFile)
+		if err != nil {
+			klog.Fatalf("Failed to load KMS key: %v", err)
+		}
+		opts = append(opts, driver.WithKeyManager(keys))
+	case *kmsEndpoint != "":
+		keys, err := kms.NewPlugin(*kmsEndpoint)
+		if err != nil {
+			klog.Fatalf("Failed to connect to KMS plugin: %v", err)
+		}
+		defer keys.Close()
+		opts = append(opts, driver.WithKeyManager(keys))
+	}
+	if *poolsConfig != "" {
+		cfg, err := volume.LoadPoolConfig(*poolsConfig)
+		if err != nil {
+			klog.Fatalf("Failed to load pool configuration: %v", err)
+		}
+		opts = append(opts, driver.WithPools(cfg))
+	}
+	// Pod status lookups are only possible when running in a cluster
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		client, err := kube.NewInClusterClient()
+		if err != nil {
+			klog.Warningf("Pod status lookups disabled: %v", err)
+		} else {
+			opts = append(opts, driver.WithPodStatusGetter(client))
+		}
+	}
+
 	// Create CSI driver
-	d, err := driver.NewDriver(*nodeID, *basePath)
+	d, err := driver.NewDriver(*nodeID, *basePath, opts...)
 	if err != nil {
 		klog.Fatalf("Failed to create driver: %v", err)
 	}
 
+	// Archive volumes that opt in before their data is removed
+	if *archiveSink != "" {
+		sink, err := archive.NewSink(*archiveSink)
+		if err != nil {
+			klog.Fatalf("Failed to create archive sink: %v", err)
+		}
+		d.VolumeManager().SetArchiver(archive.NewArchiver(sink, *nodeID))
+		klog.Infof("Archiving volumes with archiveOnDelete to %s", sink)
+	}
+
+	// Seed volumes that ask for it from an archive
+	seeder, err := seed.NewSeeder(seed.Config{
+		BaseDir:  *basePath,
+		LocalDir: *seedLocalDir,
+	})
+	if err != nil {
+		klog.Fatalf("Failed to create seeder: %v", err)
+	}
+	d.VolumeManager().SetPopulator(seeder)
+
+	// Keep volumes ready so publishing does not wait for them to be created
+	if err := d.VolumeManager().SetWarmPool(volume.WarmPoolConfig{
+		Count:   *warmPoolCount,
+		Size:    *warmPoolVolumeSize,
+		Backend: *warmPoolBackend,
+		Pool:    *warmPoolPool,
+	}); err != nil {
+		klog.Fatalf("Failed to set up warm pool: %v", err)
+	}
+
+	d.VolumeManager().SetCgroupRoot(*cgroupRoot)
+	d.VolumeManager().SetProcRoot(*procRoot)
+
+	// Keep a single namespace from taking all of the node's scratch space
+	if *quotaPolicy != "" {
+		policy, err := volume.LoadQuotaPolicy(*quotaPolicy)
+		if err != nil {
+			klog.Fatalf("Failed to load quota policy: %v", err)
+		}
+		d.VolumeManager().SetQuotaPolicy(policy)
+	}
+
+	if *metricsAddress != "" {
+		go func() {
+			if err := metrics.Serve(*metricsAddress); err != nil {
+				klog.Fatalf("Failed to serve metrics: %v", err)
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Delete retained volumes once their retention expires
+	go d.VolumeManager().RunRetentionJanitor(ctx, *retentionInterval)
+
+	// Remove deleted volumes in the background, including those left in the
+	// trash by a previous run
+	go d.VolumeManager().RunReaper(ctx, *reaperWorkers)
+	go d.VolumeManager().RunWarmPool(ctx)
+
+	// Reconcile volume state and delete abandoned volumes
+	d.VolumeManager().SetGCOptions(volume.GCOptions{IdleTTL: *idleVolumeTTL, DryRun: *gcDryRun})
+	if *gcInterval > 0 {
+		go d.VolumeManager().RunGarbageCollector(ctx, *gcInterval, d.NodeMounter().MountPoints)
+	}
+
 	// Create the gRPC server
 	s := grpc.NewServer()
 
@@ -43,22 +190,12 @@ func main() {
 	csi.RegisterControllerServer(s, d)
 	csi.RegisterNodeServer(s, d)
 
-	// Create the socket directory
-	socketDir := filepath.Dir(strings.TrimPrefix(*endpoint, "unix://"))
-	if err := os.MkdirAll(socketDir, 0755); err != nil {
-		klog.Fatalf("Failed to create socket directory: %v", err)
-	}
-
-	// Remove the socket if it exists
-	if err := os.Remove(strings.TrimPrefix(*endpoint, "unix://")); err != nil && !os.IsNotExist(err) {
-		klog.Fatalf("Failed to remove existing socket: %v", err)
-	}
-
 	// Create the listener
-	lis, err := net.Listen("unix", strings.TrimPrefix(*endpoint, "unix://"))
+	lis, err := listen(*endpoint)
 	if err != nil {
 		klog.Fatalf("Failed to listen: %v", err)
 	}
+	socketDir := filepath.Dir(strings.TrimPrefix(*endpoint, "unix://"))
 
 	// Create the registration file
 	regFile := filepath.Join(socketDir, "registration")
@@ -74,12 +211,56 @@ func main() {
 		}
 	}()
 
+	// Start the admin server on its own socket
+	var adminServer *grpc.Server
+	if *adminEndpoint != "" {
+		adminLis, err := listen(*adminEndpoint)
+		if err != nil {
+			klog.Fatalf("Failed to listen on admin endpoint: %v", err)
+		}
+
+		adminServer = grpc.NewServer()
+		adminpb.RegisterAdminServer(adminServer, admin.NewServer(d.VolumeManager(), d.NodeMounter()))
+
+		klog.Infof("Starting admin server on %s", *adminEndpoint)
+		go func() {
+			if err := adminServer.Serve(adminLis); err != nil {
+				klog.Fatalf("Failed to serve admin API: %v", err)
+			}
+		}()
+	}
+
 	// Wait for signal
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
 	<-sigc
 
 	// Cleanup
+	cancel()
+	if adminServer != nil {
+		adminServer.GracefulStop()
+	}
 	s.GracefulStop()
 	klog.Info("Driver stopped")
 }
+
+// listen creates a unix socket listener for endpoint, replacing any stale
+// socket left behind by a previous run
+func listen(endpoint string) (net.Listener, error) {
+	if !strings.HasPrefix(endpoint, "unix://") {
+		return nil, fmt.Errorf("unsupported endpoint %q, only unix:// is supported", endpoint)
+	}
+	socketPath := strings.TrimPrefix(endpoint, "unix://")
+
+	// Create the socket directory
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %v", err)
+	}
+
+	// Remove the socket if it exists
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove existing socket: %v", err)
+	}
+
+	return net.Listen("unix", socketPath)
+}
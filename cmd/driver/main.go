@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"google.golang.org/grpc"
 	"k8s.io/klog/v2"
@@ -15,8 +17,9 @@ import (
 )
 
 var (
-	endpoint = flag.String("endpoint", "unix:///var/lib/kubelet/plugins/ephemeral.csi.local/csi.sock", "CSI endpoint")
-	nodeID   = flag.String("nodeid", "", "Node ID")
+	endpoint          = flag.String("endpoint", "unix:///var/lib/kubelet/plugins/ephemeral.csi.local/csi.sock", "CSI endpoint")
+	nodeID            = flag.String("nodeid", "", "Node ID")
+	retentionInterval = flag.Duration("retention-check-interval", time.Minute, "How often retained volumes are checked for expiry")
 )
 
 func main() {
@@ -29,6 +32,12 @@ func main() {
 		klog.Fatalf("Failed to create driver: %v", err)
 	}
 
+	// Delete retained volumes once their retention expires
+	go d.VolumeManager().RunRetentionJanitor(context.Background(), *retentionInterval)
+
+	// Remove deleted volumes in the background
+	go d.VolumeManager().RunReaper(context.Background(), 1)
+
 	// Create the gRPC server
 	s := grpc.NewServer()
 
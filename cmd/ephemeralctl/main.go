@@ -0,0 +1,241 @@
+// Command ephemeralctl inspects and repairs the state of the ephemeral CSI
+// node plugin through its admin socket.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/admin/adminpb"
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/sanity"
+)
+
+const usage = `ephemeralctl inspects the ephemeral CSI node plugin on this node.
+
+Usage:
+  ephemeralctl [flags] <command> [command flags] [args]
+
+Commands:
+  list                 List volumes with pod, size, usage, mounts and age,
+                       optionally only those of a namespace (-n) or pod (-pod)
+  inspect <volume-id>  Show a single volume
+  unpublish <volume-id>
+                       Force-unpublish a volume from its mount points
+  gc                   Trigger a garbage collection run (-dry-run to only report),
+                       or show the last one (-last)
+  dump                 Dump the raw VolumeManager state
+  sanity               Run the CSI conformance harness against the CSI endpoint
+
+Flags:
+`
+
+var (
+	endpoint = flag.String("endpoint", "unix:///var/lib/kubelet/plugins/ephemeral.csi.local/admin.sock", "Admin API endpoint of the node plugin")
+	output   = flag.String("o", "table", "Output format: table, json or yaml")
+	timeout  = flag.Duration("timeout", 30*time.Second, "Timeout for admin API calls")
+)
+
+type command func(ctx context.Context, args []string) error
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(name string, args []string) error {
+	p, err := newPrinter(*output)
+	if err != nil {
+		return err
+	}
+
+	// The sanity harness talks to the CSI endpoint, not the admin API
+	if name == "sanity" {
+		return runSanity(p, args)
+	}
+
+	commands := map[string]func(adminpb.AdminClient, *printer) command{
+		"list":      listCommand,
+		"inspect":   inspectCommand,
+		"unpublish": unpublishCommand,
+		"gc":        gcCommand,
+		"dump":      dumpCommand,
+	}
+	newCommand, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q, see ephemeralctl -h", name)
+	}
+
+	conn, err := grpc.Dial(*endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", *endpoint, err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	return newCommand(adminpb.NewAdminClient(conn), p)(ctx, args)
+}
+
+func listCommand(client adminpb.AdminClient, p *printer) command {
+	return func(ctx context.Context, args []string) error {
+		fs := flag.NewFlagSet("list", flag.ExitOnError)
+		noUsage := fs.Bool("no-usage", false, "Skip walking volume trees to compute usage")
+		namespace := fs.String("n", "", "Only list volumes of pods in this namespace")
+		pod := fs.String("pod", "", "Only list volumes of this pod, requires -n")
+		fs.Parse(args)
+
+		resp, err := client.ListVolumes(ctx, &adminpb.ListVolumesRequest{
+			WithUsage: !*noUsage,
+			Namespace: *namespace,
+			Pod:       *pod,
+		})
+		if err != nil {
+			return err
+		}
+		return p.printVolumes(resp.Volumes, resp)
+	}
+}
+
+func inspectCommand(client adminpb.AdminClient, p *printer) command {
+	return func(ctx context.Context, args []string) error {
+		volumeID, err := volumeIDArg("inspect", args)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.GetVolume(ctx, &adminpb.GetVolumeRequest{VolumeId: volumeID})
+		if err != nil {
+			return err
+		}
+		return p.printVolume(resp.Volume)
+	}
+}
+
+func unpublishCommand(client adminpb.AdminClient, p *printer) command {
+	return func(ctx context.Context, args []string) error {
+		volumeID, err := volumeIDArg("unpublish", args)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.ForceUnpublish(ctx, &adminpb.ForceUnpublishRequest{VolumeId: volumeID})
+		if err != nil {
+			return err
+		}
+		return p.printMessage(resp, func() string {
+			if len(resp.Unmounted) == 0 {
+				return fmt.Sprintf("volume %s was not mounted", volumeID)
+			}
+			return fmt.Sprintf("unmounted volume %s from %s", volumeID, strings.Join(resp.Unmounted, ", "))
+		})
+	}
+}
+
+func gcCommand(client adminpb.AdminClient, p *printer) command {
+	return func(ctx context.Context, args []string) error {
+		fs := flag.NewFlagSet("gc", flag.ExitOnError)
+		dryRun := fs.Bool("dry-run", false, "Only report what would be done")
+		last := fs.Bool("last", false, "Show the report of the last run instead of running")
+		fs.Parse(args)
+
+		var resp *adminpb.RunGCResponse
+		var err error
+		if *last {
+			resp, err = client.LastGC(ctx, &adminpb.LastGCRequest{})
+		} else {
+			resp, err = client.RunGC(ctx, &adminpb.RunGCRequest{DryRun: *dryRun})
+		}
+		if err != nil {
+			return err
+		}
+		return p.printGCReport(resp)
+	}
+}
+
+func dumpCommand(client adminpb.AdminClient, p *printer) command {
+	return func(ctx context.Context, args []string) error {
+		resp, err := client.DumpState(ctx, &adminpb.DumpStateRequest{})
+		if err != nil {
+			return err
+		}
+		return p.printRawJSON([]byte(resp.StateJson))
+	}
+}
+
+func volumeIDArg(name string, args []string) (string, error) {
+	if len(args) != 1 || args[0] == "" {
+		return "", fmt.Errorf("usage: ephemeralctl %s <volume-id>", name)
+	}
+	return args[0], nil
+}
+
+func runSanity(p *printer, args []string) error {
+	fs := flag.NewFlagSet("sanity", flag.ExitOnError)
+	csiEndpoint := fs.String("csi-endpoint", "unix:///var/lib/kubelet/plugins/ephemeral.csi.local/csi.sock", "CSI endpoint of the driver under test")
+	targetDir := fs.String("target-dir", "/tmp/ephemeral-csi-sanity", "Directory in which publish targets are created")
+	size := fs.Int64("size", sanity.DefaultVolumeSize, "Capacity in bytes requested for test volumes")
+	params := fs.String("params", "", "Comma-separated key=value parameters passed to CreateVolume and NodePublishVolume")
+	run := fs.String("run", "", "Only run cases whose name matches this regular expression")
+	fs.Parse(args)
+
+	cfg := sanity.Config{
+		Endpoint:   *csiEndpoint,
+		TargetDir:  *targetDir,
+		VolumeSize: *size,
+		Parameters: map[string]string{},
+	}
+	if *params != "" {
+		for _, kv := range strings.Split(*params, ",") {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				return fmt.Errorf("invalid parameter %q, expected key=value", kv)
+			}
+			cfg.Parameters[k] = v
+		}
+	}
+	if *run != "" {
+		re, err := regexp.Compile(*run)
+		if err != nil {
+			return fmt.Errorf("invalid -run expression: %v", err)
+		}
+		cfg.Run = re
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	report, err := sanity.Run(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if err := p.printSanityReport(report); err != nil {
+		return err
+	}
+
+	if failed := report.Failed(); len(failed) > 0 {
+		return fmt.Errorf("%d of %d sanity cases failed", len(failed), len(report.Results))
+	}
+	return nil
+}
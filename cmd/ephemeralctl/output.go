@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/admin/adminpb"
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/sanity"
+)
+
+// printer renders admin API responses in the selected output format
+type printer struct {
+	format string
+	out    io.Writer
+}
+
+func newPrinter(format string) (*printer, error) {
+	switch format {
+	case "table", "json", "yaml":
+		return &printer{format: format, out: os.Stdout}, nil
+	default:
+		return nil, fmt.Errorf("unsupported output format %q, must be table, json or yaml", format)
+	}
+}
+
+// printVolumes prints volumes as a table, or msg in a structured format
+func (p *printer) printVolumes(volumes []*adminpb.Volume, msg proto.Message) error {
+	if p.format != "table" {
+		return p.printProto(msg)
+	}
+
+	w := tabwriter.NewWriter(p.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VOLUME\tPOD\tSIZE\tUSED\tMOUNTS\tAGE")
+	for _, vol := range volumes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			vol.Id,
+			valueOrNone(podName(vol)),
+			formatBytes(vol.SizeBytes),
+			formatBytes(vol.UsedBytes),
+			valueOrNone(strings.Join(vol.Mounts, ",")),
+			formatAge(vol.CreatedAt),
+		)
+	}
+	return w.Flush()
+}
+
+// printVolume prints the details of a single volume
+func (p *printer) printVolume(vol *adminpb.Volume) error {
+	if p.format != "table" {
+		return p.printProto(vol)
+	}
+
+	w := tabwriter.NewWriter(p.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", vol.Id)
+	fmt.Fprintf(w, "Path:\t%s\n", vol.Path)
+	fmt.Fprintf(w, "Pool:\t%s\n", valueOrNone(vol.Pool))
+	fmt.Fprintf(w, "Pod:\t%s\n", valueOrNone(podName(vol)))
+	if vol.Pod != nil {
+		fmt.Fprintf(w, "Pod UID:\t%s\n", valueOrNone(vol.Pod.Uid))
+		fmt.Fprintf(w, "Service account:\t%s\n", valueOrNone(vol.Pod.ServiceAccount))
+	}
+	fmt.Fprintf(w, "Size:\t%s\n", formatBytes(vol.SizeBytes))
+	fmt.Fprintf(w, "Used:\t%s\n", formatBytes(vol.UsedBytes))
+	fmt.Fprintf(w, "Retention:\t%s\n", valueOrNone(vol.Retention))
+	if vol.RetainUntil != 0 {
+		fmt.Fprintf(w, "Retained until:\t%s\n", formatTimestamp(vol.RetainUntil))
+	}
+	fmt.Fprintf(w, "Ephemeral:\t%t\n", vol.Ephemeral)
+	fmt.Fprintf(w, "Revision:\t%s\n", valueOrNone(vol.Revision))
+	fmt.Fprintf(w, "Age:\t%s\n", formatAge(vol.CreatedAt))
+	fmt.Fprintf(w, "Last access:\t%s\n", formatTimestamp(vol.LastAccess))
+	fmt.Fprintf(w, "Mounts:\t%s\n", valueOrNone(strings.Join(vol.Mounts, ", ")))
+
+	if len(vol.Attributes) > 0 {
+		fmt.Fprintln(w, "Attributes:")
+		keys := make([]string, 0, len(vol.Attributes))
+		for k := range vol.Attributes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "  %s:\t%s\n", k, vol.Attributes[k])
+		}
+	}
+	return w.Flush()
+}
+
+// printGCReport prints a summary and the affected volumes of a garbage
+// collection run
+func (p *printer) printGCReport(resp *adminpb.RunGCResponse) error {
+	if p.format != "table" {
+		return p.printProto(resp)
+	}
+
+	verb := "deleted"
+	if resp.DryRun {
+		verb = "would delete"
+	}
+	fmt.Fprintf(p.out, "%s: cleared %d stale mounts, forgot %d missing volumes, %s %d idle volumes\n",
+		formatTimestamp(resp.RanAt), len(resp.StaleMounts), len(resp.MissingVolumes), verb, len(resp.IdleVolumes))
+
+	w := tabwriter.NewWriter(p.out, 0, 8, 2, ' ', 0)
+	for _, group := range []struct {
+		name string
+		ids  []string
+	}{
+		{"stale mount", resp.StaleMounts},
+		{"missing", resp.MissingVolumes},
+		{"idle", resp.IdleVolumes},
+	} {
+		for _, id := range group.ids {
+			fmt.Fprintf(w, "  %s\t%s\n", id, group.name)
+		}
+	}
+	return w.Flush()
+}
+
+// printSanityReport prints one line per case, or the report in a
+// structured format
+func (p *printer) printSanityReport(report *sanity.Report) error {
+	if p.format != "table" {
+		data, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		return p.printRawJSON(data)
+	}
+
+	w := tabwriter.NewWriter(p.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "RESULT\tCASE\tDURATION\tMESSAGE")
+	for _, result := range report.Results {
+		outcome := "PASS"
+		switch {
+		case result.Skipped:
+			outcome = "SKIP"
+		case !result.Passed:
+			outcome = "FAIL"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", outcome, result.Name, result.Duration.Round(time.Millisecond), result.Error)
+	}
+	return w.Flush()
+}
+
+// printMessage prints a one-line summary as table output, or msg in a
+// structured format
+func (p *printer) printMessage(msg proto.Message, summary func() string) error {
+	if p.format != "table" {
+		return p.printProto(msg)
+	}
+	_, err := fmt.Fprintln(p.out, summary())
+	return err
+}
+
+func (p *printer) printProto(msg proto.Message) error {
+	data, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return p.printRawJSON(data)
+}
+
+// printRawJSON prints a JSON document, converting it to YAML if requested
+func (p *printer) printRawJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	if p.format == "yaml" {
+		enc := yaml.NewEncoder(p.out)
+		enc.SetIndent(2)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+
+	enc := json.NewEncoder(p.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// podName returns namespace/name of the pod of vol, falling back to the
+// legacy podID parameter
+func podName(vol *adminpb.Volume) string {
+	if vol.Pod != nil {
+		return vol.Pod.Namespace + "/" + vol.Pod.Name
+	}
+	return vol.PodId
+}
+
+func valueOrNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ci", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatTimestamp(unix int64) string {
+	if unix == 0 {
+		return "<never>"
+	}
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
+
+// formatAge renders the time since unix like kubectl does
+func formatAge(unix int64) string {
+	if unix == 0 {
+		return "<unknown>"
+	}
+
+	d := time.Since(time.Unix(unix, 0))
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
@@ -0,0 +1,65 @@
+// Command kms-standin is a reference KMS plugin for encrypted volumes. It
+// serves the KMS plugin API on a unix socket and wraps data keys with a
+// local key file, standing in for a plugin backed by a real KMS.
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"google.golang.org/grpc"
+	"k8s.io/klog/v2"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/kms"
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/kms/kmspb"
+)
+
+var (
+	endpoint = flag.String("endpoint", "unix:///var/run/ephemeral-csi-kms/kms.sock", "KMS plugin endpoint")
+	keyFile  = flag.String("key-file", "", "File holding the 32 byte key encryption key")
+)
+
+func main() {
+	klog.InitFlags(nil)
+	flag.Parse()
+
+	keys, err := kms.NewLocalKeyFile(*keyFile)
+	if err != nil {
+		klog.Fatalf("Failed to load key: %v", err)
+	}
+
+	if !strings.HasPrefix(*endpoint, "unix://") {
+		klog.Fatalf("Unsupported endpoint %q, only unix:// is supported", *endpoint)
+	}
+	socketPath := strings.TrimPrefix(*endpoint, "unix://")
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		klog.Fatalf("Failed to create socket directory: %v", err)
+	}
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		klog.Fatalf("Failed to remove existing socket: %v", err)
+	}
+	lis, err := net.Listen("unix", socketPath)
+	if err != nil {
+		klog.Fatalf("Failed to listen: %v", err)
+	}
+
+	s := grpc.NewServer()
+	kmspb.RegisterKeyManagementServer(s, kms.NewServer(keys))
+
+	go func() {
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+		<-sigc
+		s.GracefulStop()
+	}()
+
+	klog.Infof("Serving KMS plugin on %s", *endpoint)
+	if err := s.Serve(lis); err != nil {
+		klog.Fatalf("Failed to serve: %v", err)
+	}
+}
@@ -0,0 +1,316 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: pkg/admin/adminpb/admin.proto
+
+// Package ephemeralcsi.admin.v1 is the node-local administration API of the
+// ephemeral CSI driver. It is served on a separate unix socket by the node
+// plugin and consumed by ephemeralctl.
+
+package adminpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Admin_ListVolumes_FullMethodName    = "/ephemeralcsi.admin.v1.Admin/ListVolumes"
+	Admin_GetVolume_FullMethodName      = "/ephemeralcsi.admin.v1.Admin/GetVolume"
+	Admin_ForceUnpublish_FullMethodName = "/ephemeralcsi.admin.v1.Admin/ForceUnpublish"
+	Admin_RunGC_FullMethodName          = "/ephemeralcsi.admin.v1.Admin/RunGC"
+	Admin_LastGC_FullMethodName         = "/ephemeralcsi.admin.v1.Admin/LastGC"
+	Admin_DumpState_FullMethodName      = "/ephemeralcsi.admin.v1.Admin/DumpState"
+)
+
+// AdminClient is the client API for Admin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AdminClient interface {
+	// ListVolumes returns the volumes known to the node plugin, optionally
+	// filtered by the namespace and name of their pod.
+	ListVolumes(ctx context.Context, in *ListVolumesRequest, opts ...grpc.CallOption) (*ListVolumesResponse, error)
+	// GetVolume returns a single volume.
+	GetVolume(ctx context.Context, in *GetVolumeRequest, opts ...grpc.CallOption) (*GetVolumeResponse, error)
+	// ForceUnpublish detaches a volume from all its targets even if they
+	// are still busy.
+	ForceUnpublish(ctx context.Context, in *ForceUnpublishRequest, opts ...grpc.CallOption) (*ForceUnpublishResponse, error)
+	// RunGC triggers a garbage collection run and reports what it did.
+	RunGC(ctx context.Context, in *RunGCRequest, opts ...grpc.CallOption) (*RunGCResponse, error)
+	// LastGC returns the report of the last garbage collection run, including
+	// those run in the background.
+	LastGC(ctx context.Context, in *LastGCRequest, opts ...grpc.CallOption) (*RunGCResponse, error)
+	// DumpState returns the raw VolumeManager state as JSON.
+	DumpState(ctx context.Context, in *DumpStateRequest, opts ...grpc.CallOption) (*DumpStateResponse, error)
+}
+
+type adminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdminClient(cc grpc.ClientConnInterface) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) ListVolumes(ctx context.Context, in *ListVolumesRequest, opts ...grpc.CallOption) (*ListVolumesResponse, error) {
+	out := new(ListVolumesResponse)
+	err := c.cc.Invoke(ctx, Admin_ListVolumes_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetVolume(ctx context.Context, in *GetVolumeRequest, opts ...grpc.CallOption) (*GetVolumeResponse, error) {
+	out := new(GetVolumeResponse)
+	err := c.cc.Invoke(ctx, Admin_GetVolume_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ForceUnpublish(ctx context.Context, in *ForceUnpublishRequest, opts ...grpc.CallOption) (*ForceUnpublishResponse, error) {
+	out := new(ForceUnpublishResponse)
+	err := c.cc.Invoke(ctx, Admin_ForceUnpublish_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) RunGC(ctx context.Context, in *RunGCRequest, opts ...grpc.CallOption) (*RunGCResponse, error) {
+	out := new(RunGCResponse)
+	err := c.cc.Invoke(ctx, Admin_RunGC_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) LastGC(ctx context.Context, in *LastGCRequest, opts ...grpc.CallOption) (*RunGCResponse, error) {
+	out := new(RunGCResponse)
+	err := c.cc.Invoke(ctx, Admin_LastGC_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) DumpState(ctx context.Context, in *DumpStateRequest, opts ...grpc.CallOption) (*DumpStateResponse, error) {
+	out := new(DumpStateResponse)
+	err := c.cc.Invoke(ctx, Admin_DumpState_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdminServer is the server API for Admin service.
+// All implementations must embed UnimplementedAdminServer
+// for forward compatibility
+type AdminServer interface {
+	// ListVolumes returns the volumes known to the node plugin, optionally
+	// filtered by the namespace and name of their pod.
+	ListVolumes(context.Context, *ListVolumesRequest) (*ListVolumesResponse, error)
+	// GetVolume returns a single volume.
+	GetVolume(context.Context, *GetVolumeRequest) (*GetVolumeResponse, error)
+	// ForceUnpublish detaches a volume from all its targets even if they
+	// are still busy.
+	ForceUnpublish(context.Context, *ForceUnpublishRequest) (*ForceUnpublishResponse, error)
+	// RunGC triggers a garbage collection run and reports what it did.
+	RunGC(context.Context, *RunGCRequest) (*RunGCResponse, error)
+	// LastGC returns the report of the last garbage collection run, including
+	// those run in the background.
+	LastGC(context.Context, *LastGCRequest) (*RunGCResponse, error)
+	// DumpState returns the raw VolumeManager state as JSON.
+	DumpState(context.Context, *DumpStateRequest) (*DumpStateResponse, error)
+	mustEmbedUnimplementedAdminServer()
+}
+
+// UnimplementedAdminServer must be embedded to have forward compatible implementations.
+type UnimplementedAdminServer struct {
+}
+
+func (UnimplementedAdminServer) ListVolumes(context.Context, *ListVolumesRequest) (*ListVolumesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListVolumes not implemented")
+}
+func (UnimplementedAdminServer) GetVolume(context.Context, *GetVolumeRequest) (*GetVolumeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetVolume not implemented")
+}
+func (UnimplementedAdminServer) ForceUnpublish(context.Context, *ForceUnpublishRequest) (*ForceUnpublishResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ForceUnpublish not implemented")
+}
+func (UnimplementedAdminServer) RunGC(context.Context, *RunGCRequest) (*RunGCResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RunGC not implemented")
+}
+func (UnimplementedAdminServer) LastGC(context.Context, *LastGCRequest) (*RunGCResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LastGC not implemented")
+}
+func (UnimplementedAdminServer) DumpState(context.Context, *DumpStateRequest) (*DumpStateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DumpState not implemented")
+}
+func (UnimplementedAdminServer) mustEmbedUnimplementedAdminServer() {}
+
+// UnsafeAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AdminServer will
+// result in compilation errors.
+type UnsafeAdminServer interface {
+	mustEmbedUnimplementedAdminServer()
+}
+
+func RegisterAdminServer(s grpc.ServiceRegistrar, srv AdminServer) {
+	s.RegisterService(&Admin_ServiceDesc, srv)
+}
+
+func _Admin_ListVolumes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListVolumesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ListVolumes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_ListVolumes_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ListVolumes(ctx, req.(*ListVolumesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_GetVolume_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetVolumeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetVolume(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_GetVolume_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetVolume(ctx, req.(*GetVolumeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ForceUnpublish_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ForceUnpublishRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ForceUnpublish(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_ForceUnpublish_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ForceUnpublish(ctx, req.(*ForceUnpublishRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_RunGC_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RunGCRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).RunGC(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_RunGC_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).RunGC(ctx, req.(*RunGCRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_LastGC_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LastGCRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).LastGC(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_LastGC_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).LastGC(ctx, req.(*LastGCRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_DumpState_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DumpStateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).DumpState(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_DumpState_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).DumpState(ctx, req.(*DumpStateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Admin_ServiceDesc is the grpc.ServiceDesc for Admin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Admin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ephemeralcsi.admin.v1.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListVolumes",
+			Handler:    _Admin_ListVolumes_Handler,
+		},
+		{
+			MethodName: "GetVolume",
+			Handler:    _Admin_GetVolume_Handler,
+		},
+		{
+			MethodName: "ForceUnpublish",
+			Handler:    _Admin_ForceUnpublish_Handler,
+		},
+		{
+			MethodName: "RunGC",
+			Handler:    _Admin_RunGC_Handler,
+		},
+		{
+			MethodName: "LastGC",
+			Handler:    _Admin_LastGC_Handler,
+		},
+		{
+			MethodName: "DumpState",
+			Handler:    _Admin_DumpState_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "pkg/admin/adminpb/admin.proto",
+}
@@ -0,0 +1,165 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/admin/adminpb"
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/volume"
+)
+
+// Server implements the node-local admin API on top of the volume manager
+type Server struct {
+	adminpb.UnimplementedAdminServer
+
+	volumes *volume.VolumeManager
+	mounter *volume.NodeMounter
+}
+
+// NewServer creates a new admin server
+func NewServer(volumes *volume.VolumeManager, mounter *volume.NodeMounter) *Server {
+	return &Server{
+		volumes: volumes,
+		mounter: mounter,
+	}
+}
+
+func (s *Server) ListVolumes(ctx context.Context, req *adminpb.ListVolumesRequest) (*adminpb.ListVolumesResponse, error) {
+	if req.Pod != "" && req.Namespace == "" {
+		return nil, status.Error(codes.InvalidArgument, "filtering by pod requires a namespace")
+	}
+
+	resp := &adminpb.ListVolumesResponse{}
+	for _, vol := range s.volumes.ListVolumesByOwner(req.Namespace, req.Pod) {
+		if req.WithUsage {
+			s.refreshUsage(vol)
+		}
+		resp.Volumes = append(resp.Volumes, toProto(vol))
+	}
+	return resp, nil
+}
+
+func (s *Server) GetVolume(ctx context.Context, req *adminpb.GetVolumeRequest) (*adminpb.GetVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+
+	vol, err := s.volumes.GetVolume(req.VolumeId)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	s.refreshUsage(vol)
+
+	return &adminpb.GetVolumeResponse{Volume: toProto(vol)}, nil
+}
+
+func (s *Server) ForceUnpublish(ctx context.Context, req *adminpb.ForceUnpublishRequest) (*adminpb.ForceUnpublishResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+
+	targets, err := s.mounter.ForceUnpublishVolume(req.VolumeId)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &adminpb.ForceUnpublishResponse{Unmounted: targets}, nil
+}
+
+func (s *Server) RunGC(ctx context.Context, req *adminpb.RunGCRequest) (*adminpb.RunGCResponse, error) {
+	report, err := s.volumes.GarbageCollect(ctx, s.mounter.MountPoints, req.DryRun)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "garbage collection failed: %v", err)
+	}
+
+	return gcReportToProto(report), nil
+}
+
+func (s *Server) LastGC(ctx context.Context, req *adminpb.LastGCRequest) (*adminpb.RunGCResponse, error) {
+	report := s.volumes.LastGCReport()
+	if report == nil {
+		return nil, status.Error(codes.NotFound, "garbage collection has not run yet")
+	}
+
+	return gcReportToProto(report), nil
+}
+
+func (s *Server) DumpState(ctx context.Context, req *adminpb.DumpStateRequest) (*adminpb.DumpStateResponse, error) {
+	state := struct {
+		BaseDir string           `json:"baseDir"`
+		Volumes []*volume.Volume `json:"volumes"`
+	}{
+		BaseDir: s.volumes.BaseDir(),
+		Volumes: s.volumes.ListVolumes(),
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to encode state: %v", err)
+	}
+
+	return &adminpb.DumpStateResponse{StateJson: string(data)}, nil
+}
+
+// refreshUsage measures the on-disk usage of vol and records it
+func (s *Server) refreshUsage(vol *volume.Volume) {
+	usage, err := volume.DirUsage(vol.Path)
+	if err != nil {
+		klog.Warningf("Failed to compute usage of volume %s: %v", vol.ID, err)
+		return
+	}
+	vol.Usage = usage
+	if err := s.volumes.UpdateVolumeUsage(vol.ID, usage); err != nil {
+		klog.Warningf("Failed to record usage of volume %s: %v", vol.ID, err)
+	}
+}
+
+func toProto(vol *volume.Volume) *adminpb.Volume {
+	pb := &adminpb.Volume{
+		Id:          vol.ID,
+		Path:        vol.Path,
+		PodId:       vol.PodID,
+		SizeBytes:   vol.Size,
+		UsedBytes:   vol.Usage,
+		CreatedAt:   vol.CreatedAt,
+		LastAccess:  vol.LastAccess,
+		Retention:   vol.Retention,
+		Attributes:  vol.Attributes,
+		Ephemeral:   vol.Ephemeral,
+		RetainUntil: vol.RetainUntil,
+		Revision:    vol.Revision,
+		Pool:        vol.Pool,
+	}
+	if vol.Pod != nil {
+		pb.Pod = &adminpb.Pod{
+			Name:           vol.Pod.Name,
+			Namespace:      vol.Pod.Namespace,
+			Uid:            vol.Pod.UID,
+			ServiceAccount: vol.Pod.ServiceAccount,
+		}
+	}
+	pb.Mounts = vol.Targets
+	return pb
+}
+
+func gcReportToProto(report *volume.GCReport) *adminpb.RunGCResponse {
+	return &adminpb.RunGCResponse{
+		StaleMounts:    report.StaleMounts,
+		MissingVolumes: report.MissingVolumes,
+		IdleVolumes:    report.IdleVolumes,
+		DryRun:         report.DryRun,
+		RanAt:          report.Time.Unix(),
+	}
+}
+
+func toStatus(err error) error {
+	if errors.Is(err, volume.ErrVolumeNotFound) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
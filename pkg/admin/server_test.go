@@ -0,0 +1,201 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/admin/adminpb"
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/volume"
+)
+
+func setupTestServer(t *testing.T) (*Server, *volume.VolumeManager) {
+	volumes, err := volume.NewVolumeManager(t.TempDir())
+	require.NoError(t, err)
+
+	return NewServer(volumes, volume.NewNodeMounter(volumes, volume.NewFakeMounter())), volumes
+}
+
+func TestListVolumes(t *testing.T) {
+	server, volumes := setupTestServer(t)
+
+	_, err := volumes.CreateVolume(&csi.CreateVolumeRequest{
+		Name:       "test-volume",
+		Parameters: map[string]string{"podID": "test-pod"},
+	})
+	require.NoError(t, err)
+
+	resp, err := server.ListVolumes(context.Background(), &adminpb.ListVolumesRequest{WithUsage: true})
+	require.NoError(t, err)
+	require.Len(t, resp.Volumes, 1)
+	assert.Equal(t, "test-volume", resp.Volumes[0].Id)
+	assert.Equal(t, "test-pod", resp.Volumes[0].PodId)
+	assert.Equal(t, int64(1<<30), resp.Volumes[0].SizeBytes)
+	assert.NotZero(t, resp.Volumes[0].CreatedAt)
+}
+
+func TestListVolumesByOwner(t *testing.T) {
+	baseDir := t.TempDir()
+	volumes, err := volume.NewVolumeManager(baseDir)
+	require.NoError(t, err)
+	mounter := volume.NewNodeMounter(volumes, volume.NewFakeMounter())
+
+	podContext := func(namespace, name string) map[string]string {
+		return map[string]string{
+			volume.PodNamespaceKey:   namespace,
+			volume.PodNameKey:        name,
+			volume.PodUIDKey:         name + "-uid",
+			volume.ServiceAccountKey: "default",
+		}
+	}
+
+	// Generic ephemeral volumes learn their pod when they are published
+	_, err = volumes.CreateVolume(&csi.CreateVolumeRequest{Name: "generic"})
+	require.NoError(t, err)
+	require.NoError(t, mounter.NodePublishVolume(&csi.NodePublishVolumeRequest{
+		VolumeId:      "generic",
+		TargetPath:    t.TempDir(),
+		VolumeContext: podContext("shop", "web-0"),
+	}))
+	_, err = volumes.EnsureEphemeralVolume("inline-1", 0, podContext("shop", "web-1"))
+	require.NoError(t, err)
+	_, err = volumes.EnsureEphemeralVolume("inline-2", 0, podContext("batch", "job-0"))
+	require.NoError(t, err)
+	_, err = volumes.CreateVolume(&csi.CreateVolumeRequest{Name: "unpublished"})
+	require.NoError(t, err)
+
+	ids := func(server *Server, req *adminpb.ListVolumesRequest) []string {
+		resp, err := server.ListVolumes(context.Background(), req)
+		require.NoError(t, err)
+		var ids []string
+		for _, vol := range resp.Volumes {
+			ids = append(ids, vol.Id)
+		}
+		return ids
+	}
+
+	server := NewServer(volumes, mounter)
+	assert.Equal(t, []string{"generic", "inline-1", "inline-2", "unpublished"}, ids(server, &adminpb.ListVolumesRequest{}))
+	assert.Equal(t, []string{"generic", "inline-1"}, ids(server, &adminpb.ListVolumesRequest{Namespace: "shop"}))
+	assert.Equal(t, []string{"generic"}, ids(server, &adminpb.ListVolumesRequest{Namespace: "shop", Pod: "web-0"}))
+	assert.Empty(t, ids(server, &adminpb.ListVolumesRequest{Namespace: "batch", Pod: "web-0"}))
+
+	_, err = server.ListVolumes(context.Background(), &adminpb.ListVolumesRequest{Pod: "web-0"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	resp, err := server.GetVolume(context.Background(), &adminpb.GetVolumeRequest{VolumeId: "generic"})
+	require.NoError(t, err)
+	assert.Equal(t, &adminpb.Pod{Name: "web-0", Namespace: "shop", Uid: "web-0-uid", ServiceAccount: "default"}, resp.Volume.Pod)
+
+	// The index is rebuilt from the metadata after a restart
+	require.NoError(t, volumes.DeleteVolume(context.Background(), "inline-1"))
+	restarted, err := volume.NewVolumeManager(baseDir)
+	require.NoError(t, err)
+	server = NewServer(restarted, volume.NewNodeMounter(restarted, volume.NewFakeMounter()))
+	assert.Equal(t, []string{"generic"}, ids(server, &adminpb.ListVolumesRequest{Namespace: "shop"}))
+}
+
+func TestGetVolumeNotFound(t *testing.T) {
+	server, _ := setupTestServer(t)
+
+	_, err := server.GetVolume(context.Background(), &adminpb.GetVolumeRequest{VolumeId: "missing"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = server.GetVolume(context.Background(), &adminpb.GetVolumeRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestForceUnpublishNotMounted(t *testing.T) {
+	server, volumes := setupTestServer(t)
+
+	_, err := volumes.EnsureVolume("test-volume", 0, nil)
+	require.NoError(t, err)
+
+	resp, err := server.ForceUnpublish(context.Background(), &adminpb.ForceUnpublishRequest{VolumeId: "test-volume"})
+	require.NoError(t, err)
+	assert.Empty(t, resp.Unmounted)
+}
+
+func TestRunGCForgetsMissingVolumes(t *testing.T) {
+	server, volumes := setupTestServer(t)
+
+	vol, err := volumes.EnsureVolume("test-volume", 0, nil)
+	require.NoError(t, err)
+	require.NoError(t, os.RemoveAll(vol.Path))
+
+	resp, err := server.RunGC(context.Background(), &adminpb.RunGCRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test-volume"}, resp.MissingVolumes)
+	assert.Empty(t, volumes.ListVolumes())
+}
+
+func TestRunGCDeletesIdleVolumes(t *testing.T) {
+	server, volumes := setupTestServer(t)
+	volumes.SetGCOptions(volume.GCOptions{IdleTTL: time.Hour})
+
+	_, err := server.LastGC(context.Background(), &adminpb.LastGCRequest{})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	for _, id := range []string{"idle", "recent", "published"} {
+		_, err := volumes.EnsureVolume(id, 0, nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, server.mounter.NodePublishVolume(&csi.NodePublishVolumeRequest{
+		VolumeId:   "published",
+		TargetPath: t.TempDir(),
+	}))
+
+	longAgo := time.Now().Add(-2 * time.Hour).Unix()
+	for _, id := range []string{"idle", "published"} {
+		require.NoError(t, volumes.UpdateVolume(id, func(v *volume.Volume) {
+			v.CreatedAt = longAgo
+			v.LastAccess = longAgo
+		}))
+	}
+
+	resp, err := server.RunGC(context.Background(), &adminpb.RunGCRequest{DryRun: true})
+	require.NoError(t, err)
+	assert.True(t, resp.DryRun)
+	assert.Equal(t, []string{"idle"}, resp.IdleVolumes)
+	assert.Len(t, volumes.ListVolumes(), 3)
+
+	resp, err = server.RunGC(context.Background(), &adminpb.RunGCRequest{})
+	require.NoError(t, err)
+	assert.False(t, resp.DryRun)
+	assert.Equal(t, []string{"idle"}, resp.IdleVolumes)
+	_, err = volumes.GetVolume("idle")
+	assert.ErrorIs(t, err, volume.ErrVolumeNotFound)
+	assert.Len(t, volumes.ListVolumes(), 2)
+
+	last, err := server.LastGC(context.Background(), &adminpb.LastGCRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, resp.IdleVolumes, last.IdleVolumes)
+	assert.NotZero(t, last.RanAt)
+}
+
+func TestDumpState(t *testing.T) {
+	server, volumes := setupTestServer(t)
+
+	_, err := volumes.EnsureVolume("test-volume", 0, nil)
+	require.NoError(t, err)
+
+	resp, err := server.DumpState(context.Background(), &adminpb.DumpStateRequest{})
+	require.NoError(t, err)
+
+	var state struct {
+		BaseDir string
+		Volumes []volume.Volume
+	}
+	require.NoError(t, json.Unmarshal([]byte(resp.StateJson), &state))
+	assert.Equal(t, volumes.BaseDir(), state.BaseDir)
+	require.Len(t, state.Volumes, 1)
+	assert.Equal(t, "test-volume", state.Volumes[0].ID)
+}
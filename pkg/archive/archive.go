@@ -0,0 +1,220 @@
+// Package archive preserves the contents of volumes before they are deleted
+// by streaming them as tar+zstd archives to a sink
+package archive
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"k8s.io/klog/v2"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/metrics"
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/volume"
+)
+
+const (
+	// ManifestName is the name of the first entry of every archive
+	ManifestName = "manifest.json"
+	// DataDir is the directory in the archive that holds the volume tree
+	DataDir = "data"
+)
+
+// Manifest describes an archived volume
+type Manifest struct {
+	VolumeID     string `json:"volumeID"`
+	NodeID       string `json:"nodeID,omitempty"`
+	PodNamespace string `json:"podNamespace,omitempty"`
+	PodName      string `json:"podName,omitempty"`
+	PodUID       string `json:"podUID,omitempty"`
+	// SizeBytes is the capacity of the volume, DataBytes the size of the
+	// archived file contents
+	SizeBytes  int64     `json:"sizeBytes"`
+	DataBytes  int64     `json:"dataBytes"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastAccess time.Time `json:"lastAccess,omitempty"`
+	ArchivedAt time.Time `json:"archivedAt"`
+}
+
+// Archiver writes volume archives to a sink. It implements volume.Archiver.
+type Archiver struct {
+	sink   Sink
+	nodeID string
+}
+
+// NewArchiver creates an archiver that writes to sink
+func NewArchiver(sink Sink, nodeID string) *Archiver {
+	return &Archiver{
+		sink:   sink,
+		nodeID: nodeID,
+	}
+}
+
+// Archive streams the tree of vol to the sink. The outcome is recorded in
+// the archive metrics.
+func (a *Archiver) Archive(ctx context.Context, vol *volume.Volume) error {
+	start := time.Now()
+	name := fmt.Sprintf("%s-%s.tar.zst", vol.ID, start.UTC().Format("20060102T150405Z"))
+
+	manifest := &Manifest{
+		VolumeID:   vol.ID,
+		NodeID:     a.nodeID,
+		SizeBytes:  vol.Size,
+		CreatedAt:  time.Unix(vol.CreatedAt, 0).UTC(),
+		ArchivedAt: start.UTC(),
+	}
+	if vol.Pod != nil {
+		manifest.PodNamespace = vol.Pod.Namespace
+		manifest.PodName = vol.Pod.Name
+		manifest.PodUID = vol.Pod.UID
+	}
+	if vol.LastAccess != 0 {
+		manifest.LastAccess = time.Unix(vol.LastAccess, 0).UTC()
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(Write(pw, vol.Path, manifest))
+	}()
+
+	err := a.sink.Put(ctx, name, pr)
+	// Unblock the writer if the sink gave up early
+	pr.CloseWithError(fmt.Errorf("sink closed"))
+
+	metrics.ArchiveDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.ArchiveOperations.WithLabelValues("failure").Inc()
+		klog.Errorf("Failed to archive volume %s to %s: %v", vol.ID, a.sink, err)
+		return fmt.Errorf("failed to archive volume %s: %v", vol.ID, err)
+	}
+
+	metrics.ArchiveOperations.WithLabelValues("success").Inc()
+	metrics.ArchiveBytes.Add(float64(manifest.DataBytes))
+	klog.Infof("Archived volume %s (%d bytes) to %s/%s in %s", vol.ID, manifest.DataBytes, a.sink, name, time.Since(start).Round(time.Millisecond))
+
+	return nil
+}
+
+// Write writes a tar+zstd archive of the tree at dir to w. The manifest is
+// written first, followed by the tree under DataDir. DataBytes of the
+// manifest is filled in with the number of file bytes written.
+func Write(w io.Writer, dir string, manifest *Manifest) error {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+
+	// The manifest is written up front, before the data size is known, so
+	// that readers can stream it. Compute the size with a first pass.
+	dataBytes, err := treeSize(dir)
+	if err != nil {
+		return err
+	}
+	manifest.DataBytes = dataBytes
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    ManifestName,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: manifest.ArchivedAt,
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+
+	if err := writeTree(tw, dir); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeTree(tw *tar.Writer, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		var link string
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case info.Mode().IsDir(), info.Mode().IsRegular():
+		default:
+			// Sockets, devices and pipes have no content worth keeping
+			klog.V(4).Infof("Not archiving special file %s", path)
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(filepath.Join(DataDir, rel))
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// Files that grow while being archived are truncated to the size in
+		// the header, which tar requires
+		_, err = io.CopyN(tw, f, hdr.Size)
+		return err
+	})
+}
+
+func treeSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
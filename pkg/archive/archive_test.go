@@ -0,0 +1,212 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/volume"
+)
+
+// readArchive returns the manifest and the file contents of an archive
+func readArchive(t *testing.T, r io.Reader) (*Manifest, map[string]string) {
+	zr, err := zstd.NewReader(r)
+	require.NoError(t, err)
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	require.Equal(t, ManifestName, hdr.Name, "the manifest must be the first entry")
+	manifest := &Manifest{}
+	require.NoError(t, json.NewDecoder(tr).Decode(manifest))
+
+	files := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			data, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			files[hdr.Name] = string(data)
+		case tar.TypeSymlink:
+			files[hdr.Name] = "-> " + hdr.Linkname
+		}
+	}
+	return manifest, files
+}
+
+func newTestVolume(t *testing.T) *volume.Volume {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "logs"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "logs", "app.log"), []byte("hello\n"), 0644))
+	// Random data so the compressed archive spans several S3 parts
+	core := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(core)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "core"), core, 0644))
+	require.NoError(t, os.Symlink("logs/app.log", filepath.Join(dir, "latest")))
+
+	return &volume.Volume{
+		ID:   "vol-1",
+		Path: dir,
+		Size: 1 << 20,
+		Pod:  &volume.PodInfo{Namespace: "default", Name: "crashy"},
+	}
+}
+
+func TestArchiveToDirSink(t *testing.T) {
+	sinkDir := t.TempDir()
+	sink, err := NewSink(sinkDir)
+	require.NoError(t, err)
+
+	vol := newTestVolume(t)
+	require.NoError(t, NewArchiver(sink, "node-1").Archive(context.Background(), vol))
+
+	entries, err := os.ReadDir(sinkDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "temporary files must not be left behind")
+	assert.True(t, strings.HasPrefix(entries[0].Name(), "vol-1-"))
+	assert.True(t, strings.HasSuffix(entries[0].Name(), ".tar.zst"))
+
+	f, err := os.Open(filepath.Join(sinkDir, entries[0].Name()))
+	require.NoError(t, err)
+	defer f.Close()
+
+	manifest, files := readArchive(t, f)
+	assert.Equal(t, "vol-1", manifest.VolumeID)
+	assert.Equal(t, "node-1", manifest.NodeID)
+	assert.Equal(t, "default", manifest.PodNamespace)
+	assert.Equal(t, "crashy", manifest.PodName)
+	assert.Equal(t, int64(100006), manifest.DataBytes)
+
+	assert.Equal(t, "hello\n", files["data/logs/app.log"])
+	assert.Len(t, files["data/core"], 100000)
+	assert.Equal(t, "-> logs/app.log", files["data/latest"])
+}
+
+// fakeS3 is a minimal stand-in for an S3-compatible store that supports
+// multipart uploads
+type fakeS3 struct {
+	mu      sync.Mutex
+	parts   map[int][]byte
+	objects map[string][]byte
+	aborted bool
+	failPut bool
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		http.Error(w, "unsigned request", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.parts = map[int][]byte{}
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == http.MethodPut && query.Get("uploadId") == "upload-1":
+		if s.failPut {
+			http.Error(w, "disk full", http.StatusInternalServerError)
+			return
+		}
+		var number int
+		fmt.Sscan(query.Get("partNumber"), &number)
+		data, _ := io.ReadAll(r.Body)
+		s.parts[number] = data
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, number))
+	case r.Method == http.MethodPost && query.Get("uploadId") == "upload-1":
+		var complete completeMultipartUpload
+		if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var object []byte
+		for i, part := range complete.Parts {
+			if part.PartNumber != i+1 || part.ETag != fmt.Sprintf(`"etag-%d"`, i+1) {
+				http.Error(w, "invalid part", http.StatusBadRequest)
+				return
+			}
+			object = append(object, s.parts[part.PartNumber]...)
+		}
+		s.objects[r.URL.Path] = object
+	case r.Method == http.MethodDelete && query.Get("uploadId") == "upload-1":
+		s.aborted = true
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func TestArchiveToS3Sink(t *testing.T) {
+	store := &fakeS3{objects: map[string][]byte{}}
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	sink, err := NewS3Sink(S3Config{
+		Endpoint:   server.URL,
+		Bucket:     "archives",
+		Prefix:     "node-1",
+		AccessKey:  "access",
+		SecretKey:  "secret",
+		PartSize:   1024,
+		HTTPClient: server.Client(),
+	})
+	require.NoError(t, err)
+
+	vol := newTestVolume(t)
+	require.NoError(t, NewArchiver(sink, "node-1").Archive(context.Background(), vol))
+
+	require.Len(t, store.objects, 1)
+	for key, object := range store.objects {
+		assert.True(t, strings.HasPrefix(key, "/archives/node-1/vol-1-"), key)
+		manifest, files := readArchive(t, bytes.NewReader(object))
+		assert.Equal(t, "vol-1", manifest.VolumeID)
+		assert.Equal(t, "hello\n", files["data/logs/app.log"])
+	}
+	assert.Greater(t, len(store.parts), 1, "the archive should be uploaded in several parts")
+	assert.False(t, store.aborted)
+
+	// A failed upload is aborted
+	store.failPut = true
+	assert.Error(t, NewArchiver(sink, "node-1").Archive(context.Background(), vol))
+	assert.True(t, store.aborted)
+}
+
+func TestNewSink(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "access")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	dir := t.TempDir()
+	for _, url := range []string{dir, "file://" + dir, "s3://bucket/prefix?endpoint=http://minio:9000"} {
+		_, err := NewSink(url)
+		assert.NoError(t, err, url)
+	}
+	for _, url := range []string{"relative/dir", "s3://bucket/prefix", "ftp://host/dir"} {
+		_, err := NewSink(url)
+		assert.Error(t, err, url)
+	}
+}
@@ -0,0 +1,300 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultS3PartSize is the size of the parts archives are uploaded in.
+	// S3 requires every part but the last to be at least 5MiB.
+	DefaultS3PartSize = 8 * 1024 * 1024
+
+	defaultS3Region = "us-east-1"
+)
+
+// S3Config configures an S3Sink
+type S3Config struct {
+	// Endpoint is the base URL of the object store, e.g. https://minio:9000
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// PartSize defaults to DefaultS3PartSize
+	PartSize   int
+	HTTPClient *http.Client
+}
+
+// S3Sink uploads archives to an S3-compatible object store with multipart
+// uploads, so archives are streamed with bounded memory and no spooling to
+// disk. Requests use path-style addressing and AWS signature version 4.
+type S3Sink struct {
+	cfg      S3Config
+	endpoint *url.URL
+}
+
+// NewS3Sink creates a new S3 sink
+func NewS3Sink(cfg S3Config) (*S3Sink, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("S3 bucket is required")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, fmt.Errorf("S3 credentials are required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = defaultS3Region
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = DefaultS3PartSize
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 5 * time.Minute}
+	}
+
+	return &S3Sink{cfg: cfg, endpoint: endpoint}, nil
+}
+
+func (s *S3Sink) String() string {
+	return fmt.Sprintf("s3://%s/%s", s.cfg.Bucket, s.cfg.Prefix)
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// Put uploads the archive read from r as name below the configured prefix
+func (s *S3Sink) Put(ctx context.Context, name string, r io.Reader) error {
+	key := path.Join(s.cfg.Prefix, name)
+
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to initiate upload: %v", err)
+	}
+	initiated := &initiateMultipartUploadResult{}
+	if err := xml.Unmarshal(resp, initiated); err != nil || initiated.UploadID == "" {
+		return fmt.Errorf("failed to initiate upload: invalid response")
+	}
+	uploadID := initiated.UploadID
+
+	parts, err := s.uploadParts(ctx, key, uploadID, r)
+	if err == nil {
+		var body []byte
+		body, err = xml.Marshal(completeMultipartUpload{Parts: parts})
+		if err == nil {
+			_, err = s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body)
+		}
+	}
+	if err != nil {
+		// Do not leave the parts of a failed upload behind
+		if _, abortErr := s.do(context.Background(), http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil); abortErr != nil {
+			return fmt.Errorf("%v (aborting the upload failed as well: %v)", err, abortErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *S3Sink) uploadParts(ctx context.Context, key, uploadID string, r io.Reader) ([]completedPart, error) {
+	var parts []completedPart
+	buf := make([]byte, s.cfg.PartSize)
+
+	for number := 1; ; number++ {
+		n, readErr := io.ReadFull(r, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("failed to read archive: %v", readErr)
+		}
+		// An empty archive still needs one (empty) part
+		if n == 0 && len(parts) > 0 {
+			break
+		}
+
+		query := url.Values{
+			"partNumber": {fmt.Sprint(number)},
+			"uploadId":   {uploadID},
+		}
+		etag, err := s.putPart(ctx, key, query, buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload part %d: %v", number, err)
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: etag})
+
+		if readErr != nil {
+			break
+		}
+	}
+
+	return parts, nil
+}
+
+func (s *S3Sink) putPart(ctx context.Context, key string, query url.Values, body []byte) (string, error) {
+	req, err := s.newRequest(ctx, http.MethodPut, key, query, body)
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return "", err
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", fmt.Errorf("response has no ETag")
+	}
+	return etag, nil
+}
+
+// do performs a signed request and returns the response body
+func (s *S3Sink) do(ctx context.Context, method, key string, query url.Values, body []byte) ([]byte, error) {
+	req, err := s.newRequest(ctx, method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func (s *S3Sink) newRequest(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = "/" + s.cfg.Bucket + "/" + key
+	u.RawPath = "/" + s.cfg.Bucket + "/" + uriEncode(key, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	s.sign(req, u.RawPath, body, time.Now().UTC())
+	return req, nil
+}
+
+// sign adds an AWS signature version 4 Authorization header to req
+func (s *S3Sink) sign(req *http.Request, canonicalURI string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+// canonicalQuery encodes query sorted by key as SigV4 requires
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(query.Get(k), true))
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes s as SigV4 requires. Slashes are only encoded
+// if encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
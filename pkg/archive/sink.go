@@ -0,0 +1,116 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sink stores archives
+type Sink interface {
+	// Put stores the archive read from r under name
+	Put(ctx context.Context, name string, r io.Reader) error
+	// String describes the sink for logs
+	String() string
+}
+
+// NewSink creates a sink from its URL. Supported forms are a local or
+// hostPath directory, given as an absolute path or file:///path, and
+// s3://bucket[/prefix]?endpoint=https://host:port[&region=...] for
+// S3-compatible object stores. S3 credentials are read from the
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.
+func NewSink(rawURL string) (Sink, error) {
+	if strings.HasPrefix(rawURL, "/") {
+		return NewDirSink(rawURL)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive sink %q: %v", rawURL, err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return NewDirSink(u.Path)
+	case "s3":
+		endpoint := u.Query().Get("endpoint")
+		if endpoint == "" {
+			return nil, fmt.Errorf("invalid archive sink %q: the endpoint query parameter is required", rawURL)
+		}
+		return NewS3Sink(S3Config{
+			Endpoint:  endpoint,
+			Region:    u.Query().Get("region"),
+			Bucket:    u.Host,
+			Prefix:    strings.Trim(u.Path, "/"),
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		})
+	default:
+		return nil, fmt.Errorf("unsupported archive sink %q, must be a directory, file:// or s3:// URL", rawURL)
+	}
+}
+
+// DirSink writes archives into a directory
+type DirSink struct {
+	dir string
+}
+
+// NewDirSink creates a sink that writes into dir, creating it if needed
+func NewDirSink(dir string) (*DirSink, error) {
+	if !filepath.IsAbs(dir) {
+		return nil, fmt.Errorf("archive directory %q must be absolute", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory: %v", err)
+	}
+	return &DirSink{dir: dir}, nil
+}
+
+// Put writes the archive to a temporary file and renames it into place, so
+// that partial archives are never visible under their final name
+func (s *DirSink) Put(ctx context.Context, name string, r io.Reader) error {
+	path := filepath.Join(s.dir, name)
+	f, err := os.CreateTemp(s.dir, "."+name+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, readerWithContext(ctx, r)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s *DirSink) String() string {
+	return "file://" + s.dir
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// readerWithContext stops reading from r once ctx is done
+func readerWithContext(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -2,21 +2,31 @@ package driver
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
-	"os/exec"
-	"path/filepath"
+	"strings"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 	"k8s.io/klog/v2"
 
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/seed"
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/volume"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 )
 
 const (
 	driverName    = "ephemeral.csi.local"
 	driverVersion = "0.1.0"
+
+	// PoolTopologyKeyPrefix prefixes the topology keys telling which pools
+	// a node has, e.g. pool.ephemeral.csi.local/nvme=true
+	PoolTopologyKeyPrefix = "pool." + driverName + "/"
+
+	// kubernetesKeyPrefix prefixes the keys kubelet adds to the volume
+	// context, and the external provisioner to the parameters
+	kubernetesKeyPrefix = "csi.storage.k8s.io/"
 )
 
 type Driver struct {
@@ -24,16 +34,103 @@ type Driver struct {
 	version  string
 	nodeID   string
 	basePath string
+
+	volumes *volume.VolumeManager
+	mounter *volume.NodeMounter
+	pods    volume.PodStatusGetter
+	// topology lists the pools of the node, nil unless pools are configured
+	topology map[string]string
+	// poolTopology is the topology of the volumes in each pool
+	poolTopology map[string]map[string]string
+}
+
+// Option configures optional driver behavior
+type Option func(*options)
+
+type options struct {
+	mounter       volume.Mounter
+	pods          volume.PodStatusGetter
+	baseLayersDir string
+	pools         *volume.PoolConfig
+	keys          volume.KeyManager
+}
+
+// WithMounter makes the driver perform mounts through mounter instead of
+// mounting on the host
+func WithMounter(mounter volume.Mounter) Option {
+	return func(o *options) {
+		o.mounter = mounter
+	}
+}
+
+// WithPodStatusGetter enables pod status lookups, which the keepOnFailure
+// retention policy needs to tell whether a pod succeeded
+func WithPodStatusGetter(pods volume.PodStatusGetter) Option {
+	return func(o *options) {
+		o.pods = pods
+	}
+}
+
+// WithBaseLayerDir enables copy-on-write volumes over the read-only base
+// directories below dir
+func WithBaseLayerDir(dir string) Option {
+	return func(o *options) {
+		o.baseLayersDir = dir
+	}
 }
 
-func NewDriver(nodeID, basePath string) (*Driver, error) {
+// WithKeyManager enables encrypted volumes, whose data keys are protected by keys
+func WithKeyManager(keys volume.KeyManager) Option {
+	return func(o *options) {
+		o.keys = keys
+	}
+}
+
+// WithPools creates volumes in the given storage pools instead of the base
+// directory, and reports the pools in the topology of the node
+func WithPools(cfg volume.PoolConfig) Option {
+	return func(o *options) {
+		o.pools = &cfg
+	}
+}
+
+func NewDriver(nodeID, basePath string, opts ...Option) (*Driver, error) {
 	if basePath == "" {
 		return nil, fmt.Errorf("base path is required")
 	}
 
-	// Create the base directory if it doesn't exist
-	if err := os.MkdirAll(basePath, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create base directory: %v", err)
+	o := &options{
+		mounter: volume.NewMounter(),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	// Create the base directory if it doesn't exist and restore volume state
+	volumes, err := volume.NewVolumeManager(basePath)
+	if err != nil {
+		return nil, err
+	}
+	volumes.RegisterBackend(volume.OverlayBackendName, volume.NewOverlayBackend(o.mounter, o.baseLayersDir, o.keys))
+
+	var topology map[string]string
+	var poolTopology map[string]map[string]string
+	if o.pools != nil {
+		if err := volumes.SetPools(*o.pools); err != nil {
+			return nil, err
+		}
+		topology = make(map[string]string)
+		poolTopology = make(map[string]map[string]string)
+		for _, pool := range o.pools.Pools {
+			segments := map[string]string{PoolTopologyKeyPrefix + pool.Name: "true"}
+			for key, value := range pool.Labels {
+				segments[key] = value
+			}
+			for key, value := range segments {
+				topology[key] = value
+			}
+			poolTopology[pool.Name] = segments
+		}
 	}
 
 	return &Driver{
@@ -41,9 +138,25 @@ func NewDriver(nodeID, basePath string) (*Driver, error) {
 		version:  driverVersion,
 		nodeID:   nodeID,
 		basePath: basePath,
+		volumes:  volumes,
+		mounter:  volume.NewNodeMounter(volumes, o.mounter),
+		pods:     o.pods,
+		topology: topology,
+
+		poolTopology: poolTopology,
 	}, nil
 }
 
+// VolumeManager returns the manager tracking the volumes of this driver
+func (d *Driver) VolumeManager() *volume.VolumeManager {
+	return d.volumes
+}
+
+// NodeMounter returns the mounter used to publish volumes on this node
+func (d *Driver) NodeMounter() *volume.NodeMounter {
+	return d.mounter
+}
+
 // IdentityServer interface implementation
 func (d *Driver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
 	return &csi.GetPluginInfoResponse{
@@ -83,22 +196,37 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		return nil, status.Error(codes.InvalidArgument, "volume name is required")
 	}
 
-	// Get volume size
-	size := req.CapacityRange.GetRequiredBytes()
-	if size == 0 {
-		size = 1 * 1024 * 1024 * 1024 // Default to 1GB
+	if err := validateParameters(req.Parameters); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// Volumes with a claim are shared through the claim itself
+	if _, ok := req.Parameters[volume.ShareKeyParam]; ok {
+		return nil, status.Errorf(codes.InvalidArgument, "%s only applies to inline volumes", volume.ShareKeyParam)
+	}
+	for _, capability := range req.VolumeCapabilities {
+		if err := validateCapability(capability); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
 	}
 
 	// Create volume directory
-	volumePath := filepath.Join(d.basePath, req.Name)
-	if err := os.MkdirAll(volumePath, 0755); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to create volume directory: %v", err)
+	vol, err := d.volumes.CreateVolume(req)
+	if err != nil {
+		return nil, createError(err)
+	}
+
+	// Generic ephemeral volumes are set up and seeded before they are handed out
+	if err := d.volumes.SetupVolume(vol.ID); err != nil {
+		return nil, setupError(err)
+	}
+	if err := d.volumes.PopulateVolume(ctx, vol.ID); err != nil {
+		return nil, populateError(err)
 	}
 
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      req.Name,
-			CapacityBytes: size,
+			VolumeId:      vol.ID,
+			CapacityBytes: vol.Size,
 			VolumeContext: req.Parameters,
 		},
 	}, nil
@@ -109,10 +237,17 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
 	}
 
-	// Delete volume directory
-	volumePath := filepath.Join(d.basePath, req.VolumeId)
-	if err := os.RemoveAll(volumePath); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to delete volume directory: %v", err)
+	// Apply the retention policy, or just remove whatever is left on disk
+	// for volumes the driver does not know about
+	_, err := d.volumes.ReleaseVolume(ctx, req.VolumeId, d.pods)
+	if errors.Is(err, volume.ErrVolumeNotFound) {
+		err = d.volumes.DeleteVolume(ctx, req.VolumeId)
+	}
+	if errors.Is(err, volume.ErrVolumeDeleting) {
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete volume: %v", err)
 	}
 
 	return &csi.DeleteVolumeResponse{}, nil
@@ -131,53 +266,129 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
 	}
 
-	// Check if volume exists
-	volumePath := filepath.Join(d.basePath, req.VolumeId)
-	if _, err := os.Stat(volumePath); os.IsNotExist(err) {
-		return nil, status.Error(codes.NotFound, "volume not found")
+	if len(req.VolumeCapabilities) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities are required")
+	}
+
+	if _, err := d.volumes.GetVolume(req.VolumeId); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	// Only confirm capabilities the driver supports, all of them or none
+	for _, capability := range req.VolumeCapabilities {
+		if err := validateCapability(capability); err != nil {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+		}
 	}
 
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.VolumeContext,
 			VolumeCapabilities: req.VolumeCapabilities,
+			Parameters:         req.Parameters,
 		},
 	}, nil
 }
 
+// ListVolumes pages through the volumes of the node in ID order. Entries
+// report the capacity of the volume, this node while the volume is
+// published, and whether the volume is usable.
 func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	entries := []*csi.ListVolumesResponse_Entry{}
+	if req.MaxEntries < 0 {
+		return nil, status.Error(codes.InvalidArgument, "max entries must not be negative")
+	}
 
-	// List all volumes
-	files, err := os.ReadDir(d.basePath)
+	volumes, next, err := d.volumes.ListVolumesPage(req.StartingToken, int(req.MaxEntries))
+	if errors.Is(err, volume.ErrInvalidToken) {
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to list volumes: %v", err)
 	}
 
-	for _, file := range files {
-		if file.IsDir() {
-			info, err := file.Info()
-			if err != nil {
-				klog.Warningf("Failed to get volume info: %v", err)
-				continue
-			}
-
-			entries = append(entries, &csi.ListVolumesResponse_Entry{
-				Volume: &csi.Volume{
-					VolumeId:      file.Name(),
-					CapacityBytes: info.Size(),
-				},
-			})
-		}
+	entries := make([]*csi.ListVolumesResponse_Entry, 0, len(volumes))
+	for _, vol := range volumes {
+		published, condition := d.volumeHealth(vol)
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: d.csiVolume(vol),
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: published,
+				VolumeCondition:  condition,
+			},
+		})
 	}
 
 	return &csi.ListVolumesResponse{
-		Entries: entries,
+		Entries:   entries,
+		NextToken: next,
 	}, nil
 }
 
+// csiVolume describes a volume to the CO: its capacity, the attributes it
+// was created with and the topology of its pool
+func (d *Driver) csiVolume(vol *volume.Volume) *csi.Volume {
+	v := &csi.Volume{
+		VolumeId:      vol.ID,
+		CapacityBytes: vol.Size,
+	}
+	for key, value := range vol.Attributes {
+		// Kubelet passes the pod, and possibly its tokens, on every publish,
+		// unlike the pv/ and pvc/ keys of the external provisioner
+		if strings.HasPrefix(key, kubernetesKeyPrefix) && !strings.HasPrefix(key, kubernetesKeyPrefix+"pv") {
+			continue
+		}
+		if v.VolumeContext == nil {
+			v.VolumeContext = make(map[string]string)
+		}
+		v.VolumeContext[key] = value
+	}
+	// Report what a populated volume holds, e.g. its git commit
+	if vol.Revision != "" {
+		if v.VolumeContext == nil {
+			v.VolumeContext = make(map[string]string)
+		}
+		v.VolumeContext[volume.RevisionContextKey] = vol.Revision
+	}
+	if segments, ok := d.poolTopology[vol.Pool]; ok {
+		v.AccessibleTopology = []*csi.Topology{{Segments: segments}}
+	}
+	return v
+}
+
+// volumeHealth reports the nodes a volume is published on and its
+// condition. Volumes are local to this node, so it is the only node they
+// are published on.
+func (d *Driver) volumeHealth(vol *volume.Volume) ([]string, *csi.VolumeCondition) {
+	var published []string
+	if len(vol.Targets) > 0 {
+		published = []string{d.nodeID}
+	}
+	abnormal, message := d.volumes.VolumeCondition(vol)
+	return published, &csi.VolumeCondition{Abnormal: abnormal, Message: message}
+}
+
+// GetCapacity reports the space available to new volumes in the pool named
+// by the parameters, or the most any pool has available. Space held by
+// deleted volumes that are still waiting in the trash is not available
+// until the reaper has removed them.
 func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	pool := req.GetParameters()[volume.PoolParam]
+	available, err := d.volumes.PoolCapacity(pool)
+	if errors.Is(err, volume.ErrUnknownPool) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get capacity: %v", err)
+	}
+
+	// The trash is on the filesystem of its pool, so the free space leaves
+	// out deleted volumes until the reaper removed them
+	if deleted, pending := d.volumes.PoolTrash(pool); deleted > 0 {
+		klog.V(4).Infof("Capacity of pool %q: %d bytes available, %d more once %d deleted volumes are removed", pool, available, pending, deleted)
+	}
 	return &csi.GetCapacityResponse{
-		AvailableCapacity: 1024 * 1024 * 1024, // 1GB
+		AvailableCapacity: available,
+		MaximumVolumeSize: wrapperspb.Int64(available),
 	}, nil
 }
 
@@ -198,6 +409,27 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 					},
 				},
 			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+					},
+				},
+			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_GET_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
 			{
 				Type: &csi.ControllerServiceCapability_Rpc{
 					Rpc: &csi.ControllerServiceCapability_RPC{
@@ -205,6 +437,13 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 					},
 				},
 			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+					},
+				},
+			},
 		},
 	}, nil
 }
@@ -225,8 +464,25 @@ func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.Controller
 	return nil, status.Error(codes.Unimplemented, "ControllerExpandVolume is not supported")
 }
 
+// ControllerGetVolume describes a single volume like an entry of ListVolumes
 func (d *Driver) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "ControllerGetVolume is not supported")
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+
+	vol, err := d.volumes.GetVolume(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	published, condition := d.volumeHealth(vol)
+	return &csi.ControllerGetVolumeResponse{
+		Volume: d.csiVolume(vol),
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: published,
+			VolumeCondition:  condition,
+		},
+	}, nil
 }
 
 func (d *Driver) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
@@ -234,12 +490,54 @@ func (d *Driver) ControllerModifyVolume(ctx context.Context, req *csi.Controller
 }
 
 // NodeServer interface implementation
+
+// NodeStageVolume sets up the storage of a volume once for the node and
+// stages its global mount, which NodePublishVolume binds into each target
 func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "NodeStageVolume is not supported")
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+
+	if req.StagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is required")
+	}
+
+	if req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability is required")
+	}
+	if err := validateCapability(req.VolumeCapability); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := d.mounter.NodeStageVolume(req); err != nil {
+		switch {
+		case errors.Is(err, volume.ErrVolumeNotFound):
+			return nil, status.Error(codes.NotFound, err.Error())
+		case errors.Is(err, volume.ErrVolumeStaged):
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		case errors.Is(err, volume.ErrInvalidBase), errors.Is(err, volume.ErrBackendUnavailable), errors.Is(err, volume.ErrEncryptionUnavailable):
+			return nil, setupError(err)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to stage volume: %v", err)
+	}
+
+	return &csi.NodeStageVolumeResponse{}, nil
 }
 
 func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "NodeUnstageVolume is not supported")
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+
+	if req.StagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is required")
+	}
+
+	if err := d.mounter.NodeUnstageVolume(req); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unstage volume: %v", err)
+	}
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
 func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
@@ -251,25 +549,91 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 		return nil, status.Error(codes.InvalidArgument, "target path is required")
 	}
 
+	if req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability is required")
+	}
+	if err := validateCapability(req.VolumeCapability); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := validateParameters(req.VolumeContext); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// Publishes with a share key all map onto the same volume
+	volumeID, err := volume.SharedVolumeID(req.VolumeId, req.VolumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if volumeID != req.VolumeId {
+		klog.V(4).Infof("Publishing volume %s as shared volume %s", req.VolumeId, volumeID)
+		req = &csi.NodePublishVolumeRequest{
+			VolumeId:          volumeID,
+			PublishContext:    req.PublishContext,
+			StagingTargetPath: req.StagingTargetPath,
+			TargetPath:        req.TargetPath,
+			VolumeCapability:  req.VolumeCapability,
+			Readonly:          req.Readonly,
+			Secrets:           req.Secrets,
+			VolumeContext:     req.VolumeContext,
+		}
+	}
+
 	// Check if volume exists, if not, create it (ephemeral volume support)
-	volumePath := filepath.Join(d.basePath, req.VolumeId)
-	if _, err := os.Stat(volumePath); os.IsNotExist(err) {
-		// Create the volume directory for ephemeral volume
-		if err := os.MkdirAll(volumePath, 0755); err != nil {
-			return nil, status.Errorf(codes.Internal, "failed to create volume directory: %v", err)
+	vol, err := d.volumes.EnsureEphemeralVolume(volumeID, 0, req.VolumeContext)
+	if err != nil {
+		return nil, createError(err)
+	}
+
+	// Reserve the target before changing the volume, a publish that is
+	// rejected must not touch a volume another pod is using
+	added, err := d.mounter.ReserveTarget(req)
+	if err != nil {
+		return nil, publishError(err)
+	}
+	published := false
+	defer func() {
+		if added && !published {
+			if err := d.volumes.RemoveIOLimits(volumeID, req.TargetPath); err != nil {
+				klog.Warningf("Failed to remove I/O limits of volume %s for %s: %v", volumeID, req.TargetPath, err)
+			}
+			if err := d.volumes.RemoveTarget(volumeID, req.TargetPath); err != nil {
+				klog.Warningf("Failed to release target %s of volume %s: %v", req.TargetPath, volumeID, err)
+			}
+		}
+	}()
+
+	// Fill the volume with its initial content before it becomes visible
+	if err := d.volumes.SetupVolume(volumeID); err != nil {
+		return nil, setupError(err)
+	}
+	if err := d.volumes.PopulateVolume(ctx, volumeID); err != nil {
+		return nil, populateError(err)
+	}
+	// Render files for the pod the volume is published for
+	if err := volume.RenderFiles(volumeID, vol.Path, req.VolumeContext); err != nil {
+		if errors.Is(err, volume.ErrInvalidTemplate) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
 		}
+		return nil, status.Errorf(codes.Internal, "failed to render files: %v", err)
+	}
+
+	// Label the volume with the SELinux context kubelet passes for the pod
+	label := volume.SELinuxContext(req.VolumeCapability.GetMount().GetMountFlags())
+	if err := d.volumes.ApplySELinuxLabel(volumeID, req.TargetPath, label); err != nil {
+		return nil, selinuxError(err)
 	}
 
-	// Create target directory
-	if err := os.MkdirAll(req.TargetPath, 0755); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to create target directory: %v", err)
+	// Throttle the pod on the device of the volume
+	if err := d.volumes.ApplyIOLimits(volumeID, req.TargetPath, req.VolumeContext); err != nil {
+		return nil, ioLimitsError(err)
 	}
 
 	// Mount volume using bind mount
-	cmd := exec.Command("mount", "--bind", volumePath, req.TargetPath)
-	if err := cmd.Run(); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to mount volume: %v", err)
+	if err := d.mounter.NodePublishVolume(req); err != nil {
+		return nil, publishError(err)
 	}
+	published = true
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
@@ -283,22 +647,49 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 		return nil, status.Error(codes.InvalidArgument, "target path is required")
 	}
 
-	// Unmount volume
-	cmd := exec.Command("umount", req.TargetPath)
-	if err := cmd.Run(); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to unmount volume: %v", err)
+	// Kubelet unpublishes shared volumes by the ID it published them with
+	volumeID := d.volumes.PublishedVolumeID(req.VolumeId, req.TargetPath)
+	if volumeID != req.VolumeId {
+		req = &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: req.TargetPath}
 	}
 
-	// Remove target directory
-	if err := os.RemoveAll(req.TargetPath); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to remove target directory: %v", err)
+	// Lift the limits of the pod while the target is still recorded, then
+	// unmount the volume and remove the target directory
+	if err := d.volumes.RemoveIOLimits(volumeID, req.TargetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to remove I/O limits: %v", err)
+	}
+	if err := d.mounter.NodeUnpublishVolume(req); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unpublish volume: %v", err)
+	}
+
+	// The lifecycle of inline ephemeral volumes ends with their last target
+	if vol, err := d.volumes.GetVolume(volumeID); err == nil && vol.Ephemeral && len(vol.Targets) == 0 {
+		if _, err := d.volumes.ReleaseVolume(ctx, volumeID, d.pods); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to release volume: %v", err)
+		}
 	}
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
 func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "NodeGetVolumeStats is not supported")
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+
+	if req.VolumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume path is required")
+	}
+
+	resp, err := d.mounter.NodeGetVolumeStats(d.volumes.PublishedVolumeID(req.VolumeId, req.VolumePath))
+	if err != nil {
+		if errors.Is(err, volume.ErrVolumeNotFound) {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get volume stats: %v", err)
+	}
+
+	return resp, nil
 }
 
 func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
@@ -308,6 +699,13 @@ func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolume
 func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	return &csi.NodeGetCapabilitiesResponse{
 		Capabilities: []*csi.NodeServiceCapability{
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+					},
+				},
+			},
 			{
 				Type: &csi.NodeServiceCapability_Rpc{
 					Rpc: &csi.NodeServiceCapability_RPC{
@@ -315,12 +713,195 @@ func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabi
 					},
 				},
 			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+					},
+				},
+			},
 		},
 	}, nil
 }
 
 func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	return &csi.NodeGetInfoResponse{
+	resp := &csi.NodeGetInfoResponse{
 		NodeId: d.nodeID,
-	}, nil
+	}
+	if d.topology != nil {
+		resp.AccessibleTopology = &csi.Topology{Segments: d.topology}
+	}
+	return resp, nil
+}
+
+// validateCapability checks that a volume capability can be provided by a
+// directory local to the node: a mount with a single node access mode.
+// SINGLE_NODE_SINGLE_WRITER, the ReadWriteOncePod access mode, is enforced
+// when publishing.
+func validateCapability(capability *csi.VolumeCapability) error {
+	if capability.GetBlock() != nil {
+		return fmt.Errorf("block volumes are not supported")
+	}
+	if capability.GetMount() == nil {
+		return fmt.Errorf("volume capability must request a mount")
+	}
+	switch mode := capability.GetAccessMode().GetMode(); mode {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:
+		return nil
+	case csi.VolumeCapability_AccessMode_UNKNOWN:
+		return fmt.Errorf("volume capability must have an access mode")
+	default:
+		return fmt.Errorf("access mode %s is not supported, volumes are local to a node", mode)
+	}
+}
+
+// validateParameters checks the StorageClass parameters or volume attributes
+// the driver interprets
+func validateParameters(params map[string]string) error {
+	if _, err := volume.ParseRetentionPolicy(params[volume.RetentionPolicyParam]); err != nil {
+		return err
+	}
+
+	switch params[volume.ArchiveOnDeleteParam] {
+	case "", "true", "false":
+	default:
+		return fmt.Errorf("invalid %s value %q, must be true or false", volume.ArchiveOnDeleteParam, params[volume.ArchiveOnDeleteParam])
+	}
+
+	if err := volume.ValidateOverlayAttributes(params); err != nil {
+		return err
+	}
+	if err := volume.ValidateFileAttributes(params); err != nil {
+		return err
+	}
+	if _, err := volume.ParseIOLimits(params); err != nil {
+		return err
+	}
+	if err := volume.ValidateEncryptionAttributes(params); err != nil {
+		return err
+	}
+	if _, err := volume.ParseWipe(params); err != nil {
+		return err
+	}
+	if err := volume.ValidateIDMapAttributes(params); err != nil {
+		return err
+	}
+	if err := volume.ValidateShareAttributes(params); err != nil {
+		return err
+	}
+	// I/O limits are applied in the cgroup of a single pod
+	if limits, _ := volume.ParseIOLimits(params); !limits.IsZero() && params[volume.ShareKeyParam] != "" {
+		return fmt.Errorf("shared volumes cannot have I/O limits")
+	}
+	// Seeding starts from an empty volume, which would hide the base
+	overlay := params[volume.BaseDirParam] != "" || params[volume.BaseLayerParam] != ""
+	if overlay && (params[seed.ArchiveParam] != "" || params[seed.GitSourceParam] != "" || params[seed.OCILayoutParam] != "") {
+		return fmt.Errorf("overlay volumes cannot be seeded")
+	}
+
+	return seed.ValidateAttributes(params)
+}
+
+// createError maps a failure to create a volume to a status
+func createError(err error) error {
+	switch {
+	case errors.Is(err, volume.ErrQuotaExceeded), errors.Is(err, volume.ErrInsufficientCapacity):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, volume.ErrUnknownPool), errors.Is(err, volume.ErrEncryptionUnsupported):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, volume.ErrVolumeDeleting):
+		return status.Error(codes.Aborted, err.Error())
+	default:
+		return status.Errorf(codes.Internal, "failed to create volume: %v", err)
+	}
+}
+
+// publishError maps a failure to publish a volume at its target to a status
+func publishError(err error) error {
+	switch {
+	case errors.Is(err, volume.ErrVolumeNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, volume.ErrIDMapUnsupported), errors.Is(err, volume.ErrUserNamespaceNotFound), errors.Is(err, volume.ErrVolumeInUse):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Errorf(codes.Internal, "failed to mount volume: %v", err)
+}
+
+// selinuxError maps a failure to label a volume to a status
+func selinuxError(err error) error {
+	var code codes.Code
+	switch {
+	case errors.Is(err, volume.ErrSELinuxConflict), errors.Is(err, volume.ErrBackendUnavailable):
+		code = codes.FailedPrecondition
+	case errors.Is(err, volume.ErrVolumeNotFound):
+		code = codes.NotFound
+	default:
+		code = codes.Internal
+	}
+	return status.Errorf(code, "failed to apply SELinux label: %v", err)
+}
+
+// ioLimitsError maps a failure to apply the I/O limits of a volume to a status
+func ioLimitsError(err error) error {
+	var code codes.Code
+	switch {
+	case errors.Is(err, volume.ErrIOLimitsUnsupported):
+		code = codes.InvalidArgument
+	case errors.Is(err, volume.ErrPodCgroupNotFound), errors.Is(err, volume.ErrBackendUnavailable):
+		code = codes.FailedPrecondition
+	case errors.Is(err, volume.ErrVolumeNotFound):
+		code = codes.NotFound
+	default:
+		code = codes.Internal
+	}
+	return status.Errorf(code, "failed to apply I/O limits: %v", err)
+}
+
+// setupError maps a failure to set up the backend of a volume to a status
+func setupError(err error) error {
+	var code codes.Code
+	switch {
+	case errors.Is(err, volume.ErrInvalidBase):
+		code = codes.InvalidArgument
+	case errors.Is(err, volume.ErrBackendUnavailable), errors.Is(err, volume.ErrEncryptionUnavailable):
+		code = codes.FailedPrecondition
+	case errors.Is(err, volume.ErrVolumeNotFound):
+		code = codes.NotFound
+	default:
+		code = codes.Internal
+	}
+	return status.Errorf(code, "failed to set up volume: %v", err)
+}
+
+// populateError maps a failure to populate a volume to a status kubelet
+// retries on. Errors caused by the request itself are reported as such.
+func populateError(err error) error {
+	var code codes.Code
+	switch {
+	case errors.Is(err, volume.ErrPopulateInProgress):
+		code = codes.Aborted
+	case errors.Is(err, seed.ErrInvalidSource), errors.Is(err, seed.ErrUnsafeArchive):
+		code = codes.InvalidArgument
+	case errors.Is(err, seed.ErrChecksumMismatch):
+		code = codes.FailedPrecondition
+	case errors.Is(err, seed.ErrTooLarge):
+		code = codes.ResourceExhausted
+	case errors.Is(err, seed.ErrFetch):
+		code = codes.Unavailable
+	case errors.Is(err, volume.ErrVolumeNotFound):
+		code = codes.NotFound
+	default:
+		code = codes.Internal
+	}
+	return status.Errorf(code, "failed to populate volume: %v", err)
 }
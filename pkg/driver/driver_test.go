@@ -2,6 +2,7 @@ package driver
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
@@ -9,6 +10,11 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/seed"
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/volume"
 )
 
 func setupTestDriver(t *testing.T) (*Driver, string) {
@@ -81,6 +87,44 @@ func TestNodeGetInfo(t *testing.T) {
 	assert.Equal(t, "test-node-id", resp.NodeId)
 }
 
+func TestStoragePools(t *testing.T) {
+	tempDir := t.TempDir()
+	driver, err := NewDriver("test-node-id", filepath.Join(tempDir, "base"), WithPools(volume.PoolConfig{
+		Pools: []volume.Pool{
+			{Name: "nvme", Path: filepath.Join(tempDir, "nvme"), Labels: map[string]string{"example.com/media": "ssd"}},
+			{Name: "hdd", Path: filepath.Join(tempDir, "hdd")},
+		},
+	}))
+	require.NoError(t, err)
+
+	info, err := driver.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		PoolTopologyKeyPrefix + "nvme": "true",
+		PoolTopologyKeyPrefix + "hdd":  "true",
+		"example.com/media":            "ssd",
+	}, info.AccessibleTopology.Segments)
+
+	capacity, err := driver.GetCapacity(context.Background(), &csi.GetCapacityRequest{
+		Parameters: map[string]string{volume.PoolParam: "hdd"},
+	})
+	require.NoError(t, err)
+	assert.Positive(t, capacity.AvailableCapacity)
+
+	resp, err := driver.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:       "test-volume",
+		Parameters: map[string]string{volume.PoolParam: "hdd"},
+	})
+	require.NoError(t, err)
+	assert.DirExists(t, filepath.Join(tempDir, "hdd", resp.Volume.VolumeId))
+
+	_, err = driver.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:       "other-volume",
+		Parameters: map[string]string{volume.PoolParam: "tape"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
 func TestNodeGetCapabilities(t *testing.T) {
 	driver, tempDir := setupTestDriver(t)
 	defer cleanupTestDriver(t, tempDir)
@@ -171,6 +215,13 @@ func TestNodePublishVolume(t *testing.T) {
 	resp, err := driver.NodePublishVolume(context.Background(), req)
 	require.NoError(t, err)
 	assert.NotNil(t, resp)
+
+	// Unmount again so the temporary directory can be removed
+	_, err = driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "test-volume",
+		TargetPath: targetPath,
+	})
+	require.NoError(t, err)
 }
 
 func TestNodeUnpublishVolume(t *testing.T) {
@@ -195,3 +246,497 @@ func TestNodeUnpublishVolume(t *testing.T) {
 	require.NoError(t, err)
 	assert.NotNil(t, resp)
 }
+
+func TestNodeUnpublishVolumeAppliesRetention(t *testing.T) {
+	tempDir := t.TempDir()
+	driver, err := NewDriver("test-node-id", tempDir, WithMounter(volume.NewFakeMounter()))
+	require.NoError(t, err)
+
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+
+	for volumeID, retention := range map[string]string{"deleted": "delete", "retained": "retain:1h"} {
+		targetPath := filepath.Join(tempDir, "target-"+volumeID)
+		_, err := driver.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         volumeID,
+			TargetPath:       targetPath,
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{"retentionPolicy": retention},
+		})
+		require.NoError(t, err)
+
+		_, err = driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   volumeID,
+			TargetPath: targetPath,
+		})
+		require.NoError(t, err)
+	}
+
+	_, err = os.Stat(filepath.Join(tempDir, "deleted"))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = os.Stat(filepath.Join(tempDir, "retained"))
+	require.NoError(t, err)
+
+	// Retained volumes stay visible until the janitor expires them
+	resp, err := driver.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	require.NoError(t, err)
+	require.Len(t, resp.Entries, 1)
+	assert.Equal(t, "retained", resp.Entries[0].Volume.VolumeId)
+}
+
+func TestCreateVolumeInvalidRetentionPolicy(t *testing.T) {
+	driver, tempDir := setupTestDriver(t)
+	defer cleanupTestDriver(t, tempDir)
+
+	_, err := driver.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:       "test-volume",
+		Parameters: map[string]string{"retentionPolicy": "forever"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+type failingPopulator struct {
+	err error
+}
+
+func (p failingPopulator) Populate(ctx context.Context, vol *volume.Volume) (string, error) {
+	return "", p.err
+}
+
+func TestNodePublishVolumeSeedFailure(t *testing.T) {
+	tempDir := t.TempDir()
+	mounter := volume.NewFakeMounter()
+	driver, err := NewDriver("test-node-id", tempDir, WithMounter(mounter))
+	require.NoError(t, err)
+
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:   "seeded",
+		TargetPath: filepath.Join(tempDir, "target"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: map[string]string{
+			seed.ArchiveParam: "https://example.com/data.tar",
+			seed.SHA256Param:  "0000000000000000000000000000000000000000000000000000000000000000",
+		},
+	}
+
+	driver.VolumeManager().SetPopulator(failingPopulator{err: fmt.Errorf("%w: got 1234", seed.ErrChecksumMismatch)})
+	_, err = driver.NodePublishVolume(context.Background(), req)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Empty(t, mounter.Mounts(), "a volume that failed to seed must not be mounted")
+
+	req.VolumeContext[seed.SHA256Param] = "abc"
+	_, err = driver.NodePublishVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestNodePublishVolumeRendersFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	mounter := volume.NewFakeMounter()
+	driver, err := NewDriver("test-node-id", tempDir, WithMounter(mounter))
+	require.NoError(t, err)
+
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:   "rendered",
+		TargetPath: filepath.Join(tempDir, "target"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: map[string]string{
+			volume.FilesParamPrefix + "conf/app.yaml": "pod: {{.Pod.Namespace}}/{{.Pod.Name}}\nuid: {{.Pod.UID}}\nsa: {{.Pod.ServiceAccount}}\nlevel: {{index .Attributes \"logLevel\"}}\n",
+			"logLevel":               "debug",
+			volume.PodNameKey:        "web-0",
+			volume.PodNamespaceKey:   "shop",
+			volume.PodUIDKey:         "1234",
+			volume.ServiceAccountKey: "web",
+		},
+	}
+
+	_, err = driver.NodePublishVolume(context.Background(), req)
+	require.NoError(t, err)
+	data, err := os.ReadFile(filepath.Join(tempDir, "rendered", "conf", "app.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "pod: shop/web-0\nuid: 1234\nsa: web\nlevel: debug\n", string(data))
+
+	// A symlink left behind by a pod is replaced, not followed
+	outside := filepath.Join(t.TempDir(), "outside")
+	link := filepath.Join(tempDir, "rendered", "conf", "app.yaml")
+	require.NoError(t, os.Remove(link))
+	require.NoError(t, os.Symlink(outside, link))
+	require.NoError(t, volume.RenderFiles("rendered", filepath.Join(tempDir, "rendered"), req.VolumeContext))
+	assert.NoFileExists(t, outside)
+
+	// So is a parent directory swapped for a symlink
+	outsideDir := t.TempDir()
+	conf := filepath.Join(tempDir, "rendered", "conf")
+	require.NoError(t, os.RemoveAll(conf))
+	require.NoError(t, os.Symlink(outsideDir, conf))
+	assert.Error(t, volume.RenderFiles("rendered", filepath.Join(tempDir, "rendered"), req.VolumeContext))
+	entries, err := os.ReadDir(outsideDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	for _, files := range []map[string]string{
+		{volume.FilesParamPrefix + "../escape": "x"},
+		{volume.FilesParamPrefix + "/etc/passwd": "x"},
+		{volume.FilesParamPrefix + "bad": "{{.Pod.Name"},
+		{volume.FilesParamPrefix + "missing": "{{.Pod.Nmae}}"},
+	} {
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "invalid",
+			TargetPath:       filepath.Join(tempDir, "invalid-target"),
+			VolumeCapability: req.VolumeCapability,
+			VolumeContext:    files,
+		}
+		_, err = driver.NodePublishVolume(context.Background(), req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), "%v", files)
+	}
+}
+
+// blockBackend is a backend whose volumes are on device 7:3
+type blockBackend struct{}
+
+func (blockBackend) Setup(*volume.Volume) error            { return nil }
+func (blockBackend) Teardown(*volume.Volume) error         { return nil }
+func (blockBackend) Device(*volume.Volume) (string, error) { return "7:3", nil }
+
+func TestNodePublishVolumeRollsBackIOLimits(t *testing.T) {
+	driver, err := NewDriver("test-node-id", t.TempDir(), WithMounter(volume.NewFakeMounter()))
+	require.NoError(t, err)
+	volumes := driver.VolumeManager()
+	volumes.RegisterBackend("block", blockBackend{})
+	root := t.TempDir()
+	volumes.SetCgroupRoot(root)
+	cgroup := filepath.Join(root, "kubepods.slice", "kubepods-pod1234.slice")
+	require.NoError(t, os.MkdirAll(cgroup, 0755))
+	ioMax := filepath.Join(cgroup, "io.max")
+	require.NoError(t, os.WriteFile(ioMax, nil, 0644))
+
+	_, err = volumes.EnsureVolume("throttled", 0, nil)
+	require.NoError(t, err)
+	require.NoError(t, volumes.UpdateVolume("throttled", func(v *volume.Volume) { v.Backend = "block" }))
+
+	// The mount fails after the limits are applied, as the target is not
+	// in a pod directory the user namespace could be read from
+	_, err = driver.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "throttled",
+		TargetPath:       filepath.Join(t.TempDir(), "target"),
+		VolumeCapability: accessCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext: map[string]string{
+			volume.PodUIDKey:     "1234",
+			volume.WriteBpsParam: "1M",
+			volume.IDMapParam:    volume.IDMapAuto,
+		},
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	data, err := os.ReadFile(ioMax)
+	require.NoError(t, err)
+	assert.Equal(t, "7:3 rbps=max wbps=max riops=max wiops=max\n", string(data), "a failed publish must not leave the pod throttled")
+	vol, err := volumes.GetVolume("throttled")
+	require.NoError(t, err)
+	assert.Empty(t, vol.Targets)
+	assert.Empty(t, vol.IOCgroups)
+}
+
+func accessCapability(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func TestAccessModes(t *testing.T) {
+	driver, err := NewDriver("test-node-id", t.TempDir(), WithMounter(volume.NewFakeMounter()))
+	require.NoError(t, err)
+	ctx := context.Background()
+	multiNode := accessCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)
+	singleWriter := accessCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER)
+
+	// Directories local to the node cannot be shared between nodes
+	_, err = driver.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "shared", VolumeCapabilities: []*csi.VolumeCapability{multiNode}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = driver.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "test-volume", VolumeCapabilities: []*csi.VolumeCapability{singleWriter}})
+	require.NoError(t, err)
+
+	validated, err := driver.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "test-volume",
+		VolumeCapabilities: []*csi.VolumeCapability{singleWriter, multiNode},
+	})
+	require.NoError(t, err)
+	assert.Nil(t, validated.Confirmed)
+	assert.Contains(t, validated.Message, "MULTI_NODE_MULTI_WRITER")
+	validated, err = driver.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "test-volume",
+		VolumeCapabilities: []*csi.VolumeCapability{singleWriter},
+	})
+	require.NoError(t, err)
+	assert.NotNil(t, validated.Confirmed)
+
+	// A single writer volume is published at one target at a time
+	publish := func(target string) error {
+		_, err := driver.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:         "test-volume",
+			TargetPath:       filepath.Join(t.TempDir(), target),
+			VolumeCapability: singleWriter,
+		})
+		return err
+	}
+	first := filepath.Join(t.TempDir(), "first")
+	_, err = driver.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{VolumeId: "test-volume", TargetPath: first, VolumeCapability: singleWriter})
+	require.NoError(t, err)
+	_, err = driver.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{VolumeId: "test-volume", TargetPath: first, VolumeCapability: singleWriter})
+	require.NoError(t, err, "publishing at the same target again succeeds")
+	assert.Equal(t, codes.FailedPrecondition, status.Code(publish("second")))
+
+	// A rejected publish leaves the volume of the writer alone
+	_, err = driver.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:         "test-volume",
+		TargetPath:       filepath.Join(t.TempDir(), "rejected"),
+		VolumeCapability: singleWriter,
+		VolumeContext:    map[string]string{volume.FilesParamPrefix + "owner": "rejected"},
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	vol, err := driver.VolumeManager().GetVolume("test-volume")
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(vol.Path, "owner"))
+	assert.Equal(t, []string{first}, vol.Targets)
+
+	_, err = driver.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "test-volume", TargetPath: first})
+	require.NoError(t, err)
+	require.NoError(t, publish("second"))
+
+	capabilities, err := driver.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	require.NoError(t, err)
+	var rpcs []csi.NodeServiceCapability_RPC_Type
+	for _, capability := range capabilities.Capabilities {
+		rpcs = append(rpcs, capability.GetRpc().GetType())
+	}
+	assert.Contains(t, rpcs, csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER)
+}
+
+func TestSharedVolumes(t *testing.T) {
+	tempDir := t.TempDir()
+	driver, err := NewDriver("test-node-id", tempDir, WithMounter(volume.NewFakeMounter()))
+	require.NoError(t, err)
+	ctx := context.Background()
+	capability := accessCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER)
+
+	podContext := func(namespace, uid string) map[string]string {
+		return map[string]string{
+			volume.ShareKeyParam:   "cache",
+			volume.PodNameKey:      "pod-" + uid,
+			volume.PodNamespaceKey: namespace,
+			volume.PodUIDKey:       uid,
+		}
+	}
+	publish := func(volumeID, namespace, uid string) string {
+		target := filepath.Join(tempDir, "target-"+uid)
+		_, err := driver.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:         volumeID,
+			TargetPath:       target,
+			VolumeCapability: capability,
+			VolumeContext:    podContext(namespace, uid),
+		})
+		require.NoError(t, err)
+		return target
+	}
+
+	// Kubelet publishes the inline volume of every pod under its own ID
+	first := publish("csi-1", "team", "uid-1")
+	second := publish("csi-2", "team", "uid-2")
+	other := publish("csi-3", "other", "uid-3")
+
+	shared, err := driver.volumes.GetVolume("share-team.cache")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{first, second}, shared.Targets)
+	assert.Equal(t, []string{"uid-1", "uid-2"}, shared.PodUIDs())
+	_, err = driver.volumes.GetVolume("share-other.cache")
+	require.NoError(t, err, "namespaces do not share volumes")
+
+	stats, err := driver.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "csi-2", VolumePath: second})
+	require.NoError(t, err)
+	assert.NotEmpty(t, stats.Usage)
+
+	// The data outlives all but the last unpublish
+	_, err = driver.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-1", TargetPath: first})
+	require.NoError(t, err)
+	shared, err = driver.volumes.GetVolume("share-team.cache")
+	require.NoError(t, err)
+	assert.Equal(t, []string{second}, shared.Targets)
+	assert.Equal(t, second, shared.MountPoint)
+
+	_, err = driver.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-2", TargetPath: second})
+	require.NoError(t, err)
+	_, err = driver.volumes.GetVolume("share-team.cache")
+	assert.ErrorIs(t, err, volume.ErrVolumeNotFound)
+	_, err = driver.volumes.GetVolume("share-other.cache")
+	require.NoError(t, err)
+
+	_, err = driver.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-3", TargetPath: other})
+	require.NoError(t, err)
+
+	// Shares are scoped by namespace and only exist for inline volumes
+	_, err = driver.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:         "csi-4",
+		TargetPath:       filepath.Join(tempDir, "target-4"),
+		VolumeCapability: capability,
+		VolumeContext:    map[string]string{volume.ShareKeyParam: "cache"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = driver.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:       "claim",
+		Parameters: map[string]string{volume.ShareKeyParam: "cache"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestNodeStageVolume(t *testing.T) {
+	driver, err := NewDriver("test-node-id", t.TempDir(), WithMounter(volume.NewFakeMounter()))
+	require.NoError(t, err)
+	ctx := context.Background()
+	capability := accessCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	staging := filepath.Join(t.TempDir(), "globalmount")
+
+	_, err = driver.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{VolumeId: "missing", StagingTargetPath: staging, VolumeCapability: capability})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = driver.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{VolumeId: "test-volume", StagingTargetPath: staging})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Directory volumes stage without a global mount and publish as before
+	_, err = driver.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "test-volume", VolumeCapabilities: []*csi.VolumeCapability{capability}})
+	require.NoError(t, err)
+	_, err = driver.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{VolumeId: "test-volume", StagingTargetPath: staging, VolumeCapability: capability})
+	require.NoError(t, err)
+	target := filepath.Join(t.TempDir(), "target")
+	_, err = driver.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          "test-volume",
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  capability,
+	})
+	require.NoError(t, err)
+	_, err = driver.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "test-volume", TargetPath: target})
+	require.NoError(t, err)
+	_, err = driver.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: "test-volume", StagingTargetPath: staging})
+	require.NoError(t, err)
+
+	capabilities, err := driver.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	require.NoError(t, err)
+	var rpcs []csi.NodeServiceCapability_RPC_Type
+	for _, capability := range capabilities.Capabilities {
+		rpcs = append(rpcs, capability.GetRpc().GetType())
+	}
+	assert.Contains(t, rpcs, csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME)
+}
+
+func TestListVolumes(t *testing.T) {
+	driver, err := NewDriver("test-node-id", t.TempDir(), WithMounter(volume.NewFakeMounter()))
+	require.NoError(t, err)
+	ctx := context.Background()
+	capability := accessCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+
+	for _, name := range []string{"vol-a", "vol-b", "vol-c"} {
+		_, err := driver.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 32 << 20},
+			VolumeCapabilities: []*csi.VolumeCapability{capability},
+		})
+		require.NoError(t, err)
+	}
+	_, err = driver.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:         "vol-b",
+		TargetPath:       filepath.Join(t.TempDir(), "target"),
+		VolumeCapability: capability,
+	})
+	require.NoError(t, err)
+
+	var entries []*csi.ListVolumesResponse_Entry
+	token := ""
+	for {
+		resp, err := driver.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: token})
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(resp.Entries), 2)
+		entries = append(entries, resp.Entries...)
+		if token = resp.NextToken; token == "" {
+			break
+		}
+	}
+	require.Len(t, entries, 3)
+	for i, id := range []string{"vol-a", "vol-b", "vol-c"} {
+		assert.Equal(t, id, entries[i].Volume.VolumeId)
+		assert.Equal(t, int64(32<<20), entries[i].Volume.CapacityBytes)
+		assert.False(t, entries[i].Status.VolumeCondition.Abnormal)
+	}
+	assert.Empty(t, entries[0].Status.PublishedNodeIds)
+	assert.Equal(t, []string{"test-node-id"}, entries[1].Status.PublishedNodeIds)
+
+	_, err = driver.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: "not a token!"})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	_, err = driver.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: -1})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	tempDir := t.TempDir()
+	driver, err := NewDriver("test-node-id", filepath.Join(tempDir, "base"),
+		WithMounter(volume.NewFakeMounter()),
+		WithPools(volume.PoolConfig{
+			Pools: []volume.Pool{
+				{Name: "nvme", Path: filepath.Join(tempDir, "nvme"), Labels: map[string]string{"example.com/media": "ssd"}},
+				{Name: "hdd", Path: filepath.Join(tempDir, "hdd")},
+			},
+		}))
+	require.NoError(t, err)
+	ctx := context.Background()
+	capability := accessCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+
+	_, err = driver.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = driver.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "missing"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	parameters := map[string]string{volume.PoolParam: "nvme", volume.PVCNamespaceKey: "team"}
+	_, err = driver.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "test-volume",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 32 << 20},
+		VolumeCapabilities: []*csi.VolumeCapability{capability},
+		Parameters:         parameters,
+	})
+	require.NoError(t, err)
+	_, err = driver.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:         "test-volume",
+		TargetPath:       filepath.Join(tempDir, "target"),
+		VolumeCapability: capability,
+		VolumeContext:    map[string]string{volume.PodNameKey: "pod", volume.PodNamespaceKey: "team"},
+	})
+	require.NoError(t, err)
+
+	resp, err := driver.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "test-volume"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(32<<20), resp.Volume.CapacityBytes)
+	assert.Equal(t, parameters, resp.Volume.VolumeContext)
+	require.Len(t, resp.Volume.AccessibleTopology, 1)
+	assert.Equal(t, map[string]string{
+		PoolTopologyKeyPrefix + "nvme": "true",
+		"example.com/media":            "ssd",
+	}, resp.Volume.AccessibleTopology[0].Segments)
+	assert.Equal(t, []string{"test-node-id"}, resp.Status.PublishedNodeIds)
+	assert.False(t, resp.Status.VolumeCondition.Abnormal)
+
+	// A volume whose directory disappeared is reported abnormal
+	require.NoError(t, os.RemoveAll(filepath.Join(tempDir, "nvme", "test-volume")))
+	resp, err = driver.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "test-volume"})
+	require.NoError(t, err)
+	assert.True(t, resp.Status.VolumeCondition.Abnormal)
+}
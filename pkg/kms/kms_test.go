@@ -0,0 +1,75 @@
+package kms
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/kms/kmspb"
+)
+
+func newLocalKeyFile(t *testing.T) *LocalKeyFile {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "kek")
+	require.NoError(t, os.WriteFile(path, []byte("0123456789abcdef0123456789abcdef"), 0600))
+	keys, err := NewLocalKeyFile(path)
+	require.NoError(t, err)
+	return keys
+}
+
+func TestLocalKeyFile(t *testing.T) {
+	ctx := context.Background()
+	keys := newLocalKeyFile(t)
+
+	wrapped, err := keys.WrapKey(ctx, "vol-1", []byte("data key"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(wrapped), "data key")
+
+	key, err := keys.UnwrapKey(ctx, "vol-1", wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data key"), key)
+
+	// A wrapped key is bound to its volume
+	_, err = keys.UnwrapKey(ctx, "vol-2", wrapped)
+	assert.ErrorIs(t, err, ErrInvalidWrappedKey)
+	_, err = keys.UnwrapKey(ctx, "vol-1", wrapped[:4])
+	assert.ErrorIs(t, err, ErrInvalidWrappedKey)
+
+	short := filepath.Join(t.TempDir(), "short")
+	require.NoError(t, os.WriteFile(short, []byte("too short"), 0600))
+	_, err = NewLocalKeyFile(short)
+	assert.Error(t, err)
+}
+
+func TestPlugin(t *testing.T) {
+	ctx := context.Background()
+	socket := filepath.Join(t.TempDir(), "kms.sock")
+	lis, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	kmspb.RegisterKeyManagementServer(s, NewServer(newLocalKeyFile(t)))
+	go s.Serve(lis)
+	defer s.Stop()
+
+	plugin, err := NewPlugin("unix://" + socket)
+	require.NoError(t, err)
+	defer plugin.Close()
+
+	wrapped, err := plugin.WrapKey(ctx, "vol-1", []byte("data key"))
+	require.NoError(t, err)
+	key, err := plugin.UnwrapKey(ctx, "vol-1", wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data key"), key)
+
+	_, err = plugin.UnwrapKey(ctx, "vol-2", wrapped)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.NoError(t, plugin.DestroyKey(ctx, "vol-1"))
+}
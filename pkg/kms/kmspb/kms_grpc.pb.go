@@ -0,0 +1,196 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: pkg/kms/kmspb/kms.proto
+
+// Package ephemeralcsi.kms.v1 is the API of KMS plugins that protect the
+// data keys of encrypted volumes. The node plugin connects to a plugin on a
+// unix socket; the plugin holds the key encryption key, which never leaves
+// it.
+
+package kmspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	KeyManagement_WrapKey_FullMethodName    = "/ephemeralcsi.kms.v1.KeyManagement/WrapKey"
+	KeyManagement_UnwrapKey_FullMethodName  = "/ephemeralcsi.kms.v1.KeyManagement/UnwrapKey"
+	KeyManagement_DestroyKey_FullMethodName = "/ephemeralcsi.kms.v1.KeyManagement/DestroyKey"
+)
+
+// KeyManagementClient is the client API for KeyManagement service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type KeyManagementClient interface {
+	// WrapKey encrypts the data key of a volume.
+	WrapKey(ctx context.Context, in *WrapKeyRequest, opts ...grpc.CallOption) (*WrapKeyResponse, error)
+	// UnwrapKey decrypts a data key returned by WrapKey for the same volume.
+	UnwrapKey(ctx context.Context, in *UnwrapKeyRequest, opts ...grpc.CallOption) (*UnwrapKeyResponse, error)
+	// DestroyKey forgets anything the plugin keeps about the key of a
+	// deleted volume. It succeeds for unknown volumes.
+	DestroyKey(ctx context.Context, in *DestroyKeyRequest, opts ...grpc.CallOption) (*DestroyKeyResponse, error)
+}
+
+type keyManagementClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewKeyManagementClient(cc grpc.ClientConnInterface) KeyManagementClient {
+	return &keyManagementClient{cc}
+}
+
+func (c *keyManagementClient) WrapKey(ctx context.Context, in *WrapKeyRequest, opts ...grpc.CallOption) (*WrapKeyResponse, error) {
+	out := new(WrapKeyResponse)
+	err := c.cc.Invoke(ctx, KeyManagement_WrapKey_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyManagementClient) UnwrapKey(ctx context.Context, in *UnwrapKeyRequest, opts ...grpc.CallOption) (*UnwrapKeyResponse, error) {
+	out := new(UnwrapKeyResponse)
+	err := c.cc.Invoke(ctx, KeyManagement_UnwrapKey_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyManagementClient) DestroyKey(ctx context.Context, in *DestroyKeyRequest, opts ...grpc.CallOption) (*DestroyKeyResponse, error) {
+	out := new(DestroyKeyResponse)
+	err := c.cc.Invoke(ctx, KeyManagement_DestroyKey_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// KeyManagementServer is the server API for KeyManagement service.
+// All implementations must embed UnimplementedKeyManagementServer
+// for forward compatibility
+type KeyManagementServer interface {
+	// WrapKey encrypts the data key of a volume.
+	WrapKey(context.Context, *WrapKeyRequest) (*WrapKeyResponse, error)
+	// UnwrapKey decrypts a data key returned by WrapKey for the same volume.
+	UnwrapKey(context.Context, *UnwrapKeyRequest) (*UnwrapKeyResponse, error)
+	// DestroyKey forgets anything the plugin keeps about the key of a
+	// deleted volume. It succeeds for unknown volumes.
+	DestroyKey(context.Context, *DestroyKeyRequest) (*DestroyKeyResponse, error)
+	mustEmbedUnimplementedKeyManagementServer()
+}
+
+// UnimplementedKeyManagementServer must be embedded to have forward compatible implementations.
+type UnimplementedKeyManagementServer struct {
+}
+
+func (UnimplementedKeyManagementServer) WrapKey(context.Context, *WrapKeyRequest) (*WrapKeyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method WrapKey not implemented")
+}
+func (UnimplementedKeyManagementServer) UnwrapKey(context.Context, *UnwrapKeyRequest) (*UnwrapKeyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UnwrapKey not implemented")
+}
+func (UnimplementedKeyManagementServer) DestroyKey(context.Context, *DestroyKeyRequest) (*DestroyKeyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DestroyKey not implemented")
+}
+func (UnimplementedKeyManagementServer) mustEmbedUnimplementedKeyManagementServer() {}
+
+// UnsafeKeyManagementServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to KeyManagementServer will
+// result in compilation errors.
+type UnsafeKeyManagementServer interface {
+	mustEmbedUnimplementedKeyManagementServer()
+}
+
+func RegisterKeyManagementServer(s grpc.ServiceRegistrar, srv KeyManagementServer) {
+	s.RegisterService(&KeyManagement_ServiceDesc, srv)
+}
+
+func _KeyManagement_WrapKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WrapKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyManagementServer).WrapKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KeyManagement_WrapKey_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyManagementServer).WrapKey(ctx, req.(*WrapKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyManagement_UnwrapKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UnwrapKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyManagementServer).UnwrapKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KeyManagement_UnwrapKey_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyManagementServer).UnwrapKey(ctx, req.(*UnwrapKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyManagement_DestroyKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DestroyKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyManagementServer).DestroyKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KeyManagement_DestroyKey_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyManagementServer).DestroyKey(ctx, req.(*DestroyKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// KeyManagement_ServiceDesc is the grpc.ServiceDesc for KeyManagement service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var KeyManagement_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ephemeralcsi.kms.v1.KeyManagement",
+	HandlerType: (*KeyManagementServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "WrapKey",
+			Handler:    _KeyManagement_WrapKey_Handler,
+		},
+		{
+			MethodName: "UnwrapKey",
+			Handler:    _KeyManagement_UnwrapKey_Handler,
+		},
+		{
+			MethodName: "DestroyKey",
+			Handler:    _KeyManagement_DestroyKey_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "pkg/kms/kmspb/kms.proto",
+}
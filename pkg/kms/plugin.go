@@ -0,0 +1,107 @@
+package kms
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/kms/kmspb"
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/volume"
+)
+
+// Plugin is a key manager delegating to a KMS plugin on a gRPC endpoint,
+// which holds the key encryption key
+type Plugin struct {
+	conn   *grpc.ClientConn
+	client kmspb.KeyManagementClient
+}
+
+var _ volume.KeyManager = &Plugin{}
+
+// NewPlugin connects to the KMS plugin at endpoint, e.g.
+// unix:///run/kms/kms.sock. The connection is established lazily.
+func NewPlugin(endpoint string) (*Plugin, error) {
+	conn, err := grpc.Dial(endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	return &Plugin{conn: conn, client: kmspb.NewKeyManagementClient(conn)}, nil
+}
+
+// Close closes the connection to the plugin
+func (p *Plugin) Close() error {
+	return p.conn.Close()
+}
+
+func (p *Plugin) WrapKey(ctx context.Context, volumeID string, key []byte) ([]byte, error) {
+	resp, err := p.client.WrapKey(ctx, &kmspb.WrapKeyRequest{VolumeId: volumeID, Key: key})
+	if err != nil {
+		return nil, err
+	}
+	return resp.WrappedKey, nil
+}
+
+func (p *Plugin) UnwrapKey(ctx context.Context, volumeID string, wrapped []byte) ([]byte, error) {
+	resp, err := p.client.UnwrapKey(ctx, &kmspb.UnwrapKeyRequest{VolumeId: volumeID, WrappedKey: wrapped})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Key, nil
+}
+
+func (p *Plugin) DestroyKey(ctx context.Context, volumeID string) error {
+	_, err := p.client.DestroyKey(ctx, &kmspb.DestroyKeyRequest{VolumeId: volumeID})
+	return err
+}
+
+// server serves a key manager as a KMS plugin
+type server struct {
+	kmspb.UnimplementedKeyManagementServer
+
+	keys volume.KeyManager
+}
+
+// NewServer exposes keys through the KMS plugin API. With a LocalKeyFile
+// it is a reference stand-in for a real KMS.
+func NewServer(keys volume.KeyManager) kmspb.KeyManagementServer {
+	return &server{keys: keys}
+}
+
+func (s *server) WrapKey(ctx context.Context, req *kmspb.WrapKeyRequest) (*kmspb.WrapKeyResponse, error) {
+	if req.VolumeId == "" || len(req.Key) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume ID and key are required")
+	}
+	wrapped, err := s.keys.WrapKey(ctx, req.VolumeId, req.Key)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to wrap key: %v", err)
+	}
+	return &kmspb.WrapKeyResponse{WrappedKey: wrapped}, nil
+}
+
+func (s *server) UnwrapKey(ctx context.Context, req *kmspb.UnwrapKeyRequest) (*kmspb.UnwrapKeyResponse, error) {
+	if req.VolumeId == "" || len(req.WrappedKey) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume ID and wrapped key are required")
+	}
+	key, err := s.keys.UnwrapKey(ctx, req.VolumeId, req.WrappedKey)
+	if errors.Is(err, ErrInvalidWrappedKey) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unwrap key: %v", err)
+	}
+	return &kmspb.UnwrapKeyResponse{Key: key}, nil
+}
+
+func (s *server) DestroyKey(ctx context.Context, req *kmspb.DestroyKeyRequest) (*kmspb.DestroyKeyResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+	if err := s.keys.DestroyKey(ctx, req.VolumeId); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to destroy key: %v", err)
+	}
+	return &kmspb.DestroyKeyResponse{}, nil
+}
@@ -0,0 +1,171 @@
+// Package kube is a minimal client for the few Kubernetes API calls the
+// node plugin needs. It avoids pulling client-go into the driver image.
+package kube
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// ErrNotFound is returned when the requested object does not exist
+var ErrNotFound = errors.New("not found")
+
+// Client talks to the Kubernetes API server
+type Client struct {
+	host      string
+	tokenFile string
+	http      *http.Client
+}
+
+// NewInClusterClient creates a client from the service account mounted into
+// the pod and the KUBERNETES_SERVICE_HOST/PORT environment variables
+func NewInClusterClient() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in service account CA")
+	}
+
+	return &Client{
+		host:      "https://" + net.JoinHostPort(host, port),
+		tokenFile: serviceAccountDir + "/token",
+		http: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+// NewClient creates a client for host that authenticates with the bearer
+// token read from tokenFile, if set. It is used for tests and out-of-cluster
+// setups.
+func NewClient(host, tokenFile string, httpClient *http.Client) *Client {
+	return &Client{
+		host:      strings.TrimSuffix(host, "/"),
+		tokenFile: tokenFile,
+		http:      httpClient,
+	}
+}
+
+// Pod holds the subset of a v1.Pod the driver looks at
+type Pod struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+		UID       string `json:"uid"`
+	} `json:"metadata"`
+	Status struct {
+		Phase             string            `json:"phase"`
+		ContainerStatuses []ContainerStatus `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+// ContainerStatus holds the subset of a v1.ContainerStatus the driver looks at
+type ContainerStatus struct {
+	Name  string `json:"name"`
+	State struct {
+		Terminated *struct {
+			ExitCode int32 `json:"exitCode"`
+		} `json:"terminated"`
+	} `json:"state"`
+}
+
+// GetPod returns the pod with the given namespace and name
+func (c *Client) GetPod(ctx context.Context, namespace, name string) (*Pod, error) {
+	pod := &Pod{}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", url.PathEscape(namespace), url.PathEscape(name))
+	if err := c.get(ctx, path, pod); err != nil {
+		return nil, err
+	}
+	return pod, nil
+}
+
+// PodSucceeded reports whether the pod completed successfully: either its
+// phase is Succeeded, or every container terminated with exit code 0, which
+// covers pods that are being deleted before the phase is updated. A uid
+// that does not match means the pod was replaced and is reported as an error.
+func (c *Client) PodSucceeded(ctx context.Context, namespace, name, uid string) (bool, error) {
+	pod, err := c.GetPod(ctx, namespace, name)
+	if err != nil {
+		return false, err
+	}
+	if uid != "" && pod.Metadata.UID != uid {
+		return false, fmt.Errorf("pod %s/%s: %w (found uid %s, expected %s)", namespace, name, ErrNotFound, pod.Metadata.UID, uid)
+	}
+
+	switch pod.Status.Phase {
+	case "Succeeded":
+		return true, nil
+	case "Failed":
+		return false, nil
+	}
+
+	if len(pod.Status.ContainerStatuses) == 0 {
+		return false, nil
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.State.Terminated == nil || cs.State.Terminated.ExitCode != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, into interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.host+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	// Bound service account tokens are rotated, so read the token per request
+	if c.tokenFile != "" {
+		token, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read service account token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("GET %s: %w", path, ErrNotFound)
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("GET %s: unexpected status %s", path, resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(into); err != nil {
+		return fmt.Errorf("GET %s: failed to decode response: %v", path, err)
+	}
+	return nil
+}
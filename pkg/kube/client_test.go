@@ -0,0 +1,63 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPodSucceeded(t *testing.T) {
+	pods := map[string]string{
+		"/api/v1/namespaces/default/pods/succeeded": `{"metadata":{"uid":"1"},"status":{"phase":"Succeeded"}}`,
+		"/api/v1/namespaces/default/pods/failed":    `{"metadata":{"uid":"2"},"status":{"phase":"Failed"}}`,
+		"/api/v1/namespaces/default/pods/terminating": `{"metadata":{"uid":"3"},"status":{"phase":"Running","containerStatuses":[
+			{"name":"main","state":{"terminated":{"exitCode":0}}}]}}`,
+		"/api/v1/namespaces/default/pods/crashed": `{"metadata":{"uid":"4"},"status":{"phase":"Running","containerStatuses":[
+			{"name":"main","state":{"terminated":{"exitCode":1}}}]}}`,
+	}
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("secret\n"), 0600))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		body, ok := pods[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, tokenFile, server.Client())
+	ctx := context.Background()
+
+	tests := []struct {
+		name, uid string
+		want      bool
+	}{
+		{"succeeded", "1", true},
+		{"failed", "2", false},
+		{"terminating", "3", true},
+		{"crashed", "4", false},
+	}
+	for _, tt := range tests {
+		got, err := client.PodSucceeded(ctx, "default", tt.name, tt.uid)
+		require.NoError(t, err, tt.name)
+		assert.Equal(t, tt.want, got, tt.name)
+	}
+
+	_, err := client.PodSucceeded(ctx, "default", "succeeded", "other-uid")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	_, err = client.PodSucceeded(ctx, "default", "missing", "")
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
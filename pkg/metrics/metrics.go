@@ -0,0 +1,159 @@
+// Package metrics defines the Prometheus metrics exported by the driver
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+const namespace = "ephemeral_csi"
+
+var (
+	// Registry holds all driver metrics
+	Registry = prometheus.NewRegistry()
+
+	// ArchiveOperations counts volume archive attempts by result
+	ArchiveOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "archive_operations_total",
+		Help:      "Number of volume archive attempts, by result (success or failure).",
+	}, []string{"result"})
+
+	// ArchiveBytes counts the uncompressed bytes of volume data archived
+	ArchiveBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "archive_bytes_total",
+		Help:      "Uncompressed bytes of volume data written to archives.",
+	})
+
+	// ArchiveDuration observes how long archiving a volume took
+	ArchiveDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "archive_duration_seconds",
+		Help:      "Time taken to archive a volume.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 4, 8),
+	})
+
+	// VolumeCapacityBytes reports the capacity of each volume on the node,
+	// labeled with the pod it was last published for
+	VolumeCapacityBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "volume_capacity_bytes",
+		Help:      "Capacity of the volume, by volume and the namespace and name of the pod it was last published for.",
+	}, []string{"volume", "namespace", "pod"})
+
+	// VolumeUsedBytes reports the last measured usage of each volume
+	VolumeUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "volume_used_bytes",
+		Help:      "Last measured usage of the volume, by volume and the namespace and name of the pod it was last published for.",
+	}, []string{"volume", "namespace", "pod"})
+
+	// TrashPendingVolumes reports the deleted volumes not removed from disk yet
+	TrashPendingVolumes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "trash_pending_volumes",
+		Help:      "Number of deleted volumes waiting in the trash to be removed from disk.",
+	})
+
+	// TrashPendingBytes reports the space held by deleted volumes
+	TrashPendingBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "trash_pending_bytes",
+		Help:      "Bytes held by deleted volumes waiting in the trash to be removed from disk, which GetCapacity does not report as available. Volumes are measured when their removal starts.",
+	})
+
+	// WipedVolumes counts deleted volumes whose data was wiped, by mode
+	WipedVolumes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "wiped_volumes_total",
+		Help:      "Number of deleted volumes whose data was wiped before removal, by wipe mode (discard or overwrite).",
+	}, []string{"mode"})
+
+	// WipedBytes counts the bytes written while overwriting deleted volumes
+	WipedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "wipe_bytes_total",
+		Help:      "Bytes written over the data of deleted volumes with the overwrite wipe mode, counting every pass.",
+	})
+
+	// WarmPoolHits counts new volumes served from the warm pool
+	WarmPoolHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "warm_pool_hits_total",
+		Help:      "Number of new volumes served from the warm pool.",
+	})
+
+	// WarmPoolMisses counts new volumes that had to be created on demand
+	// while the warm pool is enabled
+	WarmPoolMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "warm_pool_misses_total",
+		Help:      "Number of new volumes created on demand because the warm pool was empty or did not match the request.",
+	})
+
+	// WarmPoolAvailable reports the volumes ready in the warm pool
+	WarmPoolAvailable = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "warm_pool_available_volumes",
+		Help:      "Number of pre-created volumes ready in the warm pool.",
+	})
+
+	// NamespaceCapacityBytes reports the total capacity of the volumes each
+	// namespace has on the node
+	NamespaceCapacityBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "namespace_capacity_bytes",
+		Help:      "Total capacity of the volumes on the node accounted to the namespace.",
+	}, []string{"namespace"})
+
+	// NamespaceVolumes reports the number of volumes each namespace has on the node
+	NamespaceVolumes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "namespace_volumes",
+		Help:      "Number of volumes on the node accounted to the namespace.",
+	}, []string{"namespace"})
+
+	// QuotaRejections counts volumes rejected because of a namespace quota
+	QuotaRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "quota_rejections_total",
+		Help:      "Number of volume requests rejected because they would exceed the quota of the namespace.",
+	}, []string{"namespace"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		ArchiveOperations,
+		ArchiveBytes,
+		ArchiveDuration,
+		VolumeCapacityBytes,
+		VolumeUsedBytes,
+		TrashPendingVolumes,
+		TrashPendingBytes,
+		WipedVolumes,
+		WipedBytes,
+		WarmPoolHits,
+		WarmPoolMisses,
+		WarmPoolAvailable,
+		NamespaceCapacityBytes,
+		NamespaceVolumes,
+		QuotaRejections,
+	)
+}
+
+// Serve exposes the metrics on address under /metrics. It blocks until the
+// server fails.
+func Serve(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+
+	klog.Infof("Serving metrics on %s", address)
+	return http.ListenAndServe(address, mux)
+}
@@ -0,0 +1,710 @@
+package sanity
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// suite holds the clients and the resources created during a run
+type suite struct {
+	cfg    Config
+	prefix string
+
+	identity   csi.IdentityClient
+	controller csi.ControllerClient
+	node       csi.NodeClient
+
+	// volumes created by the run, and published targets and staging
+	// paths keyed by path
+	volumes map[string]bool
+	targets map[string]string
+	staged  map[string]string
+	seq     int
+}
+
+type testCase struct {
+	name string
+	run  func(ctx context.Context, s *suite) error
+}
+
+// cases run in order. Each case creates and removes its own volumes.
+var cases = []testCase{
+	{"Identity/GetPluginInfo", testGetPluginInfo},
+	{"Identity/GetPluginCapabilities", testGetPluginCapabilities},
+	{"Identity/Probe", testProbe},
+
+	{"Controller/GetCapabilities", testControllerGetCapabilities},
+	{"Controller/CreateVolume/MissingName", testCreateVolumeMissingName},
+	{"Controller/CreateVolume/Capacity", testCreateVolumeCapacity},
+	{"Controller/CreateVolume/Idempotent", testCreateVolumeIdempotent},
+	{"Controller/ValidateVolumeCapabilities", testValidateVolumeCapabilities},
+	{"Controller/ValidateVolumeCapabilities/MissingCapabilities", testValidateVolumeCapabilitiesMissingCapabilities},
+	{"Controller/ValidateVolumeCapabilities/NotFound", testValidateVolumeCapabilitiesNotFound},
+	{"Controller/ValidateVolumeCapabilities/MultiNode", testValidateVolumeCapabilitiesMultiNode},
+	{"Controller/ListVolumes", testListVolumes},
+	{"Controller/ListVolumes/Pagination", testListVolumesPagination},
+	{"Controller/ListVolumes/InvalidToken", testListVolumesInvalidToken},
+	{"Controller/GetVolume", testControllerGetVolume},
+	{"Controller/GetVolume/NotFound", testControllerGetVolumeNotFound},
+	{"Controller/DeleteVolume/MissingID", testDeleteVolumeMissingID},
+	{"Controller/DeleteVolume/Idempotent", testDeleteVolumeIdempotent},
+
+	{"Node/GetInfo", testNodeGetInfo},
+	{"Node/GetCapabilities", testNodeGetCapabilities},
+	{"Node/PublishVolume/MissingArguments", testNodePublishVolumeMissingArguments},
+	{"Node/UnpublishVolume/MissingArguments", testNodeUnpublishVolumeMissingArguments},
+	{"Node/StageVolume/MissingArguments", testNodeStageVolumeMissingArguments},
+	{"Node/GetVolumeStats/NotFound", testNodeGetVolumeStatsNotFound},
+
+	{"Lifecycle/CreatePublishUnpublishDelete", testLifecycle},
+}
+
+func testGetPluginInfo(ctx context.Context, s *suite) error {
+	resp, err := s.identity.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	if err != nil {
+		return err
+	}
+	if resp.Name == "" {
+		return fmt.Errorf("plugin name is empty")
+	}
+	if resp.VendorVersion == "" {
+		return fmt.Errorf("vendor version is empty")
+	}
+	return nil
+}
+
+func testGetPluginCapabilities(ctx context.Context, s *suite) error {
+	_, err := s.identity.GetPluginCapabilities(ctx, &csi.GetPluginCapabilitiesRequest{})
+	return err
+}
+
+func testProbe(ctx context.Context, s *suite) error {
+	resp, err := s.identity.Probe(ctx, &csi.ProbeRequest{})
+	if err != nil {
+		return err
+	}
+	if resp.Ready != nil && !resp.Ready.Value {
+		return fmt.Errorf("plugin reports not ready")
+	}
+	return nil
+}
+
+func testControllerGetCapabilities(ctx context.Context, s *suite) error {
+	_, err := s.controller.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+	return err
+}
+
+func testCreateVolumeMissingName(ctx context.Context, s *suite) error {
+	if err := s.requireControllerCapability(ctx, csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		return err
+	}
+
+	_, err := s.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Parameters:         s.cfg.Parameters,
+	})
+	return expectCode(err, codes.InvalidArgument)
+}
+
+func testCreateVolumeCapacity(ctx context.Context, s *suite) error {
+	if err := s.requireControllerCapability(ctx, csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		return err
+	}
+
+	vol, err := s.createVolume(ctx, s.volumeName())
+	if err != nil {
+		return err
+	}
+	defer s.deleteVolume(ctx, vol.VolumeId)
+
+	if vol.VolumeId == "" {
+		return fmt.Errorf("CreateVolume returned an empty volume ID")
+	}
+	if vol.CapacityBytes != 0 && vol.CapacityBytes < s.cfg.VolumeSize {
+		return fmt.Errorf("CreateVolume returned capacity %d, requested %d", vol.CapacityBytes, s.cfg.VolumeSize)
+	}
+	return nil
+}
+
+func testCreateVolumeIdempotent(ctx context.Context, s *suite) error {
+	if err := s.requireControllerCapability(ctx, csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		return err
+	}
+
+	name := s.volumeName()
+	first, err := s.createVolume(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer s.deleteVolume(ctx, first.VolumeId)
+
+	second, err := s.createVolume(ctx, name)
+	if err != nil {
+		return fmt.Errorf("second CreateVolume with the same name failed: %v", err)
+	}
+	if first.VolumeId != second.VolumeId {
+		return fmt.Errorf("CreateVolume is not idempotent: got volume IDs %q and %q", first.VolumeId, second.VolumeId)
+	}
+	if first.CapacityBytes != second.CapacityBytes {
+		return fmt.Errorf("CreateVolume is not idempotent: got capacities %d and %d", first.CapacityBytes, second.CapacityBytes)
+	}
+	return nil
+}
+
+func testValidateVolumeCapabilities(ctx context.Context, s *suite) error {
+	if err := s.requireControllerCapability(ctx, csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		return err
+	}
+
+	vol, err := s.createVolume(ctx, s.volumeName())
+	if err != nil {
+		return err
+	}
+	defer s.deleteVolume(ctx, vol.VolumeId)
+
+	resp, err := s.controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           vol.VolumeId,
+		VolumeContext:      vol.VolumeContext,
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Confirmed == nil {
+		return fmt.Errorf("single node writer mount capability was not confirmed: %s", resp.Message)
+	}
+	return nil
+}
+
+func testValidateVolumeCapabilitiesMissingCapabilities(ctx context.Context, s *suite) error {
+	if err := s.requireControllerCapability(ctx, csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		return err
+	}
+
+	vol, err := s.createVolume(ctx, s.volumeName())
+	if err != nil {
+		return err
+	}
+	defer s.deleteVolume(ctx, vol.VolumeId)
+
+	_, err = s.controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId: vol.VolumeId,
+	})
+	return expectCode(err, codes.InvalidArgument)
+}
+
+func testValidateVolumeCapabilitiesNotFound(ctx context.Context, s *suite) error {
+	_, err := s.controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           s.volumeName(),
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+	})
+	return expectCode(err, codes.NotFound)
+}
+
+func testValidateVolumeCapabilitiesMultiNode(ctx context.Context, s *suite) error {
+	if err := s.requireControllerCapability(ctx, csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		return err
+	}
+
+	vol, err := s.createVolume(ctx, s.volumeName())
+	if err != nil {
+		return err
+	}
+	defer s.deleteVolume(ctx, vol.VolumeId)
+
+	capability := mountCapability()
+	capability.AccessMode.Mode = csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+	resp, err := s.controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           vol.VolumeId,
+		VolumeCapabilities: []*csi.VolumeCapability{capability},
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Confirmed != nil {
+		return fmt.Errorf("multi node writer capability of a node-local volume was confirmed")
+	}
+	return nil
+}
+
+func testListVolumes(ctx context.Context, s *suite) error {
+	if err := s.requireControllerCapability(ctx, csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
+		return err
+	}
+
+	vol, err := s.createVolume(ctx, s.volumeName())
+	if err != nil {
+		return err
+	}
+	defer s.deleteVolume(ctx, vol.VolumeId)
+
+	resp, err := s.controller.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if err != nil {
+		return err
+	}
+	for _, entry := range resp.Entries {
+		if entry.GetVolume().GetVolumeId() == vol.VolumeId {
+			return nil
+		}
+	}
+	return fmt.Errorf("volume %s is missing from ListVolumes", vol.VolumeId)
+}
+
+func testListVolumesPagination(ctx context.Context, s *suite) error {
+	if err := s.requireControllerCapability(ctx, csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
+		return err
+	}
+
+	created := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		vol, err := s.createVolume(ctx, s.volumeName())
+		if err != nil {
+			return err
+		}
+		defer s.deleteVolume(ctx, vol.VolumeId)
+		created[vol.VolumeId] = true
+	}
+
+	seen := make(map[string]bool)
+	token := ""
+	for {
+		resp, err := s.controller.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 1, StartingToken: token})
+		if err != nil {
+			return err
+		}
+		if len(resp.Entries) > 1 {
+			return fmt.Errorf("ListVolumes returned %d entries, more than the maximum of 1", len(resp.Entries))
+		}
+		for _, entry := range resp.Entries {
+			id := entry.GetVolume().GetVolumeId()
+			if seen[id] {
+				return fmt.Errorf("volume %s was listed twice", id)
+			}
+			seen[id] = true
+		}
+		if resp.NextToken == "" {
+			break
+		}
+		token = resp.NextToken
+	}
+	for id := range created {
+		if !seen[id] {
+			return fmt.Errorf("volume %s is missing from the pages of ListVolumes", id)
+		}
+	}
+	return nil
+}
+
+func testListVolumesInvalidToken(ctx context.Context, s *suite) error {
+	if err := s.requireControllerCapability(ctx, csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
+		return err
+	}
+
+	_, err := s.controller.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: "not a token!"})
+	return expectCode(err, codes.Aborted)
+}
+
+func testControllerGetVolume(ctx context.Context, s *suite) error {
+	if err := s.requireControllerCapability(ctx, csi.ControllerServiceCapability_RPC_GET_VOLUME); err != nil {
+		return err
+	}
+
+	vol, err := s.createVolume(ctx, s.volumeName())
+	if err != nil {
+		return err
+	}
+	defer s.deleteVolume(ctx, vol.VolumeId)
+
+	resp, err := s.controller.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: vol.VolumeId})
+	if err != nil {
+		return err
+	}
+	if id := resp.GetVolume().GetVolumeId(); id != vol.VolumeId {
+		return fmt.Errorf("ControllerGetVolume returned volume %q, want %q", id, vol.VolumeId)
+	}
+	if resp.GetVolume().GetCapacityBytes() != vol.CapacityBytes {
+		return fmt.Errorf("ControllerGetVolume returned capacity %d, CreateVolume %d", resp.GetVolume().GetCapacityBytes(), vol.CapacityBytes)
+	}
+	if err := s.requireControllerCapability(ctx, csi.ControllerServiceCapability_RPC_VOLUME_CONDITION); err == nil {
+		if condition := resp.GetStatus().GetVolumeCondition(); condition == nil || condition.Abnormal {
+			return fmt.Errorf("new volume is not reported healthy: %v", condition)
+		}
+	}
+	return nil
+}
+
+func testControllerGetVolumeNotFound(ctx context.Context, s *suite) error {
+	if err := s.requireControllerCapability(ctx, csi.ControllerServiceCapability_RPC_GET_VOLUME); err != nil {
+		return err
+	}
+
+	_, err := s.controller.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: s.volumeName()})
+	return expectCode(err, codes.NotFound)
+}
+
+func testDeleteVolumeMissingID(ctx context.Context, s *suite) error {
+	if err := s.requireControllerCapability(ctx, csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		return err
+	}
+
+	_, err := s.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{})
+	return expectCode(err, codes.InvalidArgument)
+}
+
+func testDeleteVolumeIdempotent(ctx context.Context, s *suite) error {
+	if err := s.requireControllerCapability(ctx, csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		return err
+	}
+
+	vol, err := s.createVolume(ctx, s.volumeName())
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.deleteVolume(ctx, vol.VolumeId); err != nil {
+			return fmt.Errorf("DeleteVolume call %d failed: %v", i+1, err)
+		}
+	}
+
+	// Deleting a volume that never existed must succeed as well
+	if err := s.deleteVolume(ctx, s.volumeName()); err != nil {
+		return fmt.Errorf("DeleteVolume of an unknown volume failed: %v", err)
+	}
+	return nil
+}
+
+func testNodeGetInfo(ctx context.Context, s *suite) error {
+	resp, err := s.node.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	if err != nil {
+		return err
+	}
+	if resp.NodeId == "" {
+		return fmt.Errorf("node ID is empty")
+	}
+	return nil
+}
+
+func testNodeGetCapabilities(ctx context.Context, s *suite) error {
+	_, err := s.node.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	return err
+}
+
+func testNodePublishVolumeMissingArguments(ctx context.Context, s *suite) error {
+	target := s.targetPath()
+	requests := map[string]*csi.NodePublishVolumeRequest{
+		"volume ID": {
+			TargetPath:       target,
+			VolumeCapability: mountCapability(),
+		},
+		"target path": {
+			VolumeId:         s.volumeName(),
+			VolumeCapability: mountCapability(),
+		},
+		"volume capability": {
+			VolumeId:   s.volumeName(),
+			TargetPath: target,
+		},
+	}
+
+	for missing, req := range requests {
+		_, err := s.node.NodePublishVolume(ctx, req)
+		if err := expectCode(err, codes.InvalidArgument); err != nil {
+			return fmt.Errorf("without %s: %v", missing, err)
+		}
+	}
+	return nil
+}
+
+func testNodeUnpublishVolumeMissingArguments(ctx context.Context, s *suite) error {
+	requests := map[string]*csi.NodeUnpublishVolumeRequest{
+		"volume ID":   {TargetPath: s.targetPath()},
+		"target path": {VolumeId: s.volumeName()},
+	}
+
+	for missing, req := range requests {
+		_, err := s.node.NodeUnpublishVolume(ctx, req)
+		if err := expectCode(err, codes.InvalidArgument); err != nil {
+			return fmt.Errorf("without %s: %v", missing, err)
+		}
+	}
+	return nil
+}
+
+func testNodeStageVolumeMissingArguments(ctx context.Context, s *suite) error {
+	if err := s.requireNodeCapability(ctx, csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME); err != nil {
+		return err
+	}
+
+	staging := s.targetPath()
+	requests := map[string]*csi.NodeStageVolumeRequest{
+		"volume ID": {
+			StagingTargetPath: staging,
+			VolumeCapability:  mountCapability(),
+		},
+		"staging target path": {
+			VolumeId:         s.volumeName(),
+			VolumeCapability: mountCapability(),
+		},
+		"volume capability": {
+			VolumeId:          s.volumeName(),
+			StagingTargetPath: staging,
+		},
+	}
+
+	for missing, req := range requests {
+		_, err := s.node.NodeStageVolume(ctx, req)
+		if err := expectCode(err, codes.InvalidArgument); err != nil {
+			return fmt.Errorf("without %s: %v", missing, err)
+		}
+	}
+	return nil
+}
+
+func testNodeGetVolumeStatsNotFound(ctx context.Context, s *suite) error {
+	if err := s.requireNodeCapability(ctx, csi.NodeServiceCapability_RPC_GET_VOLUME_STATS); err != nil {
+		return err
+	}
+
+	_, err := s.node.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   s.volumeName(),
+		VolumePath: s.targetPath(),
+	})
+	return expectCode(err, codes.NotFound)
+}
+
+func testLifecycle(ctx context.Context, s *suite) error {
+	if err := s.requireControllerCapability(ctx, csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		return err
+	}
+
+	vol, err := s.createVolume(ctx, s.volumeName())
+	if err != nil {
+		return err
+	}
+	defer s.deleteVolume(ctx, vol.VolumeId)
+
+	if _, err := s.controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           vol.VolumeId,
+		VolumeContext:      vol.VolumeContext,
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+	}); err != nil {
+		return fmt.Errorf("ValidateVolumeCapabilities: %v", err)
+	}
+
+	// A CO stages volumes before publishing them if the node asks for it
+	var staging string
+	if err := s.requireNodeCapability(ctx, csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME); err == nil {
+		staging = s.targetPath()
+		for i := 0; i < 2; i++ {
+			if err := s.stageVolume(ctx, vol.VolumeId, staging); err != nil {
+				return fmt.Errorf("NodeStageVolume call %d: %v", i+1, err)
+			}
+		}
+	}
+
+	target := s.targetPath()
+	for i := 0; i < 2; i++ {
+		if err := s.publishVolume(ctx, vol, staging, target); err != nil {
+			return fmt.Errorf("NodePublishVolume call %d: %v", i+1, err)
+		}
+	}
+
+	if err := s.requireNodeCapability(ctx, csi.NodeServiceCapability_RPC_GET_VOLUME_STATS); err == nil {
+		resp, err := s.node.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{
+			VolumeId:   vol.VolumeId,
+			VolumePath: target,
+		})
+		if err != nil {
+			return fmt.Errorf("NodeGetVolumeStats: %v", err)
+		}
+		if len(resp.Usage) == 0 {
+			return fmt.Errorf("NodeGetVolumeStats returned no usage")
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.unpublishVolume(ctx, vol.VolumeId, target); err != nil {
+			return fmt.Errorf("NodeUnpublishVolume call %d: %v", i+1, err)
+		}
+	}
+
+	if staging != "" {
+		for i := 0; i < 2; i++ {
+			if err := s.unstageVolume(ctx, vol.VolumeId, staging); err != nil {
+				return fmt.Errorf("NodeUnstageVolume call %d: %v", i+1, err)
+			}
+		}
+	}
+
+	if err := s.deleteVolume(ctx, vol.VolumeId); err != nil {
+		return fmt.Errorf("DeleteVolume: %v", err)
+	}
+	return nil
+}
+
+func (s *suite) volumeName() string {
+	s.seq++
+	return fmt.Sprintf("%s-%d", s.prefix, s.seq)
+}
+
+func (s *suite) targetPath() string {
+	s.seq++
+	return filepath.Join(s.cfg.TargetDir, fmt.Sprintf("%s-target-%d", s.prefix, s.seq))
+}
+
+func (s *suite) createVolume(ctx context.Context, name string) (*csi.Volume, error) {
+	resp, err := s.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               name,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: s.cfg.VolumeSize},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Parameters:         s.cfg.Parameters,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("CreateVolume: %v", err)
+	}
+	s.volumes[resp.Volume.VolumeId] = true
+	return resp.Volume, nil
+}
+
+func (s *suite) deleteVolume(ctx context.Context, volumeID string) error {
+	_, err := s.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	if err == nil {
+		delete(s.volumes, volumeID)
+	}
+	return err
+}
+
+func (s *suite) stageVolume(ctx context.Context, volumeID, staging string) error {
+	_, err := s.node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: staging,
+		VolumeCapability:  mountCapability(),
+	})
+	if err == nil {
+		s.staged[staging] = volumeID
+	}
+	return err
+}
+
+func (s *suite) unstageVolume(ctx context.Context, volumeID, staging string) error {
+	_, err := s.node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: staging,
+	})
+	if err == nil {
+		delete(s.staged, staging)
+	}
+	return err
+}
+
+func (s *suite) publishVolume(ctx context.Context, vol *csi.Volume, staging, target string) error {
+	volumeContext := make(map[string]string)
+	for k, v := range s.cfg.Parameters {
+		volumeContext[k] = v
+	}
+	for k, v := range vol.VolumeContext {
+		volumeContext[k] = v
+	}
+
+	_, err := s.node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          vol.VolumeId,
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  mountCapability(),
+		VolumeContext:     volumeContext,
+	})
+	if err == nil {
+		s.targets[target] = vol.VolumeId
+	}
+	return err
+}
+
+func (s *suite) unpublishVolume(ctx context.Context, volumeID, target string) error {
+	_, err := s.node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   volumeID,
+		TargetPath: target,
+	})
+	if err == nil {
+		delete(s.targets, target)
+	}
+	return err
+}
+
+// cleanup removes whatever failed cases left behind
+func (s *suite) cleanup(ctx context.Context) {
+	for target, volumeID := range s.targets {
+		if err := s.unpublishVolume(ctx, volumeID, target); err != nil {
+			klog.Warningf("sanity: failed to unpublish %s from %s: %v", volumeID, target, err)
+		}
+	}
+	for staging, volumeID := range s.staged {
+		if err := s.unstageVolume(ctx, volumeID, staging); err != nil {
+			klog.Warningf("sanity: failed to unstage %s from %s: %v", volumeID, staging, err)
+		}
+	}
+	for volumeID := range s.volumes {
+		if err := s.deleteVolume(ctx, volumeID); err != nil {
+			klog.Warningf("sanity: failed to delete volume %s: %v", volumeID, err)
+		}
+	}
+	matches, _ := filepath.Glob(filepath.Join(s.cfg.TargetDir, s.prefix+"-target-*"))
+	for _, path := range matches {
+		os.Remove(path)
+	}
+}
+
+func (s *suite) requireControllerCapability(ctx context.Context, capability csi.ControllerServiceCapability_RPC_Type) error {
+	resp, err := s.controller.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		return err
+	}
+	for _, c := range resp.Capabilities {
+		if c.GetRpc().GetType() == capability {
+			return nil
+		}
+	}
+	return skip("controller capability %s is not supported", capability)
+}
+
+func (s *suite) requireNodeCapability(ctx context.Context, capability csi.NodeServiceCapability_RPC_Type) error {
+	resp, err := s.node.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	if err != nil {
+		return err
+	}
+	for _, c := range resp.Capabilities {
+		if c.GetRpc().GetType() == capability {
+			return nil
+		}
+	}
+	return skip("node capability %s is not supported", capability)
+}
+
+func mountCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+}
+
+// expectCode checks that err is a gRPC status with the given code
+func expectCode(err error, code codes.Code) error {
+	if err == nil {
+		return fmt.Errorf("expected %s, got success", code)
+	}
+	if st, ok := status.FromError(err); !ok || st.Code() != code {
+		return fmt.Errorf("expected %s, got %v", code, err)
+	}
+	return nil
+}
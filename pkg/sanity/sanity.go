@@ -0,0 +1,155 @@
+// Package sanity is a self-contained CSI conformance harness. It drives the
+// full volume lifecycle of a driver over its gRPC endpoint and checks the
+// responses, including idempotency and error codes, against the CSI spec.
+package sanity
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultVolumeSize is the capacity requested for test volumes
+	DefaultVolumeSize = 16 * 1024 * 1024
+)
+
+// Config configures a sanity run
+type Config struct {
+	// Endpoint is the CSI endpoint of the driver under test, e.g.
+	// unix:///var/lib/kubelet/plugins/ephemeral.csi.local/csi.sock
+	Endpoint string
+	// TargetDir is a directory on the node under which publish targets are
+	// created. It must be visible to the driver under test.
+	TargetDir string
+	// Parameters are passed to CreateVolume and NodePublishVolume
+	Parameters map[string]string
+	// VolumeSize is the capacity requested for test volumes
+	VolumeSize int64
+	// Run selects the cases to run by name. All cases run if nil.
+	Run *regexp.Regexp
+}
+
+// Result is the outcome of a single case
+type Result struct {
+	Name     string        `json:"name"`
+	Passed   bool          `json:"passed"`
+	Skipped  bool          `json:"skipped,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Report is the outcome of a sanity run
+type Report struct {
+	Endpoint string   `json:"endpoint"`
+	Results  []Result `json:"results"`
+}
+
+// Failed returns the results of the cases that failed
+func (r *Report) Failed() []Result {
+	var failed []Result
+	for _, result := range r.Results {
+		if !result.Passed && !result.Skipped {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// errSkip is returned by cases that do not apply to the driver under test
+type errSkip struct {
+	reason string
+}
+
+func (e errSkip) Error() string {
+	return e.reason
+}
+
+func skip(format string, args ...interface{}) error {
+	return errSkip{reason: fmt.Sprintf(format, args...)}
+}
+
+// Run connects to the driver at cfg.Endpoint and runs the selected cases.
+// An error is only returned if the harness itself could not run; failed
+// cases are reported in the Report.
+func Run(ctx context.Context, cfg Config) (*Report, error) {
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("endpoint is required")
+	}
+	if cfg.TargetDir == "" {
+		cfg.TargetDir = os.TempDir()
+	}
+	if cfg.VolumeSize == 0 {
+		cfg.VolumeSize = DefaultVolumeSize
+	}
+
+	if err := os.MkdirAll(cfg.TargetDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create target directory: %v", err)
+	}
+
+	conn, err := grpc.DialContext(ctx, cfg.Endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", cfg.Endpoint, err)
+	}
+	defer conn.Close()
+
+	prefix, err := randomPrefix()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &suite{
+		cfg:        cfg,
+		prefix:     prefix,
+		identity:   csi.NewIdentityClient(conn),
+		controller: csi.NewControllerClient(conn),
+		node:       csi.NewNodeClient(conn),
+		volumes:    make(map[string]bool),
+		targets:    make(map[string]string),
+		staged:     make(map[string]string),
+	}
+	defer s.cleanup(ctx)
+
+	report := &Report{Endpoint: cfg.Endpoint}
+	for _, tc := range cases {
+		if cfg.Run != nil && !cfg.Run.MatchString(tc.name) {
+			continue
+		}
+
+		start := time.Now()
+		err := tc.run(ctx, s)
+		result := Result{
+			Name:     tc.name,
+			Passed:   err == nil,
+			Duration: time.Since(start),
+		}
+		if skipped, ok := err.(errSkip); ok {
+			result.Skipped = true
+			result.Error = skipped.reason
+		} else if err != nil {
+			result.Error = err.Error()
+		}
+
+		klog.V(4).Infof("sanity: %s passed=%v skipped=%v %s", tc.name, result.Passed, result.Skipped, result.Error)
+		report.Results = append(report.Results, result)
+	}
+
+	return report, nil
+}
+
+func randomPrefix() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate volume name prefix: %v", err)
+	}
+	return "sanity-" + hex.EncodeToString(b), nil
+}
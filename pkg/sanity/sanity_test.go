@@ -0,0 +1,82 @@
+package sanity
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/driver"
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/volume"
+)
+
+// startDriver serves the driver on a unix socket in a temporary directory.
+// Mounts are faked unless the test runs as root.
+func startDriver(t *testing.T) string {
+	tempDir := t.TempDir()
+
+	var opts []driver.Option
+	if os.Geteuid() != 0 {
+		opts = append(opts, driver.WithMounter(volume.NewFakeMounter()))
+	}
+
+	d, err := driver.NewDriver("sanity-node", filepath.Join(tempDir, "volumes"), opts...)
+	require.NoError(t, err)
+
+	socket := filepath.Join(tempDir, "csi.sock")
+	lis, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	s := grpc.NewServer()
+	csi.RegisterIdentityServer(s, d)
+	csi.RegisterControllerServer(s, d)
+	csi.RegisterNodeServer(s, d)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	return "unix://" + socket
+}
+
+func TestSanity(t *testing.T) {
+	endpoint := startDriver(t)
+	targetDir := t.TempDir()
+
+	report, err := Run(context.Background(), Config{
+		Endpoint:  endpoint,
+		TargetDir: targetDir,
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, report.Results)
+
+	for _, result := range report.Results {
+		assert.True(t, result.Passed || result.Skipped, "%s: %s", result.Name, result.Error)
+	}
+	assert.Empty(t, report.Failed())
+
+	// Everything the run created is cleaned up again
+	entries, err := os.ReadDir(targetDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestSanityRunFilter(t *testing.T) {
+	endpoint := startDriver(t)
+
+	report, err := Run(context.Background(), Config{
+		Endpoint:  endpoint,
+		TargetDir: t.TempDir(),
+		Run:       regexp.MustCompile("^Identity/"),
+	})
+	require.NoError(t, err)
+	require.Len(t, report.Results, 3)
+	for _, result := range report.Results {
+		assert.Contains(t, result.Name, "Identity/")
+	}
+}
@@ -0,0 +1,396 @@
+package seed
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"k8s.io/klog/v2"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// maxSymlinkFollows bounds symlink resolution like the kernel does
+const maxSymlinkFollows = 40
+
+const (
+	// whiteoutPrefix marks an entry of a lower layer as deleted
+	whiteoutPrefix = ".wh."
+	// opaqueWhiteout hides all lower layer entries of its directory
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// Extract unpacks the tar archive read from r into dir and returns the
+// number of file bytes written. Gzip and zstd compression are detected
+// automatically. Entries with absolute paths, entries and links that would
+// escape dir, and writes through symlinks are rejected with
+// ErrUnsafeArchive, leaving a partially extracted tree behind. More than
+// limit file bytes fail with ErrTooLarge. Devices, FIFOs and ownership are
+// not restored.
+func Extract(r io.Reader, dir string, limit int64) (int64, error) {
+	e := newExtractor(dir, limit, false)
+	if err := e.apply(r); err != nil {
+		return e.written, err
+	}
+	return e.written, e.finish()
+}
+
+// extractor unpacks one or more tar streams into the same directory. With
+// whiteouts enabled each stream is applied as an image layer on top of the
+// previous ones.
+type extractor struct {
+	dir       string
+	limit     int64
+	whiteouts bool
+
+	// written counts file bytes across all streams
+	written int64
+	// links are checked by finish once all streams are applied
+	links []string
+	// layerPaths holds the entries of the stream being applied, which
+	// whiteouts of the same layer must not remove
+	layerPaths map[string]bool
+}
+
+func newExtractor(dir string, limit int64, whiteouts bool) *extractor {
+	return &extractor{
+		dir:       dir,
+		limit:     limit,
+		whiteouts: whiteouts,
+	}
+}
+
+// apply unpacks the tar stream read from r
+func (e *extractor) apply(r io.Reader) error {
+	tr, closeFn, err := newTarReader(r)
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	e.beginLayer()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read seed archive: %v", err)
+		}
+		if err := e.applyEntry(tr, hdr); err != nil {
+			return err
+		}
+	}
+}
+
+// applyFile writes r as a single file, which is how OCI artifacts store
+// their content
+func (e *extractor) applyFile(name string, r io.Reader, size int64) error {
+	e.beginLayer()
+	return e.applyEntry(r, &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Now(),
+	})
+}
+
+func (e *extractor) beginLayer() {
+	e.layerPaths = map[string]bool{}
+}
+
+func (e *extractor) applyEntry(r io.Reader, hdr *tar.Header) error {
+	name, err := entryName(hdr.Name)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		return nil
+	}
+	if err := ensureParents(e.dir, name); err != nil {
+		return err
+	}
+	if e.whiteouts && strings.HasPrefix(path.Base(name), whiteoutPrefix) {
+		return e.applyWhiteout(name)
+	}
+
+	target := filepath.Join(e.dir, filepath.FromSlash(name))
+	mode := hdr.FileInfo().Mode().Perm()
+	// An entry of an upper layer replaces whole trees of lower layers
+	replaceTree := e.whiteouts && !e.layerPaths[name]
+	e.layerPaths[name] = true
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		// Directories stay writable for the owner so they can be filled
+		info, err := os.Lstat(target)
+		if err == nil && !info.IsDir() {
+			if !e.whiteouts {
+				return fmt.Errorf("%w: %s is not a directory", ErrUnsafeArchive, hdr.Name)
+			}
+			// A directory of an upper layer replaces a file of a lower one
+			if err = os.Remove(target); err == nil {
+				err = os.ErrNotExist
+			}
+		}
+		if os.IsNotExist(err) {
+			err = os.Mkdir(target, mode|0700)
+		}
+		if err != nil {
+			return err
+		}
+		return os.Chmod(target, mode|0700)
+
+	case tar.TypeReg, tar.TypeRegA:
+		if e.written+hdr.Size > e.limit {
+			return fmt.Errorf("%w: more than %d bytes", ErrTooLarge, e.limit)
+		}
+		if err := removeExisting(target, replaceTree); err != nil {
+			return err
+		}
+		n, err := writeFile(target, r, hdr.Size, mode)
+		e.written += n
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+
+	case tar.TypeSymlink:
+		if err := removeExisting(target, replaceTree); err != nil {
+			return err
+		}
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+		e.links = append(e.links, name)
+
+	case tar.TypeLink:
+		linkName, err := entryName(hdr.Linkname)
+		if err != nil || linkName == "." {
+			return fmt.Errorf("%w: hard link %s -> %s escapes the volume", ErrUnsafeArchive, hdr.Name, hdr.Linkname)
+		}
+		if err := ensureParents(e.dir, linkName); err != nil {
+			return err
+		}
+		if err := removeExisting(target, replaceTree); err != nil {
+			return err
+		}
+		if err := os.Link(filepath.Join(e.dir, filepath.FromSlash(linkName)), target); err != nil {
+			return err
+		}
+		// A hard link to a symlink is a symlink as well
+		e.links = append(e.links, name)
+
+	default:
+		klog.V(4).Infof("Skipping seed archive entry %s of type %q", hdr.Name, hdr.Typeflag)
+	}
+
+	return nil
+}
+
+// applyWhiteout removes what a whiteout entry hides of the lower layers
+func (e *extractor) applyWhiteout(name string) error {
+	parent, base := path.Dir(name), path.Base(name)
+
+	if base == opaqueWhiteout {
+		dir := filepath.Join(e.dir, filepath.FromSlash(parent))
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if child := path.Join(parent, entry.Name()); !e.layerPaths[child] {
+				if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	hidden := path.Join(parent, strings.TrimPrefix(base, whiteoutPrefix))
+	if e.layerPaths[hidden] {
+		return nil
+	}
+	return os.RemoveAll(filepath.Join(e.dir, filepath.FromSlash(hidden)))
+}
+
+// removeExisting makes room for an entry that replaces an earlier one.
+// Directories are only replaced if they are empty, unless replaceTree is set.
+func removeExisting(target string, replaceTree bool) error {
+	remove := os.Remove
+	if replaceTree {
+		remove = os.RemoveAll
+	}
+	if err := remove(target); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("%w: cannot replace %s: %v", ErrUnsafeArchive, target, err)
+	}
+	return nil
+}
+
+// finish checks the links once the tree is complete, since later entries
+// can change where earlier links resolve to
+func (e *extractor) finish() error {
+	for _, name := range e.links {
+		escapes, err := resolveEscapes(e.dir, name)
+		if err != nil {
+			return err
+		}
+		if escapes {
+			return fmt.Errorf("%w: symlink %s points outside of the volume", ErrUnsafeArchive, name)
+		}
+	}
+	return nil
+}
+
+func newTarReader(r io.Reader) (*tar.Reader, func(), error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(zstdMagic))
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read seed archive: %v", err)
+		}
+		return tar.NewReader(zr), func() { zr.Close() }, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read seed archive: %v", err)
+		}
+		return tar.NewReader(zr), zr.Close, nil
+	default:
+		return tar.NewReader(br), func() {}, nil
+	}
+}
+
+// entryName returns the cleaned, slash separated name of an entry relative
+// to the extraction root
+func entryName(name string) (string, error) {
+	if path.IsAbs(name) || strings.HasPrefix(name, `\`) {
+		return "", fmt.Errorf("%w: absolute path %s", ErrUnsafeArchive, name)
+	}
+	cleaned := path.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("%w: path %s escapes the volume", ErrUnsafeArchive, name)
+	}
+	return cleaned, nil
+}
+
+// ensureParents creates the missing parent directories of name below dir.
+// Existing parents must be real directories, never symlinks, so that no
+// entry is written outside of dir.
+func ensureParents(dir, name string) error {
+	current := dir
+	parts := strings.Split(name, "/")
+	for _, part := range parts[:len(parts)-1] {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(current, 0755); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case !info.IsDir():
+			return fmt.Errorf("%w: %s traverses a symlink or file", ErrUnsafeArchive, name)
+		}
+	}
+	return nil
+}
+
+// resolveEscapes resolves name below root component by component, following
+// symlinks as if root were the filesystem root, and reports whether the
+// resolution ever leaves root. Components that do not exist are resolved
+// lexically.
+func resolveEscapes(root, name string) (bool, error) {
+	var resolved []string
+	pending := strings.Split(name, "/")
+	follows := 0
+
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return true, nil
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		resolved = append(resolved, part)
+		current := filepath.Join(append([]string{root}, resolved...)...)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		if follows++; follows > maxSymlinkFollows {
+			return false, fmt.Errorf("%w: too many levels of symlinks at %s", ErrUnsafeArchive, name)
+		}
+		link, err := os.Readlink(current)
+		if err != nil {
+			return false, err
+		}
+		if path.IsAbs(link) {
+			return true, nil
+		}
+		resolved = resolved[:len(resolved)-1]
+		pending = append(strings.Split(link, "/"), pending...)
+	}
+
+	return false, nil
+}
+
+// writeFile creates a new file. O_EXCL also refuses to follow a symlink
+// that might have been left at path.
+func writeFile(path string, r io.Reader, size int64, mode os.FileMode) (int64, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.CopyN(f, r, size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	// The umask may have masked some permission bits
+	return n, os.Chmod(path, mode)
+}
+
+// within reports whether path is root or below it
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,138 @@
+package seed
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// tempFile is an archive downloaded into the seed directory, removed on Close
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// open returns the verified archive at source. Archives larger than limit
+// cannot fit the volume and are rejected early.
+func (s *Seeder) open(ctx context.Context, source, digest string, limit int64) (io.ReadCloser, error) {
+	if filepath.IsAbs(source) {
+		return s.openLocal(source, digest)
+	}
+	return s.download(ctx, source, digest, limit)
+}
+
+func (s *Seeder) openLocal(source, digest string) (io.ReadCloser, error) {
+	path, err := s.localPath(source)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFetch, err)
+	}
+	if err := verify(f, digest); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// localPath resolves a local source, which must be below the local seed
+// directory. Symlinks are resolved so they cannot point outside of it.
+func (s *Seeder) localPath(source string) (string, error) {
+	if s.localDir == "" {
+		return "", fmt.Errorf("%w: local seed sources are disabled on this node", ErrInvalidSource)
+	}
+
+	root, err := filepath.EvalSymlinks(s.localDir)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrFetch, err)
+	}
+	path, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrFetch, err)
+	}
+	if !within(root, path) {
+		return "", fmt.Errorf("%w: %s is outside of %s", ErrInvalidSource, source, s.localDir)
+	}
+	return path, nil
+}
+
+// download stores the archive in a temporary file while hashing it, so that
+// nothing is extracted before the archive is verified. The download is
+// limited to the volume capacity.
+func (s *Seeder) download(ctx context.Context, source, digest string, limit int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSource, err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFetch, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: unexpected status %s", ErrFetch, resp.Status)
+	}
+	if resp.ContentLength > limit {
+		return nil, fmt.Errorf("%w: archive is %d bytes, the volume %d", ErrTooLarge, resp.ContentLength, limit)
+	}
+
+	f, err := os.CreateTemp(s.tempDir, "download-*")
+	if err != nil {
+		return nil, err
+	}
+	archive := &tempFile{File: f}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		archive.Close()
+		return nil, fmt.Errorf("%w: %v", ErrFetch, err)
+	}
+	if n > limit {
+		archive.Close()
+		return nil, fmt.Errorf("%w: archive is larger than the volume (%d bytes)", ErrTooLarge, limit)
+	}
+	if err := checkDigest(h, digest); err != nil {
+		archive.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		archive.Close()
+		return nil, err
+	}
+	return archive, nil
+}
+
+func verify(r io.Reader, digest string) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return fmt.Errorf("%w: %v", ErrFetch, err)
+	}
+	return checkDigest(h, digest)
+}
+
+func checkDigest(h hash.Hash, digest string) error {
+	if got := hex.EncodeToString(h.Sum(nil)); got != digest {
+		return fmt.Errorf("%w: got %s, want %s", ErrChecksumMismatch, got, digest)
+	}
+	return nil
+}
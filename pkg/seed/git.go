@@ -0,0 +1,198 @@
+package seed
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/volume"
+)
+
+const (
+	// GitSourceParam is the absolute path of a node-local git repository,
+	// typically a bare mirror kept up to date by the node, or of a git bundle
+	GitSourceParam = "gitSource"
+	// GitRefParam is the branch, tag or commit to check out, HEAD by default
+	GitRefParam = "gitRef"
+)
+
+func validateGitAttributes(attributes map[string]string) error {
+	source, ref := attributes[GitSourceParam], attributes[GitRefParam]
+	if source == "" {
+		if ref != "" {
+			return fmt.Errorf("%w: %s requires %s", ErrInvalidSource, GitRefParam, GitSourceParam)
+		}
+		return nil
+	}
+
+	if !filepath.IsAbs(source) {
+		return fmt.Errorf("%w: %s must be an absolute path", ErrInvalidSource, GitSourceParam)
+	}
+	if strings.HasPrefix(ref, "-") || strings.ContainsAny(ref, " \t\n\x00") {
+		return fmt.Errorf("%w: invalid %s %q", ErrInvalidSource, GitRefParam, ref)
+	}
+	return nil
+}
+
+// checkout checks out the git ref of the volume into the volume directory
+// and returns the commit. The objects of the source repository are copied
+// into the checkout, so that it is self-contained inside the pod and does
+// not break when the source is repacked. Bundles are unpacked into a mirror
+// once, which checkouts are cloned from the same way.
+func (s *Seeder) checkout(ctx context.Context, vol *volume.Volume) (string, error) {
+	source, err := s.localPath(vol.Attributes[GitSourceParam])
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrFetch, err)
+	}
+	repo := source
+	if info.Mode().IsRegular() {
+		if repo, err = s.bundleMirror(ctx, source, info); err != nil {
+			return "", err
+		}
+	}
+
+	ref := vol.Attributes[GitRefParam]
+	if ref == "" {
+		ref = "HEAD"
+	}
+	out, err := runGit(ctx, repo, "rev-parse", "--verify", "--quiet", "--end-of-options", ref+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("%w: cannot resolve %s in %s: %v", ErrFetch, ref, source, err)
+	}
+	commit := strings.TrimSpace(out)
+
+	size, err := treeSize(ctx, repo, commit)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrFetch, err)
+	}
+	objects, err := objectsSize(ctx, repo)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrFetch, err)
+	}
+	if size+objects > vol.Size {
+		return "", fmt.Errorf("%w: the work tree of %s is %d bytes and the repository %d, the volume %d", ErrTooLarge, commit, size, objects, vol.Size)
+	}
+
+	// The clone borrows the objects of the source and --dissociate then
+	// repacks them into the checkout, dropping the alternates
+	if _, err := runGit(ctx, "", "clone", "--reference", repo, "--dissociate", "--no-checkout", "--quiet", "--", repo, vol.Path); err != nil {
+		return "", err
+	}
+	if _, err := runGit(ctx, vol.Path, "checkout", "--quiet", "--detach", commit); err != nil {
+		return "", err
+	}
+
+	return commit, nil
+}
+
+// bundleMirror returns a bare repository unpacked from the bundle at path.
+// Mirrors are keyed by the path, size and modification time of the bundle,
+// so a replaced bundle gets a new mirror while existing checkouts keep using
+// the old one.
+func (s *Seeder) bundleMirror(ctx context.Context, path string, info os.FileInfo) (string, error) {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d", path, info.Size(), info.ModTime().UnixNano())))
+	mirror := filepath.Join(s.mirrorDir, hex.EncodeToString(sum[:16])+".git")
+
+	s.mirrorMu.Lock()
+	defer s.mirrorMu.Unlock()
+
+	if _, err := os.Stat(mirror); err == nil {
+		return mirror, nil
+	}
+
+	if err := os.MkdirAll(s.mirrorDir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.MkdirTemp(s.mirrorDir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	if _, err := runGit(ctx, "", "clone", "--bare", "--quiet", "--", path, filepath.Join(tmp, "repo")); err != nil {
+		return "", fmt.Errorf("%w: failed to unpack bundle %s: %v", ErrFetch, path, err)
+	}
+	if err := os.Rename(filepath.Join(tmp, "repo"), mirror); err != nil {
+		return "", err
+	}
+	klog.Infof("Unpacked git bundle %s into %s", path, mirror)
+
+	return mirror, nil
+}
+
+// treeSize returns the total size of the files in the tree of commit
+func treeSize(ctx context.Context, repo, commit string) (int64, error) {
+	out, err := runGit(ctx, repo, "ls-tree", "-r", "-l", "-z", commit)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, entry := range strings.Split(out, "\x00") {
+		meta, _, _ := strings.Cut(entry, "\t")
+		fields := strings.Fields(meta)
+		// Submodules have no size
+		if len(fields) != 4 || fields[3] == "-" {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected ls-tree output %q", entry)
+		}
+		size += n
+	}
+	return size, nil
+}
+
+// objectsSize returns the bytes the objects of repo take on disk
+func objectsSize(ctx context.Context, repo string) (int64, error) {
+	out, err := runGit(ctx, repo, "count-objects", "-v")
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, line := range strings.Split(out, "\n") {
+		key, value, _ := strings.Cut(line, ": ")
+		if key != "size" && key != "size-pack" {
+			continue
+		}
+		kib, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected count-objects output %q", line)
+		}
+		size += kib << 10
+	}
+	return size, nil
+}
+
+// runGit runs git in dir and returns its output. Repositories on the node
+// are usually owned by another user, and hooks are never run.
+func runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	command := args[0]
+	args = append([]string{"-c", "safe.directory=*", "-c", "core.hooksPath=/dev/null"}, args...)
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_CONFIG_NOSYSTEM=1")
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
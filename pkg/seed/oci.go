@@ -0,0 +1,321 @@
+package seed
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/volume"
+)
+
+const (
+	// OCILayoutParam is the absolute path of an OCI image layout directory
+	OCILayoutParam = "ociLayout"
+	// OCIRefParam selects the image in the layout, either by the
+	// org.opencontainers.image.ref.name annotation (usually a tag) or by
+	// manifest digest. It may be omitted if the layout holds one image.
+	OCIRefParam = "ociRef"
+
+	refNameAnnotation = "org.opencontainers.image.ref.name"
+	titleAnnotation   = "org.opencontainers.image.title"
+
+	// maxManifestSize bounds the index and manifest blobs that are read
+	// into memory
+	maxManifestSize = 4 * 1024 * 1024
+)
+
+var (
+	indexMediaTypes = map[string]bool{
+		"application/vnd.oci.image.index.v1+json":                   true,
+		"application/vnd.docker.distribution.manifest.list.v2+json": true,
+	}
+	manifestMediaTypes = map[string]bool{
+		"application/vnd.oci.image.manifest.v1+json":           true,
+		"application/vnd.docker.distribution.manifest.v2+json": true,
+	}
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+type ociIndex struct {
+	MediaType string          `json:"mediaType"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+func validateOCIAttributes(attributes map[string]string) error {
+	layout, ref := attributes[OCILayoutParam], attributes[OCIRefParam]
+	if layout == "" {
+		if ref != "" {
+			return fmt.Errorf("%w: %s requires %s", ErrInvalidSource, OCIRefParam, OCILayoutParam)
+		}
+		return nil
+	}
+
+	if !filepath.IsAbs(layout) {
+		return fmt.Errorf("%w: %s must be an absolute path", ErrInvalidSource, OCILayoutParam)
+	}
+	if strings.HasPrefix(ref, "sha256:") {
+		if _, err := parseDigest(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unpackImage applies the layers of the image selected by the volume
+// attributes to the volume directory and returns the manifest digest.
+// Layers are verified against their digests as they are applied; a
+// mismatch fails the attempt, which clears the volume.
+func (s *Seeder) unpackImage(ctx context.Context, vol *volume.Volume) (string, error) {
+	layout, err := s.localPath(vol.Attributes[OCILayoutParam])
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Join(layout, "oci-layout")); err != nil {
+		return "", fmt.Errorf("%w: %s is not an OCI image layout: %v", ErrFetch, layout, err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(layout, "index.json"))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrFetch, err)
+	}
+	index := &ociIndex{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return "", fmt.Errorf("%w: invalid index.json: %v", ErrFetch, err)
+	}
+
+	desc, err := selectImage(index, vol.Attributes[OCIRefParam])
+	if err != nil {
+		return "", err
+	}
+	manifest, desc, err := resolveManifest(layout, desc)
+	if err != nil {
+		return "", err
+	}
+
+	e := newExtractor(vol.Path, vol.Size, true)
+	for _, layer := range manifest.Layers {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if err := applyLayer(e, layout, layer); err != nil {
+			return "", err
+		}
+	}
+	if err := e.finish(); err != nil {
+		return "", err
+	}
+	klog.V(4).Infof("Unpacked %d layers (%d bytes) of %s into volume %s", len(manifest.Layers), e.written, desc.Digest, vol.ID)
+
+	return desc.Digest, nil
+}
+
+// selectImage finds the image named by ref in the top-level index
+func selectImage(index *ociIndex, ref string) (ociDescriptor, error) {
+	if ref == "" {
+		if len(index.Manifests) != 1 {
+			return ociDescriptor{}, fmt.Errorf("%w: the layout holds %d images, %s is required", ErrInvalidSource, len(index.Manifests), OCIRefParam)
+		}
+		return index.Manifests[0], nil
+	}
+
+	for _, desc := range index.Manifests {
+		if desc.Digest == ref || desc.Annotations[refNameAnnotation] == ref {
+			return desc, nil
+		}
+	}
+	return ociDescriptor{}, fmt.Errorf("%w: image %s not found in the layout", ErrFetch, ref)
+}
+
+// resolveManifest reads the manifest desc points to, descending into image
+// indexes by picking the manifest for the platform of the node
+func resolveManifest(layout string, desc ociDescriptor) (*ociManifest, ociDescriptor, error) {
+	// Indexes may be nested, but not endlessly
+	for depth := 0; depth < 4; depth++ {
+		if desc.Size > maxManifestSize {
+			return nil, desc, fmt.Errorf("%w: manifest %s is too large", ErrFetch, desc.Digest)
+		}
+		data, err := readBlob(layout, desc)
+		if err != nil {
+			return nil, desc, err
+		}
+
+		mediaType := desc.MediaType
+		if mediaType == "" {
+			var probe struct {
+				MediaType string `json:"mediaType"`
+			}
+			json.Unmarshal(data, &probe)
+			mediaType = probe.MediaType
+		}
+
+		switch {
+		case indexMediaTypes[mediaType]:
+			index := &ociIndex{}
+			if err := json.Unmarshal(data, index); err != nil {
+				return nil, desc, fmt.Errorf("%w: invalid index %s: %v", ErrFetch, desc.Digest, err)
+			}
+			if desc, err = selectPlatform(index); err != nil {
+				return nil, desc, err
+			}
+		case manifestMediaTypes[mediaType]:
+			manifest := &ociManifest{}
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return nil, desc, fmt.Errorf("%w: invalid manifest %s: %v", ErrFetch, desc.Digest, err)
+			}
+			return manifest, desc, nil
+		default:
+			return nil, desc, fmt.Errorf("%w: unsupported manifest media type %q", ErrInvalidSource, mediaType)
+		}
+	}
+	return nil, desc, fmt.Errorf("%w: image indexes are nested too deeply", ErrInvalidSource)
+}
+
+// selectPlatform picks the manifest for the node from a multi-platform index.
+// Entries without a platform, as artifacts have, match any node.
+func selectPlatform(index *ociIndex) (ociDescriptor, error) {
+	for _, desc := range index.Manifests {
+		if desc.Platform == nil || (desc.Platform.OS == runtime.GOOS && desc.Platform.Architecture == runtime.GOARCH) {
+			return desc, nil
+		}
+	}
+	return ociDescriptor{}, fmt.Errorf("%w: no manifest for %s/%s", ErrFetch, runtime.GOOS, runtime.GOARCH)
+}
+
+// applyLayer applies an image layer, or writes the blob of an artifact layer
+// as the file named by its title annotation
+func applyLayer(e *extractor, layout string, layer ociDescriptor) error {
+	f, err := openBlob(layout, layer)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	vr, err := newVerifyingReader(f, layer)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case strings.Contains(layer.MediaType, ".tar"):
+		err = e.apply(vr)
+	case layer.Annotations[titleAnnotation] != "":
+		err = e.applyFile(layer.Annotations[titleAnnotation], vr, layer.Size)
+	default:
+		return fmt.Errorf("%w: unsupported layer media type %q", ErrInvalidSource, layer.MediaType)
+	}
+	if err != nil {
+		return err
+	}
+	return vr.verify()
+}
+
+func openBlob(layout string, desc ociDescriptor) (*os.File, error) {
+	hexDigest, err := parseDigest(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(layout, "blobs", "sha256", hexDigest))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFetch, err)
+	}
+	return f, nil
+}
+
+// readBlob reads and verifies a small blob
+func readBlob(layout string, desc ociDescriptor) ([]byte, error) {
+	f, err := openBlob(layout, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	vr, err := newVerifyingReader(f, desc)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(vr)
+	if err != nil {
+		return nil, err
+	}
+	return data, vr.verify()
+}
+
+// parseDigest returns the hex part of a sha256 digest
+func parseDigest(digest string) (string, error) {
+	hexDigest, ok := strings.CutPrefix(digest, "sha256:")
+	if b, err := hex.DecodeString(hexDigest); !ok || err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("%w: unsupported digest %q", ErrInvalidSource, digest)
+	}
+	return hexDigest, nil
+}
+
+// verifyingReader hashes a blob as it is read and checks it against its
+// descriptor once it has been consumed
+type verifyingReader struct {
+	r      io.Reader
+	hash   hash.Hash
+	n      int64
+	desc   ociDescriptor
+	digest string
+}
+
+func newVerifyingReader(r io.Reader, desc ociDescriptor) (*verifyingReader, error) {
+	digest, err := parseDigest(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	// Read one byte more than expected to detect oversized blobs
+	return &verifyingReader{
+		r:      io.LimitReader(r, desc.Size+1),
+		hash:   sha256.New(),
+		desc:   desc,
+		digest: digest,
+	}, nil
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	v.n += int64(n)
+	return n, err
+}
+
+// verify consumes what is left of the blob and checks its size and digest
+func (v *verifyingReader) verify() error {
+	if _, err := io.Copy(io.Discard, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrFetch, err)
+	}
+	if v.n != v.desc.Size {
+		return fmt.Errorf("%w: blob %s is not %d bytes", ErrChecksumMismatch, v.desc.Digest, v.desc.Size)
+	}
+	if got := hex.EncodeToString(v.hash.Sum(nil)); got != v.digest {
+		return fmt.Errorf("%w: blob %s has digest sha256:%s", ErrChecksumMismatch, v.desc.Digest, got)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+// Package seed fills new volumes with initial content, so pods do not have
+// to download and unpack the same data into their scratch space themselves
+package seed
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/volume"
+)
+
+const (
+	// ArchiveParam is a local path or HTTP(S) URL of a tar archive, optionally
+	// gzip or zstd compressed, that is extracted into new volumes
+	ArchiveParam = "seedArchive"
+	// SHA256Param is the hex SHA-256 digest the archive must match
+	SHA256Param = "seedSHA256"
+
+	// tempDirName holds downloads in progress below the volume base directory
+	tempDirName = ".seeds"
+	// mirrorDirName holds bare repositories unpacked from git bundles
+	mirrorDirName = ".git-mirrors"
+)
+
+var (
+	// ErrInvalidSource is returned for unusable seed attributes
+	ErrInvalidSource = errors.New("invalid seed source")
+	// ErrFetch is returned when the seed source could not be retrieved, or
+	// the git ref or OCI image could not be resolved
+	ErrFetch = errors.New("failed to fetch seed source")
+	// ErrChecksumMismatch is returned when the archive does not match
+	// seedSHA256 or an OCI blob does not match its digest
+	ErrChecksumMismatch = errors.New("seed archive checksum mismatch")
+	// ErrUnsafeArchive is returned for archives with entries that would
+	// escape the volume
+	ErrUnsafeArchive = errors.New("unsafe seed archive")
+	// ErrTooLarge is returned when the seed content does not fit the volume
+	ErrTooLarge = errors.New("seed content does not fit the volume")
+)
+
+// Config configures a Seeder
+type Config struct {
+	// BaseDir is the volume base directory; downloads are staged below it
+	BaseDir string
+	// LocalDir is the only directory local archives, git mirrors, bundles
+	// and OCI layouts may be read from. Local sources are rejected if it is empty.
+	LocalDir string
+	// HTTPClient defaults to a client without an overall timeout, downloads
+	// are bounded by the population timeout instead
+	HTTPClient *http.Client
+}
+
+// Seeder populates volumes from the seed archive, git source or OCI image
+// named in their attributes. It implements volume.Populator.
+type Seeder struct {
+	tempDir   string
+	mirrorDir string
+	localDir  string
+	client    *http.Client
+
+	// mirrorMu serializes unpacking git bundles
+	mirrorMu sync.Mutex
+}
+
+// NewSeeder creates a seeder. Downloads and partially unpacked bundles left
+// behind by a previous run are removed.
+func NewSeeder(cfg Config) (*Seeder, error) {
+	tempDir := filepath.Join(cfg.BaseDir, tempDirName)
+	if err := os.RemoveAll(tempDir); err != nil {
+		return nil, fmt.Errorf("failed to clean up seed downloads: %v", err)
+	}
+	if err := os.MkdirAll(tempDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create seed download directory: %v", err)
+	}
+
+	// Bundles that were being unpacked when the driver stopped
+	mirrorDir := filepath.Join(cfg.BaseDir, mirrorDirName)
+	partial, _ := filepath.Glob(filepath.Join(mirrorDir, ".tmp-*"))
+	for _, dir := range partial {
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, fmt.Errorf("failed to clean up git mirrors: %v", err)
+		}
+	}
+
+	localDir := cfg.LocalDir
+	if localDir != "" {
+		var err error
+		if localDir, err = filepath.Abs(localDir); err != nil {
+			return nil, err
+		}
+	}
+
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{}
+	}
+
+	return &Seeder{
+		tempDir:   tempDir,
+		mirrorDir: mirrorDir,
+		localDir:  localDir,
+		client:    client,
+	}, nil
+}
+
+// ValidateAttributes checks the seed attributes of a volume without fetching
+// anything
+func ValidateAttributes(attributes map[string]string) error {
+	sources := 0
+	for _, param := range []string{ArchiveParam, GitSourceParam, OCILayoutParam} {
+		if attributes[param] != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return fmt.Errorf("%w: %s, %s and %s are mutually exclusive", ErrInvalidSource, ArchiveParam, GitSourceParam, OCILayoutParam)
+	}
+
+	if err := validateArchiveAttributes(attributes); err != nil {
+		return err
+	}
+	if err := validateGitAttributes(attributes); err != nil {
+		return err
+	}
+	return validateOCIAttributes(attributes)
+}
+
+func validateArchiveAttributes(attributes map[string]string) error {
+	source, digest := attributes[ArchiveParam], attributes[SHA256Param]
+	if source == "" {
+		if digest != "" {
+			return fmt.Errorf("%w: %s requires %s", ErrInvalidSource, SHA256Param, ArchiveParam)
+		}
+		return nil
+	}
+
+	if digest == "" {
+		return fmt.Errorf("%w: %s requires %s", ErrInvalidSource, ArchiveParam, SHA256Param)
+	}
+	if b, err := hex.DecodeString(digest); err != nil || len(b) != 32 {
+		return fmt.Errorf("%w: %s must be 64 hex characters", ErrInvalidSource, SHA256Param)
+	}
+
+	if filepath.IsAbs(source) {
+		return nil
+	}
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: %s must be an absolute path or an http(s) URL", ErrInvalidSource, ArchiveParam)
+	}
+	return nil
+}
+
+// Populate fills the volume directory from the seed archive, git source or
+// OCI image in its attributes and returns the revision of the content.
+// Volumes without a seed source are left untouched.
+func (s *Seeder) Populate(ctx context.Context, vol *volume.Volume) (string, error) {
+	if vol.Attributes[ArchiveParam] == "" && vol.Attributes[GitSourceParam] == "" && vol.Attributes[OCILayoutParam] == "" {
+		return "", nil
+	}
+	if err := ValidateAttributes(vol.Attributes); err != nil {
+		return "", err
+	}
+
+	// Start from an empty volume, an earlier attempt may have been cut short
+	if err := clearDir(vol.Path); err != nil {
+		return "", err
+	}
+
+	start := time.Now()
+	var revision string
+	var err error
+	switch {
+	case vol.Attributes[GitSourceParam] != "":
+		revision, err = s.checkout(ctx, vol)
+	case vol.Attributes[OCILayoutParam] != "":
+		revision, err = s.unpackImage(ctx, vol)
+	default:
+		revision, err = s.extractArchive(ctx, vol)
+	}
+	if err != nil {
+		if cleanupErr := clearDir(vol.Path); cleanupErr != nil {
+			klog.Warningf("Failed to clean up partially seeded volume %s: %v", vol.ID, cleanupErr)
+		}
+		return "", err
+	}
+
+	klog.Infof("Seeded volume %s with %s in %s", vol.ID, revision, time.Since(start).Round(time.Millisecond))
+	return revision, nil
+}
+
+// extractArchive verifies the seed archive of the volume and extracts it
+// into the volume directory. The revision is the archive digest.
+func (s *Seeder) extractArchive(ctx context.Context, vol *volume.Volume) (string, error) {
+	source := vol.Attributes[ArchiveParam]
+	digest := strings.ToLower(vol.Attributes[SHA256Param])
+
+	archive, err := s.open(ctx, source, digest, vol.Size)
+	if err != nil {
+		return "", err
+	}
+	defer archive.Close()
+
+	written, err := Extract(archive, vol.Path, vol.Size)
+	if err != nil {
+		return "", err
+	}
+	klog.V(4).Infof("Extracted %d bytes from %s into volume %s", written, source, vol.ID)
+
+	return "sha256:" + digest, nil
+}
+
+// clearDir removes the contents of dir, but not dir itself
+func clearDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,439 @@
+package seed
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/volume"
+)
+
+type entry struct {
+	name, body, link string
+	typ              byte
+}
+
+func makeTar(t *testing.T, entries ...entry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typ, Linkname: e.link, Mode: 0644, Size: int64(len(e.body))}
+		if e.typ == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Size > 0 {
+			_, err := tw.Write([]byte(e.body))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestExtract(t *testing.T) {
+	dir := t.TempDir()
+	archive := gzipped(t, makeTar(t,
+		entry{name: "./", typ: tar.TypeDir},
+		entry{name: "data/", typ: tar.TypeDir},
+		entry{name: "data/train.csv", body: "a,b\n1,2\n"},
+		entry{name: "nested/deep/file", body: "x"},
+		entry{name: "latest", typ: tar.TypeSymlink, link: "data/train.csv"},
+		entry{name: "nested/up", typ: tar.TypeSymlink, link: "../data"},
+		entry{name: "copy", typ: tar.TypeLink, link: "data/train.csv"},
+	))
+
+	written, err := Extract(bytes.NewReader(archive), dir, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, int64(9), written)
+
+	data, err := os.ReadFile(filepath.Join(dir, "latest"))
+	require.NoError(t, err)
+	assert.Equal(t, "a,b\n1,2\n", string(data))
+	data, err = os.ReadFile(filepath.Join(dir, "nested", "up", "train.csv"))
+	require.NoError(t, err)
+	assert.Equal(t, "a,b\n1,2\n", string(data))
+	data, err = os.ReadFile(filepath.Join(dir, "copy"))
+	require.NoError(t, err)
+	assert.Equal(t, "a,b\n1,2\n", string(data))
+}
+
+func TestExtractRejectsUnsafeArchives(t *testing.T) {
+	tests := map[string][]entry{
+		"absolute path": {{name: "/etc/passwd", body: "x"}},
+		"dotdot":        {{name: "a/../../escape", body: "x"}},
+		"absolute symlink": {
+			{name: "etc", typ: tar.TypeSymlink, link: "/etc"},
+		},
+		"symlink escape": {
+			{name: "out", typ: tar.TypeSymlink, link: "../.."},
+		},
+		"write through symlink": {
+			{name: "sub/", typ: tar.TypeDir},
+			{name: "sub/link", typ: tar.TypeSymlink, link: "."},
+			{name: "sub/link/file", body: "x"},
+		},
+		// Each link stays inside on its own, together they escape
+		"chained symlinks": {
+			{name: "d/", typ: tar.TypeDir},
+			{name: "d/x", typ: tar.TypeSymlink, link: "up/.."},
+			{name: "d/up", typ: tar.TypeSymlink, link: ".."},
+		},
+		"hard link escape": {
+			{name: "passwd", typ: tar.TypeLink, link: "../../etc/passwd"},
+		},
+	}
+
+	for name, entries := range tests {
+		t.Run(name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "volume")
+			require.NoError(t, os.Mkdir(dir, 0755))
+
+			_, err := Extract(bytes.NewReader(makeTar(t, entries...)), dir, 1<<20)
+			assert.True(t, errors.Is(err, ErrUnsafeArchive), "got %v", err)
+
+			// Nothing may have been written next to the volume
+			siblings, err := os.ReadDir(parent)
+			require.NoError(t, err)
+			assert.Len(t, siblings, 1)
+		})
+	}
+}
+
+func TestExtractSizeLimit(t *testing.T) {
+	archive := makeTar(t,
+		entry{name: "a", body: "0123456789"},
+		entry{name: "b", body: "0123456789"},
+	)
+	_, err := Extract(bytes.NewReader(archive), t.TempDir(), 15)
+	assert.True(t, errors.Is(err, ErrTooLarge), "got %v", err)
+}
+
+func TestPopulate(t *testing.T) {
+	archive := gzipped(t, makeTar(t, entry{name: "hello.txt", body: "hello"}))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/seed.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(archive)
+	}))
+	defer server.Close()
+
+	localDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(localDir, "seed.tar.gz"), archive, 0644))
+
+	baseDir := t.TempDir()
+	vm, err := volume.NewVolumeManager(baseDir)
+	require.NoError(t, err)
+	seeder, err := NewSeeder(Config{BaseDir: baseDir, LocalDir: localDir, HTTPClient: server.Client()})
+	require.NoError(t, err)
+	vm.SetPopulator(seeder)
+	ctx := context.Background()
+
+	populate := func(id, source, digest string) error {
+		_, err := vm.EnsureVolume(id, 1<<20, map[string]string{
+			ArchiveParam: source,
+			SHA256Param:  digest,
+		})
+		require.NoError(t, err)
+		return vm.PopulateVolume(ctx, id)
+	}
+
+	for id, source := range map[string]string{
+		"http":  server.URL + "/seed.tar.gz",
+		"local": filepath.Join(localDir, "seed.tar.gz"),
+	} {
+		require.NoError(t, populate(id, source, digestOf(archive)), id)
+		data, err := os.ReadFile(filepath.Join(baseDir, id, "hello.txt"))
+		require.NoError(t, err, id)
+		assert.Equal(t, "hello", string(data))
+
+		vol, err := vm.GetVolume(id)
+		require.NoError(t, err)
+		assert.True(t, vol.Populated)
+	}
+
+	// A populated volume is not seeded again
+	require.NoError(t, os.Remove(filepath.Join(baseDir, "http", "hello.txt")))
+	require.NoError(t, vm.PopulateVolume(ctx, "http"))
+	assert.NoFileExists(t, filepath.Join(baseDir, "http", "hello.txt"))
+
+	err = populate("mismatch", server.URL+"/seed.tar.gz", digestOf([]byte("other")))
+	assert.True(t, errors.Is(err, ErrChecksumMismatch), "got %v", err)
+	entries, err := os.ReadDir(filepath.Join(baseDir, "mismatch"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	err = populate("missing", server.URL+"/missing.tar.gz", digestOf(archive))
+	assert.True(t, errors.Is(err, ErrFetch), "got %v", err)
+
+	err = populate("outside", "/etc/hostname", digestOf(archive))
+	assert.True(t, errors.Is(err, ErrInvalidSource), "got %v", err)
+
+	// Downloads do not outlive the attempt
+	downloads, err := os.ReadDir(filepath.Join(baseDir, tempDirName))
+	require.NoError(t, err)
+	assert.Empty(t, downloads)
+}
+
+func TestValidateAttributes(t *testing.T) {
+	digest := digestOf(nil)
+	valid := []map[string]string{
+		nil,
+		{ArchiveParam: "https://example.com/data.tar.zst", SHA256Param: digest},
+		{ArchiveParam: "/srv/seeds/data.tar", SHA256Param: digest},
+		{GitSourceParam: "/srv/repo.git", GitRefParam: "release-1.2"},
+		{OCILayoutParam: "/srv/layouts/tools", OCIRefParam: "1.0"},
+	}
+	for _, attrs := range valid {
+		assert.NoError(t, ValidateAttributes(attrs), attrs)
+	}
+
+	invalid := []map[string]string{
+		{ArchiveParam: "https://example.com/data.tar"},
+		{SHA256Param: digest},
+		{ArchiveParam: "https://example.com/data.tar", SHA256Param: "abc"},
+		{ArchiveParam: "relative/data.tar", SHA256Param: digest},
+		{ArchiveParam: "ftp://example.com/data.tar", SHA256Param: digest},
+		{GitRefParam: "main"},
+		{GitSourceParam: "relative/repo.git"},
+		{GitSourceParam: "/srv/repo.git", GitRefParam: "--upload-pack=evil"},
+		{GitSourceParam: "/srv/repo.git", ArchiveParam: "/srv/seeds/data.tar", SHA256Param: digest},
+		{OCIRefParam: "1.0"},
+		{OCILayoutParam: "layouts/tools"},
+		{OCILayoutParam: "/srv/layouts/tools", OCIRefParam: "sha256:abc"},
+		{OCILayoutParam: "/srv/layouts/tools", GitSourceParam: "/srv/repo.git"},
+	}
+	for _, attrs := range invalid {
+		assert.True(t, errors.Is(ValidateAttributes(attrs), ErrInvalidSource), attrs)
+	}
+}
+
+func gitCmd(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		"GIT_CONFIG_NOSYSTEM=1", "HOME="+dir)
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	return strings.TrimSpace(string(out))
+}
+
+func TestPopulateFromGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	localDir := t.TempDir()
+	work := filepath.Join(localDir, "work")
+	require.NoError(t, os.Mkdir(work, 0755))
+	gitCmd(t, work, "init", "--quiet", "--initial-branch=main")
+	require.NoError(t, os.WriteFile(filepath.Join(work, "README"), []byte("v1"), 0644))
+	gitCmd(t, work, "add", "README")
+	gitCmd(t, work, "commit", "--quiet", "-m", "v1")
+	gitCmd(t, work, "tag", "v1")
+	v1 := gitCmd(t, work, "rev-parse", "HEAD")
+	require.NoError(t, os.WriteFile(filepath.Join(work, "README"), []byte("v2"), 0644))
+	gitCmd(t, work, "commit", "--quiet", "-am", "v2")
+	v2 := gitCmd(t, work, "rev-parse", "HEAD")
+
+	mirror := filepath.Join(localDir, "mirror.git")
+	gitCmd(t, localDir, "clone", "--quiet", "--mirror", work, mirror)
+	bundle := filepath.Join(localDir, "repo.bundle")
+	gitCmd(t, work, "bundle", "create", bundle, "--all")
+
+	baseDir := t.TempDir()
+	vm, err := volume.NewVolumeManager(baseDir)
+	require.NoError(t, err)
+	seeder, err := NewSeeder(Config{BaseDir: baseDir, LocalDir: localDir})
+	require.NoError(t, err)
+	vm.SetPopulator(seeder)
+
+	tests := []struct {
+		id, source, ref, revision, content string
+	}{
+		{"mirror-head", mirror, "", v2, "v2"},
+		{"mirror-tag", mirror, "v1", v1, "v1"},
+		{"mirror-commit", mirror, v1[:12], v1, "v1"},
+		{"bundle-branch", bundle, "main", v2, "v2"},
+		{"bundle-tag", bundle, "v1", v1, "v1"},
+	}
+	for _, tt := range tests {
+		_, err := vm.EnsureVolume(tt.id, 1<<20, map[string]string{GitSourceParam: tt.source, GitRefParam: tt.ref})
+		require.NoError(t, err)
+		require.NoError(t, vm.PopulateVolume(context.Background(), tt.id), tt.id)
+
+		data, err := os.ReadFile(filepath.Join(baseDir, tt.id, "README"))
+		require.NoError(t, err, tt.id)
+		assert.Equal(t, tt.content, string(data), tt.id)
+		// Objects are copied, so the checkout does not depend on the source
+		assert.NoFileExists(t, filepath.Join(baseDir, tt.id, ".git", "objects", "info", "alternates"), tt.id)
+		gitCmd(t, filepath.Join(baseDir, tt.id), "cat-file", "-e", tt.revision)
+
+		vol, err := vm.GetVolume(tt.id)
+		require.NoError(t, err)
+		assert.Equal(t, tt.revision, vol.Revision, tt.id)
+	}
+
+	// Both bundle checkouts share one mirror
+	mirrors, err := filepath.Glob(filepath.Join(baseDir, mirrorDirName, "*.git"))
+	require.NoError(t, err)
+	assert.Len(t, mirrors, 1)
+
+	_, err = vm.EnsureVolume("unknown-ref", 1<<20, map[string]string{GitSourceParam: mirror, GitRefParam: "nope"})
+	require.NoError(t, err)
+	err = vm.PopulateVolume(context.Background(), "unknown-ref")
+	assert.True(t, errors.Is(err, ErrFetch), "got %v", err)
+
+	_, err = vm.EnsureVolume("too-small", 1, map[string]string{GitSourceParam: mirror})
+	require.NoError(t, err)
+	err = vm.PopulateVolume(context.Background(), "too-small")
+	assert.True(t, errors.Is(err, ErrTooLarge), "got %v", err)
+}
+
+// writeBlob stores data in the OCI layout and returns its descriptor
+func writeBlob(t *testing.T, layout, mediaType string, data []byte) ociDescriptor {
+	digest := digestOf(data)
+	require.NoError(t, os.MkdirAll(filepath.Join(layout, "blobs", "sha256"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(layout, "blobs", "sha256", digest), data, 0644))
+	return ociDescriptor{MediaType: mediaType, Digest: "sha256:" + digest, Size: int64(len(data))}
+}
+
+func writeManifest(t *testing.T, layout string, layers ...ociDescriptor) ociDescriptor {
+	const mediaType = "application/vnd.oci.image.manifest.v1+json"
+	data, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     mediaType,
+		"config":        writeBlob(t, layout, "application/vnd.oci.image.config.v1+json", []byte("{}")),
+		"layers":        layers,
+	})
+	require.NoError(t, err)
+	return writeBlob(t, layout, mediaType, data)
+}
+
+func TestPopulateFromOCILayout(t *testing.T) {
+	localDir := t.TempDir()
+	layout := filepath.Join(localDir, "layout")
+	require.NoError(t, os.MkdirAll(layout, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(layout, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644))
+
+	base := writeBlob(t, layout, "application/vnd.oci.image.layer.v1.tar+gzip", gzipped(t, makeTar(t,
+		entry{name: "bin/", typ: tar.TypeDir},
+		entry{name: "bin/tool", body: "v1"},
+		entry{name: "share/", typ: tar.TypeDir},
+		entry{name: "share/old", body: "old"},
+		entry{name: "share/keep", body: "keep"},
+		entry{name: "etc/", typ: tar.TypeDir},
+		entry{name: "etc/conf", body: "conf"},
+	)))
+	update := writeBlob(t, layout, "application/vnd.oci.image.layer.v1.tar", makeTar(t,
+		entry{name: "bin/tool", body: "v2"},
+		entry{name: "share/.wh.old"},
+		entry{name: "etc/.wh..wh..opq"},
+		entry{name: "etc/new", body: "new"},
+	))
+	image := writeManifest(t, layout, base, update)
+	image.Annotations = map[string]string{refNameAnnotation: "1.0"}
+
+	model := writeBlob(t, layout, "application/vnd.example.model", []byte("weights"))
+	model.Annotations = map[string]string{titleAnnotation: "model.bin"}
+	artifact := writeManifest(t, layout, model)
+	artifact.Annotations = map[string]string{refNameAnnotation: "model"}
+
+	corrupt := writeBlob(t, layout, "application/vnd.oci.image.layer.v1.tar", makeTar(t, entry{name: "x", body: "x"}))
+	broken := writeManifest(t, layout, corrupt)
+	broken.Annotations = map[string]string{refNameAnnotation: "broken"}
+	hexDigest, _ := parseDigest(corrupt.Digest)
+	require.NoError(t, os.WriteFile(filepath.Join(layout, "blobs", "sha256", hexDigest), makeTar(t, entry{name: "x", body: "y"}), 0644))
+
+	index, err := json.Marshal(ociIndex{Manifests: []ociDescriptor{image, artifact, broken}})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(layout, "index.json"), index, 0644))
+
+	baseDir := t.TempDir()
+	vm, err := volume.NewVolumeManager(baseDir)
+	require.NoError(t, err)
+	seeder, err := NewSeeder(Config{BaseDir: baseDir, LocalDir: localDir})
+	require.NoError(t, err)
+	vm.SetPopulator(seeder)
+
+	populate := func(id, ref string) error {
+		_, err := vm.EnsureVolume(id, 1<<20, map[string]string{OCILayoutParam: layout, OCIRefParam: ref})
+		require.NoError(t, err)
+		return vm.PopulateVolume(context.Background(), id)
+	}
+	read := func(id, name string) string {
+		data, err := os.ReadFile(filepath.Join(baseDir, id, name))
+		require.NoError(t, err, name)
+		return string(data)
+	}
+
+	for _, ref := range []string{"1.0", image.Digest} {
+		id := "image-" + ref[:3]
+		require.NoError(t, populate(id, ref), ref)
+		assert.Equal(t, "v2", read(id, "bin/tool"))
+		assert.Equal(t, "keep", read(id, "share/keep"))
+		assert.NoFileExists(t, filepath.Join(baseDir, id, "share", "old"))
+		assert.NoFileExists(t, filepath.Join(baseDir, id, "share", ".wh.old"))
+		assert.NoFileExists(t, filepath.Join(baseDir, id, "etc", "conf"))
+		assert.Equal(t, "new", read(id, "etc/new"))
+
+		vol, err := vm.GetVolume(id)
+		require.NoError(t, err)
+		assert.Equal(t, image.Digest, vol.Revision)
+	}
+
+	require.NoError(t, populate("artifact", "model"))
+	assert.Equal(t, "weights", read("artifact", "model.bin"))
+
+	err = populate("broken", "broken")
+	assert.True(t, errors.Is(err, ErrChecksumMismatch), "got %v", err)
+	entries, err := os.ReadDir(filepath.Join(baseDir, "broken"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	err = populate("missing", "2.0")
+	assert.True(t, errors.Is(err, ErrFetch), "got %v", err)
+
+	err = populate("ambiguous", "")
+	assert.True(t, errors.Is(err, ErrInvalidSource), "got %v", err)
+}
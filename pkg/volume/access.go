@@ -0,0 +1,112 @@
+package volume
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// ErrVolumeInUse is returned when publishing a volume for a single writer
+// while it is published elsewhere, or publishing a single writer volume at
+// another target
+var ErrVolumeInUse = errors.New("volume is in use at another target")
+
+// AddTarget records that a volume is being published at target. A single
+// writer volume, the ReadWriteOncePod access mode, may only be published at
+// one target at a time. Adding a target that is already recorded succeeds.
+// podUID is the pod the target belongs to, empty if unknown.
+func (m *VolumeManager) AddTarget(volumeID, target, podUID string, singleWriter bool) error {
+	_, err := m.ReserveTarget(volumeID, target, podUID, singleWriter)
+	return err
+}
+
+// ReserveTarget is AddTarget, and reports whether target was added rather
+// than recorded already. A publish that fails after adding the target
+// releases it again with RemoveTarget.
+func (m *VolumeManager) ReserveTarget(volumeID, target, podUID string, singleWriter bool) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	volume, exists := m.volumes[volumeID]
+	if !exists {
+		return false, fmt.Errorf("volume %s: %w", volumeID, ErrVolumeNotFound)
+	}
+	if slices.Contains(volume.Targets, target) {
+		return false, nil
+	}
+	if len(volume.Targets) > 0 && (singleWriter || volume.SingleWriter) {
+		return false, fmt.Errorf("%w: volume %s is already published at %s", ErrVolumeInUse, volumeID, volume.Targets[0])
+	}
+
+	volume.Targets = append(volume.Targets, target)
+	volume.SingleWriter = singleWriter
+	if podUID != "" {
+		if volume.TargetPods == nil {
+			volume.TargetPods = make(map[string]string)
+		}
+		volume.TargetPods[target] = podUID
+	}
+	return true, m.saveVolume(volume)
+}
+
+// RemoveTarget records that a volume is no longer published at target
+func (m *VolumeManager) RemoveTarget(volumeID, target string) error {
+	return m.UpdateVolume(volumeID, func(v *Volume) {
+		v.removeTarget(target)
+	})
+}
+
+// PublishedVolumeID returns the ID of the volume published at target. That
+// is volumeID itself, unless the publish was mapped onto a shared volume.
+func (m *VolumeManager) PublishedVolumeID(volumeID, target string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.volumes[volumeID]; exists {
+		return volumeID
+	}
+	for id, volume := range m.volumes {
+		if slices.Contains(volume.Targets, target) {
+			return id
+		}
+	}
+	return volumeID
+}
+
+// PodUIDs returns the sorted UIDs of the pods the volume is published for
+func (v *Volume) PodUIDs() []string {
+	var uids []string
+	for _, uid := range v.TargetPods {
+		if !slices.Contains(uids, uid) {
+			uids = append(uids, uid)
+		}
+	}
+	slices.Sort(uids)
+	return uids
+}
+
+// removeTarget forgets target. The mount point moves to a target that is
+// still published, so it is only cleared by the last unpublish.
+func (v *Volume) removeTarget(target string) {
+	v.Targets = slices.DeleteFunc(v.Targets, func(t string) bool { return t == target })
+	delete(v.TargetPods, target)
+	if len(v.TargetPods) == 0 {
+		v.TargetPods = nil
+	}
+	delete(v.IOCgroups, target)
+	if len(v.IOCgroups) == 0 {
+		v.IOCgroups = nil
+		v.IODevice = ""
+	}
+	if v.MountPoint == target {
+		v.MountPoint = ""
+		if len(v.Targets) > 0 {
+			v.MountPoint = v.Targets[len(v.Targets)-1]
+		}
+	}
+	if len(v.Targets) == 0 {
+		v.Targets = nil
+		v.SingleWriter = false
+		v.SubPath = ""
+	}
+}
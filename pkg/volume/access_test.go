@@ -0,0 +1,37 @@
+package volume
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTargets(t *testing.T) {
+	baseDir := t.TempDir()
+	m, err := NewVolumeManager(baseDir)
+	require.NoError(t, err)
+	vol, err := m.EnsureVolume("vol-1", 0, nil)
+	require.NoError(t, err)
+
+	// Several writers may share a volume
+	require.NoError(t, m.AddTarget(vol.ID, "/a", "", false))
+	require.NoError(t, m.AddTarget(vol.ID, "/b", "", false))
+	assert.ErrorIs(t, m.AddTarget(vol.ID, "/c", "", true), ErrVolumeInUse)
+
+	// A single writer has it to itself, which survives a restart
+	require.NoError(t, m.RemoveTarget(vol.ID, "/a"))
+	require.NoError(t, m.RemoveTarget(vol.ID, "/b"))
+	require.NoError(t, m.AddTarget(vol.ID, "/c", "", true))
+	require.NoError(t, m.AddTarget(vol.ID, "/c", "", true))
+	m, err = NewVolumeManager(baseDir)
+	require.NoError(t, err)
+	assert.ErrorIs(t, m.AddTarget(vol.ID, "/d", "", false), ErrVolumeInUse)
+
+	require.NoError(t, m.RemoveTarget(vol.ID, "/c"))
+	vol, err = m.GetVolume(vol.ID)
+	require.NoError(t, err)
+	assert.Empty(t, vol.Targets)
+	assert.False(t, vol.SingleWriter)
+	require.NoError(t, m.AddTarget(vol.ID, "/d", "", false))
+}
@@ -0,0 +1,136 @@
+package volume
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrBackendUnavailable is returned for volumes whose backend is not
+// registered on this node
+var ErrBackendUnavailable = errors.New("volume backend is not available")
+
+// Backend provides the storage behind the directory of a volume. Volumes
+// without a backend are plain directories below the base directory.
+type Backend interface {
+	// Setup makes the volume directory usable, e.g. by mounting a
+	// filesystem on it. It is called before a volume is populated or
+	// published, must be idempotent, and is needed again after the node
+	// restarted.
+	Setup(volume *Volume) error
+	// Teardown releases what Setup set up and removes the state of the
+	// backend. The volume directory itself is removed by the caller, as
+	// are the DataPaths of volumes that are wiped.
+	Teardown(volume *Volume) error
+}
+
+// Releaser is implemented by backends that hold resources of the node while
+// a volume is set up, such as mounts, loop devices or unlocked dm-crypt
+// devices, which are released while the volume is not staged
+type Releaser interface {
+	// Release undoes Setup but keeps the data of the volume, which the
+	// next Setup makes usable again
+	Release(volume *Volume) error
+}
+
+// Allocator is implemented by backends that give each volume storage of
+// its own of the size of the volume, such as an image file
+type Allocator interface {
+	// AllocatesSize reports whether a volume takes its full size from its
+	// pool rather than the space its data uses
+	AllocatesSize() bool
+}
+
+// RegisterBackend makes a backend available to volumes under name
+func (m *VolumeManager) RegisterBackend(name string, backend Backend) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.backends[name] = backend
+}
+
+// SetupVolume prepares the storage of the volume for use
+func (m *VolumeManager) SetupVolume(volumeID string) error {
+	return m.setupVolume(volumeID, false)
+}
+
+// setupVolume sets up a volume, one that is being deleted only if deleting
+// is set, to archive it
+func (m *VolumeManager) setupVolume(volumeID string, deleting bool) error {
+	m.setupMu.Lock()
+	defer m.setupMu.Unlock()
+
+	volume, err := m.GetVolume(volumeID)
+	if err != nil {
+		return err
+	}
+	if volume.Deleting && !deleting {
+		return fmt.Errorf("volume %s: %w", volumeID, ErrVolumeDeleting)
+	}
+	backend, err := m.backendFor(volume)
+	if backend == nil || err != nil {
+		return err
+	}
+
+	return backend.Setup(volume)
+}
+
+// releaseVolume releases what the backend of a volume set up, if it holds
+// anything
+func (m *VolumeManager) releaseVolume(volumeID string) error {
+	m.setupMu.Lock()
+	defer m.setupMu.Unlock()
+
+	volume, err := m.GetVolume(volumeID)
+	if err != nil {
+		return err
+	}
+	backend, err := m.backendFor(volume)
+	if err != nil {
+		return err
+	}
+	releaser, ok := backend.(Releaser)
+	if !ok {
+		return nil
+	}
+	return releaser.Release(volume)
+}
+
+// backendFor returns the backend of the volume, nil for plain directories
+func (m *VolumeManager) backendFor(volume *Volume) (Backend, error) {
+	if volume.Backend == "" {
+		return nil, nil
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	backend, ok := m.backends[volume.Backend]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrBackendUnavailable, volume.Backend)
+	}
+	return backend, nil
+}
+
+// allocatesLocked reports whether volumes of the named backend take their
+// full size from their pool
+func (m *VolumeManager) allocatesLocked(name string) bool {
+	allocator, ok := m.backends[name].(Allocator)
+	return ok && allocator.AllocatesSize()
+}
+
+// poolBackend picks the backend for a new volume in pool, the one chosen by
+// its attributes or else the default of the pool
+func poolBackend(attributes map[string]string, pool Pool) string {
+	if backend := backendName(attributes); backend != "" {
+		return backend
+	}
+	return pool.Backend
+}
+
+// backendName picks the backend for a new volume from its attributes
+func backendName(attributes map[string]string) string {
+	if attributes[BaseDirParam] != "" || attributes[BaseLayerParam] != "" {
+		return OverlayBackendName
+	}
+	return ""
+}
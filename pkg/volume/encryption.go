@@ -0,0 +1,141 @@
+package volume
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// EncryptedParam opts an image-backed volume into encryption at rest
+	EncryptedParam = "encrypted"
+
+	// dataKeySize is the size of the random data key of a volume, for
+	// aes-xts-plain64 with 256-bit AES
+	dataKeySize = 64
+
+	// kmsTimeout bounds calls to the key manager
+	kmsTimeout = 30 * time.Second
+)
+
+// ErrEncryptionUnavailable is returned for encrypted volumes on nodes
+// without a key manager
+var ErrEncryptionUnavailable = errors.New("encryption is not configured on this node")
+
+// ErrEncryptionUnsupported is returned for encrypted volumes that are plain
+// directories, which have no image to encrypt
+var ErrEncryptionUnsupported = errors.New("encryption requires an image-backed volume")
+
+// KeyManager protects the data keys of encrypted volumes. Data keys are
+// only stored wrapped, next to the volume.
+type KeyManager interface {
+	// WrapKey encrypts the data key of a volume
+	WrapKey(ctx context.Context, volumeID string, key []byte) ([]byte, error)
+	// UnwrapKey decrypts a key returned by WrapKey for the same volume
+	UnwrapKey(ctx context.Context, volumeID string, wrapped []byte) ([]byte, error)
+	// DestroyKey forgets anything kept about the key of a deleted volume
+	DestroyKey(ctx context.Context, volumeID string) error
+}
+
+// IsEncrypted reports whether the attributes ask for encryption at rest
+func IsEncrypted(attributes map[string]string) bool {
+	return attributes[EncryptedParam] == "true"
+}
+
+// ValidateEncryptionAttributes checks the encryption attribute of a volume.
+// Whether the volume is image-backed also depends on its pool, which is
+// checked once the volume is placed.
+func ValidateEncryptionAttributes(attributes map[string]string) error {
+	switch attributes[EncryptedParam] {
+	case "", "false", "true":
+		return nil
+	default:
+		return fmt.Errorf("invalid %s value %q, must be true or false", EncryptedParam, attributes[EncryptedParam])
+	}
+}
+
+// cryptDevice manages dm-crypt devices on top of image files
+type cryptDevice interface {
+	// Format initializes a LUKS header on image that key unlocks
+	Format(image string, key []byte) error
+	// Open unlocks image as the device /dev/mapper/<name> and returns its path
+	Open(image, name string, key []byte) (string, error)
+	// IsOpen reports whether the device name is unlocked
+	IsOpen(name string) bool
+	// Close locks the device name again
+	Close(name string) error
+	// Erase wipes the keyslots of image, which makes its data unrecoverable
+	Erase(image string) error
+}
+
+// cryptsetup manages LUKS2 devices with the cryptsetup command
+type cryptsetup struct{}
+
+func (cryptsetup) Format(image string, key []byte) error {
+	// The key is random, so key stretching would only slow down setup
+	return runCryptsetup(key, "luksFormat", "--type", "luks2", "--batch-mode",
+		"--pbkdf", "pbkdf2", "--pbkdf-force-iterations", "1000", "--key-file", "-", image)
+}
+
+func (cryptsetup) Open(image, name string, key []byte) (string, error) {
+	if err := runCryptsetup(key, "open", "--type", "luks2", "--key-file", "-", image, name); err != nil {
+		return "", err
+	}
+	return mapperPath(name), nil
+}
+
+func (cryptsetup) IsOpen(name string) bool {
+	_, err := os.Stat(mapperPath(name))
+	return err == nil
+}
+
+func (cryptsetup) Close(name string) error {
+	return runCryptsetup(nil, "close", name)
+}
+
+func (cryptsetup) Erase(image string) error {
+	return runCryptsetup(nil, "erase", "--batch-mode", image)
+}
+
+func mapperPath(name string) string {
+	return filepath.Join("/dev/mapper", name)
+}
+
+func runCryptsetup(key []byte, args ...string) error {
+	cmd := exec.Command("cryptsetup", args...)
+	cmd.Stdin = bytes.NewReader(key)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cryptsetup %s failed: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// newDataKey returns a random data key
+func newDataKey() ([]byte, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %v", err)
+	}
+	return key, nil
+}
+
+// writeFileAtomic writes data to path through a temporary file, so path
+// either holds all of data or does not exist
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
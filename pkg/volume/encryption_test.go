@@ -0,0 +1,163 @@
+package volume
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeKeys wraps keys by prefixing the volume ID
+type fakeKeys struct {
+	destroyed []string
+}
+
+func (k *fakeKeys) WrapKey(ctx context.Context, volumeID string, key []byte) ([]byte, error) {
+	return append([]byte(volumeID+":"), key...), nil
+}
+
+func (k *fakeKeys) UnwrapKey(ctx context.Context, volumeID string, wrapped []byte) ([]byte, error) {
+	key, ok := bytes.CutPrefix(wrapped, []byte(volumeID+":"))
+	if !ok {
+		return nil, fmt.Errorf("key of another volume")
+	}
+	return key, nil
+}
+
+func (k *fakeKeys) DestroyKey(ctx context.Context, volumeID string) error {
+	k.destroyed = append(k.destroyed, volumeID)
+	return nil
+}
+
+// fakeCrypt records the keys images are formatted with
+type fakeCrypt struct {
+	keys   map[string][]byte
+	open   map[string]bool
+	erased []string
+}
+
+func (c *fakeCrypt) Format(image string, key []byte) error {
+	c.keys[filepath.Base(image)] = key
+	return nil
+}
+
+func (c *fakeCrypt) Open(image, name string, key []byte) (string, error) {
+	// Formatting happens on the temporary image
+	want := c.keys[filepath.Base(image)]
+	if want == nil {
+		want = c.keys[filepath.Base(image)+".tmp"]
+	}
+	if !bytes.Equal(want, key) {
+		return "", fmt.Errorf("wrong key for %s", image)
+	}
+	c.open[name] = true
+	return mapperPath(name), nil
+}
+
+func (c *fakeCrypt) IsOpen(name string) bool { return c.open[name] }
+
+func (c *fakeCrypt) Close(name string) error {
+	delete(c.open, name)
+	return nil
+}
+
+func (c *fakeCrypt) Erase(image string) error {
+	c.erased = append(c.erased, image)
+	return nil
+}
+
+func TestEncryptedOverlayVolume(t *testing.T) {
+	m, mounter, layersDir := newOverlayManager(t)
+	keys := &fakeKeys{}
+	crypt := &fakeCrypt{keys: make(map[string][]byte), open: make(map[string]bool)}
+	backend := NewOverlayBackend(mounter, layersDir, keys).(*overlayBackend)
+	backend.crypt = crypt
+	var formatted []string
+	backend.mkfs = func(device string) error {
+		formatted = append(formatted, device)
+		return nil
+	}
+	m.RegisterBackend(OverlayBackendName, backend)
+
+	vol, err := m.EnsureVolume("vol-1", 64<<20, map[string]string{BaseLayerParam: "dataset", EncryptedParam: "true"})
+	require.NoError(t, err)
+	require.NoError(t, m.SetupVolume(vol.ID))
+
+	// The filesystem is created on the unlocked device and the data key is
+	// only stored wrapped
+	state := filepath.Join(m.BaseDir(), overlayDirName, vol.ID)
+	device := mapperPath("ephemeral-csi-vol-1")
+	assert.Equal(t, []string{device}, formatted)
+	assert.Equal(t, []string{"ext4"}, mounter.MountOptions(filepath.Join(state, "fs")))
+	wrapped, err := os.ReadFile(filepath.Join(state, "key.wrapped"))
+	require.NoError(t, err)
+	assert.Equal(t, append([]byte("vol-1:"), crypt.keys["upper.img.tmp"]...), wrapped)
+	assert.Len(t, crypt.keys["upper.img.tmp"], dataKeySize)
+
+	// After a restart the image is unlocked with the unwrapped key
+	require.NoError(t, mounter.Unmount(vol.Path, 0))
+	require.NoError(t, mounter.Unmount(filepath.Join(state, "fs"), 0))
+	require.NoError(t, crypt.Close("ephemeral-csi-vol-1"))
+	crypt.keys["upper.img"] = crypt.keys["upper.img.tmp"]
+	require.NoError(t, m.SetupVolume(vol.ID))
+	assert.True(t, crypt.IsOpen("ephemeral-csi-vol-1"))
+
+	// Releasing the volume, e.g. when it is unstaged, locks the device but
+	// keeps the keys
+	require.NoError(t, m.releaseVolume(vol.ID))
+	assert.False(t, crypt.IsOpen("ephemeral-csi-vol-1"))
+	assert.Empty(t, mounter.Mounts())
+	assert.FileExists(t, filepath.Join(state, "key.wrapped"))
+	require.NoError(t, m.SetupVolume(vol.ID))
+	assert.True(t, crypt.IsOpen("ephemeral-csi-vol-1"))
+
+	// Deleting destroys the keys
+	require.NoError(t, m.DeleteVolume(context.Background(), vol.ID))
+	assert.False(t, crypt.IsOpen("ephemeral-csi-vol-1"))
+	assert.Equal(t, []string{filepath.Join(state, "upper.img")}, crypt.erased)
+	assert.Equal(t, []string{"vol-1"}, keys.destroyed)
+	assert.NoDirExists(t, state)
+}
+
+func TestEncryptionUnavailable(t *testing.T) {
+	m, _, _ := newOverlayManager(t)
+
+	vol, err := m.EnsureVolume("vol-1", 0, map[string]string{BaseLayerParam: "dataset", EncryptedParam: "true"})
+	require.NoError(t, err)
+	assert.ErrorIs(t, m.SetupVolume(vol.ID), ErrEncryptionUnavailable)
+
+	assert.Error(t, ValidateEncryptionAttributes(map[string]string{EncryptedParam: "yes"}))
+	assert.NoError(t, ValidateEncryptionAttributes(map[string]string{BaseLayerParam: "dataset", EncryptedParam: "true"}))
+
+	// Plain directories have no image to encrypt
+	_, err = m.EnsureVolume("vol-2", 0, map[string]string{EncryptedParam: "true"})
+	assert.ErrorIs(t, err, ErrEncryptionUnsupported)
+}
+
+func TestEncryptedPoolVolume(t *testing.T) {
+	m, mounter, layersDir := newOverlayManager(t)
+	backend := NewOverlayBackend(mounter, layersDir, &fakeKeys{}).(*overlayBackend)
+	backend.crypt = &fakeCrypt{keys: make(map[string][]byte), open: make(map[string]bool)}
+	backend.mkfs = func(string) error { return nil }
+	m.RegisterBackend(OverlayBackendName, backend)
+	require.NoError(t, m.SetPools(PoolConfig{
+		Pools: []Pool{{Name: "secure", Path: filepath.Join(t.TempDir(), "secure"), Backend: OverlayBackendName}},
+	}))
+
+	// The pool makes the volume image-backed, and it starts out empty
+	vol, err := m.EnsureVolume("vol-1", 64<<20, map[string]string{EncryptedParam: "true"})
+	require.NoError(t, err)
+	assert.Equal(t, OverlayBackendName, vol.Backend)
+	require.NoError(t, m.SetupVolume(vol.ID))
+
+	lower := filepath.Join(filepath.Dir(vol.Path), overlayDirName, vol.ID, "lower")
+	assert.Contains(t, mounter.MountOptions(vol.Path), "lowerdir="+lower)
+	entries, err := os.ReadDir(lower)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,180 @@
+package volume
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/template"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// FilesParamPrefix marks attributes holding a file to render into the
+	// volume at publish time: files.<path> is a text/template for the file at
+	// <path>, relative to the volume root
+	FilesParamPrefix = "files."
+
+	// maxRenderedFileSize bounds the size of a rendered file
+	maxRenderedFileSize = 1 << 20
+)
+
+// ErrInvalidTemplate is returned for unusable files.<path> attributes
+var ErrInvalidTemplate = errors.New("invalid file template")
+
+// TemplateData is what file templates are rendered with
+type TemplateData struct {
+	Pod      PodInfo
+	VolumeID string
+	// Attributes holds the volume context, including the StorageClass
+	// parameters or inline volume attributes
+	Attributes map[string]string
+}
+
+// ValidateFileAttributes checks the paths and templates of the files.<path>
+// attributes without rendering them
+func ValidateFileAttributes(attributes map[string]string) error {
+	for key, text := range attributes {
+		name, ok := strings.CutPrefix(key, FilesParamPrefix)
+		if !ok {
+			continue
+		}
+		if _, err := parseFileTemplate(name, text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RenderFiles renders the files.<path> attributes in volumeContext into the
+// volume directory. Files are rewritten on every publish, so they always
+// reflect the pod the volume is published for.
+func RenderFiles(volumeID, volumePath string, volumeContext map[string]string) error {
+	var names []string
+	for key := range volumeContext {
+		if name, ok := strings.CutPrefix(key, FilesParamPrefix); ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	data := TemplateData{
+		VolumeID:   volumeID,
+		Attributes: copyAttributes(volumeContext),
+	}
+	if pod := PodInfoFromContext(volumeContext); pod != nil {
+		data.Pod = *pod
+	}
+
+	for _, name := range names {
+		tmpl, err := parseFileTemplate(name, volumeContext[FilesParamPrefix+name])
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidTemplate, name, err)
+		}
+		if buf.Len() > maxRenderedFileSize {
+			return fmt.Errorf("%w: %s renders to more than %d bytes", ErrInvalidTemplate, name, maxRenderedFileSize)
+		}
+		if err := writeRenderedFile(volumePath, name, buf.Bytes()); err != nil {
+			return fmt.Errorf("failed to write %s: %v", name, err)
+		}
+	}
+	klog.V(4).Infof("Rendered %d files into volume %s", len(names), volumeID)
+
+	return nil
+}
+
+func parseFileTemplate(name, text string) (*template.Template, error) {
+	if !filepath.IsLocal(name) || filepath.Clean(name) != name {
+		return nil, fmt.Errorf("%w: %s%s must be a relative path within the volume", ErrInvalidTemplate, FilesParamPrefix, name)
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTemplate, err)
+	}
+	return tmpl, nil
+}
+
+// writeRenderedFile replaces the file at name below root. The volume may
+// be in use by a pod, which can swap any parent for a symlink pointing
+// outside the volume at any time. The path is therefore walked one
+// directory at a time without following symlinks, and the file is created
+// and renamed relative to the directory that was opened, never by path.
+func writeRenderedFile(root, name string, content []byte) error {
+	dirfd, err := syscall.Open(root, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer func() { syscall.Close(dirfd) }()
+
+	dir := root
+	for _, part := range strings.Split(filepath.Dir(name), string(filepath.Separator)) {
+		if part == "." {
+			break
+		}
+		dir = filepath.Join(dir, part)
+		fd, err := openDirAt(dirfd, part)
+		if err == syscall.ENOENT {
+			if err := syscall.Mkdirat(dirfd, part, defaultVolumePermissions); err != nil && err != syscall.EEXIST {
+				return &os.PathError{Op: "mkdir", Path: dir, Err: err}
+			}
+			fd, err = openDirAt(dirfd, part)
+		}
+		if err == syscall.ELOOP || err == syscall.ENOTDIR {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		if err != nil {
+			return &os.PathError{Op: "open", Path: dir, Err: err}
+		}
+		syscall.Close(dirfd)
+		dirfd = fd
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tmp := ".render-" + hex.EncodeToString(suffix)
+	fd, err := syscall.Openat(dirfd, tmp, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0644)
+	if err != nil {
+		return &os.PathError{Op: "create", Path: filepath.Join(dir, tmp), Err: err}
+	}
+	file := os.NewFile(uintptr(fd), filepath.Join(dir, tmp))
+	_, err = file.Write(content)
+	if err == nil {
+		// The mode passed to openat is subject to the umask
+		err = file.Chmod(0644)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	// Renaming replaces a symlink at the target instead of following it
+	if err == nil {
+		if err = syscall.Renameat(dirfd, tmp, dirfd, filepath.Base(name)); err != nil {
+			err = &os.PathError{Op: "rename", Path: filepath.Join(root, name), Err: err}
+		}
+	}
+	if err != nil {
+		syscall.Unlinkat(dirfd, tmp)
+	}
+	return err
+}
+
+// openDirAt opens the directory name in dirfd, failing with ELOOP if it is
+// a symlink
+func openDirAt(dirfd int, name string) (int, error) {
+	return syscall.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+}
@@ -0,0 +1,233 @@
+package volume
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// GCOptions configures garbage collection
+type GCOptions struct {
+	// IdleTTL is how long an unpublished volume may go without being
+	// accessed before it is deleted, zero to keep idle volumes
+	IdleTTL time.Duration
+	// DryRun only reports what garbage collection would do
+	DryRun bool
+}
+
+// GCReport summarizes a garbage collection run
+type GCReport struct {
+	// StaleMounts lists volume IDs with recorded targets that were no longer mounted
+	StaleMounts []string
+	// MissingVolumes lists volume IDs whose directory disappeared from disk
+	MissingVolumes []string
+	// IdleVolumes lists unpublished volumes that were deleted because they
+	// had not been accessed within the idle TTL
+	IdleVolumes []string
+	// DryRun is set if nothing was changed
+	DryRun bool
+	// Time is when the run started
+	Time time.Time
+}
+
+// SetGCOptions configures subsequent garbage collection runs
+func (m *VolumeManager) SetGCOptions(opts GCOptions) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.gcOptions = opts
+}
+
+// LastGCReport returns the report of the last garbage collection run, nil
+// if there was none yet
+func (m *VolumeManager) LastGCReport() *GCReport {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.lastGC
+}
+
+// TouchVolume records that the volume was accessed
+func (m *VolumeManager) TouchVolume(volumeID string) error {
+	return m.UpdateVolume(volumeID, func(volume *Volume) {
+		volume.LastAccess = time.Now().Unix()
+	})
+}
+
+// GarbageCollect reconciles the in-memory state with the node: mount points
+// that are no longer mounted are cleared and volumes whose directory has
+// disappeared are forgotten. Unpublished volumes idle for longer than the
+// idle TTL are deleted. With dryRun, or if the options ask for it, the run
+// only reports what it would do. mountPoints returns the set of mount
+// points on the node.
+func (m *VolumeManager) GarbageCollect(ctx context.Context, mountPoints func() (map[string]bool, error), dryRun bool) (*GCReport, error) {
+	// The mount table is read once, and not while holding the lock
+	mounted, err := m.mountedTargets(mountPoints)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	opts := m.gcOptions
+	dryRun = dryRun || opts.DryRun
+	report := &GCReport{DryRun: dryRun, Time: time.Now()}
+	idle, err := m.reconcileLocked(mounted, report, opts.IdleTTL)
+	m.mu.Unlock()
+	if err != nil {
+		return report, err
+	}
+
+	// Deleting may take a while, e.g. to archive the volume
+	for _, id := range idle {
+		if dryRun {
+			klog.Infof("GC (dry run): would delete volume %s, idle for more than %s", id, opts.IdleTTL)
+			report.IdleVolumes = append(report.IdleVolumes, id)
+			continue
+		}
+		// The volume may have been published in the meantime
+		if volume, err := m.GetVolume(id); err != nil || !isIdle(volume, report.Time, opts.IdleTTL) {
+			continue
+		}
+		if err := m.DeleteVolume(ctx, id); err != nil {
+			klog.Errorf("GC: failed to delete idle volume %s: %v", id, err)
+			continue
+		}
+		klog.Infof("GC: deleted volume %s, idle for more than %s", id, opts.IdleTTL)
+		report.IdleVolumes = append(report.IdleVolumes, id)
+	}
+
+	klog.Infof("GC: cleared %d stale mounts, forgot %d missing volumes, deleted %d idle volumes (dry run: %t)",
+		len(report.StaleMounts), len(report.MissingVolumes), len(report.IdleVolumes), dryRun)
+
+	m.mu.Lock()
+	m.lastGC = report
+	m.mu.Unlock()
+
+	return report, nil
+}
+
+// mountedTargets reports for the targets of all volumes whether they are
+// mounted
+func (m *VolumeManager) mountedTargets(mountPoints func() (map[string]bool, error)) (map[string]bool, error) {
+	m.mu.RLock()
+	var targets []string
+	for _, volume := range m.volumes {
+		targets = append(targets, volume.Targets...)
+	}
+	m.mu.RUnlock()
+
+	points, err := mountPoints()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount points: %v", err)
+	}
+
+	mounted := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		path, err := mountPath(target)
+		if err != nil {
+			return nil, err
+		}
+		mounted[target] = points[path]
+	}
+	return mounted, nil
+}
+
+// reconcileLocked fixes up the recorded state of the volumes and returns the
+// IDs of idle volumes. mounted is the result of mountedTargets.
+func (m *VolumeManager) reconcileLocked(mounted map[string]bool, report *GCReport, idleTTL time.Duration) ([]string, error) {
+	var idle []string
+	for _, id := range m.sortedIDsLocked() {
+		volume := m.volumes[id]
+
+		if _, err := os.Stat(volume.Path); os.IsNotExist(err) {
+			report.MissingVolumes = append(report.MissingVolumes, id)
+			if report.DryRun {
+				klog.Infof("GC (dry run): would forget volume %s whose directory %s is gone", id, volume.Path)
+				continue
+			}
+			if err := m.removeVolumeMetadata(id); err != nil {
+				return nil, err
+			}
+			delete(m.volumes, id)
+			m.unindexLocked(id)
+			klog.Infof("GC: forgot volume %s whose directory %s is gone", id, volume.Path)
+			continue
+		}
+
+		// Forget the targets that are no longer mounted, e.g. after a reboot
+		var stale []string
+		checked := true
+		for _, target := range volume.Targets {
+			isMounted, ok := mounted[target]
+			if !ok {
+				// Published after the mount table was read
+				checked = false
+				continue
+			}
+			if !isMounted {
+				stale = append(stale, target)
+			}
+		}
+		if len(stale) > 0 {
+			report.StaleMounts = append(report.StaleMounts, id)
+			if report.DryRun {
+				klog.Infof("GC (dry run): would clear stale mount points %v of volume %s", stale, id)
+				// Judge idleness as if the targets had been cleared
+				volume = volume.copy()
+			} else {
+				klog.Infof("GC: clearing stale mount points %v of volume %s", stale, id)
+			}
+			for _, target := range stale {
+				volume.removeTarget(target)
+			}
+			if !report.DryRun {
+				if err := m.saveVolume(volume); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if !checked {
+			continue
+		}
+
+		if _, populating := m.populating[id]; !populating && !volume.Deleting && isIdle(volume, report.Time, idleTTL) {
+			idle = append(idle, id)
+		}
+	}
+	return idle, nil
+}
+
+// isIdle reports whether volume is unpublished and unstaged and was last
+// accessed more than ttl before now. Volumes kept by their retention policy
+// are left to the retention janitor.
+func isIdle(volume *Volume, now time.Time, ttl time.Duration) bool {
+	if ttl <= 0 || len(volume.Targets) > 0 || volume.StagingPath != "" || volume.RetainUntil != 0 {
+		return false
+	}
+	lastUsed := volume.LastAccess
+	if volume.CreatedAt > lastUsed {
+		lastUsed = volume.CreatedAt
+	}
+	return now.Sub(time.Unix(lastUsed, 0)) > ttl
+}
+
+// RunGarbageCollector collects garbage every interval until ctx is done
+func (m *VolumeManager) RunGarbageCollector(ctx context.Context, interval time.Duration, mountPoints func() (map[string]bool, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := m.GarbageCollect(ctx, mountPoints, false); err != nil {
+			klog.Errorf("GC: %v", err)
+		}
+	}
+}
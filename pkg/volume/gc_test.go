@@ -0,0 +1,59 @@
+package volume
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGarbageCollectStaleTargets(t *testing.T) {
+	m, err := NewVolumeManager(t.TempDir())
+	require.NoError(t, err)
+	m.SetGCOptions(GCOptions{IdleTTL: time.Nanosecond})
+
+	shared, err := m.EnsureVolume("shared", 0, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.AddTarget(shared.ID, "/a", "uid-1", false))
+	require.NoError(t, m.AddTarget(shared.ID, "/b", "uid-2", false))
+	require.NoError(t, m.UpdateVolume(shared.ID, func(v *Volume) { v.MountPoint = "/b" }))
+	single, err := m.EnsureVolume("single", 0, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.AddTarget(single.ID, "/c", "", true))
+
+	// Only /a is still mounted, e.g. after the node rebooted
+	mountPoints := func() (map[string]bool, error) { return map[string]bool{"/a": true}, nil }
+	report, err := m.GarbageCollect(context.Background(), mountPoints, false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"shared", "single"}, report.StaleMounts)
+	assert.Equal(t, []string{"single"}, report.IdleVolumes, "a volume with a mounted target is not idle")
+
+	shared, err = m.GetVolume(shared.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/a"}, shared.Targets)
+	assert.Equal(t, "/a", shared.MountPoint)
+	assert.Equal(t, []string{"uid-1"}, shared.PodUIDs())
+}
+
+func TestGarbageCollectReadsMountsUnlocked(t *testing.T) {
+	m, err := NewVolumeManager(t.TempDir())
+	require.NoError(t, err)
+
+	volume, err := m.EnsureVolume("vol", 0, nil)
+	require.NoError(t, err)
+
+	// A target published while the mount table is read is not stale yet
+	mountPoints := func() (map[string]bool, error) {
+		require.NoError(t, m.AddTarget(volume.ID, "/a", "", false))
+		return map[string]bool{}, nil
+	}
+	report, err := m.GarbageCollect(context.Background(), mountPoints, false)
+	require.NoError(t, err)
+	assert.Empty(t, report.StaleMounts)
+
+	volume, err = m.GetVolume(volume.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/a"}, volume.Targets)
+}
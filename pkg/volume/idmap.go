@@ -0,0 +1,378 @@
+package volume
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// IDMapParam makes NodePublishVolume create an ID-mapped bind mount for
+	// pods in a user namespace. Its value is either IDMapAuto, or the
+	// mapping of the pod as comma separated container:host:size ranges,
+	// which apply to both user and group IDs.
+	IDMapParam = "idMap"
+	// IDMapAuto discovers the mapping of the user namespace of the pod
+	IDMapAuto = "auto"
+
+	// DefaultProcRoot is where the proc filesystem of the host is mounted
+	DefaultProcRoot = "/proc"
+)
+
+var (
+	// ErrIDMapUnsupported is returned when the kernel or the filesystem of
+	// a volume cannot create ID-mapped mounts
+	ErrIDMapUnsupported = errors.New("ID-mapped mounts are not supported")
+	// ErrUserNamespaceNotFound is returned when the user namespace of the
+	// pod a volume is published for cannot be found
+	ErrUserNamespaceNotFound = errors.New("pod user namespace not found")
+)
+
+// IDRange maps Size IDs starting at ContainerID in a user namespace to
+// those starting at HostID
+type IDRange struct {
+	ContainerID uint32 `json:"containerId"`
+	HostID      uint32 `json:"hostId"`
+	Size        uint32 `json:"length"`
+}
+
+// IDMapping is the user and group ID mapping of a user namespace
+type IDMapping struct {
+	UIDs []IDRange `json:"uidMappings"`
+	GIDs []IDRange `json:"gidMappings"`
+}
+
+func (m *IDMapping) String() string {
+	return "uids=" + formatIDRanges(m.UIDs) + " gids=" + formatIDRanges(m.GIDs)
+}
+
+// ValidateIDMapAttributes checks the ID mapping attribute of a volume
+func ValidateIDMapAttributes(attributes map[string]string) error {
+	value := attributes[IDMapParam]
+	if value == "" || value == IDMapAuto {
+		return nil
+	}
+	_, err := parseIDRanges(value)
+	return err
+}
+
+// parseIDRanges parses comma separated container:host:size ranges
+func parseIDRanges(value string) ([]IDRange, error) {
+	var ranges []IDRange
+	for _, field := range strings.Split(value, ",") {
+		parts := strings.Split(strings.TrimSpace(field), ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid %s range %q, must be container:host:size", IDMapParam, field)
+		}
+		var ids [3]uint32
+		for i, part := range parts {
+			id, err := strconv.ParseUint(part, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s range %q: %v", IDMapParam, field, err)
+			}
+			ids[i] = uint32(id)
+		}
+		if ids[2] == 0 {
+			return nil, fmt.Errorf("invalid %s range %q, the size must not be zero", IDMapParam, field)
+		}
+		ranges = append(ranges, IDRange{ContainerID: ids[0], HostID: ids[1], Size: ids[2]})
+	}
+	return ranges, nil
+}
+
+func formatIDRanges(ranges []IDRange) string {
+	fields := make([]string, len(ranges))
+	for i, r := range ranges {
+		fields[i] = fmt.Sprintf("%d:%d:%d", r.ContainerID, r.HostID, r.Size)
+	}
+	return strings.Join(fields, ",")
+}
+
+// SetProcRoot sets where the proc filesystem of the host is mounted, which
+// the user namespaces of pods are discovered in
+func (m *VolumeManager) SetProcRoot(root string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.procRoot = root
+}
+
+// PodIDMapping returns the ID mapping a volume published at targetPath is
+// mounted with, or nil if it is mounted as is. An automatic mapping is
+// read from a process of the pod, or before its sandbox runs, from the
+// mapping kubelet recorded in the pod directory the target is in.
+func (m *VolumeManager) PodIDMapping(volumeContext map[string]string, targetPath string) (*IDMapping, error) {
+	value := volumeContext[IDMapParam]
+	switch value {
+	case "":
+		return nil, nil
+	case IDMapAuto:
+	default:
+		ranges, err := parseIDRanges(value)
+		if err != nil {
+			return nil, err
+		}
+		return &IDMapping{UIDs: ranges, GIDs: ranges}, nil
+	}
+
+	uid := volumeContext[PodUIDKey]
+	if uid == "" {
+		return nil, fmt.Errorf("%w: the volume context has no pod UID, podInfoOnMount must be enabled", ErrUserNamespaceNotFound)
+	}
+	m.mu.RLock()
+	cgroupRoot, procRoot := m.cgroupRoot, m.procRoot
+	m.mu.RUnlock()
+
+	if cgroup, err := findPodCgroup(cgroupRoot, uid); err == nil {
+		mapping, err := processIDMapping(cgroup, procRoot)
+		if mapping != nil || err != nil {
+			return mapping, err
+		}
+	}
+	return kubeletIDMapping(targetPath, uid)
+}
+
+// processIDMapping returns the mapping of the first process below cgroup
+// that is in a user namespace of its own, nil if there is none. The PIDs in
+// cgroup.procs are those of the pid namespace of the driver, so procRoot
+// must be the proc filesystem of that namespace, which for the host /proc
+// takes a driver running with hostPID. A PID that names a process outside
+// the pod cgroup in procRoot is skipped.
+func processIDMapping(cgroup, procRoot string) (*IDMapping, error) {
+	hostNS, err := os.Readlink(filepath.Join(procRoot, "self", "ns", "user"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the user namespace of the driver: %v", err)
+	}
+
+	var mapping *IDMapping
+	err = filepath.WalkDir(cgroup, func(path string, d os.DirEntry, err error) error {
+		if err != nil || mapping != nil || d.IsDir() || d.Name() != "cgroup.procs" {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, pid := range strings.Fields(string(data)) {
+			proc := filepath.Join(procRoot, pid)
+			if !inPodCgroup(proc, filepath.Base(cgroup)) {
+				// Gone already, or a different process of another pid
+				// namespace than the PIDs are from
+				continue
+			}
+			ns, err := os.Readlink(filepath.Join(proc, "ns", "user"))
+			if err != nil || ns == hostNS {
+				// Gone already, or a host process such as the pause
+				// container of a pod with host users
+				continue
+			}
+			uids, err := readIDMap(filepath.Join(proc, "uid_map"))
+			if err != nil {
+				return err
+			}
+			gids, err := readIDMap(filepath.Join(proc, "gid_map"))
+			if err != nil {
+				return err
+			}
+			mapping = &IDMapping{UIDs: uids, GIDs: gids}
+			klog.V(4).Infof("Found the user namespace of pod cgroup %s in process %s", cgroup, pid)
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return mapping, err
+}
+
+// inPodCgroup reports whether the cgroup file of the process at proc names
+// the pod cgroup podCgroup, the last component of its path. The paths are
+// relative to the cgroup namespace of the reader, so only the component of
+// the pod is compared.
+func inPodCgroup(proc, podCgroup string) bool {
+	data, err := os.ReadFile(filepath.Join(proc, "cgroup"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// See cgroups(7): hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) == 3 && slices.Contains(strings.Split(fields[2], "/"), podCgroup) {
+			return true
+		}
+	}
+	return false
+}
+
+// readIDMap reads a uid_map or gid_map file of a process
+func readIDMap(path string) ([]IDRange, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ranges []IDRange
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid line %q in %s", line, path)
+		}
+		var ids [3]uint32
+		for i, field := range fields {
+			id, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid line %q in %s: %v", line, path, err)
+			}
+			ids[i] = uint32(id)
+		}
+		ranges = append(ranges, IDRange{ContainerID: ids[0], HostID: ids[1], Size: ids[2]})
+	}
+	return ranges, nil
+}
+
+// kubeletIDMapping reads the mapping kubelet allocated for a pod from the
+// userns file in the pod directory, which targets are below:
+// <kubelet>/pods/<uid>/volumes/kubernetes.io~csi/<name>/mount
+func kubeletIDMapping(targetPath, uid string) (*IDMapping, error) {
+	podDir := filepath.Dir(filepath.Dir(filepath.Dir(filepath.Dir(filepath.Clean(targetPath)))))
+	if filepath.Base(podDir) != uid || filepath.Base(filepath.Dir(podDir)) != "pods" {
+		return nil, fmt.Errorf("%w: target %s is not in the kubelet directory of pod %s", ErrUserNamespaceNotFound, targetPath, uid)
+	}
+
+	data, err := os.ReadFile(filepath.Join(podDir, "userns"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: pod %s has no process and kubelet recorded no mapping for it, is hostUsers false?", ErrUserNamespaceNotFound, uid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var mapping IDMapping
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("invalid user namespace record of pod %s: %v", uid, err)
+	}
+	if len(mapping.UIDs) == 0 || len(mapping.GIDs) == 0 {
+		return nil, fmt.Errorf("%w: kubelet recorded an empty mapping for pod %s", ErrUserNamespaceNotFound, uid)
+	}
+	return &mapping, nil
+}
+
+// Linux mount API values not in the syscall package
+const (
+	sysOpenTree     = 428
+	sysMoveMount    = 429
+	sysMountSetattr = 442
+
+	openTreeClone       = 0x1
+	atEmptyPath         = 0x1000
+	atRecursive         = 0x8000
+	moveMountFEmptyPath = 0x4
+	mountAttrIDMap      = 0x100000
+	atFDCWD             = -0x64
+	mountAttrSize       = 32
+)
+
+// mountAttr is struct mount_attr of mount_setattr(2)
+type mountAttr struct {
+	attrSet     uint64
+	attrClr     uint64
+	propagation uint64
+	usernsFD    uint64
+}
+
+// idMappedBindMount clones the tree at source, marks the clone ID-mapped
+// with a user namespace of the mapping, and attaches it at target
+func idMappedBindMount(source, target string, mapping *IDMapping) error {
+	userns, err := newUserNamespace(mapping)
+	if err != nil {
+		return fmt.Errorf("failed to create user namespace for %s: %w", mapping, err)
+	}
+	defer userns.Close()
+
+	tree, err := openTree(source)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(tree)
+
+	attr := mountAttr{attrSet: mountAttrIDMap, usernsFD: uint64(userns.Fd())}
+	_, _, errno := syscall.Syscall6(sysMountSetattr, uintptr(tree), uintptr(unsafe.Pointer(emptyPath)),
+		atEmptyPath|atRecursive, uintptr(unsafe.Pointer(&attr)), mountAttrSize, 0)
+	switch errno {
+	case 0:
+	case syscall.ENOSYS:
+		return fmt.Errorf("%w: the kernel lacks mount_setattr(2), Linux 5.12 or later is needed", ErrIDMapUnsupported)
+	case syscall.EINVAL:
+		return fmt.Errorf("%w: the filesystem of %s cannot be ID-mapped on this kernel", ErrIDMapUnsupported, source)
+	default:
+		return fmt.Errorf("failed to ID-map %s: %w", source, errno)
+	}
+
+	targetPtr, err := syscall.BytePtrFromString(target)
+	if err != nil {
+		return err
+	}
+	fdcwd := atFDCWD
+	_, _, errno = syscall.Syscall6(sysMoveMount, uintptr(tree), uintptr(unsafe.Pointer(emptyPath)),
+		uintptr(fdcwd), uintptr(unsafe.Pointer(targetPtr)), moveMountFEmptyPath, 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to attach ID-mapped mount at %s: %v", target, errno)
+	}
+	return nil
+}
+
+// emptyPath is the "" path of the *at syscalls operating on a descriptor
+var emptyPath = &[]byte{0}[0]
+
+// openTree returns a detached clone of the mount tree at path
+func openTree(path string) (int, error) {
+	pathPtr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+	fdcwd := atFDCWD
+	fd, _, errno := syscall.Syscall(sysOpenTree, uintptr(fdcwd), uintptr(unsafe.Pointer(pathPtr)),
+		openTreeClone|syscall.O_CLOEXEC|atRecursive)
+	if errno == syscall.ENOSYS {
+		return -1, fmt.Errorf("%w: the kernel lacks open_tree(2), Linux 5.12 or later is needed", ErrIDMapUnsupported)
+	}
+	if errno != 0 {
+		return -1, fmt.Errorf("failed to clone mount of %s: %w", path, errno)
+	}
+	return int(fd), nil
+}
+
+// newUserNamespace returns a handle on a new user namespace with mapping.
+// The namespace is created by a short-lived child process and stays alive
+// as long as the handle is open.
+func newUserNamespace(mapping *IDMapping) (*os.File, error) {
+	cmd := exec.Command("sleep", "infinity")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		UidMappings: sysProcIDMaps(mapping.UIDs),
+		GidMappings: sysProcIDMaps(mapping.GIDs),
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	return os.Open(filepath.Join("/proc", strconv.Itoa(cmd.Process.Pid), "ns", "user"))
+}
+
+func sysProcIDMaps(ranges []IDRange) []syscall.SysProcIDMap {
+	maps := make([]syscall.SysProcIDMap, len(ranges))
+	for i, r := range ranges {
+		maps[i] = syscall.SysProcIDMap{ContainerID: int(r.ContainerID), HostID: int(r.HostID), Size: int(r.Size)}
+	}
+	return maps
+}
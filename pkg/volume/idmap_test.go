@@ -0,0 +1,122 @@
+package volume
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testMapping = &IDMapping{
+	UIDs: []IDRange{{ContainerID: 0, HostID: 100000, Size: 65536}},
+	GIDs: []IDRange{{ContainerID: 0, HostID: 100000, Size: 65536}},
+}
+
+func TestValidateIDMapAttributes(t *testing.T) {
+	assert.NoError(t, ValidateIDMapAttributes(nil))
+	assert.NoError(t, ValidateIDMapAttributes(map[string]string{IDMapParam: "auto"}))
+	assert.NoError(t, ValidateIDMapAttributes(map[string]string{IDMapParam: "0:100000:1000,1000:200000:64536"}))
+	for _, value := range []string{"0:100000", "0:100000:0", "0:-1:10", "root:100000:10"} {
+		assert.Error(t, ValidateIDMapAttributes(map[string]string{IDMapParam: value}), value)
+	}
+}
+
+func TestPodIDMapping(t *testing.T) {
+	m, err := NewVolumeManager(t.TempDir())
+	require.NoError(t, err)
+	cgroupRoot, procRoot := t.TempDir(), t.TempDir()
+	m.SetCgroupRoot(cgroupRoot)
+	m.SetProcRoot(procRoot)
+
+	mapping, err := m.PodIDMapping(map[string]string{}, "/target")
+	require.NoError(t, err)
+	assert.Nil(t, mapping)
+
+	mapping, err = m.PodIDMapping(map[string]string{IDMapParam: "0:100000:65536"}, "/target")
+	require.NoError(t, err)
+	assert.Equal(t, testMapping, mapping)
+
+	// Before the pod runs, the mapping kubelet recorded for it is used
+	uid := "0b8e5b5c-58d6-4a3e-8a42-3b5a4a1ed8a1"
+	podDir := filepath.Join(t.TempDir(), "pods", uid)
+	target := filepath.Join(podDir, "volumes", "kubernetes.io~csi", "scratch", "mount")
+	volumeContext := map[string]string{IDMapParam: IDMapAuto, PodUIDKey: uid}
+	_, err = m.PodIDMapping(volumeContext, target)
+	assert.ErrorIs(t, err, ErrUserNamespaceNotFound)
+
+	require.NoError(t, os.MkdirAll(podDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(podDir, "userns"),
+		[]byte(`{"uidMappings":[{"hostId":100000,"containerId":0,"length":65536}],"gidMappings":[{"hostId":100000,"containerId":0,"length":65536}]}`), 0600))
+	mapping, err = m.PodIDMapping(volumeContext, target)
+	require.NoError(t, err)
+	assert.Equal(t, testMapping, mapping)
+
+	// Once it runs, the mapping of its processes is used, skipping those
+	// in the user namespace of the host
+	podCgroup := "/kubepods/besteffort/pod" + uid + "/container"
+	container := filepath.Join(cgroupRoot, podCgroup)
+	require.NoError(t, os.MkdirAll(container, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(container, "cgroup.procs"), []byte("41\n42\n43\n"), 0644))
+	for pid, ns := range map[string]string{"self": "user:[1]", "41": "user:[3]", "42": "user:[1]", "43": "user:[2]"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(procRoot, pid, "ns"), 0755))
+		require.NoError(t, os.Symlink(ns, filepath.Join(procRoot, pid, "ns", "user")))
+		require.NoError(t, os.WriteFile(filepath.Join(procRoot, pid, "cgroup"), []byte("0::"+podCgroup+"\n"), 0644))
+	}
+	for pid, hostID := range map[string]string{"41": "400000", "43": "200000"} {
+		require.NoError(t, os.WriteFile(filepath.Join(procRoot, pid, "uid_map"), []byte("         0     "+hostID+"      65536\n"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(procRoot, pid, "gid_map"), []byte("         0     300000      65536\n"), 0644))
+	}
+	// In the proc root, PID 41 is a process of another pod, as when the
+	// proc root is not of the pid namespace the PIDs are from
+	require.NoError(t, os.WriteFile(filepath.Join(procRoot, "41", "cgroup"), []byte("0::/kubepods/besteffort/podother/container\n"), 0644))
+	mapping, err = m.PodIDMapping(volumeContext, target)
+	require.NoError(t, err)
+	assert.Equal(t, &IDMapping{
+		UIDs: []IDRange{{ContainerID: 0, HostID: 200000, Size: 65536}},
+		GIDs: []IDRange{{ContainerID: 0, HostID: 300000, Size: 65536}},
+	}, mapping)
+}
+
+func TestNodePublishIDMappedVolume(t *testing.T) {
+	m, err := NewVolumeManager(t.TempDir())
+	require.NoError(t, err)
+	mounter := NewFakeMounter()
+	nodeMounter := NewNodeMounter(m, mounter)
+
+	vol, err := m.EnsureVolume("vol-1", 0, nil)
+	require.NoError(t, err)
+	target := filepath.Join(t.TempDir(), "target")
+	require.NoError(t, nodeMounter.NodePublishVolume(&csi.NodePublishVolumeRequest{
+		VolumeId:      vol.ID,
+		TargetPath:    target,
+		VolumeContext: map[string]string{IDMapParam: "0:100000:65536"},
+	}))
+	assert.Equal(t, vol.Path, mounter.Mounts()[target])
+	assert.Equal(t, []string{"bind", "uids=0:100000:65536 gids=0:100000:65536"}, mounter.MountOptions(target))
+}
+
+func TestIDMappedBindMount(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping test that requires root privileges")
+	}
+	source, target := t.TempDir(), t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(source, "file"), nil, 0644))
+
+	err := idMappedBindMount(source, target, testMapping)
+	if errors.Is(err, ErrIDMapUnsupported) || errors.Is(err, syscall.EPERM) {
+		t.Skipf("ID-mapped mounts are not available: %v", err)
+	}
+	require.NoError(t, err)
+	defer syscall.Unmount(target, 0)
+
+	// Files owned by root on disk appear owned by the host ID of root in
+	// the user namespace of the pod
+	info, err := os.Stat(filepath.Join(target, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(100000), info.Sys().(*syscall.Stat_t).Uid)
+}
@@ -0,0 +1,90 @@
+package volume
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// ErrInvalidToken is returned for a listing token that was not returned by
+// a previous listing
+var ErrInvalidToken = errors.New("invalid listing token")
+
+// ListVolumesPage returns snapshots of at most maxEntries volumes in ID
+// order, all of them if maxEntries is zero, starting at token, and the
+// token continuing the listing, empty after the last page. Tokens name the
+// ID a page starts at, so listings stay stable while volumes are created
+// and deleted in between: no volume is skipped or listed twice, unless it
+// is created or deleted during the listing.
+func (m *VolumeManager) ListVolumesPage(token string, maxEntries int) ([]*Volume, string, error) {
+	start, err := decodeToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	first, _ := slices.BinarySearch(m.ids, start)
+	last := len(m.ids)
+	if maxEntries > 0 {
+		last = min(last, first+maxEntries)
+	}
+
+	volumes := make([]*Volume, 0, last-first)
+	for _, id := range m.ids[first:last] {
+		volumes = append(volumes, m.volumes[id].copy())
+	}
+	var next string
+	if last < len(m.ids) {
+		next = encodeToken(m.ids[last])
+	}
+	return volumes, next, nil
+}
+
+// VolumeCondition reports whether the volume is usable, and why not
+func (m *VolumeManager) VolumeCondition(volume *Volume) (abnormal bool, message string) {
+	if _, err := m.backendFor(volume); err != nil {
+		return true, err.Error()
+	}
+	info, err := os.Stat(volume.Path)
+	switch {
+	case os.IsNotExist(err):
+		return true, fmt.Sprintf("volume directory %s is missing", volume.Path)
+	case err != nil:
+		return true, fmt.Sprintf("volume directory %s is not accessible: %v", volume.Path, err)
+	case !info.IsDir():
+		return true, fmt.Sprintf("volume path %s is not a directory", volume.Path)
+	}
+	return false, "volume is healthy"
+}
+
+func encodeToken(volumeID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(volumeID))
+}
+
+func decodeToken(token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	id, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || validateVolumeID(string(id)) != nil {
+		return "", fmt.Errorf("%w: %q", ErrInvalidToken, token)
+	}
+	return string(id), nil
+}
+
+// insertIDLocked adds a volume ID to the sorted IDs, unless it is there
+func (m *VolumeManager) insertIDLocked(volumeID string) {
+	if i, found := slices.BinarySearch(m.ids, volumeID); !found {
+		m.ids = slices.Insert(m.ids, i, volumeID)
+	}
+}
+
+func (m *VolumeManager) removeIDLocked(volumeID string) {
+	if i, found := slices.BinarySearch(m.ids, volumeID); found {
+		m.ids = slices.Delete(m.ids, i, i+1)
+	}
+}
@@ -0,0 +1,75 @@
+package volume
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListVolumesPage(t *testing.T) {
+	baseDir := t.TempDir()
+	m, err := NewVolumeManager(baseDir)
+	require.NoError(t, err)
+	for i := 5; i >= 1; i-- {
+		_, err := m.EnsureVolume(fmt.Sprintf("vol-%d", i), 0, nil)
+		require.NoError(t, err)
+	}
+
+	ids := func(volumes []*Volume) []string {
+		var ids []string
+		for _, volume := range volumes {
+			ids = append(ids, volume.ID)
+		}
+		return ids
+	}
+
+	page, next, err := m.ListVolumesPage("", 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vol-1", "vol-2"}, ids(page))
+	require.NotEmpty(t, next)
+
+	// Deleting the volume the next page starts at neither skips nor
+	// repeats volumes, and tokens survive a restart
+	require.NoError(t, m.DeleteVolume(context.Background(), "vol-3"))
+	m, err = NewVolumeManager(baseDir)
+	require.NoError(t, err)
+	page, next, err = m.ListVolumesPage(next, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vol-4", "vol-5"}, ids(page))
+	assert.Empty(t, next)
+
+	page, next, err = m.ListVolumesPage("", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vol-1", "vol-2", "vol-4", "vol-5"}, ids(page))
+	assert.Empty(t, next)
+	assert.Equal(t, ids(page), ids(m.ListVolumes()))
+
+	for _, token := range []string{"not a token!", encodeToken("../x"), encodeToken(".metadata")} {
+		_, _, err := m.ListVolumesPage(token, 1)
+		assert.ErrorIs(t, err, ErrInvalidToken, token)
+	}
+}
+
+func TestVolumeCondition(t *testing.T) {
+	m, err := NewVolumeManager(t.TempDir())
+	require.NoError(t, err)
+	vol, err := m.EnsureVolume("vol-1", 0, nil)
+	require.NoError(t, err)
+
+	abnormal, _ := m.VolumeCondition(vol)
+	assert.False(t, abnormal)
+
+	require.NoError(t, os.RemoveAll(vol.Path))
+	abnormal, message := m.VolumeCondition(vol)
+	assert.True(t, abnormal)
+	assert.Contains(t, message, "missing")
+
+	vol.Backend = "unknown"
+	abnormal, message = m.VolumeCondition(vol)
+	assert.True(t, abnormal)
+	assert.Contains(t, message, ErrBackendUnavailable.Error())
+}
@@ -1,10 +1,15 @@
 package volume
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"k8s.io/klog/v2"
@@ -15,24 +20,133 @@ const (
 	defaultVolumePermissions = 0755
 )
 
+// ErrVolumeNotFound is returned when a volume is not known to the manager
+var ErrVolumeNotFound = errors.New("volume not found")
+
+// ErrVolumeDeleting is returned when using a volume that is being deleted
+var ErrVolumeDeleting = errors.New("volume is being deleted")
+
+// ArchiveOnDeleteParam opts a volume into being archived before its data is removed
+const ArchiveOnDeleteParam = "archiveOnDelete"
+
 // VolumeManager handles the lifecycle of ephemeral volumes
 type VolumeManager struct {
-	baseDir string
-	mu      sync.RWMutex
-	volumes map[string]*Volume
+	baseDir  string
+	mu       sync.RWMutex
+	volumes  map[string]*Volume
+	archiver Archiver
+
+	populator  Populator
+	populating map[string]*populateOp
+
+	backends map[string]Backend
+	// setupMu serializes setting up volume backends
+	setupMu sync.Mutex
+	// deletions has a value when volumes were marked for deletion in the
+	// background, and removing holds the IDs of the volumes being torn down
+	deletions chan struct{}
+	removing  map[string]struct{}
+
+	// ids are the IDs of all volumes in sort order, which volumes are
+	// listed in
+	ids []string
+
+	// byNamespace indexes volume IDs by the namespace they are accounted
+	// to, and owners records what each volume is indexed by
+	byNamespace map[string]map[string]struct{}
+	owners      map[string]volumeOwner
+
+	// trash holds deleted volumes until the reaper removed them
+	trash *trash
+	// warm is the pool of pre-created volumes, nil if disabled
+	warm *warmPool
+
+	gcOptions GCOptions
+	lastGC    *GCReport
+
+	// quotas limits the volumes of each namespace, nil if unlimited
+	quotas *QuotaPolicy
+
+	// pools are the directories volumes are created in
+	pools *pools
+	// freeSpace returns the free space of the filesystem of a path
+	freeSpace func(path string) (int64, error)
+
+	// cgroupRoot is where the cgroup v2 hierarchy I/O limits are applied
+	// in is mounted
+	cgroupRoot string
+
+	// procRoot is where the user namespaces of pods are discovered in
+	procRoot string
+
+	// setFileLabel sets the SELinux label of a file
+	setFileLabel func(path, label string) error
+}
+
+// Archiver preserves the contents of a volume before it is deleted
+type Archiver interface {
+	Archive(ctx context.Context, volume *Volume) error
 }
 
 // Volume represents an ephemeral volume
 type Volume struct {
-	ID         string
-	Path       string
-	Size       int64
-	PodID      string
-	Retention  string
-	MountPoint string
-	SubPath    string
-	Usage      int64
-	LastAccess int64
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// PodID is the legacy podID StorageClass parameter, see Pod instead
+	PodID      string            `json:"podID,omitempty"`
+	Retention  string            `json:"retention,omitempty"`
+	MountPoint string            `json:"mountPoint,omitempty"`
+	SubPath    string            `json:"subPath,omitempty"`
+	Usage      int64             `json:"usage"`
+	LastAccess int64             `json:"lastAccess,omitempty"`
+	CreatedAt  int64             `json:"createdAt"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Ephemeral is set for inline volumes created by NodePublishVolume,
+	// whose lifecycle ends when they are unpublished
+	Ephemeral bool `json:"ephemeral,omitempty"`
+	// RetainUntil is the unix time after which a released volume that is
+	// kept by its retention policy gets deleted, zero while in use
+	RetainUntil int64 `json:"retainUntil,omitempty"`
+	// Populated is set once the initial content requested by the volume
+	// attributes has been put in place
+	Populated bool `json:"populated,omitempty"`
+	// Revision identifies the content the volume was populated with, e.g.
+	// the commit of a git checkout
+	Revision string `json:"revision,omitempty"`
+	// Backend names the backend providing the volume directory, empty for
+	// plain directories
+	Backend string `json:"backend,omitempty"`
+	// Pod is the pod the volume was last published for
+	Pod *PodInfo `json:"pod,omitempty"`
+	// Pool is the storage pool the volume was created in
+	Pool string `json:"pool,omitempty"`
+	// IOCgroups maps the targets of throttled pods to the pod cgroup the
+	// I/O limits of the volume are applied in, and IODevice is the
+	// major:minor number of the limited device
+	IOCgroups map[string]string `json:"ioCgroups,omitempty"`
+	IODevice  string            `json:"ioDevice,omitempty"`
+	// IOCgroup is the cgroup recorded for the last target before cgroups
+	// were recorded by target, it is moved to IOCgroups when loaded
+	IOCgroup string `json:"ioCgroup,omitempty"`
+	// SELinuxLabel is the SELinux context the volume was labeled with for
+	// the pod it is published for
+	SELinuxLabel string `json:"seLinuxLabel,omitempty"`
+	// Targets are all paths the volume is currently published at, and
+	// SingleWriter is set while it is published for a single writer
+	Targets      []string `json:"targets,omitempty"`
+	SingleWriter bool     `json:"singleWriter,omitempty"`
+	// TargetPods maps the targets of the volume to the UIDs of the pods
+	// they were published for, if known
+	TargetPods map[string]string `json:"targetPods,omitempty"`
+	// StagingPath is where the global mount of the volume is staged, empty
+	// for unstaged volumes and plain directories
+	StagingPath string `json:"stagingPath,omitempty"`
+	// Deleting is set once the volume is being deleted, e.g. while a
+	// backed volume deleted with archiveOnDelete is archived in the
+	// background, or while its backend is torn down. Volumes whose deletion
+	// was interrupted are deleted in the background.
+	Deleting bool `json:"deleting,omitempty"`
 }
 
 // NewVolumeManager creates a new volume manager
@@ -41,111 +155,457 @@ func NewVolumeManager(baseDir string) (*VolumeManager, error) {
 		return nil, fmt.Errorf("failed to create base directory: %v", err)
 	}
 
-	return &VolumeManager{
-		baseDir: baseDir,
-		volumes: make(map[string]*Volume),
-	}, nil
+	trash, err := newTrash(baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &VolumeManager{
+		baseDir:     baseDir,
+		volumes:     make(map[string]*Volume),
+		populating:  make(map[string]*populateOp),
+		backends:    make(map[string]Backend),
+		byNamespace: make(map[string]map[string]struct{}),
+		owners:      make(map[string]volumeOwner),
+		deletions:   make(chan struct{}, 1),
+		removing:    make(map[string]struct{}),
+		trash:       trash,
+		pools:       defaultPools(baseDir),
+		freeSpace:   statfsFree,
+		cgroupRoot:  DefaultCgroupRoot,
+		procRoot:    DefaultProcRoot,
+
+		setFileLabel: lsetfilecon,
+	}
+
+	if err := m.loadVolumes(); err != nil {
+		return nil, fmt.Errorf("failed to load volume metadata: %v", err)
+	}
+
+	return m, nil
 }
 
-// CreateVolume creates a new ephemeral volume
-func (m *VolumeManager) CreateVolume(req *csi.CreateVolumeRequest) (*Volume, error) {
+// SetArchiver configures where volumes that set archiveOnDelete are archived
+func (m *VolumeManager) SetArchiver(archiver Archiver) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	m.archiver = archiver
+}
+
+// BaseDir returns the directory volumes are created in
+func (m *VolumeManager) BaseDir() string {
+	return m.baseDir
+}
+
+// CreateVolume creates a new ephemeral volume
+func (m *VolumeManager) CreateVolume(req *csi.CreateVolumeRequest) (*Volume, error) {
 	// Generate unique volume ID
 	volumeID := generateVolumeID(req.Name)
 
-	// Create volume directory
-	volumePath := filepath.Join(m.baseDir, volumeID)
-	if err := os.MkdirAll(volumePath, defaultVolumePermissions); err != nil {
-		return nil, fmt.Errorf("failed to create volume directory: %v", err)
+	return m.ensureVolume(volumeID, req.CapacityRange.GetRequiredBytes(), req.Parameters, false)
+}
+
+// EnsureVolume returns the volume with the given ID, creating it if it does not exist yet
+func (m *VolumeManager) EnsureVolume(volumeID string, size int64, attributes map[string]string) (*Volume, error) {
+	return m.ensureVolume(volumeID, size, attributes, false)
+}
+
+// EnsureEphemeralVolume is like EnsureVolume, but a newly created volume is
+// marked as an inline ephemeral volume
+func (m *VolumeManager) EnsureEphemeralVolume(volumeID string, size int64, attributes map[string]string) (*Volume, error) {
+	return m.ensureVolume(volumeID, size, attributes, true)
+}
+
+func (m *VolumeManager) ensureVolume(volumeID string, size int64, attributes map[string]string, ephemeral bool) (*Volume, error) {
+	if err := validateVolumeID(volumeID); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if volume, exists := m.volumes[volumeID]; exists {
+		if volume.Deleting {
+			return nil, fmt.Errorf("volume %s: %w", volumeID, ErrVolumeDeleting)
+		}
+		// A volume published for a pod counts against the pod's namespace
+		if namespace := namespaceFromAttributes(attributes); namespace != volumeNamespace(volume) {
+			if err := m.checkQuotaLocked(namespace, volume); err != nil {
+				return nil, err
+			}
+		}
+		return volume.copy(), nil
 	}
 
-	// Parse volume attributes
-	size := parseSize(req.CapacityRange.GetRequiredBytes())
-	retention := req.Parameters["retentionPolicy"]
-	podID := req.Parameters["podID"]
+	sized := size > 0
+	size = parseSize(size)
+	pool, err := m.placeLocked(attributes, size, sized)
+	if err != nil {
+		return nil, err
+	}
+	backend := poolBackend(attributes, pool)
+	if backend == "" && IsEncrypted(attributes) {
+		return nil, fmt.Errorf("%w: set a base or use a pool with the %s backend", ErrEncryptionUnsupported, OverlayBackendName)
+	}
 
+	volumePath := filepath.Join(pool.Path, volumeID)
 	volume := &Volume{
-		ID:        volumeID,
-		Path:      volumePath,
-		Size:      size,
-		PodID:     podID,
-		Retention: retention,
+		ID:         volumeID,
+		Path:       volumePath,
+		Size:       size,
+		PodID:      attributes["podID"],
+		Retention:  attributes[RetentionPolicyParam],
+		CreatedAt:  time.Now().Unix(),
+		Attributes: copyAttributes(attributes),
+		Ephemeral:  ephemeral,
+		Backend:    backend,
+		Pod:        PodInfoFromContext(attributes),
+		Pool:       pool.Name,
+	}
+	if err := m.checkQuotaLocked(namespaceFromAttributes(attributes), volume); err != nil {
+		return nil, err
+	}
+
+	// Take a pre-created volume if one matches, or create the directory
+	if _, err := os.Stat(volumePath); !os.IsNotExist(err) || !m.claimWarmLocked(volume) {
+		if err := os.MkdirAll(volumePath, defaultVolumePermissions); err != nil {
+			return nil, fmt.Errorf("failed to create volume directory: %v", err)
+		}
+	}
+
+	if err := m.saveVolume(volume); err != nil {
+		return nil, err
 	}
 
 	m.volumes[volumeID] = volume
+	m.indexLocked(volume)
 	klog.Infof("Created volume %s at %s", volumeID, volumePath)
 
-	return volume, nil
+	return volume.copy(), nil
 }
 
-// DeleteVolume deletes an ephemeral volume
-func (m *VolumeManager) DeleteVolume(volumeID string) error {
+// DeleteVolume deletes an ephemeral volume. Deleting an unknown volume
+// removes any directory left behind for it and succeeds.
+func (m *VolumeManager) DeleteVolume(ctx context.Context, volumeID string) error {
+	if err := validateVolumeID(volumeID); err != nil {
+		return err
+	}
+
+	// The contents of backed volumes are only visible while they are set
+	// up, so those to archive are marked for deletion, and archived and
+	// removed in the background by RunReaper, as the archive takes as long
+	// as the sink does. Plain directories are archived by the reaper from
+	// the trash.
+	m.mu.Lock()
+	volume, exists := m.volumes[volumeID]
+	archive := exists && m.archiver != nil && volume.Attributes[ArchiveOnDeleteParam] == "true"
+	if archive && volume.Backend != "" {
+		var err error
+		if !volume.Deleting {
+			volume.Deleting = true
+			if err = m.saveVolume(volume); err == nil {
+				klog.Infof("Archiving volume %s before deleting it", volumeID)
+				m.signalDeletions()
+			}
+		}
+		m.mu.Unlock()
+		return err
+	}
+	m.mu.Unlock()
+
+	return m.removeVolume(volumeID, archive)
+}
+
+// removeVolume tears down a volume, moves its directory to the trash and
+// forgets it. archive records that the trash entry is to be archived.
+// Tearing down may take a while, e.g. to destroy the key of an encrypted
+// volume, so the volume is marked as deleting and torn down without holding
+// the locks. A volume that fails to be torn down stays marked, and its
+// deletion is retried in the background.
+func (m *VolumeManager) removeVolume(volumeID string, archive bool) error {
+	volume, backend, err := m.beginRemoval(volumeID)
+	if err != nil {
+		return err
+	}
+
+	var volumePaths, dataPaths []string
+	var usage int64
+	var archived *Volume
+	wipe := Wipe{Mode: WipeNone}
+	if volume != nil {
+		defer m.endRemoval(volumeID)
+		if archive {
+			archived = volume
+		}
+		volumePaths, usage = []string{volume.Path}, volume.Usage
+		if wipe, err = ParseWipe(volume.Attributes); err != nil {
+			return err
+		}
+		if backend != nil {
+			if err := backend.Teardown(volume); err != nil {
+				time.AfterFunc(time.Minute, m.signalDeletions)
+				return fmt.Errorf("failed to tear down volume %s: %v", volumeID, err)
+			}
+			// Data the backend keeps elsewhere is wiped along with the
+			// volume directory
+			if locator, ok := backend.(DataLocator); ok && wipe.Mode != WipeNone {
+				dataPaths = locator.DataPaths(volume)
+			}
+		}
+	} else {
+		// Look for what is left of an unknown volume in every pool
+		for _, pool := range m.pools.list {
+			volumePaths = append(volumePaths, filepath.Join(pool.Path, volumeID))
+		}
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	volume, exists := m.volumes[volumeID]
-	if !exists {
-		return fmt.Errorf("volume %s not found", volumeID)
+	// Move the volume directory out of the way, its contents are removed
+	// in the background
+	for _, volumePath := range volumePaths {
+		if err := m.trash.moveToTrash(volumeID, volumePath, filepath.Dir(volumePath), usage, wipe, archived); err != nil {
+			return fmt.Errorf("failed to delete volume directory: %v", err)
+		}
+	}
+	for _, dataPath := range dataPaths {
+		if err := m.trash.moveToTrash(volumeID, dataPath, filepath.Dir(volumePaths[0]), 0, wipe, nil); err != nil {
+			return fmt.Errorf("failed to delete volume data: %v", err)
+		}
 	}
 
-	// Remove volume directory
-	if err := os.RemoveAll(volume.Path); err != nil {
-		return fmt.Errorf("failed to delete volume directory: %v", err)
+	if volume == nil {
+		klog.Infof("Deleted volume %s", volumeID)
+		return nil
+	}
+	if err := m.removeVolumeMetadata(volumeID); err != nil {
+		return err
 	}
 
 	delete(m.volumes, volumeID)
+	m.unindexLocked(volumeID)
 	klog.Infof("Deleted volume %s", volumeID)
 
 	return nil
 }
 
-// GetVolume returns a volume by ID
+// beginRemoval marks a volume as deleting and returns a snapshot of it and
+// its backend, nil for unknown volumes. A setup in progress is waited for,
+// later ones refuse the volume.
+func (m *VolumeManager) beginRemoval(volumeID string) (*Volume, Backend, error) {
+	m.setupMu.Lock()
+	defer m.setupMu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	volume, exists := m.volumes[volumeID]
+	if !exists {
+		return nil, nil, nil
+	}
+	if _, removing := m.removing[volumeID]; removing {
+		return nil, nil, fmt.Errorf("volume %s: %w", volumeID, ErrVolumeDeleting)
+	}
+	var backend Backend
+	if volume.Backend != "" {
+		var ok bool
+		if backend, ok = m.backends[volume.Backend]; !ok {
+			return nil, nil, fmt.Errorf("%w: %s", ErrBackendUnavailable, volume.Backend)
+		}
+	}
+
+	volume.Deleting = true
+	if err := m.saveVolume(volume); err != nil {
+		return nil, nil, err
+	}
+	m.removing[volumeID] = struct{}{}
+	return volume.copy(), backend, nil
+}
+
+func (m *VolumeManager) endRemoval(volumeID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.removing, volumeID)
+}
+
+func (m *VolumeManager) signalDeletions() {
+	select {
+	case m.deletions <- struct{}{}:
+	default:
+	}
+}
+
+// runDeletions archives and removes the volumes marked for deletion until
+// ctx is done, starting with those marked before a restart. A deletion that
+// fails is retried after a minute.
+func (m *VolumeManager) runDeletions(ctx context.Context) {
+	m.signalDeletions()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.deletions:
+		}
+
+		for _, id := range m.deletingIDs() {
+			if err := m.finishDeletion(ctx, id); err != nil {
+				if ctx.Err() != nil {
+					// Shutting down, the deletion resumes after a restart
+					return
+				}
+				klog.Errorf("Failed to delete volume %s, retrying: %v", id, err)
+				time.AfterFunc(time.Minute, m.signalDeletions)
+			}
+		}
+	}
+}
+
+func (m *VolumeManager) deletingIDs() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var ids []string
+	for _, id := range m.ids {
+		if _, removing := m.removing[id]; m.volumes[id].Deleting && !removing {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// finishDeletion removes a volume marked for deletion, archiving it first
+// while it is set up if it is a backed volume deleted with archiveOnDelete.
+// A failed archive is logged but does not block the deletion, which would
+// otherwise be retried forever while the sink is unavailable, unless ctx is
+// done.
+func (m *VolumeManager) finishDeletion(ctx context.Context, volumeID string) error {
+	volume, err := m.GetVolume(volumeID)
+	if errors.Is(err, ErrVolumeNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	archive := volume.Attributes[ArchiveOnDeleteParam] == "true"
+	if archive && volume.Backend != "" {
+		m.mu.RLock()
+		archiver := m.archiver
+		m.mu.RUnlock()
+		if archiver == nil {
+			err = fmt.Errorf("no archive sink is configured")
+		} else if err = m.setupVolume(volumeID, true); err == nil {
+			// Backed volumes may not be set up after a restart
+			err = archiver.Archive(ctx, volume)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			klog.Errorf("Deleting volume %s without an archive: %v", volumeID, err)
+		}
+		archive = false
+	}
+
+	return m.removeVolume(volumeID, archive)
+}
+
+// GetVolume returns a snapshot of the volume with the given ID
 func (m *VolumeManager) GetVolume(volumeID string) (*Volume, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	volume, exists := m.volumes[volumeID]
 	if !exists {
-		return nil, fmt.Errorf("volume %s not found", volumeID)
+		return nil, fmt.Errorf("volume %s: %w", volumeID, ErrVolumeNotFound)
 	}
 
-	return volume, nil
+	return volume.copy(), nil
 }
 
-// ListVolumes returns all volumes
+// ListVolumes returns snapshots of all volumes, sorted by ID
 func (m *VolumeManager) ListVolumes() []*Volume {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	volumes := make([]*Volume, 0, len(m.volumes))
-	for _, volume := range m.volumes {
-		volumes = append(volumes, volume)
+	volumes := make([]*Volume, 0, len(m.ids))
+	for _, id := range m.ids {
+		volumes = append(volumes, m.volumes[id].copy())
 	}
 
 	return volumes
 }
 
-// UpdateVolumeUsage updates the usage statistics for a volume
-func (m *VolumeManager) UpdateVolumeUsage(volumeID string, usage int64) error {
+// UpdateVolume applies fn to the volume with the given ID and persists the result
+func (m *VolumeManager) UpdateVolume(volumeID string, fn func(*Volume)) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	volume, exists := m.volumes[volumeID]
 	if !exists {
-		return fmt.Errorf("volume %s not found", volumeID)
+		return fmt.Errorf("volume %s: %w", volumeID, ErrVolumeNotFound)
 	}
 
-	volume.Usage = usage
-	return nil
+	fn(volume)
+	m.indexLocked(volume)
+	return m.saveVolume(volume)
+}
+
+// UpdateVolumeUsage updates the usage statistics for a volume
+func (m *VolumeManager) UpdateVolumeUsage(volumeID string, usage int64) error {
+	return m.UpdateVolume(volumeID, func(volume *Volume) {
+		volume.Usage = usage
+	})
+}
+
+func (m *VolumeManager) sortedIDsLocked() []string {
+	return slices.Clone(m.ids)
+}
+
+func (v *Volume) copy() *Volume {
+	c := *v
+	c.Attributes = copyAttributes(v.Attributes)
+	c.Targets = append([]string(nil), v.Targets...)
+	c.TargetPods = copyAttributes(v.TargetPods)
+	c.IOCgroups = copyAttributes(v.IOCgroups)
+	if v.Pod != nil {
+		pod := *v.Pod
+		c.Pod = &pod
+	}
+	return &c
 }
 
 // Helper functions
 
 func generateVolumeID(name string) string {
-	// TODO: Implement proper volume ID generation
-	return fmt.Sprintf("vol-%s", name)
+	// The CO guarantees that names are unique, and reusing them as IDs makes
+	// CreateVolume idempotent across retries.
+	return name
+}
+
+// validateVolumeID rejects IDs that cannot safely be used as a directory name
+// under the base directory. Hidden names are reserved for driver state.
+func validateVolumeID(volumeID string) error {
+	if volumeID == "" {
+		return fmt.Errorf("volume ID is required")
+	}
+	if strings.ContainsRune(volumeID, filepath.Separator) || strings.HasPrefix(volumeID, ".") {
+		return fmt.Errorf("invalid volume ID %q", volumeID)
+	}
+	return nil
+}
+
+func copyAttributes(attributes map[string]string) map[string]string {
+	if attributes == nil {
+		return nil
+	}
+	c := make(map[string]string, len(attributes))
+	for k, v := range attributes {
+		c[k] = v
+	}
+	return c
 }
 
 func parseSize(size int64) int64 {
@@ -0,0 +1,279 @@
+package volume
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Mounter abstracts the mount operations performed on the node so that the
+// driver can be exercised without privileges
+type Mounter interface {
+	// BindMount bind mounts source onto target
+	BindMount(source, target string) error
+	// IDMappedBindMount bind mounts source onto target with the IDs of its
+	// files mapped through mapping, as seen from a user namespace with
+	// that mapping
+	IDMappedBindMount(source, target string, mapping *IDMapping) error
+	// Mount mounts source onto target with the given filesystem type and
+	// mount options
+	Mount(source, target, fstype string, options []string) error
+	// Unmount unmounts target, passing flags to umount2(2)
+	Unmount(target string, flags int) error
+	// IsMountPoint reports whether path is a mount point
+	IsMountPoint(path string) (bool, error)
+	// MountPoints returns the set of all mount points
+	MountPoints() (map[string]bool, error)
+}
+
+// NewMounter returns a Mounter that mounts on the host
+func NewMounter() Mounter {
+	return &hostMounter{}
+}
+
+type hostMounter struct{}
+
+func (hostMounter) BindMount(source, target string) error {
+	// Use the mount command for bind mounting
+	cmd := exec.Command("mount", "--bind", source, target)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to bind mount: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (hostMounter) IDMappedBindMount(source, target string, mapping *IDMapping) error {
+	return idMappedBindMount(source, target, mapping)
+}
+
+func (hostMounter) Mount(source, target, fstype string, options []string) error {
+	args := []string{"-t", fstype}
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	cmd := exec.Command("mount", append(args, source, target)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to mount %s: %v: %s", fstype, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (hostMounter) Unmount(target string, flags int) error {
+	return syscall.Unmount(target, flags)
+}
+
+func (hostMounter) IsMountPoint(path string) (bool, error) {
+	return IsMountPoint(path)
+}
+
+func (hostMounter) MountPoints() (map[string]bool, error) {
+	return MountPoints()
+}
+
+// FakeMounter records mounts in memory instead of performing them. It is
+// used to run the driver unprivileged, e.g. in tests and the sanity harness.
+type FakeMounter struct {
+	mu      sync.Mutex
+	mounts  map[string]string
+	options map[string][]string
+}
+
+// NewFakeMounter creates a new fake mounter
+func NewFakeMounter() *FakeMounter {
+	return &FakeMounter{
+		mounts:  make(map[string]string),
+		options: make(map[string][]string),
+	}
+}
+
+func (f *FakeMounter) BindMount(source, target string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := os.Stat(source); err != nil {
+		return fmt.Errorf("failed to bind mount: %v", err)
+	}
+	if _, err := os.Stat(target); err != nil {
+		return fmt.Errorf("failed to bind mount: %v", err)
+	}
+	f.mounts[filepath.Clean(target)] = source
+	return nil
+}
+
+// IDMappedBindMount records a bind mount with the mapping as its options
+func (f *FakeMounter) IDMappedBindMount(source, target string, mapping *IDMapping) error {
+	if err := f.BindMount(source, target); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.options[filepath.Clean(target)] = []string{"bind", mapping.String()}
+	return nil
+}
+
+func (f *FakeMounter) Mount(source, target, fstype string, options []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := os.Stat(target); err != nil {
+		return fmt.Errorf("failed to mount %s: %v", fstype, err)
+	}
+	f.mounts[filepath.Clean(target)] = source
+	f.options[filepath.Clean(target)] = append([]string{fstype}, options...)
+	return nil
+}
+
+func (f *FakeMounter) Unmount(target string, flags int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	target = filepath.Clean(target)
+	if _, ok := f.mounts[target]; !ok {
+		return syscall.EINVAL
+	}
+	delete(f.mounts, target)
+	delete(f.options, target)
+	return nil
+}
+
+func (f *FakeMounter) IsMountPoint(path string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		return false, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.mounts[filepath.Clean(path)]
+	return ok, nil
+}
+
+func (f *FakeMounter) MountPoints() (map[string]bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	points := make(map[string]bool, len(f.mounts))
+	for target := range f.mounts {
+		points[target] = true
+	}
+	return points, nil
+}
+
+// Mounts returns a copy of the recorded mounts, keyed by target
+func (f *FakeMounter) Mounts() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	mounts := make(map[string]string, len(f.mounts))
+	for target, source := range f.mounts {
+		mounts[target] = source
+	}
+	return mounts
+}
+
+// MountOptions returns the filesystem type followed by the options of the
+// mount at target, nil for plain bind mounts
+func (f *FakeMounter) MountOptions(target string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.options[filepath.Clean(target)]...)
+}
+
+// IsMountPoint reports whether path is listed as a mount point in the
+// mount table of the current process
+func IsMountPoint(path string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		return false, err
+	}
+	path, err := mountPath(path)
+	if err != nil {
+		return false, err
+	}
+
+	found := false
+	err = scanMountInfo(func(mountPoint string) bool {
+		found = mountPoint == path
+		return !found
+	})
+	return found, err
+}
+
+// MountPoints returns the set of mount points in the mount table of the
+// current process
+func MountPoints() (map[string]bool, error) {
+	points := make(map[string]bool)
+	err := scanMountInfo(func(mountPoint string) bool {
+		points[mountPoint] = true
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// mountPath returns path as it is listed in the mount table, absolute and
+// with symlinks resolved as far as it exists
+func mountPath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return path, nil
+}
+
+// scanMountInfo calls visit with every mount point in the mount table of
+// the current process until visit returns false
+func scanMountInfo(visit func(mountPoint string) bool) error {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// See proc(5): the fifth field is the mount point
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		if !visit(unescapeMountPath(fields[4])) {
+			return nil
+		}
+	}
+
+	return scanner.Err()
+}
+
+// unescapeMountPath decodes the octal escapes used in /proc mount tables
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -1,11 +1,13 @@
 package volume
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"k8s.io/klog/v2"
@@ -14,15 +16,27 @@ import (
 // NodeMounter handles volume mounting operations
 type NodeMounter struct {
 	volumeManager *VolumeManager
+	mounter       Mounter
 }
 
 // NewNodeMounter creates a new node mounter
-func NewNodeMounter(volumeManager *VolumeManager) *NodeMounter {
+func NewNodeMounter(volumeManager *VolumeManager, mounter Mounter) *NodeMounter {
 	return &NodeMounter{
 		volumeManager: volumeManager,
+		mounter:       mounter,
 	}
 }
 
+// IsMountPoint reports whether path is a mount point
+func (m *NodeMounter) IsMountPoint(path string) (bool, error) {
+	return m.mounter.IsMountPoint(path)
+}
+
+// MountPoints returns the set of all mount points
+func (m *NodeMounter) MountPoints() (map[string]bool, error) {
+	return m.mounter.MountPoints()
+}
+
 // NodePublishVolume mounts the volume to the target path
 func (m *NodeMounter) NodePublishVolume(req *csi.NodePublishVolumeRequest) error {
 	volumeID := req.GetVolumeId()
@@ -31,7 +45,47 @@ func (m *NodeMounter) NodePublishVolume(req *csi.NodePublishVolumeRequest) error
 	// Get volume information
 	volume, err := m.volumeManager.GetVolume(volumeID)
 	if err != nil {
-		return fmt.Errorf("failed to get volume: %v", err)
+		return fmt.Errorf("failed to get volume: %w", err)
+	}
+
+	// Publishing the same volume to the same target twice is a no-op
+	if mounted, err := m.mounter.IsMountPoint(targetPath); err == nil && mounted {
+		klog.V(4).Infof("Volume %s is already mounted at %s", volumeID, targetPath)
+		return nil
+	}
+
+	// Pods in a user namespace get a mount mapping their IDs, so files
+	// are owned by the same IDs on disk as inside the pod
+	mapping, err := m.volumeManager.PodIDMapping(req.GetVolumeContext(), targetPath)
+	if err != nil {
+		return err
+	}
+
+	// Reserve the target, which fails if a single writer has the volume.
+	// The caller may have reserved it already.
+	added, err := m.ReserveTarget(req)
+	if err != nil {
+		return err
+	}
+	published := false
+	defer func() {
+		if added && !published {
+			if err := m.volumeManager.RemoveTarget(volumeID, targetPath); err != nil {
+				klog.Warningf("Failed to release target %s of volume %s: %v", targetPath, volumeID, err)
+			}
+		}
+	}()
+	bindMount := m.mounter.BindMount
+	if mapping != nil {
+		bindMount = func(source, target string) error {
+			return m.mounter.IDMappedBindMount(source, target, mapping)
+		}
+	}
+
+	// Staged volumes are published from their staging path
+	source, err := m.publishSource(volume, req.GetStagingTargetPath())
+	if err != nil {
+		return err
 	}
 
 	// Create target directory if it doesn't exist
@@ -40,9 +94,9 @@ func (m *NodeMounter) NodePublishVolume(req *csi.NodePublishVolumeRequest) error
 	}
 
 	// Handle subpath if specified
-	if req.GetVolumeContext()["subPath"] != "" {
-		subPath := req.GetVolumeContext()["subPath"]
-		volumePath := filepath.Join(volume.Path, subPath)
+	subPath := req.GetVolumeContext()["subPath"]
+	if subPath != "" {
+		volumePath := filepath.Join(source, subPath)
 
 		// Create subpath directory
 		if err := os.MkdirAll(volumePath, 0755); err != nil {
@@ -51,55 +105,105 @@ func (m *NodeMounter) NodePublishVolume(req *csi.NodePublishVolumeRequest) error
 
 		// Bind mount the subpath
 		if err := bindMount(volumePath, targetPath); err != nil {
-			return fmt.Errorf("failed to bind mount subpath: %v", err)
+			return fmt.Errorf("failed to bind mount subpath: %w", err)
 		}
 	} else {
 		// Bind mount the entire volume
-		if err := bindMount(volume.Path, targetPath); err != nil {
-			return fmt.Errorf("failed to bind mount volume: %v", err)
+		if err := bindMount(source, targetPath); err != nil {
+			return fmt.Errorf("failed to bind mount volume: %w", err)
 		}
 	}
+	if mapping != nil {
+		klog.V(4).Infof("Mounted volume %s ID-mapped with %s", volumeID, mapping)
+	}
 
-	// Update volume mount point
-	volume.MountPoint = targetPath
+	// Update volume mount point and owner
+	pod := PodInfoFromContext(req.GetVolumeContext())
+	if err := m.volumeManager.UpdateVolume(volumeID, func(v *Volume) {
+		if pod != nil {
+			v.Pod = pod
+		}
+		v.MountPoint = targetPath
+		v.SubPath = subPath
+		v.LastAccess = time.Now().Unix()
+		// A retained volume that is used again is no longer up for expiry
+		v.RetainUntil = 0
+	}); err != nil {
+		return err
+	}
+	published = true
 	klog.Infof("Mounted volume %s to %s", volumeID, targetPath)
 
 	return nil
 }
 
+// ReserveTarget records the target of a publish before anything is done to
+// the volume, so that a publish that would fail because a single writer has
+// the volume changes nothing. It reports whether the target was added, in
+// which case a failed publish releases it with RemoveTarget.
+func (m *NodeMounter) ReserveTarget(req *csi.NodePublishVolumeRequest) (bool, error) {
+	singleWriter := req.GetVolumeCapability().GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER
+	podUID := req.GetVolumeContext()[PodUIDKey]
+	return m.volumeManager.ReserveTarget(req.GetVolumeId(), req.GetTargetPath(), podUID, singleWriter)
+}
+
 // NodeUnpublishVolume unmounts the volume from the target path
 func (m *NodeMounter) NodeUnpublishVolume(req *csi.NodeUnpublishVolumeRequest) error {
 	volumeID := req.GetVolumeId()
 	targetPath := req.GetTargetPath()
 
-	// Get volume information
-	volume, err := m.volumeManager.GetVolume(volumeID)
-	if err != nil {
-		return fmt.Errorf("failed to get volume: %v", err)
+	if err := m.unmountTarget(targetPath, 0); err != nil {
+		return err
 	}
 
-	// Unmount the volume
-	if err := syscall.Unmount(targetPath, 0); err != nil {
-		return fmt.Errorf("failed to unmount volume: %v", err)
+	// Forget the target. The volume may already be gone, e.g. after a
+	// retried call, in which case there is nothing left to record.
+	err := m.volumeManager.UpdateVolume(volumeID, func(v *Volume) {
+		v.LastAccess = time.Now().Unix()
+		v.removeTarget(targetPath)
+	})
+	if err != nil && !errors.Is(err, ErrVolumeNotFound) {
+		return err
 	}
+	klog.Infof("Unmounted volume %s from %s", volumeID, targetPath)
 
-	// Remove target directory
-	if err := os.RemoveAll(targetPath); err != nil {
-		return fmt.Errorf("failed to remove target directory: %v", err)
+	return nil
+}
+
+// ForceUnpublishVolume lazily detaches the volume from all its targets, even
+// if they are still busy, and returns the detached paths
+func (m *NodeMounter) ForceUnpublishVolume(volumeID string) ([]string, error) {
+	volume, err := m.volumeManager.GetVolume(volumeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get volume: %w", err)
 	}
 
-	// Clear volume mount point
-	volume.MountPoint = ""
-	klog.Infof("Unmounted volume %s from %s", volumeID, targetPath)
+	var detached []string
+	for _, target := range volume.Targets {
+		if err := m.unmountTarget(target, syscall.MNT_DETACH); err != nil {
+			return detached, err
+		}
+		if err := m.volumeManager.RemoveTarget(volumeID, target); err != nil {
+			return detached, err
+		}
+		klog.Warningf("Force unpublished volume %s from %s", volumeID, target)
+		detached = append(detached, target)
+	}
 
-	return nil
+	return detached, nil
 }
 
 // NodeGetVolumeStats returns volume statistics
 func (m *NodeMounter) NodeGetVolumeStats(volumeID string) (*csi.NodeGetVolumeStatsResponse, error) {
 	volume, err := m.volumeManager.GetVolume(volumeID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get volume: %v", err)
+		return nil, fmt.Errorf("failed to get volume: %w", err)
+	}
+
+	// Kubelet polls the stats of volumes in use, which keeps them from
+	// being collected as idle
+	if err := m.volumeManager.TouchVolume(volumeID); err != nil {
+		klog.Warningf("Failed to record access to volume %s: %v", volumeID, err)
 	}
 
 	// Get filesystem statistics
@@ -126,12 +230,46 @@ func (m *NodeMounter) NodeGetVolumeStats(volumeID string) (*csi.NodeGetVolumeSta
 	}, nil
 }
 
-// bindMount performs a bind mount operation
-func bindMount(source, target string) error {
-	// Use the mount command for bind mounting
-	cmd := exec.Command("mount", "--bind", source, target)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to bind mount: %v", err)
+// unmountTarget unmounts and removes the target path. Targets that are not
+// mounted, or do not exist at all, are only cleaned up.
+func (m *NodeMounter) unmountTarget(targetPath string, flags int) error {
+	mounted, err := m.mounter.IsMountPoint(targetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to check mount point: %v", err)
 	}
+
+	// Unmount the volume
+	if mounted {
+		if err := m.mounter.Unmount(targetPath, flags); err != nil {
+			return fmt.Errorf("failed to unmount volume: %v", err)
+		}
+	}
+
+	// Remove target directory
+	if err := os.RemoveAll(targetPath); err != nil {
+		return fmt.Errorf("failed to remove target directory: %v", err)
+	}
+
 	return nil
 }
+
+// DirUsage returns the number of bytes allocated on disk for the tree at path
+func DirUsage(path string) (int64, error) {
+	var usage int64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			usage += stat.Blocks * 512
+		} else {
+			usage += info.Size()
+		}
+		return nil
+	})
+	return usage, err
+}
@@ -0,0 +1,455 @@
+package volume
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// BaseDirParam is the absolute path of the read-only lower directory of
+	// an overlay volume
+	BaseDirParam = "baseDir"
+	// BaseLayerParam names a lower directory below the base layer directory
+	// of the node, as an alternative to BaseDirParam
+	BaseLayerParam = "baseLayer"
+
+	// OverlayBackendName is the backend of copy-on-write volumes
+	OverlayBackendName = "overlay"
+
+	// overlayDirName holds the upper layers next to the volume directories,
+	// so they are on the filesystem of the volume's pool
+	overlayDirName = ".overlay"
+)
+
+// ErrInvalidBase is returned for unusable overlay base attributes
+var ErrInvalidBase = errors.New("invalid overlay base")
+
+// ValidateOverlayAttributes checks the overlay attributes of a volume
+func ValidateOverlayAttributes(attributes map[string]string) error {
+	dir, layer := attributes[BaseDirParam], attributes[BaseLayerParam]
+	switch {
+	case dir != "" && layer != "":
+		return fmt.Errorf("%w: %s and %s are mutually exclusive", ErrInvalidBase, BaseDirParam, BaseLayerParam)
+	case dir != "" && !filepath.IsAbs(dir):
+		return fmt.Errorf("%w: %s must be an absolute path", ErrInvalidBase, BaseDirParam)
+	case layer != "" && (strings.ContainsRune(layer, filepath.Separator) || layer == "." || layer == ".."):
+		return fmt.Errorf("%w: %s must be a plain name", ErrInvalidBase, BaseLayerParam)
+	}
+	// Overlay mount options cannot express these characters
+	if strings.ContainsAny(dir+layer, ",:") {
+		return fmt.Errorf("%w: the base must not contain ',' or ':'", ErrInvalidBase)
+	}
+	return nil
+}
+
+// overlayBackend mounts an overlayfs over a shared read-only base directory
+// on the volume directory. The upper and work directories live on a
+// per-volume ext4 image of the volume size, which enforces the size limit
+// on what the volume adds to the base. Images of encrypted volumes are LUKS
+// devices whose data key is kept wrapped by the key manager.
+type overlayBackend struct {
+	mounter   Mounter
+	layersDir string
+	keys      KeyManager
+	crypt     cryptDevice
+	// mkfs formats the upper layer image
+	mkfs func(image string) error
+}
+
+// NewOverlayBackend creates the backend of copy-on-write volumes. Lower
+// directories must be below layersDir; overlay volumes are rejected if it is
+// empty. Encrypted volumes need keys, and are rejected if it is nil.
+func NewOverlayBackend(mounter Mounter, layersDir string, keys KeyManager) Backend {
+	return &overlayBackend{
+		mounter:   mounter,
+		layersDir: layersDir,
+		keys:      keys,
+		crypt:     cryptsetup{},
+		mkfs:      mkfsExt4,
+	}
+}
+
+func (b *overlayBackend) Setup(volume *Volume) error {
+	lower, err := b.lowerDir(volume)
+	if err != nil {
+		return err
+	}
+
+	if mounted, err := b.mounter.IsMountPoint(volume.Path); err != nil {
+		return err
+	} else if mounted {
+		return nil
+	}
+
+	encrypted := IsEncrypted(volume.Attributes)
+	if encrypted && b.keys == nil {
+		return ErrEncryptionUnavailable
+	}
+
+	state := overlayState(volume)
+	upperFS := filepath.Join(state, "fs")
+	if err := os.MkdirAll(upperFS, 0700); err != nil {
+		return fmt.Errorf("failed to create overlay state directory: %v", err)
+	}
+
+	// The image is only created once, it holds the data of the volume
+	image := filepath.Join(state, "upper.img")
+	if _, err := os.Stat(image); os.IsNotExist(err) {
+		create := b.createImage
+		if encrypted {
+			create = func(image string, size int64) error {
+				return b.createEncryptedImage(volume, image, size)
+			}
+		}
+		if err := create(image, volume.Size); err != nil {
+			return err
+		}
+	}
+	if mounted, err := b.mounter.IsMountPoint(upperFS); err != nil {
+		return err
+	} else if !mounted {
+		source, options := image, []string{"loop"}
+		if encrypted {
+			if source, err = b.openEncrypted(volume, image); err != nil {
+				return err
+			}
+			options = nil
+		}
+		if err := b.mounter.Mount(source, upperFS, "ext4", options); err != nil {
+			return err
+		}
+	}
+
+	upper, work := filepath.Join(upperFS, "upper"), filepath.Join(upperFS, "work")
+	for _, dir := range []string{upper, work} {
+		if err := os.MkdirAll(dir, defaultVolumePermissions); err != nil {
+			return fmt.Errorf("failed to create overlay directory: %v", err)
+		}
+	}
+
+	options := []string{"lowerdir=" + lower, "upperdir=" + upper, "workdir=" + work}
+	if volume.SELinuxLabel != "" {
+		options = append(options, contextOption(volume.SELinuxLabel))
+	}
+	if err := b.mounter.Mount("overlay", volume.Path, "overlay", options); err != nil {
+		return err
+	}
+	klog.Infof("Mounted overlay of %s on volume %s", lower, volume.ID)
+
+	return nil
+}
+
+func (b *overlayBackend) Teardown(volume *Volume) error {
+	state := overlayState(volume)
+	if err := b.unmount(volume); err != nil {
+		return err
+	}
+
+	if IsEncrypted(volume.Attributes) {
+		if err := b.destroyEncrypted(volume, filepath.Join(state, "upper.img")); err != nil {
+			return err
+		}
+	}
+
+	// The upper layer of a wiped volume is wiped and removed by the caller
+	if wipe, err := ParseWipe(volume.Attributes); err != nil || wipe.Mode != WipeNone {
+		return err
+	}
+	// Discarding the upper layer leaves the base untouched
+	if err := os.RemoveAll(state); err != nil {
+		return fmt.Errorf("failed to remove overlay state: %v", err)
+	}
+	return nil
+}
+
+// Release unmounts the overlay and its upper layer, which detaches the loop
+// device, and locks the device of an encrypted volume. The image keeps the
+// data for the next Setup.
+func (b *overlayBackend) Release(volume *Volume) error {
+	if err := b.unmount(volume); err != nil {
+		return err
+	}
+	if name := mapperName(volume); IsEncrypted(volume.Attributes) && b.crypt.IsOpen(name) {
+		if err := b.crypt.Close(name); err != nil {
+			return err
+		}
+	}
+	klog.Infof("Released overlay of volume %s", volume.ID)
+	return nil
+}
+
+// unmount unmounts the overlay of volume and its upper layer
+func (b *overlayBackend) unmount(volume *Volume) error {
+	for _, path := range []string{volume.Path, filepath.Join(overlayState(volume), "fs")} {
+		mounted, err := b.mounter.IsMountPoint(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if mounted {
+			if err := b.mounter.Unmount(path, 0); err != nil {
+				return fmt.Errorf("failed to unmount %s: %v", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// RemountContext mounts the overlay again with the SELinux label of the
+// volume. The upper layer stays mounted, so nothing written is lost. A
+// staging mount still binds the old overlay and is bound again.
+func (b *overlayBackend) RemountContext(volume *Volume) error {
+	if mounted, err := b.mounter.IsMountPoint(volume.Path); err != nil {
+		return err
+	} else if mounted {
+		if err := b.mounter.Unmount(volume.Path, 0); err != nil {
+			return fmt.Errorf("failed to unmount %s: %v", volume.Path, err)
+		}
+	}
+	if err := b.Setup(volume); err != nil {
+		return err
+	}
+
+	if volume.StagingPath == "" {
+		return nil
+	}
+	if mounted, err := b.mounter.IsMountPoint(volume.StagingPath); err != nil && !os.IsNotExist(err) {
+		return err
+	} else if mounted {
+		if err := b.mounter.Unmount(volume.StagingPath, 0); err != nil {
+			return fmt.Errorf("failed to unmount %s: %v", volume.StagingPath, err)
+		}
+	}
+	return b.mounter.BindMount(volume.Path, volume.StagingPath)
+}
+
+// DataPaths returns the state holding the upper layer of volume
+func (b *overlayBackend) DataPaths(volume *Volume) []string {
+	return []string{overlayState(volume)}
+}
+
+// Device returns the loop device holding the upper layer of the volume
+func (b *overlayBackend) Device(volume *Volume) (string, error) {
+	upperFS := filepath.Join(overlayState(volume), "fs")
+	if mounted, err := b.mounter.IsMountPoint(upperFS); err != nil || !mounted {
+		return "", fmt.Errorf("upper layer of volume %s is not mounted", volume.ID)
+	}
+	return deviceNumber(upperFS)
+}
+
+// AllocatesSize reports that the upper layer image of a volume is as large
+// as the volume
+func (b *overlayBackend) AllocatesSize() bool {
+	return true
+}
+
+// Prewarm creates and formats the upper layer image ahead of time, which
+// is the slow part of setting up an overlay volume
+func (b *overlayBackend) Prewarm(dir string, size int64) error {
+	return b.createImage(filepath.Join(dir, "upper.img"), size)
+}
+
+// Claim moves a prewarmed upper layer image to the state of volume, where
+// Setup picks it up
+func (b *overlayBackend) Claim(dir string, volume *Volume) error {
+	state := overlayState(volume)
+	if err := os.MkdirAll(state, 0700); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(dir, "upper.img"), filepath.Join(state, "upper.img"))
+}
+
+// overlayState returns the directory holding the upper layer of volume
+func overlayState(volume *Volume) string {
+	return filepath.Join(filepath.Dir(volume.Path), overlayDirName, volume.ID)
+}
+
+// lowerDir resolves the base of a volume, which must be a directory below
+// the base layer directory. Volumes that get the backend from their pool
+// may have no base, they start from an empty directory.
+func (b *overlayBackend) lowerDir(volume *Volume) (string, error) {
+	attributes := volume.Attributes
+	if err := ValidateOverlayAttributes(attributes); err != nil {
+		return "", err
+	}
+	if attributes[BaseDirParam] == "" && attributes[BaseLayerParam] == "" {
+		lower := filepath.Join(overlayState(volume), "lower")
+		if err := os.MkdirAll(lower, 0755); err != nil {
+			return "", fmt.Errorf("failed to create empty base: %v", err)
+		}
+		return lower, nil
+	}
+	if b.layersDir == "" {
+		return "", fmt.Errorf("%w: overlay volumes are disabled on this node", ErrInvalidBase)
+	}
+
+	lower := attributes[BaseDirParam]
+	if lower == "" {
+		lower = filepath.Join(b.layersDir, attributes[BaseLayerParam])
+	}
+
+	// Resolve symlinks so they cannot point outside the base layer directory
+	root, err := filepath.EvalSymlinks(b.layersDir)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidBase, err)
+	}
+	resolved, err := filepath.EvalSymlinks(lower)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidBase, err)
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%w: %s is not below %s", ErrInvalidBase, lower, b.layersDir)
+	}
+	if info, err := os.Stat(resolved); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("%w: %s is not a directory", ErrInvalidBase, lower)
+	}
+	return resolved, nil
+}
+
+// mapperName is the name of the dm-crypt device of an encrypted volume
+func mapperName(volume *Volume) string {
+	return "ephemeral-csi-" + volume.ID
+}
+
+// createEncryptedImage creates a LUKS formatted image of size bytes holding
+// an ext4 filesystem. The random data key is stored wrapped by the key
+// manager before the image uses it, so the image is never left without its
+// key. The image only appears under its final name once formatted.
+func (b *overlayBackend) createEncryptedImage(volume *Volume, image string, size int64) error {
+	key, err := newDataKey()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+	wrapped, err := b.keys.WrapKey(ctx, volume.ID, key)
+	if err != nil {
+		return fmt.Errorf("failed to wrap data key of volume %s: %v", volume.ID, err)
+	}
+	if err := writeFileAtomic(filepath.Join(filepath.Dir(image), "key.wrapped"), wrapped, 0600); err != nil {
+		return fmt.Errorf("failed to store data key of volume %s: %v", volume.ID, err)
+	}
+
+	tmp := image + ".tmp"
+	err = createSparseFile(tmp, size)
+	if err == nil {
+		err = b.crypt.Format(tmp, key)
+	}
+	if err == nil {
+		var device string
+		if device, err = b.crypt.Open(tmp, mapperName(volume), key); err == nil {
+			err = b.mkfs(device)
+			if closeErr := b.crypt.Close(mapperName(volume)); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, image)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to create encrypted upper layer image: %v", err)
+	}
+	return nil
+}
+
+// openEncrypted unlocks the image of an encrypted volume and returns the
+// path of the unlocked device
+func (b *overlayBackend) openEncrypted(volume *Volume, image string) (string, error) {
+	name := mapperName(volume)
+	if b.crypt.IsOpen(name) {
+		return mapperPath(name), nil
+	}
+
+	wrapped, err := os.ReadFile(filepath.Join(filepath.Dir(image), "key.wrapped"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read data key of volume %s: %v", volume.ID, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+	key, err := b.keys.UnwrapKey(ctx, volume.ID, wrapped)
+	if err != nil {
+		return "", fmt.Errorf("failed to unwrap data key of volume %s: %v", volume.ID, err)
+	}
+	return b.crypt.Open(image, name, key)
+}
+
+// destroyEncrypted locks the device of an encrypted volume and destroys its
+// keys. Once the keyslots are erased and the wrapped key is gone, the data
+// in the image cannot be recovered, even from a copy of the disk.
+func (b *overlayBackend) destroyEncrypted(volume *Volume, image string) error {
+	name := mapperName(volume)
+	if b.crypt.IsOpen(name) {
+		if err := b.crypt.Close(name); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(image); err == nil {
+		if err := b.crypt.Erase(image); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(filepath.Join(filepath.Dir(image), "key.wrapped")); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove data key of volume %s: %v", volume.ID, err)
+	}
+
+	if b.keys != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+		defer cancel()
+		if err := b.keys.DestroyKey(ctx, volume.ID); err != nil {
+			// The key is unusable without the erased keyslots anyway
+			klog.Warningf("Key manager failed to destroy the key of volume %s: %v", volume.ID, err)
+		}
+	}
+	klog.Infof("Destroyed the data key of volume %s", volume.ID)
+	return nil
+}
+
+// createImage creates a sparse image of size bytes and formats it. It only
+// appears under its final name once formatted.
+func (b *overlayBackend) createImage(image string, size int64) error {
+	tmp := image + ".tmp"
+	err := createSparseFile(tmp, size)
+	if err == nil {
+		err = b.mkfs(tmp)
+	}
+	if err == nil {
+		err = os.Rename(tmp, image)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to create upper layer image: %v", err)
+	}
+	return nil
+}
+
+// createSparseFile creates a file of size bytes that takes no space yet
+func createSparseFile(path string, size int64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func mkfsExt4(image string) error {
+	cmd := exec.Command("mkfs.ext4", "-q", "-F", "-m", "0", image)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("mkfs.ext4: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package volume
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newOverlayManager(t *testing.T) (*VolumeManager, *FakeMounter, string) {
+	t.Helper()
+	baseDir, layersDir := t.TempDir(), t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(layersDir, "dataset"), 0755))
+
+	m, err := NewVolumeManager(baseDir)
+	require.NoError(t, err)
+	mounter := NewFakeMounter()
+	backend := NewOverlayBackend(mounter, layersDir, nil).(*overlayBackend)
+	backend.mkfs = func(string) error { return nil }
+	m.RegisterBackend(OverlayBackendName, backend)
+
+	return m, mounter, layersDir
+}
+
+func TestOverlayVolume(t *testing.T) {
+	m, mounter, layersDir := newOverlayManager(t)
+
+	vol, err := m.EnsureVolume("vol-1", 64<<20, map[string]string{BaseLayerParam: "dataset"})
+	require.NoError(t, err)
+	assert.Equal(t, OverlayBackendName, vol.Backend)
+	require.NoError(t, m.SetupVolume(vol.ID))
+	// Setting up again, e.g. for a second publish, keeps the existing mounts
+	require.NoError(t, m.SetupVolume(vol.ID))
+
+	state := filepath.Join(m.BaseDir(), overlayDirName, vol.ID)
+	image, err := os.Stat(filepath.Join(state, "upper.img"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(64<<20), image.Size(), "the upper layer is limited to the volume size")
+	assert.Equal(t, []string{"ext4", "loop"}, mounter.MountOptions(filepath.Join(state, "fs")))
+
+	layer, err := filepath.EvalSymlinks(filepath.Join(layersDir, "dataset"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"overlay",
+		"lowerdir=" + layer,
+		"upperdir=" + filepath.Join(state, "fs", "upper"),
+		"workdir=" + filepath.Join(state, "fs", "work"),
+	}, mounter.MountOptions(vol.Path))
+
+	// Deleting the volume discards the upper layer and leaves the base alone
+	require.NoError(t, m.DeleteVolume(context.Background(), vol.ID))
+	assert.Empty(t, mounter.Mounts())
+	assert.NoDirExists(t, state)
+	assert.NoDirExists(t, vol.Path)
+	assert.DirExists(t, layer)
+}
+
+func TestOverlayVolumeInvalidBase(t *testing.T) {
+	m, mounter, layersDir := newOverlayManager(t)
+	outside := t.TempDir()
+	require.NoError(t, os.Symlink(outside, filepath.Join(layersDir, "escape")))
+
+	tests := []map[string]string{
+		{BaseLayerParam: "missing"},
+		{BaseLayerParam: "escape"},
+		{BaseDirParam: outside},
+		{BaseDirParam: layersDir},
+	}
+	for i, attributes := range tests {
+		vol, err := m.EnsureVolume("vol-"+string(rune('a'+i)), 0, attributes)
+		require.NoError(t, err)
+		err = m.SetupVolume(vol.ID)
+		assert.True(t, errors.Is(err, ErrInvalidBase), "%v: %v", attributes, err)
+	}
+	assert.Empty(t, mounter.Mounts())
+
+	for _, attributes := range []map[string]string{
+		{BaseLayerParam: "a", BaseDirParam: "/b"},
+		{BaseLayerParam: "../dataset"},
+		{BaseDirParam: "relative"},
+		{BaseDirParam: "/with,comma"},
+	} {
+		assert.Error(t, ValidateOverlayAttributes(attributes), "%v", attributes)
+	}
+	assert.NoError(t, ValidateOverlayAttributes(map[string]string{BaseDirParam: "/srv/base"}))
+}
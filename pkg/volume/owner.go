@@ -0,0 +1,151 @@
+package volume
+
+import (
+	"slices"
+	"sort"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/metrics"
+)
+
+// PodInfo is the pod a volume is published for, as passed by kubelet when
+// the CSIDriver object sets podInfoOnMount
+type PodInfo struct {
+	Name           string `json:"name"`
+	Namespace      string `json:"namespace"`
+	UID            string `json:"uid,omitempty"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+}
+
+// PodInfoFromContext returns the pod described by the podInfoOnMount keys of
+// a volume context, nil if kubelet did not pass one
+func PodInfoFromContext(volumeContext map[string]string) *PodInfo {
+	if volumeContext[PodNameKey] == "" || volumeContext[PodNamespaceKey] == "" {
+		return nil
+	}
+	return &PodInfo{
+		Name:           volumeContext[PodNameKey],
+		Namespace:      volumeContext[PodNamespaceKey],
+		UID:            volumeContext[PodUIDKey],
+		ServiceAccount: volumeContext[ServiceAccountKey],
+	}
+}
+
+// ListVolumesByOwner returns snapshots of the volumes accounted to
+// namespace, sorted by ID: those last published for a pod in namespace and
+// unpublished ones provisioned for a claim in it. A non-empty pod only
+// matches volumes last published for that pod, and an empty namespace
+// matches all volumes.
+func (m *VolumeManager) ListVolumesByOwner(namespace, pod string) []*Volume {
+	if namespace == "" {
+		return m.ListVolumes()
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var volumes []*Volume
+	for id := range m.byNamespace[namespace] {
+		volume := m.volumes[id]
+		if pod == "" || (volume.Pod != nil && volume.Pod.Name == pod) {
+			volumes = append(volumes, volume.copy())
+		}
+	}
+
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].ID < volumes[j].ID
+	})
+
+	return volumes
+}
+
+// volumeOwner is what a volume is indexed and labeled by
+type volumeOwner struct {
+	namespace string
+	pod       string
+	// size is accounted to the namespace
+	size int64
+}
+
+func ownerOf(volume *Volume) volumeOwner {
+	owner := volumeOwner{namespace: volumeNamespace(volume), size: volume.Size}
+	if volume.Pod != nil {
+		owner.pod = volume.Pod.Name
+	}
+	return owner
+}
+
+// indexLocked updates the indexes, the namespace consumption and the volume
+// metrics after volume was added or changed. Volumes are only re-indexed if
+// their owner changed, as most updates only touch their usage.
+func (m *VolumeManager) indexLocked(volume *Volume) {
+	owner := ownerOf(volume)
+	if old, indexed := m.owners[volume.ID]; !indexed || old != owner {
+		if indexed {
+			m.unindexOwnerLocked(volume.ID)
+		} else {
+			m.insertIDLocked(volume.ID)
+		}
+		m.indexOwnerLocked(volume.ID, owner)
+		if owner.namespace != "" {
+			m.updateNamespaceMetricsLocked(owner.namespace)
+		}
+	}
+	m.updateVolumeMetricsLocked(volume, owner)
+}
+
+// indexAllLocked builds the indexes and the metrics of all volumes at once,
+// after they were loaded
+func (m *VolumeManager) indexAllLocked() {
+	m.ids = make([]string, 0, len(m.volumes))
+	for id, volume := range m.volumes {
+		m.ids = append(m.ids, id)
+		owner := ownerOf(volume)
+		m.indexOwnerLocked(id, owner)
+		m.updateVolumeMetricsLocked(volume, owner)
+	}
+	slices.Sort(m.ids)
+	for namespace := range m.byNamespace {
+		m.updateNamespaceMetricsLocked(namespace)
+	}
+}
+
+// unindexLocked removes a volume from the indexes and the volume metrics
+// after it was deleted
+func (m *VolumeManager) unindexLocked(volumeID string) {
+	m.unindexOwnerLocked(volumeID)
+	m.removeIDLocked(volumeID)
+}
+
+func (m *VolumeManager) indexOwnerLocked(volumeID string, owner volumeOwner) {
+	m.owners[volumeID] = owner
+	if owner.namespace == "" {
+		return
+	}
+	if m.byNamespace[owner.namespace] == nil {
+		m.byNamespace[owner.namespace] = make(map[string]struct{})
+	}
+	m.byNamespace[owner.namespace][volumeID] = struct{}{}
+}
+
+func (m *VolumeManager) unindexOwnerLocked(volumeID string) {
+	owner, ok := m.owners[volumeID]
+	if !ok {
+		return
+	}
+	delete(m.owners, volumeID)
+	if owner.namespace != "" {
+		delete(m.byNamespace[owner.namespace], volumeID)
+		if len(m.byNamespace[owner.namespace]) == 0 {
+			delete(m.byNamespace, owner.namespace)
+		}
+		m.updateNamespaceMetricsLocked(owner.namespace)
+	}
+
+	metrics.VolumeCapacityBytes.DeleteLabelValues(volumeID, owner.namespace, owner.pod)
+	metrics.VolumeUsedBytes.DeleteLabelValues(volumeID, owner.namespace, owner.pod)
+}
+
+func (m *VolumeManager) updateVolumeMetricsLocked(volume *Volume, owner volumeOwner) {
+	metrics.VolumeCapacityBytes.WithLabelValues(volume.ID, owner.namespace, owner.pod).Set(float64(volume.Size))
+	metrics.VolumeUsedBytes.WithLabelValues(volume.ID, owner.namespace, owner.pod).Set(float64(volume.Usage))
+}
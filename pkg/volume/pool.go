@@ -0,0 +1,333 @@
+package volume
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// PoolParam names the storage pool a volume is created in
+	PoolParam = "pool"
+
+	// DefaultPoolName is the pool of the base directory when no pools are
+	// configured
+	DefaultPoolName = "default"
+)
+
+var (
+	// ErrUnknownPool is returned when a volume asks for a pool that is not
+	// configured on this node
+	ErrUnknownPool = errors.New("unknown storage pool")
+	// ErrInsufficientCapacity is returned when no pool has room for a volume
+	ErrInsufficientCapacity = errors.New("insufficient capacity")
+)
+
+// PlacementStrategy picks the pool of volumes that do not name one
+type PlacementStrategy string
+
+const (
+	// PlacementMostFree picks the pool with the most available space
+	PlacementMostFree PlacementStrategy = "most-free"
+	// PlacementRoundRobin cycles through the pools
+	PlacementRoundRobin PlacementStrategy = "round-robin"
+	// PlacementWeighted spreads volumes over the pools in proportion to
+	// their weight
+	PlacementWeighted PlacementStrategy = "weighted"
+)
+
+// Pool is a directory volumes are created in, typically the mount point of
+// a dedicated disk
+type Pool struct {
+	Name string
+	Path string
+	// Backend is used for volumes in the pool whose attributes do not
+	// select one, empty for plain directories
+	Backend string
+	// Reserve is the space kept free on the filesystem of the pool
+	Reserve int64
+	// Weight is the share of volumes the weighted strategy places in the
+	// pool, 1 if unset
+	Weight int
+	// Labels are added to the topology reported for the node
+	Labels map[string]string
+}
+
+// PoolConfig configures the storage pools of a node
+type PoolConfig struct {
+	Placement PlacementStrategy
+	Pools     []Pool
+}
+
+// poolFile is the format of a pool configuration file, e.g.
+//
+//	placement: most-free
+//	pools:
+//	- name: nvme
+//	  path: /mnt/nvme/ephemeral-csi
+//	  reserve: 10Gi
+//	  labels:
+//	    ephemeral.csi.local/media: ssd
+type poolFile struct {
+	Placement PlacementStrategy `yaml:"placement"`
+	Pools     []poolEntry       `yaml:"pools"`
+}
+
+type poolEntry struct {
+	Name    string            `yaml:"name"`
+	Path    string            `yaml:"path"`
+	Backend string            `yaml:"backend"`
+	Reserve string            `yaml:"reserve"`
+	Weight  int               `yaml:"weight"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+// LoadPoolConfig reads a pool configuration from a YAML or JSON file
+func LoadPoolConfig(path string) (PoolConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return PoolConfig{}, fmt.Errorf("failed to read pool configuration: %v", err)
+	}
+
+	var file poolFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return PoolConfig{}, fmt.Errorf("failed to parse pool configuration %s: %v", path, err)
+	}
+
+	cfg := PoolConfig{Placement: file.Placement}
+	for _, entry := range file.Pools {
+		pool := Pool{
+			Name:    entry.Name,
+			Path:    entry.Path,
+			Backend: entry.Backend,
+			Weight:  entry.Weight,
+			Labels:  entry.Labels,
+		}
+		if entry.Reserve != "" {
+			if pool.Reserve, err = parseByteSize(entry.Reserve); err != nil {
+				return PoolConfig{}, fmt.Errorf("invalid reserve of pool %s in %s: %v", entry.Name, path, err)
+			}
+		}
+		cfg.Pools = append(cfg.Pools, pool)
+	}
+
+	return cfg, nil
+}
+
+// pools holds the configured pools and the state of the placement strategy
+type pools struct {
+	placement PlacementStrategy
+	list      []Pool
+	// next is the round-robin position
+	next int
+	// current holds the smooth weighted round-robin state of each pool
+	current []int
+}
+
+// defaultPools is the single pool of the base directory
+func defaultPools(baseDir string) *pools {
+	return &pools{
+		placement: PlacementMostFree,
+		list:      []Pool{{Name: DefaultPoolName, Path: baseDir}},
+		current:   make([]int, 1),
+	}
+}
+
+// SetPools replaces the pools volumes are created in. The base directory
+// keeps the metadata of all volumes, and may be one of the pools. Backends
+// must be registered before.
+func (m *VolumeManager) SetPools(cfg PoolConfig) error {
+	if cfg.Placement == "" {
+		cfg.Placement = PlacementMostFree
+	}
+	switch cfg.Placement {
+	case PlacementMostFree, PlacementRoundRobin, PlacementWeighted:
+	default:
+		return fmt.Errorf("unsupported placement strategy %q, must be %s, %s or %s",
+			cfg.Placement, PlacementMostFree, PlacementRoundRobin, PlacementWeighted)
+	}
+	if len(cfg.Pools) == 0 {
+		return fmt.Errorf("at least one pool is required")
+	}
+
+	m.mu.RLock()
+	backends := m.backends
+	m.mu.RUnlock()
+
+	names := make(map[string]bool)
+	for i := range cfg.Pools {
+		pool := &cfg.Pools[i]
+		switch {
+		case pool.Name == "" || strings.ContainsAny(pool.Name, "/ "):
+			return fmt.Errorf("invalid pool name %q", pool.Name)
+		case names[pool.Name]:
+			return fmt.Errorf("duplicate pool %s", pool.Name)
+		case !filepath.IsAbs(pool.Path):
+			return fmt.Errorf("path of pool %s must be absolute", pool.Name)
+		case pool.Reserve < 0 || pool.Weight < 0:
+			return fmt.Errorf("reserve and weight of pool %s must not be negative", pool.Name)
+		}
+		names[pool.Name] = true
+		pool.Path = filepath.Clean(pool.Path)
+		// Directories below the base directory are taken for volumes
+		if rel, err := filepath.Rel(m.baseDir, pool.Path); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("path of pool %s must not be below the base directory %s", pool.Name, m.baseDir)
+		}
+		if _, ok := backends[pool.Backend]; pool.Backend != "" && !ok {
+			return fmt.Errorf("%w: %s of pool %s", ErrBackendUnavailable, pool.Backend, pool.Name)
+		}
+		if pool.Weight == 0 {
+			pool.Weight = 1
+		}
+		if err := os.MkdirAll(pool.Path, defaultVolumePermissions); err != nil {
+			return fmt.Errorf("failed to create directory of pool %s: %v", pool.Name, err)
+		}
+		if err := m.trash.resume(pool.Path); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pools = &pools{
+		placement: cfg.Placement,
+		list:      cfg.Pools,
+		current:   make([]int, len(cfg.Pools)),
+	}
+	for _, pool := range cfg.Pools {
+		klog.Infof("Using pool %s at %s", pool.Name, pool.Path)
+	}
+
+	return nil
+}
+
+// Pools returns the configured pools
+func (m *VolumeManager) Pools() []Pool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]Pool(nil), m.pools.list...)
+}
+
+// PoolCapacity returns the space available to new volumes in the named
+// pool. Without a name it returns the most any pool has available, which
+// is the largest volume that can be created.
+func (m *VolumeManager) PoolCapacity(name string) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var best int64
+	for _, pool := range m.pools.list {
+		if name != "" && pool.Name != name {
+			continue
+		}
+		available, err := m.poolAvailable(pool)
+		if err != nil {
+			return 0, err
+		}
+		if name != "" {
+			return available, nil
+		}
+		if available > best {
+			best = available
+		}
+	}
+	if name != "" {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownPool, name)
+	}
+	return best, nil
+}
+
+// poolAvailable returns the free space of the filesystem of pool minus its reserve
+func (m *VolumeManager) poolAvailable(pool Pool) (int64, error) {
+	free, err := m.freeSpace(pool.Path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get free space of pool %s: %v", pool.Name, err)
+	}
+	if available := free - pool.Reserve; available > 0 {
+		return available, nil
+	}
+	return 0, nil
+}
+
+// placeLocked picks the pool of a new volume of size bytes: the pool named
+// by its attributes, or else one chosen by the placement strategy among
+// the pools with enough space. Plain directories only use space as data is
+// written, so the space is only checked for them if sized is set, i.e. the
+// size was requested rather than defaulted.
+func (m *VolumeManager) placeLocked(attributes map[string]string, size int64, sized bool) (Pool, error) {
+	p := m.pools
+	name := attributes[PoolParam]
+
+	var candidates []int
+	var mostFree int64
+	best := -1
+	for i, pool := range p.list {
+		if name != "" && pool.Name != name {
+			continue
+		}
+		available, err := m.poolAvailable(pool)
+		if err != nil {
+			return Pool{}, err
+		}
+		if (sized || m.allocatesLocked(poolBackend(attributes, pool))) && available < size {
+			if name != "" {
+				return Pool{}, fmt.Errorf("%w: pool %s has %d bytes available, %d requested", ErrInsufficientCapacity, name, available, size)
+			}
+			continue
+		}
+		candidates = append(candidates, i)
+		if best < 0 || available > mostFree {
+			best, mostFree = i, available
+		}
+	}
+	switch {
+	case name != "" && len(candidates) == 0:
+		return Pool{}, fmt.Errorf("%w: %s", ErrUnknownPool, name)
+	case len(candidates) == 0:
+		return Pool{}, fmt.Errorf("%w: no pool has %d bytes available", ErrInsufficientCapacity, size)
+	case len(candidates) == 1 || p.placement == PlacementMostFree:
+		return p.list[best], nil
+	case p.placement == PlacementRoundRobin:
+		// Take the first candidate at or after the position
+		start := p.next % len(p.list)
+		best = candidates[0]
+		for _, i := range candidates {
+			if i >= start {
+				best = i
+				break
+			}
+		}
+		p.next = best + 1
+		return p.list[best], nil
+	default:
+		// Smooth weighted round-robin spreads volumes evenly over time
+		total := 0
+		best = candidates[0]
+		for _, i := range candidates {
+			p.current[i] += p.list[i].Weight
+			total += p.list[i].Weight
+			if p.current[i] > p.current[best] {
+				best = i
+			}
+		}
+		p.current[best] -= total
+		return p.list[best], nil
+	}
+}
+
+// statfsFree returns the space available to unprivileged users on the
+// filesystem of path
+func statfsFree(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
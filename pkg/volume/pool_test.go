@@ -0,0 +1,144 @@
+package volume
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newPoolManager returns a manager with pools fast, slow and small, whose
+// free space is taken from free
+func newPoolManager(t *testing.T, placement PlacementStrategy, free map[string]int64) *VolumeManager {
+	t.Helper()
+	root := t.TempDir()
+	m, err := NewVolumeManager(filepath.Join(root, "base"))
+	require.NoError(t, err)
+
+	require.NoError(t, m.SetPools(PoolConfig{
+		Placement: placement,
+		Pools: []Pool{
+			{Name: "fast", Path: filepath.Join(root, "fast"), Weight: 2},
+			{Name: "slow", Path: filepath.Join(root, "slow"), Reserve: 1 << 20},
+			{Name: "small", Path: filepath.Join(root, "small")},
+		},
+	}))
+	m.freeSpace = func(path string) (int64, error) {
+		return free[filepath.Base(path)], nil
+	}
+	return m
+}
+
+func placeVolumes(t *testing.T, m *VolumeManager, count int) []string {
+	t.Helper()
+	var placed []string
+	for i := 0; i < count; i++ {
+		vol, err := m.EnsureVolume(filepath.Base(t.Name())+string(rune('a'+i)), 4<<20, nil)
+		require.NoError(t, err)
+		placed = append(placed, vol.Pool)
+	}
+	return placed
+}
+
+func TestPoolPlacement(t *testing.T) {
+	free := map[string]int64{"fast": 10 << 20, "slow": 20 << 20, "small": 1 << 20}
+
+	m := newPoolManager(t, PlacementMostFree, free)
+	assert.Equal(t, []string{"slow", "slow"}, placeVolumes(t, m, 2))
+
+	// Pools without room for the volume are skipped
+	m = newPoolManager(t, PlacementRoundRobin, free)
+	assert.Equal(t, []string{"fast", "slow", "fast", "slow"}, placeVolumes(t, m, 4))
+
+	m = newPoolManager(t, PlacementWeighted, free)
+	assert.Equal(t, []string{"fast", "slow", "fast", "fast", "slow", "fast"}, placeVolumes(t, m, 6))
+}
+
+func TestNamedPool(t *testing.T) {
+	m := newPoolManager(t, PlacementMostFree, map[string]int64{"fast": 10 << 20, "slow": 5 << 20, "small": 1 << 20})
+
+	vol, err := m.EnsureVolume("vol-1", 4<<20, map[string]string{PoolParam: "slow"})
+	require.NoError(t, err)
+	assert.Equal(t, "slow", vol.Pool)
+	assert.DirExists(t, vol.Path)
+	assert.Equal(t, filepath.Join(m.Pools()[1].Path, "vol-1"), vol.Path)
+
+	// The reserve of the pool is kept free
+	_, err = m.EnsureVolume("vol-2", 5<<20, map[string]string{PoolParam: "slow"})
+	assert.ErrorIs(t, err, ErrInsufficientCapacity)
+	_, err = m.EnsureVolume("vol-2", 1<<20, map[string]string{PoolParam: "nvme"})
+	assert.ErrorIs(t, err, ErrUnknownPool)
+	_, err = m.EnsureVolume("vol-2", 64<<20, nil)
+	assert.ErrorIs(t, err, ErrInsufficientCapacity)
+
+	available, err := m.PoolCapacity("slow")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4<<20), available)
+	available, err = m.PoolCapacity("")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10<<20), available)
+
+	// Deleted volumes go to the trash of their pool
+	require.NoError(t, m.DeleteVolume(context.Background(), vol.ID))
+	assert.NoDirExists(t, vol.Path)
+	entries, err := os.ReadDir(filepath.Join(m.Pools()[1].Path, trashDirName))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+	deleted, _ := m.PoolTrash("slow")
+	assert.Equal(t, 1, deleted)
+	deleted, _ = m.PoolTrash("fast")
+	assert.Zero(t, deleted)
+	deleted, _ = m.PoolTrash("")
+	assert.Equal(t, 1, deleted)
+}
+
+// imageBackend is a backend whose volumes take their full size up front
+type imageBackend struct{}
+
+func (imageBackend) Setup(*Volume) error    { return nil }
+func (imageBackend) Teardown(*Volume) error { return nil }
+func (imageBackend) AllocatesSize() bool    { return true }
+
+func TestDefaultSizePlacement(t *testing.T) {
+	m := newPoolManager(t, PlacementMostFree, map[string]int64{"fast": 10 << 20, "slow": 20 << 20, "small": 1 << 20})
+	m.RegisterBackend(OverlayBackendName, imageBackend{})
+
+	// Plain directories without a requested size only take what is written
+	vol, err := m.EnsureVolume("vol-1", 0, map[string]string{PoolParam: "small"})
+	require.NoError(t, err)
+	assert.Equal(t, "small", vol.Pool)
+	vol, err = m.EnsureVolume("vol-2", 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "slow", vol.Pool)
+
+	// A requested size, or an image of the default size, needs the room
+	_, err = m.EnsureVolume("vol-3", 4<<20, map[string]string{PoolParam: "small"})
+	assert.ErrorIs(t, err, ErrInsufficientCapacity)
+	_, err = m.EnsureVolume("vol-3", 0, map[string]string{PoolParam: "small", BaseDirParam: t.TempDir()})
+	assert.ErrorIs(t, err, ErrInsufficientCapacity)
+	_, err = m.EnsureVolume("vol-3", 0, map[string]string{BaseDirParam: t.TempDir()})
+	assert.ErrorIs(t, err, ErrInsufficientCapacity)
+}
+
+func TestSetPoolsValidation(t *testing.T) {
+	baseDir := t.TempDir()
+	m, err := NewVolumeManager(baseDir)
+	require.NoError(t, err)
+
+	for name, cfg := range map[string]PoolConfig{
+		"no pools":        {},
+		"bad placement":   {Placement: "random", Pools: []Pool{{Name: "a", Path: t.TempDir()}}},
+		"relative path":   {Pools: []Pool{{Name: "a", Path: "pool"}}},
+		"duplicate name":  {Pools: []Pool{{Name: "a", Path: t.TempDir()}, {Name: "a", Path: t.TempDir()}}},
+		"below base path": {Pools: []Pool{{Name: "a", Path: filepath.Join(baseDir, "a")}}},
+		"unknown backend": {Pools: []Pool{{Name: "a", Path: t.TempDir(), Backend: "zfs"}}},
+	} {
+		assert.Error(t, m.SetPools(cfg), name)
+	}
+
+	// The base directory itself may be a pool
+	assert.NoError(t, m.SetPools(PoolConfig{Pools: []Pool{{Name: "a", Path: baseDir}}}))
+}
@@ -0,0 +1,101 @@
+package volume
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// ErrPopulateInProgress is returned when the caller gave up waiting for a
+// volume to be populated. Population carries on in the background and a
+// retried call picks up its result.
+var ErrPopulateInProgress = errors.New("volume is still being populated")
+
+// RevisionContextKey reports the revision of a populated volume in the
+// volume context returned by ListVolumes
+const RevisionContextKey = "ephemeral.csi.local/revision"
+
+// populateTimeout bounds a single population attempt, which is detached from
+// the CSI call that started it so large downloads survive kubelet retries
+const populateTimeout = 30 * time.Minute
+
+// Populator fills a new volume with initial content, as requested by its
+// attributes. It returns the revision of the content, such as the commit of
+// a git checkout, and must leave the volume untouched if nothing is
+// requested.
+type Populator interface {
+	Populate(ctx context.Context, volume *Volume) (revision string, err error)
+}
+
+type populateOp struct {
+	done chan struct{}
+	err  error
+}
+
+// SetPopulator configures how new volumes are filled with initial content
+func (m *VolumeManager) SetPopulator(populator Populator) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.populator = populator
+}
+
+// PopulateVolume fills the volume with its initial content unless that
+// already happened. Concurrent calls for the same volume share one attempt.
+// If ctx is done before the attempt finishes, ErrPopulateInProgress is
+// returned; a failed attempt is retried by the next call.
+func (m *VolumeManager) PopulateVolume(ctx context.Context, volumeID string) error {
+	m.mu.Lock()
+	volume, exists := m.volumes[volumeID]
+	if !exists {
+		m.mu.Unlock()
+		return fmt.Errorf("volume %s: %w", volumeID, ErrVolumeNotFound)
+	}
+	if volume.Populated || m.populator == nil {
+		m.mu.Unlock()
+		return nil
+	}
+
+	op, running := m.populating[volumeID]
+	if !running {
+		op = &populateOp{done: make(chan struct{})}
+		m.populating[volumeID] = op
+		go m.populate(op, m.populator, volume.copy())
+	}
+	m.mu.Unlock()
+
+	select {
+	case <-op.done:
+		return op.err
+	case <-ctx.Done():
+		return fmt.Errorf("volume %s: %w", volumeID, ErrPopulateInProgress)
+	}
+}
+
+func (m *VolumeManager) populate(op *populateOp, populator Populator, volume *Volume) {
+	ctx, cancel := context.WithTimeout(context.Background(), populateTimeout)
+	defer cancel()
+
+	start := time.Now()
+	revision, err := populator.Populate(ctx, volume)
+	if err == nil {
+		err = m.UpdateVolume(volume.ID, func(v *Volume) {
+			v.Populated = true
+			v.Revision = revision
+		})
+	}
+	if err != nil {
+		klog.Errorf("Failed to populate volume %s: %v", volume.ID, err)
+	} else {
+		klog.V(4).Infof("Populated volume %s in %s", volume.ID, time.Since(start).Round(time.Millisecond))
+	}
+
+	m.mu.Lock()
+	op.err = err
+	delete(m.populating, volume.ID)
+	m.mu.Unlock()
+	close(op.done)
+}
@@ -0,0 +1,219 @@
+package volume
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/metrics"
+)
+
+// PVCNamespaceKey is the namespace of the claim a volume is provisioned
+// for, passed to CreateVolume when the external-provisioner runs with
+// --extra-create-metadata
+const PVCNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+
+// ErrQuotaExceeded is returned when a volume would take a namespace over its quota
+var ErrQuotaExceeded = errors.New("namespace quota exceeded")
+
+// Quota limits what the volumes of a namespace may use on a node. Zero
+// values are unlimited.
+type Quota struct {
+	// MaxBytes is the maximum total capacity of the volumes
+	MaxBytes int64
+	// MaxVolumes is the maximum number of volumes
+	MaxVolumes int
+}
+
+// QuotaPolicy maps namespaces to their quota
+type QuotaPolicy struct {
+	// Default applies to namespaces without a quota of their own, nil to
+	// leave them unlimited
+	Default *Quota
+	// Namespaces holds the quotas of individual namespaces
+	Namespaces map[string]Quota
+}
+
+// quotaFile is the format of a quota policy file, e.g.
+//
+//	default:
+//	  maxCapacity: 20Gi
+//	namespaces:
+//	  batch:
+//	    maxCapacity: 100Gi
+//	    maxVolumes: 50
+type quotaFile struct {
+	Default    *quotaEntry           `yaml:"default"`
+	Namespaces map[string]quotaEntry `yaml:"namespaces"`
+}
+
+type quotaEntry struct {
+	MaxCapacity string `yaml:"maxCapacity"`
+	MaxVolumes  int    `yaml:"maxVolumes"`
+}
+
+// LoadQuotaPolicy reads a quota policy from a YAML or JSON file
+func LoadQuotaPolicy(path string) (*QuotaPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quota policy: %v", err)
+	}
+
+	var file quotaFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse quota policy %s: %v", path, err)
+	}
+
+	policy := &QuotaPolicy{Namespaces: make(map[string]Quota, len(file.Namespaces))}
+	if file.Default != nil {
+		quota, err := file.Default.quota()
+		if err != nil {
+			return nil, fmt.Errorf("invalid default quota in %s: %v", path, err)
+		}
+		policy.Default = &quota
+	}
+	for namespace, entry := range file.Namespaces {
+		quota, err := entry.quota()
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota for namespace %s in %s: %v", namespace, path, err)
+		}
+		policy.Namespaces[namespace] = quota
+	}
+
+	return policy, nil
+}
+
+func (e quotaEntry) quota() (Quota, error) {
+	if e.MaxVolumes < 0 {
+		return Quota{}, fmt.Errorf("maxVolumes must not be negative")
+	}
+	quota := Quota{MaxVolumes: e.MaxVolumes}
+	if e.MaxCapacity != "" {
+		size, err := parseByteSize(e.MaxCapacity)
+		if err != nil {
+			return Quota{}, fmt.Errorf("invalid maxCapacity: %v", err)
+		}
+		quota.MaxBytes = size
+	}
+	return quota, nil
+}
+
+// byteSuffixes are the suffixes accepted by parseByteSize, binary ones first
+// so "Gi" is not taken for "G"
+var byteSuffixes = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+	{"k", 1e3}, {"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+}
+
+// parseByteSize parses a byte count with an optional Kubernetes style
+// suffix such as Mi or G
+func parseByteSize(s string) (int64, error) {
+	multiplier := int64(1)
+	for _, b := range byteSuffixes {
+		if strings.HasSuffix(s, b.suffix) {
+			s, multiplier = strings.TrimSuffix(s, b.suffix), b.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a byte size", s)
+	}
+	return n * multiplier, nil
+}
+
+// quotaFor returns the quota of namespace, nil if it is unlimited
+func (p *QuotaPolicy) quotaFor(namespace string) *Quota {
+	if quota, ok := p.Namespaces[namespace]; ok {
+		return &quota
+	}
+	return p.Default
+}
+
+// SetQuotaPolicy enforces policy on subsequently created or published
+// volumes, nil to disable quotas
+func (m *VolumeManager) SetQuotaPolicy(policy *QuotaPolicy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.quotas = policy
+}
+
+// volumeNamespace returns the namespace a volume is accounted to: the one of
+// the pod it was last published for, or else of the claim it was provisioned for
+func volumeNamespace(volume *Volume) string {
+	if volume.Pod != nil {
+		return volume.Pod.Namespace
+	}
+	return volume.Attributes[PVCNamespaceKey]
+}
+
+// namespaceFromAttributes returns the namespace a request is made for, empty
+// if the attributes do not tell
+func namespaceFromAttributes(attributes map[string]string) string {
+	if namespace := attributes[PodNamespaceKey]; namespace != "" {
+		return namespace
+	}
+	return attributes[PVCNamespaceKey]
+}
+
+// namespaceUsageLocked returns the total capacity and number of the volumes
+// accounted to namespace, leaving out the volume with ID except
+func (m *VolumeManager) namespaceUsageLocked(namespace, except string) (int64, int) {
+	var bytes int64
+	var count int
+	for id := range m.byNamespace[namespace] {
+		if id == except {
+			continue
+		}
+		bytes += m.volumes[id].Size
+		count++
+	}
+	return bytes, count
+}
+
+// checkQuotaLocked returns ErrQuotaExceeded if volume would take namespace
+// over its quota. Volumes without a namespace are not subject to quotas.
+func (m *VolumeManager) checkQuotaLocked(namespace string, volume *Volume) error {
+	if m.quotas == nil || namespace == "" {
+		return nil
+	}
+	quota := m.quotas.quotaFor(namespace)
+	if quota == nil {
+		return nil
+	}
+
+	bytes, count := m.namespaceUsageLocked(namespace, volume.ID)
+	var err error
+	switch {
+	case quota.MaxVolumes > 0 && count+1 > quota.MaxVolumes:
+		err = fmt.Errorf("%w: namespace %s already has %d volumes on this node, its quota allows %d",
+			ErrQuotaExceeded, namespace, count, quota.MaxVolumes)
+	case quota.MaxBytes > 0 && bytes+volume.Size > quota.MaxBytes:
+		err = fmt.Errorf("%w: volume %s of %d bytes would bring namespace %s to %d bytes on this node, its quota allows %d",
+			ErrQuotaExceeded, volume.ID, volume.Size, namespace, bytes+volume.Size, quota.MaxBytes)
+	default:
+		return nil
+	}
+	metrics.QuotaRejections.WithLabelValues(namespace).Inc()
+	return err
+}
+
+// updateNamespaceMetricsLocked exports the consumption of namespace
+func (m *VolumeManager) updateNamespaceMetricsLocked(namespace string) {
+	bytes, count := m.namespaceUsageLocked(namespace, "")
+	if count == 0 {
+		metrics.NamespaceCapacityBytes.DeleteLabelValues(namespace)
+		metrics.NamespaceVolumes.DeleteLabelValues(namespace)
+		return
+	}
+	metrics.NamespaceCapacityBytes.WithLabelValues(namespace).Set(float64(bytes))
+	metrics.NamespaceVolumes.WithLabelValues(namespace).Set(float64(count))
+}
@@ -0,0 +1,113 @@
+package volume
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/metrics"
+)
+
+func podAttributes(namespace, pod string) map[string]string {
+	return map[string]string{PodNamespaceKey: namespace, PodNameKey: pod}
+}
+
+func TestLoadQuotaPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+default:
+  maxCapacity: 2Gi
+namespaces:
+  batch:
+    maxCapacity: "500M"
+    maxVolumes: 3
+`), 0644))
+
+	policy, err := LoadQuotaPolicy(path)
+	require.NoError(t, err)
+	assert.Equal(t, &Quota{MaxBytes: 2 << 30}, policy.Default)
+	assert.Equal(t, Quota{MaxBytes: 500e6, MaxVolumes: 3}, policy.Namespaces["batch"])
+
+	require.NoError(t, os.WriteFile(path, []byte("default:\n  maxCapacity: lots\n"), 0644))
+	_, err = LoadQuotaPolicy(path)
+	assert.Error(t, err)
+}
+
+func TestNamespaceQuota(t *testing.T) {
+	m, err := NewVolumeManager(t.TempDir())
+	require.NoError(t, err)
+	m.SetQuotaPolicy(&QuotaPolicy{
+		Default:    &Quota{MaxBytes: 3 << 20},
+		Namespaces: map[string]Quota{"batch": {MaxVolumes: 2}},
+	})
+
+	// Capacity is limited by the default quota
+	_, err = m.EnsureVolume("vol-1", 2<<20, podAttributes("web", "a"))
+	require.NoError(t, err)
+	_, err = m.EnsureVolume("vol-2", 2<<20, podAttributes("web", "b"))
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	_, err = m.EnsureVolume("vol-2", 1<<20, podAttributes("web", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, float64(3<<20), testutil.ToFloat64(metrics.NamespaceCapacityBytes.WithLabelValues("web")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.NamespaceVolumes.WithLabelValues("web")))
+
+	// The number of volumes by the namespace's own quota, counting volumes
+	// provisioned for its claims
+	_, err = m.EnsureVolume("vol-3", 1<<30, map[string]string{PVCNamespaceKey: "batch"})
+	require.NoError(t, err)
+	_, err = m.EnsureVolume("vol-4", 1<<30, podAttributes("batch", "a"))
+	require.NoError(t, err)
+	_, err = m.EnsureVolume("vol-5", 1<<30, podAttributes("batch", "b"))
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+
+	// Publishing an existing volume for a pod counts it against the pod's namespace
+	_, err = m.EnsureVolume("vol-1", 0, podAttributes("batch", "c"))
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	_, err = m.EnsureVolume("vol-1", 0, podAttributes("web", "c"))
+	require.NoError(t, err)
+
+	// Deleting frees the quota
+	require.NoError(t, m.DeleteVolume(context.Background(), "vol-4"))
+	_, err = m.EnsureVolume("vol-5", 1<<30, podAttributes("batch", "b"))
+	require.NoError(t, err)
+
+	// Volumes without a namespace are not limited
+	_, err = m.EnsureVolume("vol-6", 8<<20, nil)
+	require.NoError(t, err)
+}
+
+func TestVolumeMetricsFollowOwner(t *testing.T) {
+	baseDir := t.TempDir()
+	m, err := NewVolumeManager(baseDir)
+	require.NoError(t, err)
+
+	_, err = m.EnsureVolume("owned-1", 1<<20, podAttributes("web", "a"))
+	require.NoError(t, err)
+	require.NoError(t, m.UpdateVolumeUsage("owned-1", 4096))
+	assert.Equal(t, float64(4096), testutil.ToFloat64(metrics.VolumeUsedBytes.WithLabelValues("owned-1", "web", "a")))
+
+	// Publishing for another pod replaces the series of the previous one
+	require.NoError(t, m.UpdateVolume("owned-1", func(v *Volume) {
+		v.Pod = &PodInfo{Name: "b", Namespace: "web"}
+	}))
+	assert.Equal(t, float64(1<<20), testutil.ToFloat64(metrics.VolumeCapacityBytes.WithLabelValues("owned-1", "web", "b")))
+	assert.False(t, metrics.VolumeCapacityBytes.DeleteLabelValues("owned-1", "web", "a"))
+	assert.False(t, metrics.VolumeUsedBytes.DeleteLabelValues("owned-1", "web", "a"))
+
+	// The index is rebuilt after a restart
+	m, err = NewVolumeManager(baseDir)
+	require.NoError(t, err)
+	volumes := m.ListVolumesByOwner("web", "b")
+	require.Len(t, volumes, 1)
+	assert.Equal(t, "owned-1", volumes[0].ID)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.NamespaceVolumes.WithLabelValues("web")))
+
+	require.NoError(t, m.DeleteVolume(context.Background(), "owned-1"))
+	assert.False(t, metrics.VolumeCapacityBytes.DeleteLabelValues("owned-1", "web", "b"))
+	assert.Empty(t, m.ListVolumesByOwner("web", ""))
+}
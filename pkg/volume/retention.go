@@ -0,0 +1,180 @@
+package volume
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// RetentionMode selects what happens to the data of a volume once it is
+// released, i.e. deleted by the CO or unpublished for inline volumes
+type RetentionMode string
+
+const (
+	// RetentionDelete removes the data immediately. This is the default.
+	RetentionDelete RetentionMode = "delete"
+	// RetentionRetain keeps the data for a TTL after release
+	RetentionRetain RetentionMode = "retain"
+	// RetentionKeepOnFailure keeps the data for a TTL only if the pod that
+	// used the volume did not succeed
+	RetentionKeepOnFailure RetentionMode = "keepOnFailure"
+
+	// DefaultRetentionTTL applies to keepOnFailure when no TTL is given
+	DefaultRetentionTTL = 24 * time.Hour
+)
+
+// Keys of the pod information kubelet adds to the volume context when the
+// CSIDriver object sets podInfoOnMount
+const (
+	PodNameKey           = "csi.storage.k8s.io/pod.name"
+	PodNamespaceKey      = "csi.storage.k8s.io/pod.namespace"
+	PodUIDKey            = "csi.storage.k8s.io/pod.uid"
+	ServiceAccountKey    = "csi.storage.k8s.io/serviceAccount.name"
+	EphemeralVolumeKey   = "csi.storage.k8s.io/ephemeral"
+	RetentionPolicyParam = "retentionPolicy"
+)
+
+// RetentionPolicy is the parsed form of the retentionPolicy parameter
+type RetentionPolicy struct {
+	Mode RetentionMode
+	TTL  time.Duration
+}
+
+// ParseRetentionPolicy parses "delete", "retain:<duration>" or
+// "keepOnFailure[:<duration>]". An empty string means delete.
+func ParseRetentionPolicy(s string) (RetentionPolicy, error) {
+	mode, ttl, hasTTL := strings.Cut(s, ":")
+
+	policy := RetentionPolicy{Mode: RetentionMode(mode)}
+	switch policy.Mode {
+	case "", RetentionDelete:
+		if hasTTL {
+			return policy, fmt.Errorf("retention policy %q does not take a duration", s)
+		}
+		policy.Mode = RetentionDelete
+		return policy, nil
+	case RetentionRetain:
+		if !hasTTL {
+			return policy, fmt.Errorf("retention policy %q requires a duration, e.g. retain:1h", s)
+		}
+	case RetentionKeepOnFailure:
+		if !hasTTL {
+			policy.TTL = DefaultRetentionTTL
+			return policy, nil
+		}
+	default:
+		return policy, fmt.Errorf("unknown retention policy %q, must be delete, retain:<duration> or keepOnFailure[:<duration>]", s)
+	}
+
+	d, err := time.ParseDuration(ttl)
+	if err != nil || d <= 0 {
+		return policy, fmt.Errorf("invalid duration in retention policy %q", s)
+	}
+	policy.TTL = d
+	return policy, nil
+}
+
+// PodStatusGetter reports whether a pod completed successfully
+type PodStatusGetter interface {
+	PodSucceeded(ctx context.Context, namespace, name, uid string) (bool, error)
+}
+
+// IsRetained reports whether the volume was released and only kept around
+// because of its retention policy
+func (v *Volume) IsRetained() bool {
+	return v.RetainUntil != 0
+}
+
+// ReleaseVolume applies the retention policy of a volume whose consumer is
+// gone. It returns true if the data was deleted and false if it is retained
+// until the janitor expires it. pods may be nil, in which case the outcome
+// of the pod is unknown and keepOnFailure retains the data.
+func (m *VolumeManager) ReleaseVolume(ctx context.Context, volumeID string, pods PodStatusGetter) (bool, error) {
+	volume, err := m.GetVolume(volumeID)
+	if err != nil {
+		return false, err
+	}
+	if volume.IsRetained() {
+		return false, nil
+	}
+
+	policy, err := ParseRetentionPolicy(volume.Retention)
+	if err != nil {
+		// The policy was validated on creation, so this is metadata written
+		// by someone else. Err on the side of keeping the data.
+		klog.Warningf("Volume %s has an invalid retention policy, retaining it for %s: %v", volumeID, DefaultRetentionTTL, err)
+		policy = RetentionPolicy{Mode: RetentionRetain, TTL: DefaultRetentionTTL}
+	}
+
+	switch policy.Mode {
+	case RetentionDelete:
+		return true, m.DeleteVolume(ctx, volumeID)
+	case RetentionKeepOnFailure:
+		succeeded, err := podSucceeded(ctx, volume, pods)
+		if err != nil {
+			klog.Warningf("Could not determine whether the pod of volume %s succeeded, retaining it: %v", volumeID, err)
+		} else if succeeded {
+			return true, m.DeleteVolume(ctx, volumeID)
+		}
+	}
+
+	retainUntil := time.Now().Add(policy.TTL).Unix()
+	if err := m.UpdateVolume(volumeID, func(v *Volume) {
+		v.RetainUntil = retainUntil
+	}); err != nil {
+		return false, err
+	}
+	klog.Infof("Retaining volume %s until %s (policy %q)", volumeID, time.Unix(retainUntil, 0).UTC().Format(time.RFC3339), volume.Retention)
+
+	return false, nil
+}
+
+// ExpireRetainedVolumes deletes the retained volumes whose TTL passed before
+// now and returns their IDs
+func (m *VolumeManager) ExpireRetainedVolumes(ctx context.Context, now time.Time) ([]string, error) {
+	var expired []string
+	for _, volume := range m.ListVolumes() {
+		if !volume.IsRetained() || volume.RetainUntil > now.Unix() || volume.Deleting {
+			continue
+		}
+		if err := m.DeleteVolume(ctx, volume.ID); err != nil {
+			return expired, fmt.Errorf("failed to delete expired volume %s: %v", volume.ID, err)
+		}
+		klog.Infof("Deleted volume %s whose retention expired", volume.ID)
+		expired = append(expired, volume.ID)
+	}
+	return expired, nil
+}
+
+// RunRetentionJanitor expires retained volumes every interval until ctx is
+// done. Because retention deadlines are persisted with the volume metadata,
+// volumes retained before a restart are picked up again.
+func (m *VolumeManager) RunRetentionJanitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := m.ExpireRetainedVolumes(ctx, time.Now()); err != nil {
+			klog.Errorf("Retention janitor: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func podSucceeded(ctx context.Context, volume *Volume, pods PodStatusGetter) (bool, error) {
+	if volume.Pod == nil {
+		return false, fmt.Errorf("no pod information recorded for the volume")
+	}
+	if pods == nil {
+		return false, fmt.Errorf("pod status lookups are not configured")
+	}
+	return pods.PodSucceeded(ctx, volume.Pod.Namespace, volume.Pod.Name, volume.Pod.UID)
+}
@@ -0,0 +1,124 @@
+package volume
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakePods struct {
+	succeeded bool
+	err       error
+}
+
+func (f fakePods) PodSucceeded(ctx context.Context, namespace, name, uid string) (bool, error) {
+	return f.succeeded, f.err
+}
+
+func TestParseRetentionPolicy(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    RetentionPolicy
+		wantErr bool
+	}{
+		{in: "", want: RetentionPolicy{Mode: RetentionDelete}},
+		{in: "delete", want: RetentionPolicy{Mode: RetentionDelete}},
+		{in: "retain:1h", want: RetentionPolicy{Mode: RetentionRetain, TTL: time.Hour}},
+		{in: "keepOnFailure", want: RetentionPolicy{Mode: RetentionKeepOnFailure, TTL: DefaultRetentionTTL}},
+		{in: "keepOnFailure:30m", want: RetentionPolicy{Mode: RetentionKeepOnFailure, TTL: 30 * time.Minute}},
+		{in: "retain", wantErr: true},
+		{in: "retain:-1h", wantErr: true},
+		{in: "retain:soon", wantErr: true},
+		{in: "delete:1h", wantErr: true},
+		{in: "forever", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRetentionPolicy(tt.in)
+		if tt.wantErr {
+			assert.Error(t, err, tt.in)
+			continue
+		}
+		require.NoError(t, err, tt.in)
+		assert.Equal(t, tt.want, got, tt.in)
+	}
+}
+
+func TestReleaseVolume(t *testing.T) {
+	podInfo := map[string]string{
+		PodNamespaceKey: "default",
+		PodNameKey:      "job-1",
+	}
+
+	tests := []struct {
+		name      string
+		retention string
+		pods      PodStatusGetter
+		deleted   bool
+	}{
+		{name: "default deletes", deleted: true},
+		{name: "retain keeps", retention: "retain:1h"},
+		{name: "keepOnFailure deletes on success", retention: "keepOnFailure", pods: fakePods{succeeded: true}, deleted: true},
+		{name: "keepOnFailure keeps on failure", retention: "keepOnFailure", pods: fakePods{succeeded: false}},
+		{name: "keepOnFailure keeps when unknown", retention: "keepOnFailure", pods: fakePods{err: os.ErrNotExist}},
+		{name: "keepOnFailure keeps without lookups", retention: "keepOnFailure"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewVolumeManager(t.TempDir())
+			require.NoError(t, err)
+
+			attributes := copyAttributes(podInfo)
+			attributes[RetentionPolicyParam] = tt.retention
+			vol, err := m.EnsureVolume("test-volume", 0, attributes)
+			require.NoError(t, err)
+
+			deleted, err := m.ReleaseVolume(context.Background(), vol.ID, tt.pods)
+			require.NoError(t, err)
+			assert.Equal(t, tt.deleted, deleted)
+
+			_, statErr := os.Stat(vol.Path)
+			if tt.deleted {
+				assert.True(t, os.IsNotExist(statErr))
+				return
+			}
+			require.NoError(t, statErr)
+
+			retained, err := m.GetVolume(vol.ID)
+			require.NoError(t, err)
+			assert.True(t, retained.IsRetained())
+			assert.Greater(t, retained.RetainUntil, time.Now().Unix())
+		})
+	}
+}
+
+func TestExpireRetainedVolumesAfterRestart(t *testing.T) {
+	baseDir := t.TempDir()
+
+	m, err := NewVolumeManager(baseDir)
+	require.NoError(t, err)
+	vol, err := m.EnsureVolume("test-volume", 0, map[string]string{RetentionPolicyParam: "retain:1h"})
+	require.NoError(t, err)
+	_, err = m.ReleaseVolume(context.Background(), vol.ID, nil)
+	require.NoError(t, err)
+
+	// A new manager on the same directory picks up the retention deadline
+	m, err = NewVolumeManager(baseDir)
+	require.NoError(t, err)
+
+	expired, err := m.ExpireRetainedVolumes(context.Background(), time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, expired)
+
+	expired, err = m.ExpireRetainedVolumes(context.Background(), time.Now().Add(2*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test-volume"}, expired)
+	assert.Empty(t, m.ListVolumes())
+	_, err = os.Stat(vol.Path)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,143 @@
+package volume
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"k8s.io/klog/v2"
+)
+
+// selinuxXattr holds the SELinux label of a file
+const selinuxXattr = "security.selinux"
+
+// ErrSELinuxConflict is returned when a volume is published with an SELinux
+// label other than the one it is in use with
+var ErrSELinuxConflict = errors.New("volume is in use with another SELinux label")
+
+// ContextMounter is implemented by backends that mount a filesystem of their
+// own on the volume directory, which takes the SELinux label of the volume
+// as a context mount option instead of every file being relabeled
+type ContextMounter interface {
+	// RemountContext mounts the volume again with its SELinuxLabel
+	RemountContext(volume *Volume) error
+}
+
+// SELinuxContext returns the label of the context= option kubelet passes in
+// the mount flags of a volume on SELinux enabled nodes, or "" without one.
+// The label is usually quoted, as its MCS categories contain commas.
+func SELinuxContext(mountFlags []string) string {
+	for _, flag := range mountFlags {
+		for _, option := range splitMountOptions(flag) {
+			if label, ok := strings.CutPrefix(option, "context="); ok {
+				return strings.Trim(label, `"`)
+			}
+		}
+	}
+	return ""
+}
+
+// splitMountOptions splits comma separated mount options, keeping commas
+// within quotes
+func splitMountOptions(options string) []string {
+	var split []string
+	quoted, start := false, 0
+	for i, c := range options {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			split = append(split, options[start:i])
+			start = i + 1
+		}
+	}
+	return append(split, options[start:])
+}
+
+// contextOption returns the mount option applying an SELinux label to a
+// whole filesystem
+func contextOption(label string) string {
+	return fmt.Sprintf("context=%q", label)
+}
+
+// ApplySELinuxLabel labels the contents of a volume with label, the
+// context kubelet passes for the pod it is published for, so that the
+// containers of the pod, which run with the same MCS categories, can use
+// it. Volumes of a backend mounting its own filesystem are remounted with
+// a context mount option, plain directories are relabeled file by file.
+// Relabeling is skipped if the volume already has the label.
+func (m *VolumeManager) ApplySELinuxLabel(volumeID, targetPath, label string) error {
+	if label == "" {
+		return nil
+	}
+
+	m.setupMu.Lock()
+	defer m.setupMu.Unlock()
+
+	volume, err := m.GetVolume(volumeID)
+	if err != nil {
+		return err
+	}
+	if volume.SELinuxLabel == label {
+		return nil
+	}
+	// Relabeling would lock out the pod the volume is published for
+	if volume.MountPoint != "" && volume.MountPoint != targetPath && volume.SELinuxLabel != "" {
+		return fmt.Errorf("%w: %s", ErrSELinuxConflict, volume.SELinuxLabel)
+	}
+
+	backend, err := m.backendFor(volume)
+	if err != nil {
+		return err
+	}
+	volume.SELinuxLabel = label
+	if remounter, ok := backend.(ContextMounter); ok {
+		err = remounter.RemountContext(volume)
+	} else {
+		err = relabelTree(volume.Path, label, m.setFileLabel)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to label volume %s with %s: %v", volumeID, label, err)
+	}
+	klog.Infof("Labeled volume %s with SELinux context %s", volumeID, label)
+
+	return m.UpdateVolume(volumeID, func(v *Volume) {
+		v.SELinuxLabel = label
+	})
+}
+
+// relabelTree sets the label of every file below root, without following
+// symlinks
+func relabelTree(root, label string, setFileLabel func(path, label string) error) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return setFileLabel(path, label)
+	})
+}
+
+// lsetfilecon sets the SELinux label of path like lsetfilecon(3), which
+// stores it NUL terminated. Symlinks are labeled themselves, never their
+// targets, which may be outside the volume.
+func lsetfilecon(path, label string) error {
+	pathPtr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	namePtr, err := syscall.BytePtrFromString(selinuxXattr)
+	if err != nil {
+		return err
+	}
+	value := append([]byte(label), 0)
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(namePtr)),
+		uintptr(unsafe.Pointer(&value[0])), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return &fs.PathError{Op: "lsetxattr", Path: path, Err: errno}
+	}
+	return nil
+}
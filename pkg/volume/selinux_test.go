@@ -0,0 +1,84 @@
+package volume
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testLabel = "system_u:object_r:container_file_t:s0:c1,c2"
+
+func TestSELinuxContext(t *testing.T) {
+	assert.Equal(t, testLabel, SELinuxContext([]string{`context="` + testLabel + `"`}))
+	assert.Equal(t, testLabel, SELinuxContext([]string{"noatime", `ro,context="` + testLabel + `",nodev`}))
+	assert.Equal(t, "system_u:object_r:container_file_t:s0", SELinuxContext([]string{"context=system_u:object_r:container_file_t:s0"}))
+	assert.Empty(t, SELinuxContext([]string{"noatime"}))
+	assert.Empty(t, SELinuxContext(nil))
+}
+
+func TestApplySELinuxLabel(t *testing.T) {
+	m, err := NewVolumeManager(t.TempDir())
+	require.NoError(t, err)
+	labels := make(map[string]string)
+	m.setFileLabel = func(path, label string) error {
+		labels[path] = label
+		return nil
+	}
+
+	vol, err := m.EnsureVolume("vol-1", 0, nil)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(vol.Path, "dir"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(vol.Path, "dir", "file"), nil, 0644))
+	require.NoError(t, os.Symlink("/etc/passwd", filepath.Join(vol.Path, "link")))
+
+	// Without a context there is nothing to do
+	require.NoError(t, m.ApplySELinuxLabel(vol.ID, "/target-1", ""))
+	assert.Empty(t, labels)
+
+	require.NoError(t, m.ApplySELinuxLabel(vol.ID, "/target-1", testLabel))
+	assert.Equal(t, map[string]string{
+		vol.Path:                               testLabel,
+		filepath.Join(vol.Path, "dir"):         testLabel,
+		filepath.Join(vol.Path, "dir", "file"): testLabel,
+		filepath.Join(vol.Path, "link"):        testLabel,
+	}, labels)
+	vol, err = m.GetVolume(vol.ID)
+	require.NoError(t, err)
+	assert.Equal(t, testLabel, vol.SELinuxLabel)
+
+	// A volume that has the label already is not walked again
+	clear(labels)
+	require.NoError(t, m.ApplySELinuxLabel(vol.ID, "/target-1", testLabel))
+	assert.Empty(t, labels)
+
+	// Relabeling a volume in use by another pod would lock that pod out
+	require.NoError(t, m.UpdateVolume(vol.ID, func(v *Volume) { v.MountPoint = "/target-1" }))
+	err = m.ApplySELinuxLabel(vol.ID, "/target-2", "system_u:object_r:container_file_t:s0:c3,c4")
+	assert.ErrorIs(t, err, ErrSELinuxConflict)
+	assert.Empty(t, labels)
+}
+
+func TestApplySELinuxLabelOverlay(t *testing.T) {
+	m, mounter, _ := newOverlayManager(t)
+	m.setFileLabel = func(path, label string) error {
+		t.Errorf("overlay volume relabeled file by file: %s", path)
+		return nil
+	}
+
+	vol, err := m.EnsureVolume("vol-1", 64<<20, map[string]string{BaseLayerParam: "dataset"})
+	require.NoError(t, err)
+	require.NoError(t, m.SetupVolume(vol.ID))
+	assert.NotContains(t, mounter.MountOptions(vol.Path), contextOption(testLabel))
+
+	// The overlay is mounted again with the context of the pod
+	require.NoError(t, m.ApplySELinuxLabel(vol.ID, "/target", testLabel))
+	assert.Contains(t, mounter.MountOptions(vol.Path), `context="`+testLabel+`"`)
+
+	// and keeps it when set up again after a restart
+	require.NoError(t, mounter.Unmount(vol.Path, 0))
+	require.NoError(t, m.SetupVolume(vol.ID))
+	assert.Contains(t, mounter.MountOptions(vol.Path), `context="`+testLabel+`"`)
+}
@@ -0,0 +1,45 @@
+package volume
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// ShareKeyParam is the inline volume attribute naming a volume that the
+// pods of a namespace share on the node. Every publish with the same key is
+// mapped onto one backing volume, which is released once the last pod
+// using it unpublishes it.
+const ShareKeyParam = "shareKey"
+
+// shareKeyPattern matches a DNS label, like the namespace names share keys
+// are scoped by
+var shareKeyPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// ValidateShareAttributes checks the share key of an inline volume
+func ValidateShareAttributes(attributes map[string]string) error {
+	key, ok := attributes[ShareKeyParam]
+	if !ok {
+		return nil
+	}
+	if !shareKeyPattern.MatchString(key) {
+		return fmt.Errorf("invalid %s %q, must be a DNS label", ShareKeyParam, key)
+	}
+	return nil
+}
+
+// SharedVolumeID returns the ID of the volume a publish of volumeID with
+// volumeContext is mapped onto. That is volumeID itself, unless the context
+// has a share key, in which case the volume is shared by all pods of the
+// namespace that use the key. Namespaces cannot contain dots, so IDs of
+// different namespaces never collide.
+func SharedVolumeID(volumeID string, volumeContext map[string]string) (string, error) {
+	key := volumeContext[ShareKeyParam]
+	if key == "" {
+		return volumeID, nil
+	}
+	namespace := volumeContext[PodNamespaceKey]
+	if namespace == "" {
+		return "", fmt.Errorf("%s requires the pod namespace, enable podInfoOnMount", ShareKeyParam)
+	}
+	return fmt.Sprintf("share-%s.%s", namespace, key), nil
+}
@@ -0,0 +1,85 @@
+package volume
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedVolumeID(t *testing.T) {
+	id, err := SharedVolumeID("csi-1", map[string]string{PodNamespaceKey: "team"})
+	require.NoError(t, err)
+	assert.Equal(t, "csi-1", id)
+
+	id, err = SharedVolumeID("csi-1", map[string]string{ShareKeyParam: "cache", PodNamespaceKey: "team"})
+	require.NoError(t, err)
+	assert.Equal(t, "share-team.cache", id)
+	require.NoError(t, validateVolumeID(id))
+
+	_, err = SharedVolumeID("csi-1", map[string]string{ShareKeyParam: "cache"})
+	assert.Error(t, err)
+
+	for _, key := range []string{"cache", "build-1", "a"} {
+		assert.NoError(t, ValidateShareAttributes(map[string]string{ShareKeyParam: key}), key)
+	}
+	for _, key := range []string{"", "Cache", "../x", "a.b", "-a"} {
+		assert.Error(t, ValidateShareAttributes(map[string]string{ShareKeyParam: key}), key)
+	}
+}
+
+func TestRemoveSharedTarget(t *testing.T) {
+	m, err := NewVolumeManager(t.TempDir())
+	require.NoError(t, err)
+	vol, err := m.EnsureEphemeralVolume("share-team.cache", 0, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.AddTarget(vol.ID, "/a", "uid-1", false))
+	require.NoError(t, m.AddTarget(vol.ID, "/b", "uid-2", false))
+	require.NoError(t, m.UpdateVolume(vol.ID, func(v *Volume) { v.MountPoint = "/a" }))
+	assert.Equal(t, vol.ID, m.PublishedVolumeID("csi-2", "/b"))
+	assert.Equal(t, "csi-3", m.PublishedVolumeID("csi-3", "/c"))
+
+	// The mount point moves on to a remaining target
+	require.NoError(t, m.RemoveTarget(vol.ID, "/a"))
+	vol, err = m.GetVolume(vol.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "/b", vol.MountPoint)
+	assert.Equal(t, []string{"uid-2"}, vol.PodUIDs())
+
+	require.NoError(t, m.RemoveTarget(vol.ID, "/b"))
+	vol, err = m.GetVolume(vol.ID)
+	require.NoError(t, err)
+	assert.Empty(t, vol.MountPoint)
+	assert.Empty(t, vol.PodUIDs())
+}
+
+func TestForceUnpublishSharedVolume(t *testing.T) {
+	m, err := NewVolumeManager(t.TempDir())
+	require.NoError(t, err)
+	mounter := NewFakeMounter()
+	nm := NewNodeMounter(m, mounter)
+	vol, err := m.EnsureEphemeralVolume("share-team.cache", 0, nil)
+	require.NoError(t, err)
+
+	var targets []string
+	for _, uid := range []string{"uid-1", "uid-2"} {
+		target := filepath.Join(t.TempDir(), "target")
+		require.NoError(t, nm.NodePublishVolume(&csi.NodePublishVolumeRequest{
+			VolumeId:      vol.ID,
+			TargetPath:    target,
+			VolumeContext: map[string]string{PodUIDKey: uid},
+		}))
+		targets = append(targets, target)
+	}
+
+	detached, err := nm.ForceUnpublishVolume(vol.ID)
+	require.NoError(t, err)
+	assert.Equal(t, targets, detached)
+	assert.Empty(t, mounter.Mounts())
+	vol, err = m.GetVolume(vol.ID)
+	require.NoError(t, err)
+	assert.Empty(t, vol.Targets)
+	assert.Empty(t, vol.MountPoint)
+}
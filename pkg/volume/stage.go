@@ -0,0 +1,128 @@
+package volume
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog/v2"
+)
+
+// ErrVolumeStaged is returned when staging a volume that is already staged
+// at another path
+var ErrVolumeStaged = errors.New("volume is staged at another path")
+
+// NodeStageVolume makes the global mount of a volume available at the
+// staging path, which the targets of the volume are then bind mounted from.
+// The backend mounts or opens its storage once per volume, on the volume
+// directory, and staging binds that directory. NodeUnstageVolume releases
+// the storage again. Plain directories have no global mount and are
+// published straight from the volume directory, so staging them does
+// nothing. Staging again at the same path succeeds.
+func (m *NodeMounter) NodeStageVolume(req *csi.NodeStageVolumeRequest) error {
+	volumeID := req.GetVolumeId()
+	stagingPath := req.GetStagingTargetPath()
+
+	volume, err := m.volumeManager.GetVolume(volumeID)
+	if err != nil {
+		return fmt.Errorf("failed to get volume: %w", err)
+	}
+	if volume.Backend == "" {
+		klog.V(4).Infof("Volume %s is a plain directory, nothing to stage", volumeID)
+		return nil
+	}
+	if volume.StagingPath != "" && volume.StagingPath != stagingPath {
+		return fmt.Errorf("%w: %s", ErrVolumeStaged, volume.StagingPath)
+	}
+
+	if err := m.volumeManager.SetupVolume(volumeID); err != nil {
+		return fmt.Errorf("failed to set up volume: %w", err)
+	}
+	if err := m.stage(volume, stagingPath); err != nil {
+		return err
+	}
+	if err := m.volumeManager.UpdateVolume(volumeID, func(v *Volume) {
+		v.StagingPath = stagingPath
+	}); err != nil {
+		return err
+	}
+	klog.Infof("Staged volume %s at %s", volumeID, stagingPath)
+
+	return nil
+}
+
+// NodeUnstageVolume unmounts the global mount of a volume from the staging
+// path, and has the backend release the storage of the volume unless it is
+// still published. The staging directory itself belongs to the CO.
+func (m *NodeMounter) NodeUnstageVolume(req *csi.NodeUnstageVolumeRequest) error {
+	volumeID := req.GetVolumeId()
+	stagingPath := req.GetStagingTargetPath()
+
+	mounted, err := m.mounter.IsMountPoint(stagingPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to check mount point: %v", err)
+	}
+	if mounted {
+		if err := m.mounter.Unmount(stagingPath, 0); err != nil {
+			return fmt.Errorf("failed to unmount staging path: %v", err)
+		}
+	}
+
+	// The volume may already be gone, e.g. after a retried call
+	released := false
+	err = m.volumeManager.UpdateVolume(volumeID, func(v *Volume) {
+		if v.StagingPath == stagingPath {
+			v.StagingPath = ""
+		}
+		released = v.StagingPath == "" && len(v.Targets) == 0
+	})
+	if errors.Is(err, ErrVolumeNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if released {
+		if err := m.volumeManager.releaseVolume(volumeID); err != nil {
+			return fmt.Errorf("failed to release volume: %w", err)
+		}
+	}
+	klog.Infof("Unstaged volume %s from %s", volumeID, stagingPath)
+
+	return nil
+}
+
+// publishSource returns the directory the targets of volume are bind
+// mounted from: the staging path if the volume is staged there, otherwise
+// the volume directory. A staging mount lost to a reboot is mounted again,
+// as kubelet only stages volumes it does not consider staged.
+func (m *NodeMounter) publishSource(volume *Volume, stagingPath string) (string, error) {
+	if stagingPath == "" || volume.StagingPath != stagingPath {
+		return volume.Path, nil
+	}
+	if err := m.stage(volume, stagingPath); err != nil {
+		return "", err
+	}
+	return stagingPath, nil
+}
+
+// stage bind mounts the volume directory at the staging path, unless it is
+// mounted there already
+func (m *NodeMounter) stage(volume *Volume, stagingPath string) error {
+	mounted, err := m.mounter.IsMountPoint(stagingPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to check mount point: %v", err)
+	}
+	if mounted {
+		return nil
+	}
+
+	if err := os.MkdirAll(stagingPath, 0750); err != nil {
+		return fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	if err := m.mounter.BindMount(volume.Path, stagingPath); err != nil {
+		return fmt.Errorf("failed to stage volume: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package volume
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStageVolume(t *testing.T) {
+	m, mounter, _ := newOverlayManager(t)
+	nm := NewNodeMounter(m, mounter)
+	vol, err := m.EnsureVolume("vol-1", 64<<20, map[string]string{BaseLayerParam: "dataset"})
+	require.NoError(t, err)
+	require.NoError(t, m.SetupVolume(vol.ID))
+
+	staging := filepath.Join(t.TempDir(), "globalmount")
+	stage := &csi.NodeStageVolumeRequest{VolumeId: vol.ID, StagingTargetPath: staging}
+	require.NoError(t, nm.NodeStageVolume(stage))
+	require.NoError(t, nm.NodeStageVolume(stage), "staging again succeeds")
+	assert.Equal(t, vol.Path, mounter.Mounts()[staging])
+	assert.ErrorIs(t, nm.NodeStageVolume(&csi.NodeStageVolumeRequest{VolumeId: vol.ID, StagingTargetPath: t.TempDir()}), ErrVolumeStaged)
+
+	// Targets bind the global mount from the staging path
+	publish := func(target string) {
+		t.Helper()
+		require.NoError(t, nm.NodePublishVolume(&csi.NodePublishVolumeRequest{
+			VolumeId:          vol.ID,
+			StagingTargetPath: staging,
+			TargetPath:        target,
+		}))
+		assert.Equal(t, staging, mounter.Mounts()[target])
+	}
+	publish(filepath.Join(t.TempDir(), "first"))
+
+	// The staging mount is gone after a reboot, while the metadata is not
+	require.NoError(t, mounter.Unmount(staging, 0))
+	m, err = NewVolumeManager(m.BaseDir())
+	require.NoError(t, err)
+	nm = NewNodeMounter(m, mounter)
+	publish(filepath.Join(t.TempDir(), "second"))
+	assert.Equal(t, vol.Path, mounter.Mounts()[staging])
+
+	unstage := &csi.NodeUnstageVolumeRequest{VolumeId: vol.ID, StagingTargetPath: staging}
+	require.NoError(t, nm.NodeUnstageVolume(unstage))
+	require.NoError(t, nm.NodeUnstageVolume(unstage), "unstaging again succeeds")
+	assert.NotContains(t, mounter.Mounts(), staging)
+	vol, err = m.GetVolume(vol.ID)
+	require.NoError(t, err)
+	assert.Empty(t, vol.StagingPath)
+}
+
+func TestUnstageReleasesBackend(t *testing.T) {
+	m, mounter, _ := newOverlayManager(t)
+	nm := NewNodeMounter(m, mounter)
+	vol, err := m.EnsureVolume("vol-1", 64<<20, map[string]string{BaseLayerParam: "dataset"})
+	require.NoError(t, err)
+	upperFS := filepath.Join(overlayState(vol), "fs")
+
+	// Staging mounts the overlay and its upper layer image
+	staging := filepath.Join(t.TempDir(), "globalmount")
+	require.NoError(t, nm.NodeStageVolume(&csi.NodeStageVolumeRequest{VolumeId: vol.ID, StagingTargetPath: staging}))
+	mounts := mounter.Mounts()
+	assert.Equal(t, "overlay", mounts[vol.Path])
+	assert.Contains(t, mounts, upperFS)
+	assert.Equal(t, vol.Path, mounts[staging])
+
+	// and unstaging releases them, keeping the image
+	require.NoError(t, nm.NodeUnstageVolume(&csi.NodeUnstageVolumeRequest{VolumeId: vol.ID, StagingTargetPath: staging}))
+	assert.Empty(t, mounter.Mounts())
+	assert.FileExists(t, filepath.Join(overlayState(vol), "upper.img"))
+
+	require.NoError(t, nm.NodeStageVolume(&csi.NodeStageVolumeRequest{VolumeId: vol.ID, StagingTargetPath: staging}))
+	assert.Equal(t, "overlay", mounter.Mounts()[vol.Path])
+}
+
+func TestStageVolumeAfterReboot(t *testing.T) {
+	m, mounter, layersDir := newOverlayManager(t)
+	nm := NewNodeMounter(m, mounter)
+	vol, err := m.EnsureVolume("vol-1", 64<<20, map[string]string{BaseLayerParam: "dataset"})
+	require.NoError(t, err)
+	staging := filepath.Join(t.TempDir(), "globalmount")
+	require.NoError(t, nm.NodeStageVolume(&csi.NodeStageVolumeRequest{VolumeId: vol.ID, StagingTargetPath: staging}))
+
+	// After a reboot no mounts are left, only the metadata and the image
+	m, err = NewVolumeManager(m.BaseDir())
+	require.NoError(t, err)
+	mounter = NewFakeMounter()
+	backend := NewOverlayBackend(mounter, layersDir, nil).(*overlayBackend)
+	backend.mkfs = func(string) error { return nil }
+	m.RegisterBackend(OverlayBackendName, backend)
+	nm = NewNodeMounter(m, mounter)
+
+	// Kubelet stages the volume again, which sets up the backend before
+	// binding the global mount
+	require.NoError(t, nm.NodeStageVolume(&csi.NodeStageVolumeRequest{VolumeId: vol.ID, StagingTargetPath: staging}))
+	mounts := mounter.Mounts()
+	assert.Equal(t, "overlay", mounts[vol.Path])
+	assert.Contains(t, mounts, filepath.Join(overlayState(vol), "fs"))
+	assert.Equal(t, vol.Path, mounts[staging])
+
+	target := filepath.Join(t.TempDir(), "target")
+	require.NoError(t, nm.NodePublishVolume(&csi.NodePublishVolumeRequest{
+		VolumeId:          vol.ID,
+		StagingTargetPath: staging,
+		TargetPath:        target,
+	}))
+	assert.Equal(t, staging, mounter.Mounts()[target])
+}
+
+func TestStagePlainVolume(t *testing.T) {
+	m, err := NewVolumeManager(t.TempDir())
+	require.NoError(t, err)
+	mounter := NewFakeMounter()
+	nm := NewNodeMounter(m, mounter)
+	vol, err := m.EnsureVolume("vol-1", 0, nil)
+	require.NoError(t, err)
+
+	// Plain directories are published from the volume directory
+	staging := filepath.Join(t.TempDir(), "globalmount")
+	require.NoError(t, nm.NodeStageVolume(&csi.NodeStageVolumeRequest{VolumeId: vol.ID, StagingTargetPath: staging}))
+	target := filepath.Join(t.TempDir(), "target")
+	require.NoError(t, nm.NodePublishVolume(&csi.NodePublishVolumeRequest{
+		VolumeId:          vol.ID,
+		StagingTargetPath: staging,
+		TargetPath:        target,
+	}))
+	assert.Equal(t, map[string]string{target: vol.Path}, mounter.Mounts())
+	require.NoError(t, nm.NodeUnstageVolume(&csi.NodeUnstageVolumeRequest{VolumeId: vol.ID, StagingTargetPath: staging}))
+}
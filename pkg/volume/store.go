@@ -0,0 +1,141 @@
+package volume
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// metadataDir holds one JSON document per volume so that state survives
+	// driver restarts. It lives under the base directory and is hidden so it
+	// is never mistaken for a volume.
+	metadataDir = ".metadata"
+)
+
+func (m *VolumeManager) metadataPath(volumeID string) string {
+	return filepath.Join(m.baseDir, metadataDir, volumeID+".json")
+}
+
+// saveVolume persists the volume metadata atomically
+func (m *VolumeManager) saveVolume(volume *Volume) error {
+	if err := os.MkdirAll(filepath.Join(m.baseDir, metadataDir), defaultVolumePermissions); err != nil {
+		return fmt.Errorf("failed to create metadata directory: %v", err)
+	}
+
+	data, err := json.MarshalIndent(volume, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata for volume %s: %v", volume.ID, err)
+	}
+
+	path := m.metadataPath(volume.ID)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write metadata for volume %s: %v", volume.ID, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write metadata for volume %s: %v", volume.ID, err)
+	}
+
+	return nil
+}
+
+// removeVolumeMetadata deletes the persisted metadata of a volume
+func (m *VolumeManager) removeVolumeMetadata(volumeID string) error {
+	if err := os.Remove(m.metadataPath(volumeID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove metadata for volume %s: %v", volumeID, err)
+	}
+	return nil
+}
+
+// loadVolumes restores the volume map from the metadata directory. Volume
+// directories without metadata, e.g. created by an older driver version,
+// are adopted with default attributes.
+func (m *VolumeManager) loadVolumes() error {
+	entries, err := os.ReadDir(filepath.Join(m.baseDir, metadataDir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(m.baseDir, metadataDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+
+		volume := &Volume{}
+		if err := json.Unmarshal(data, volume); err != nil {
+			klog.Warningf("Ignoring corrupt metadata file %s: %v", entry.Name(), err)
+			continue
+		}
+		if validateVolumeID(volume.ID) != nil {
+			klog.Warningf("Ignoring metadata file %s with invalid volume ID %q", entry.Name(), volume.ID)
+			continue
+		}
+		// Inline volumes recorded before pod ownership was tracked
+		if volume.Pod == nil {
+			volume.Pod = PodInfoFromContext(volume.Attributes)
+		}
+		// Volumes created before pools were configurable
+		if volume.Pool == "" {
+			volume.Pool = DefaultPoolName
+		}
+		// Volumes published before all targets were tracked
+		if volume.MountPoint != "" && len(volume.Targets) == 0 {
+			volume.Targets = []string{volume.MountPoint}
+		}
+		// Volumes throttled before cgroups were recorded by target
+		if volume.IOCgroup != "" {
+			if volume.MountPoint != "" {
+				volume.IOCgroups = map[string]string{volume.MountPoint: volume.IOCgroup}
+			}
+			volume.IOCgroup = ""
+		}
+		m.volumes[volume.ID] = volume
+	}
+
+	dirs, err := os.ReadDir(m.baseDir)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() || strings.HasPrefix(dir.Name(), ".") {
+			continue
+		}
+		if _, exists := m.volumes[dir.Name()]; exists {
+			continue
+		}
+
+		createdAt := time.Now().Unix()
+		if info, err := dir.Info(); err == nil {
+			createdAt = info.ModTime().Unix()
+		}
+
+		volume := &Volume{
+			ID:        dir.Name(),
+			Path:      filepath.Join(m.baseDir, dir.Name()),
+			Size:      parseSize(0),
+			CreatedAt: createdAt,
+			Pool:      DefaultPoolName,
+		}
+		if err := m.saveVolume(volume); err != nil {
+			return err
+		}
+		m.volumes[volume.ID] = volume
+		klog.Infof("Adopted existing volume directory %s", volume.Path)
+	}
+
+	m.indexAllLocked()
+	klog.V(4).Infof("Loaded %d volumes from %s", len(m.volumes), m.baseDir)
+	return nil
+}
@@ -0,0 +1,249 @@
+package volume
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"k8s.io/klog/v2"
+)
+
+// Attributes limiting the I/O of the pod a volume is published for
+const (
+	ReadBpsParam   = "readBps"
+	WriteBpsParam  = "writeBps"
+	ReadIopsParam  = "readIops"
+	WriteIopsParam = "writeIops"
+
+	// DefaultCgroupRoot is where the cgroup v2 hierarchy is mounted
+	DefaultCgroupRoot = "/sys/fs/cgroup"
+)
+
+var (
+	// ErrIOLimitsUnsupported is returned when I/O limits are requested for a
+	// volume that is not backed by a block device of its own
+	ErrIOLimitsUnsupported = errors.New("I/O limits require a block-backed volume")
+	// ErrPodCgroupNotFound is returned when the cgroup of the pod a volume
+	// is published for cannot be found
+	ErrPodCgroupNotFound = errors.New("pod cgroup not found")
+)
+
+// BlockDevicer is implemented by backends that put a volume on a block
+// device of its own, which can be throttled
+type BlockDevicer interface {
+	// Device returns the major:minor number of the block device of a set
+	// up volume
+	Device(volume *Volume) (string, error)
+}
+
+// IOLimits are the cgroup v2 io.max limits of a volume, zero values are
+// unlimited
+type IOLimits struct {
+	ReadBps   int64
+	WriteBps  int64
+	ReadIops  int64
+	WriteIops int64
+}
+
+// ParseIOLimits reads the I/O limits from the attributes of a volume.
+// Bandwidths accept suffixes such as Mi.
+func ParseIOLimits(attributes map[string]string) (IOLimits, error) {
+	var limits IOLimits
+	for _, limit := range []struct {
+		param string
+		value *int64
+		bytes bool
+	}{
+		{ReadBpsParam, &limits.ReadBps, true},
+		{WriteBpsParam, &limits.WriteBps, true},
+		{ReadIopsParam, &limits.ReadIops, false},
+		{WriteIopsParam, &limits.WriteIops, false},
+	} {
+		s := attributes[limit.param]
+		if s == "" {
+			continue
+		}
+		var err error
+		if limit.bytes {
+			*limit.value, err = parseByteSize(s)
+		} else {
+			*limit.value, err = strconv.ParseInt(s, 10, 64)
+		}
+		if err != nil || *limit.value <= 0 {
+			return IOLimits{}, fmt.Errorf("invalid %s value %q, must be a positive number", limit.param, s)
+		}
+	}
+	return limits, nil
+}
+
+// IsZero reports whether no limit is set
+func (l IOLimits) IsZero() bool {
+	return l == IOLimits{}
+}
+
+// ioMaxLine formats the io.max line of device, unset limits are lifted
+func (l IOLimits) ioMaxLine(device string) string {
+	format := func(v int64) string {
+		if v == 0 {
+			return "max"
+		}
+		return strconv.FormatInt(v, 10)
+	}
+	return fmt.Sprintf("%s rbps=%s wbps=%s riops=%s wiops=%s\n",
+		device, format(l.ReadBps), format(l.WriteBps), format(l.ReadIops), format(l.WriteIops))
+}
+
+// SetCgroupRoot sets where the cgroup v2 hierarchy is mounted, which
+// defaults to DefaultCgroupRoot
+func (m *VolumeManager) SetCgroupRoot(root string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cgroupRoot = root
+}
+
+// ApplyIOLimits limits the I/O the pod described by volumeContext does on
+// the device of the volume, as requested by the context. The cgroup is
+// recorded for target, so the limits can be removed when the volume is
+// unpublished from it.
+func (m *VolumeManager) ApplyIOLimits(volumeID, target string, volumeContext map[string]string) error {
+	limits, err := ParseIOLimits(volumeContext)
+	if err != nil || limits.IsZero() {
+		return err
+	}
+
+	volume, err := m.GetVolume(volumeID)
+	if err != nil {
+		return err
+	}
+	backend, err := m.backendFor(volume)
+	if err != nil {
+		return err
+	}
+	devicer, ok := backend.(BlockDevicer)
+	if !ok {
+		return fmt.Errorf("%w, volume %s is a plain directory", ErrIOLimitsUnsupported, volumeID)
+	}
+	device, err := devicer.Device(volume)
+	if err != nil {
+		return err
+	}
+
+	uid := volumeContext[PodUIDKey]
+	if uid == "" {
+		return fmt.Errorf("%w: the volume context has no pod UID, podInfoOnMount must be enabled", ErrPodCgroupNotFound)
+	}
+	m.mu.RLock()
+	root := m.cgroupRoot
+	m.mu.RUnlock()
+	cgroup, err := findPodCgroup(root, uid)
+	if err != nil {
+		return err
+	}
+
+	if err := writeIOMax(cgroup, limits.ioMaxLine(device)); err != nil {
+		return err
+	}
+	klog.Infof("Limited I/O of pod %s on volume %s (%s): %+v", uid, volumeID, device, limits)
+
+	return m.UpdateVolume(volumeID, func(v *Volume) {
+		if v.IOCgroups == nil {
+			v.IOCgroups = make(map[string]string)
+		}
+		v.IOCgroups[target] = cgroup
+		v.IODevice = device
+	})
+}
+
+// RemoveIOLimits lifts the limits ApplyIOLimits set for the pod of target,
+// unless another target of the same pod still uses the volume. A pod cgroup
+// that is already gone has no limits left to remove.
+func (m *VolumeManager) RemoveIOLimits(volumeID, target string) error {
+	volume, err := m.GetVolume(volumeID)
+	if errors.Is(err, ErrVolumeNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cgroup, ok := volume.IOCgroups[target]
+	if !ok {
+		return nil
+	}
+
+	inUse := false
+	for other, otherCgroup := range volume.IOCgroups {
+		inUse = inUse || (other != target && otherCgroup == cgroup)
+	}
+	if !inUse {
+		err = writeIOMax(cgroup, IOLimits{}.ioMaxLine(volume.IODevice))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		klog.V(4).Infof("Removed I/O limits of volume %s from %s", volumeID, cgroup)
+	}
+
+	return m.UpdateVolume(volumeID, func(v *Volume) {
+		delete(v.IOCgroups, target)
+		if len(v.IOCgroups) == 0 {
+			v.IOCgroups = nil
+			v.IODevice = ""
+		}
+	})
+}
+
+// findPodCgroup returns the cgroup of the pod with the given UID, as laid
+// out by kubelet with either the systemd or the cgroupfs cgroup driver
+func findPodCgroup(root, uid string) (string, error) {
+	if strings.ContainsAny(uid, "/.") {
+		return "", fmt.Errorf("%w: invalid pod UID %q", ErrPodCgroupNotFound, uid)
+	}
+	escaped := strings.ReplaceAll(uid, "-", "_")
+	candidates := []string{
+		filepath.Join("kubepods.slice", "kubepods-pod"+escaped+".slice"),
+		filepath.Join("kubepods.slice", "kubepods-burstable.slice", "kubepods-burstable-pod"+escaped+".slice"),
+		filepath.Join("kubepods.slice", "kubepods-besteffort.slice", "kubepods-besteffort-pod"+escaped+".slice"),
+		filepath.Join("kubepods", "pod"+uid),
+		filepath.Join("kubepods", "burstable", "pod"+uid),
+		filepath.Join("kubepods", "besteffort", "pod"+uid),
+	}
+	for _, candidate := range candidates {
+		path := filepath.Join(root, candidate)
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%w: no cgroup for pod %s below %s", ErrPodCgroupNotFound, uid, root)
+}
+
+func writeIOMax(cgroup, line string) error {
+	f, err := os.OpenFile(filepath.Join(cgroup, "io.max"), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open io.max of %s: %w", cgroup, err)
+	}
+	_, err = f.WriteString(line)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write io.max of %s: %w", cgroup, err)
+	}
+	return nil
+}
+
+// deviceNumber returns the major:minor number of the device holding the
+// filesystem path is on
+func deviceNumber(path string) (string, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return "", err
+	}
+	dev := uint64(stat.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	return fmt.Sprintf("%d:%d", major, minor), nil
+}
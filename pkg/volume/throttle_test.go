@@ -0,0 +1,89 @@
+package volume
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockBackend is a backend whose volumes are on device 7:3
+type blockBackend struct{}
+
+func (blockBackend) Setup(*Volume) error            { return nil }
+func (blockBackend) Teardown(*Volume) error         { return nil }
+func (blockBackend) Device(*Volume) (string, error) { return "7:3", nil }
+
+func TestParseIOLimits(t *testing.T) {
+	limits, err := ParseIOLimits(map[string]string{ReadBpsParam: "10Mi", WriteIopsParam: "500"})
+	require.NoError(t, err)
+	assert.Equal(t, IOLimits{ReadBps: 10 << 20, WriteIops: 500}, limits)
+	assert.Equal(t, "7:3 rbps=10485760 wbps=max riops=max wiops=500\n", limits.ioMaxLine("7:3"))
+
+	for _, value := range []string{"0", "-1", "fast", "1.5"} {
+		_, err := ParseIOLimits(map[string]string{ReadIopsParam: value})
+		assert.Error(t, err, value)
+	}
+}
+
+func TestIOLimits(t *testing.T) {
+	m, err := NewVolumeManager(t.TempDir())
+	require.NoError(t, err)
+	m.RegisterBackend("block", blockBackend{})
+
+	// A burstable pod laid out by the systemd cgroup driver
+	root := t.TempDir()
+	m.SetCgroupRoot(root)
+	cgroup := filepath.Join(root, "kubepods.slice", "kubepods-burstable.slice", "kubepods-burstable-pod1234_abcd.slice")
+	require.NoError(t, os.MkdirAll(cgroup, 0755))
+	ioMax := filepath.Join(cgroup, "io.max")
+	require.NoError(t, os.WriteFile(ioMax, nil, 0644))
+
+	volumeContext := map[string]string{PodUIDKey: "1234-abcd", WriteBpsParam: "1M"}
+	vol, err := m.EnsureVolume("vol-1", 0, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.UpdateVolume(vol.ID, func(v *Volume) { v.Backend = "block" }))
+
+	require.NoError(t, m.ApplyIOLimits(vol.ID, "/a", volumeContext))
+	data, err := os.ReadFile(ioMax)
+	require.NoError(t, err)
+	assert.Equal(t, "7:3 rbps=max wbps=1000000 riops=max wiops=max\n", string(data))
+
+	// A second pod sharing the volume has limits of its own, which stay
+	// when the first pod goes
+	other := filepath.Join(root, "kubepods.slice", "kubepods-pod5678.slice")
+	require.NoError(t, os.MkdirAll(other, 0755))
+	otherIOMax := filepath.Join(other, "io.max")
+	require.NoError(t, os.WriteFile(otherIOMax, nil, 0644))
+	require.NoError(t, m.ApplyIOLimits(vol.ID, "/b", map[string]string{PodUIDKey: "5678", ReadIopsParam: "100"}))
+	vol, err = m.GetVolume(vol.ID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"/a": cgroup, "/b": other}, vol.IOCgroups)
+
+	require.NoError(t, m.RemoveIOLimits(vol.ID, "/a"))
+	data, err = os.ReadFile(ioMax)
+	require.NoError(t, err)
+	assert.Equal(t, "7:3 rbps=max wbps=max riops=max wiops=max\n", string(data))
+	data, err = os.ReadFile(otherIOMax)
+	require.NoError(t, err)
+	assert.Equal(t, "7:3 rbps=max wbps=max riops=100 wiops=max\n", string(data))
+	vol, err = m.GetVolume(vol.ID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"/b": other}, vol.IOCgroups)
+	assert.Equal(t, "7:3", vol.IODevice)
+
+	require.NoError(t, m.RemoveIOLimits(vol.ID, "/b"))
+	vol, err = m.GetVolume(vol.ID)
+	require.NoError(t, err)
+	assert.Empty(t, vol.IOCgroups)
+	assert.Empty(t, vol.IODevice)
+
+	// Limits need the pod cgroup and a block device
+	assert.ErrorIs(t, m.ApplyIOLimits(vol.ID, "/c", map[string]string{PodUIDKey: "9999", WriteBpsParam: "1M"}), ErrPodCgroupNotFound)
+	plain, err := m.EnsureVolume("vol-2", 0, nil)
+	require.NoError(t, err)
+	assert.ErrorIs(t, m.ApplyIOLimits(plain.ID, "/a", volumeContext), ErrIOLimitsUnsupported)
+	assert.NoError(t, m.ApplyIOLimits(plain.ID, "/a", map[string]string{PodUIDKey: "1234-abcd"}))
+}
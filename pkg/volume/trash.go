@@ -0,0 +1,376 @@
+package volume
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/metrics"
+)
+
+// trashDirName holds deleted volumes next to the volume directories until
+// the reaper has removed their contents
+const trashDirName = ".trash"
+
+// trash is the queue of deleted volume trees waiting to be removed. Deleting
+// a tree with many files can take longer than kubelet waits for an RPC, so
+// volumes are renamed into a trash directory on their filesystem, which is
+// atomic, and removed in the background. Entries are tracked by path.
+type trash struct {
+	mu sync.Mutex
+	// queue lists the entries not picked up by a worker yet, oldest first
+	queue []string
+	// sizes holds the known size of every pending entry, including those
+	// being removed
+	sizes map[string]int64
+	// ready has a value while the queue is not empty
+	ready chan struct{}
+}
+
+func newTrash(baseDir string) (*trash, error) {
+	t := &trash{
+		sizes: make(map[string]int64),
+		ready: make(chan struct{}, 1),
+	}
+	if err := t.resume(baseDir); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// resume queues what was left in the trash directory below dir when the
+// driver stopped
+func (t *trash) resume(dir string) error {
+	trashDir := filepath.Join(dir, trashDirName)
+	if err := os.MkdirAll(trashDir, 0700); err != nil {
+		return fmt.Errorf("failed to create trash directory: %v", err)
+	}
+
+	entries, err := os.ReadDir(trashDir)
+	if err != nil {
+		return fmt.Errorf("failed to read trash directory: %v", err)
+	}
+	queued := 0
+	for _, entry := range entries {
+		path := filepath.Join(trashDir, entry.Name())
+		if owner, ok := stateEntry(path); ok {
+			// The state of an entry that never made it into the trash
+			if _, err := os.Lstat(owner); os.IsNotExist(err) {
+				os.Remove(path)
+			}
+			continue
+		}
+		queued++
+		t.mu.Lock()
+		_, known := t.sizes[path]
+		t.mu.Unlock()
+		if !known {
+			t.add(path, 0)
+		}
+	}
+	if queued > 0 {
+		klog.Infof("Resuming removal of %d deleted volumes in %s", queued, trashDir)
+	}
+
+	return nil
+}
+
+// moveToTrash renames path into the trash directory of the pool directory
+// it is in. size is an estimate of its usage until a worker measures it.
+// The wipe state and the volume to archive, if any, are recorded before the
+// rename, so an entry is never removed unwiped or unarchived.
+func (t *trash) moveToTrash(volumeID, path, poolDir string, size int64, wipe Wipe, archive *Volume) error {
+	trashDir := filepath.Join(poolDir, trashDirName)
+	entry := filepath.Join(trashDir, volumeID+"."+strconv.FormatInt(time.Now().UnixNano(), 10))
+	if wipe.Mode != WipeNone {
+		if err := writeWipeState(entry, &wipeState{Mode: wipe.Mode, Passes: wipe.Passes}); err != nil {
+			return fmt.Errorf("failed to record wipe state: %v", err)
+		}
+	}
+	if archive != nil {
+		if err := writeArchiveState(entry, archive); err != nil {
+			os.Remove(wipeStatePath(entry))
+			return fmt.Errorf("failed to record archive state: %v", err)
+		}
+	}
+	if err := os.Rename(path, entry); err != nil {
+		os.Remove(wipeStatePath(entry))
+		os.Remove(archiveStatePath(entry))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	t.add(entry, size)
+	return nil
+}
+
+// archiveSuffix marks the volume a trash entry is archived as before it is
+// removed
+const archiveSuffix = ".archive"
+
+func archiveStatePath(entry string) string {
+	return entry + archiveSuffix
+}
+
+// stateEntry returns the entry a name in the trash directory is the wipe or
+// archive state of, or a partial write of one, if it is one
+func stateEntry(path string) (string, bool) {
+	name := strings.TrimSuffix(path, ".tmp")
+	for _, suffix := range []string{wipeSuffix, archiveSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix), true
+		}
+	}
+	return "", false
+}
+
+func readArchiveState(entry string) (*Volume, error) {
+	data, err := os.ReadFile(archiveStatePath(entry))
+	if err != nil {
+		return nil, err
+	}
+	var volume Volume
+	if err := json.Unmarshal(data, &volume); err != nil {
+		return nil, fmt.Errorf("invalid archive state of %s: %v", entry, err)
+	}
+	return &volume, nil
+}
+
+func writeArchiveState(entry string, volume *Volume) error {
+	data, err := json.Marshal(volume)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(archiveStatePath(entry), data, 0600)
+}
+
+func (t *trash) add(path string, size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.queue = append(t.queue, path)
+	t.sizes[path] = size
+	t.signalLocked()
+	t.updateMetricsLocked()
+}
+
+// next waits for an entry to remove
+func (t *trash) next(ctx context.Context) (string, bool) {
+	for {
+		t.mu.Lock()
+		if len(t.queue) > 0 {
+			path := t.queue[0]
+			t.queue = t.queue[1:]
+			// Wake up the next worker if there is more to do
+			if len(t.queue) > 0 {
+				t.signalLocked()
+			}
+			t.mu.Unlock()
+			return path, true
+		}
+		t.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return "", false
+		case <-t.ready:
+		}
+	}
+}
+
+func (t *trash) signalLocked() {
+	select {
+	case t.ready <- struct{}{}:
+	default:
+	}
+}
+
+// remove wipes an entry if requested and deletes it from disk
+func (t *trash) remove(ctx context.Context, path string) error {
+	if usage, err := DirUsage(path); err == nil {
+		t.setSize(path, usage)
+	}
+
+	start := time.Now()
+	wipe, err := wipeEntry(ctx, path)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	if wipe != nil && wipe.Mode == WipeDiscard {
+		if err := trimFilesystem(filepath.Dir(path)); err != nil {
+			klog.Warningf("Failed to trim the filesystem of %s after removing it: %v", path, err)
+		}
+	}
+	if err := os.Remove(wipeStatePath(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	klog.V(4).Infof("Removed deleted volume %s in %s", path, time.Since(start).Round(time.Millisecond))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sizes, path)
+	t.updateMetricsLocked()
+	return nil
+}
+
+func (t *trash) setSize(path string, size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sizes[path] = size
+	t.updateMetricsLocked()
+}
+
+// pending returns the number of entries and bytes waiting to be removed
+func (t *trash) pending() (int, int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.sizes), t.bytesLocked()
+}
+
+// pendingIn is pending for the entries in the trash directory trashDir
+func (t *trash) pendingIn(trashDir string) (int, int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var entries int
+	var bytes int64
+	for path, size := range t.sizes {
+		if filepath.Dir(path) == trashDir {
+			entries++
+			bytes += size
+		}
+	}
+	return entries, bytes
+}
+
+func (t *trash) bytesLocked() int64 {
+	var bytes int64
+	for _, size := range t.sizes {
+		bytes += size
+	}
+	return bytes
+}
+
+func (t *trash) updateMetricsLocked() {
+	metrics.TrashPendingVolumes.Set(float64(len(t.sizes)))
+	metrics.TrashPendingBytes.Set(float64(t.bytesLocked()))
+}
+
+// RunReaper removes deleted volumes from the trash with the given number of
+// workers until ctx is done. Entries that fail to be removed are retried
+// after a minute. It also archives and removes the backed volumes marked for
+// deletion.
+func (m *VolumeManager) RunReaper(ctx context.Context, workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m.runDeletions(ctx)
+	}()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				path, ok := m.trash.next(ctx)
+				if !ok {
+					return
+				}
+				if err := m.archiveEntry(ctx, path); err != nil {
+					// Shutting down, the archive resumes after a restart
+					return
+				}
+				if err := m.trash.remove(ctx, path); err != nil {
+					if ctx.Err() != nil {
+						// Shutting down, the wipe resumes after a restart
+						return
+					}
+					klog.Errorf("Failed to remove deleted volume %s, retrying: %v", path, err)
+					// The entry stays on disk, so it is also picked up
+					// again after a restart
+					time.AfterFunc(time.Minute, func() { m.trash.requeue(path) })
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// archiveEntry archives a trash entry if its volume was deleted with
+// archiveOnDelete, which happens before any wipe. A failed archive does not
+// block the removal, unless ctx is done, in which case the entry is archived
+// after a restart.
+func (m *VolumeManager) archiveEntry(ctx context.Context, entry string) error {
+	volume, err := readArchiveState(entry)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err == nil {
+		m.mu.RLock()
+		archiver := m.archiver
+		m.mu.RUnlock()
+		if archiver == nil {
+			err = fmt.Errorf("no archive sink is configured")
+		} else {
+			volume.Path = entry
+			err = archiver.Archive(ctx, volume)
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		klog.Errorf("Removing deleted volume %s without an archive: %v", entry, err)
+	}
+
+	if err := os.Remove(archiveStatePath(entry)); err != nil && !os.IsNotExist(err) {
+		klog.Warningf("Failed to remove the archive state of %s: %v", entry, err)
+	}
+	return nil
+}
+
+func (t *trash) requeue(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.queue = append(t.queue, path)
+	t.signalLocked()
+}
+
+// PoolTrash returns the number of volumes deleted from the named pool, or
+// from all pools without a name, and the bytes they hold that are still
+// waiting to be removed
+func (m *VolumeManager) PoolTrash(name string) (int, int64) {
+	if name == "" {
+		return m.trash.pending()
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, pool := range m.pools.list {
+		if pool.Name == name {
+			return m.trash.pendingIn(filepath.Join(pool.Path, trashDirName))
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,235 @@
+package volume
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteVolumeThroughTrash(t *testing.T) {
+	baseDir := t.TempDir()
+	m, err := NewVolumeManager(baseDir)
+	require.NoError(t, err)
+
+	vol, err := m.EnsureVolume("vol-1", 0, nil)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, os.WriteFile(filepath.Join(vol.Path, fmt.Sprintf("file-%d", i)), []byte("data"), 0644))
+	}
+
+	// Deleting only moves the volume out of the way
+	require.NoError(t, m.DeleteVolume(context.Background(), vol.ID))
+	assert.NoDirExists(t, vol.Path)
+	_, err = m.GetVolume(vol.ID)
+	assert.ErrorIs(t, err, ErrVolumeNotFound)
+	pending, _ := m.trash.pending()
+	assert.Equal(t, 1, pending)
+
+	// The same volume may be created and deleted again right away
+	_, err = m.EnsureVolume(vol.ID, 0, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.DeleteVolume(context.Background(), vol.ID))
+
+	// Removal resumes after a restart
+	m, err = NewVolumeManager(baseDir)
+	require.NoError(t, err)
+	pending, _ = m.trash.pending()
+	assert.Equal(t, 2, pending)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.RunReaper(ctx, 2)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool {
+		pending, bytes := m.trash.pending()
+		return pending == 0 && bytes == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	entries, err := os.ReadDir(filepath.Join(baseDir, trashDirName))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	cancel()
+	<-done
+}
+
+// recordingArchiver records the files of the volumes it archives
+type recordingArchiver struct {
+	mu    sync.Mutex
+	files map[string][]string
+}
+
+func (a *recordingArchiver) Archive(ctx context.Context, volume *Volume) error {
+	entries, err := os.ReadDir(volume.Path)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, entry := range entries {
+		a.files[volume.ID] = append(a.files[volume.ID], entry.Name())
+	}
+	return nil
+}
+
+func (a *recordingArchiver) archived(volumeID string) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.files[volumeID]
+}
+
+func TestArchiveFromTrash(t *testing.T) {
+	baseDir := t.TempDir()
+	m, err := NewVolumeManager(baseDir)
+	require.NoError(t, err)
+	m.SetArchiver(&recordingArchiver{files: make(map[string][]string)})
+
+	vol, err := m.EnsureVolume("vol-1", 0, map[string]string{ArchiveOnDeleteParam: "true"})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(vol.Path, "result"), []byte("data"), 0644))
+
+	// Deleting does not wait for the archive
+	require.NoError(t, m.DeleteVolume(context.Background(), vol.ID))
+	assert.NoDirExists(t, vol.Path)
+
+	// The archive resumes after a restart
+	m, err = NewVolumeManager(baseDir)
+	require.NoError(t, err)
+	archiver := &recordingArchiver{files: make(map[string][]string)}
+	m.SetArchiver(archiver)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.RunReaper(ctx, 1)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool {
+		pending, _ := m.trash.pending()
+		return pending == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"result"}, archiver.archived(vol.ID))
+	entries, err := os.ReadDir(filepath.Join(baseDir, trashDirName))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	cancel()
+	<-done
+}
+
+func TestArchiveBackedVolume(t *testing.T) {
+	baseDir := t.TempDir()
+	m, err := NewVolumeManager(baseDir)
+	require.NoError(t, err)
+	m.RegisterBackend("block", blockBackend{})
+	m.SetArchiver(&recordingArchiver{files: make(map[string][]string)})
+
+	vol, err := m.EnsureVolume("vol-1", 0, map[string]string{ArchiveOnDeleteParam: "true"})
+	require.NoError(t, err)
+	require.NoError(t, m.UpdateVolume(vol.ID, func(v *Volume) { v.Backend = "block" }))
+	require.NoError(t, os.WriteFile(filepath.Join(vol.Path, "result"), []byte("data"), 0644))
+
+	// Deleting only marks the volume, which is archived in the background
+	// while it is still set up
+	require.NoError(t, m.DeleteVolume(context.Background(), vol.ID))
+	require.NoError(t, m.DeleteVolume(context.Background(), vol.ID))
+	vol, err = m.GetVolume(vol.ID)
+	require.NoError(t, err)
+	assert.True(t, vol.Deleting)
+	assert.DirExists(t, vol.Path)
+	_, err = m.EnsureVolume(vol.ID, 0, nil)
+	assert.ErrorIs(t, err, ErrVolumeDeleting)
+
+	// The deletion resumes after a restart
+	m, err = NewVolumeManager(baseDir)
+	require.NoError(t, err)
+	m.RegisterBackend("block", blockBackend{})
+	archiver := &recordingArchiver{files: make(map[string][]string)}
+	m.SetArchiver(archiver)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.RunReaper(ctx, 1)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool {
+		_, err := m.GetVolume(vol.ID)
+		return errors.Is(err, ErrVolumeNotFound)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"result"}, archiver.archived(vol.ID))
+	assert.NoDirExists(t, vol.Path)
+
+	cancel()
+	<-done
+}
+
+// blockingBackend is a backend whose Teardown waits for release, and fails
+// with err
+type blockingBackend struct {
+	started chan struct{}
+	release chan error
+}
+
+func (b *blockingBackend) Setup(*Volume) error { return nil }
+
+func (b *blockingBackend) Teardown(*Volume) error {
+	b.started <- struct{}{}
+	return <-b.release
+}
+
+func TestDeleteVolumeTearsDownWithoutLocks(t *testing.T) {
+	m, err := NewVolumeManager(t.TempDir())
+	require.NoError(t, err)
+	backend := &blockingBackend{started: make(chan struct{}), release: make(chan error)}
+	m.RegisterBackend("slow", backend)
+	m.RegisterBackend("block", blockBackend{})
+
+	vol, err := m.EnsureVolume("vol-1", 0, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.UpdateVolume(vol.ID, func(v *Volume) { v.Backend = "slow" }))
+	other, err := m.EnsureVolume("vol-2", 0, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.UpdateVolume(other.ID, func(v *Volume) { v.Backend = "block" }))
+
+	deleted := make(chan error)
+	go func() { deleted <- m.DeleteVolume(context.Background(), vol.ID) }()
+	<-backend.started
+
+	// Other volumes are usable while the volume is torn down, the volume
+	// itself is not
+	_, err = m.EnsureVolume("vol-3", 0, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.SetupVolume(other.ID))
+	assert.ErrorIs(t, m.SetupVolume(vol.ID), ErrVolumeDeleting)
+	assert.ErrorIs(t, m.DeleteVolume(context.Background(), vol.ID), ErrVolumeDeleting)
+	deleting, err := m.GetVolume(vol.ID)
+	require.NoError(t, err)
+	assert.True(t, deleting.Deleting)
+
+	// A failed teardown leaves the volume marked, and is retried
+	backend.release <- errors.New("device busy")
+	assert.Error(t, <-deleted)
+	_, err = m.GetVolume(vol.ID)
+	require.NoError(t, err)
+
+	go func() { deleted <- m.DeleteVolume(context.Background(), vol.ID) }()
+	<-backend.started
+	backend.release <- nil
+	require.NoError(t, <-deleted)
+	_, err = m.GetVolume(vol.ID)
+	assert.ErrorIs(t, err, ErrVolumeNotFound)
+	assert.NoDirExists(t, vol.Path)
+}
@@ -0,0 +1,259 @@
+package volume
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/metrics"
+)
+
+// warmDirName holds pre-created volumes next to the volume directories of
+// a pool
+const warmDirName = ".warm"
+
+// Prewarmer is implemented by backends whose expensive setup, such as
+// formatting an image, can be done before a volume is requested
+type Prewarmer interface {
+	// Prewarm prepares the backend state for a volume of size bytes in dir
+	Prewarm(dir string, size int64) error
+	// Claim hands the state prepared in dir over to volume
+	Claim(dir string, volume *Volume) error
+}
+
+// WarmPoolConfig configures the pool of pre-created volumes
+type WarmPoolConfig struct {
+	// Count is the number of volumes kept ready
+	Count int
+	// Size is the capacity of the volumes, only requests for exactly this
+	// capacity are served from the pool
+	Size int64
+	// Backend is the backend the volumes are prepared for, empty for plain
+	// directories
+	Backend string
+	// Pool is the storage pool the volumes are created in, empty for the
+	// first pool
+	Pool string
+}
+
+// warmPool keeps pre-created volumes ready to be claimed. Every entry is a
+// directory below the warm directory holding the volume directory and the
+// state prepared by the backend. Entries are named after the configuration
+// they were prepared for, so a changed configuration discards them.
+type warmPool struct {
+	// cfg names the pool even if the configuration left it empty
+	cfg    WarmPoolConfig
+	dir    string
+	prefix string
+
+	mu    sync.Mutex
+	ready []string
+	seq   int64
+	// refill has a value while the pool needs refilling
+	refill chan struct{}
+}
+
+// SetWarmPool keeps cfg.Count volumes ready to be claimed by new volumes.
+// RunWarmPool fills the pool.
+func (m *VolumeManager) SetWarmPool(cfg WarmPoolConfig) error {
+	if cfg.Count <= 0 {
+		return nil
+	}
+	cfg.Size = parseSize(cfg.Size)
+
+	var poolPath string
+	for _, pool := range m.Pools() {
+		if cfg.Pool == "" || pool.Name == cfg.Pool {
+			cfg.Pool, poolPath = pool.Name, pool.Path
+			break
+		}
+	}
+	if poolPath == "" {
+		return fmt.Errorf("%w: %s", ErrUnknownPool, cfg.Pool)
+	}
+
+	backendName := cfg.Backend
+	if backendName == "" {
+		backendName = "dir"
+	}
+	pool := &warmPool{
+		cfg:    cfg,
+		dir:    filepath.Join(poolPath, warmDirName),
+		prefix: fmt.Sprintf("%s-%d-", backendName, cfg.Size),
+		seq:    time.Now().UnixNano(),
+		refill: make(chan struct{}, 1),
+	}
+	if err := os.MkdirAll(pool.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create warm pool directory: %v", err)
+	}
+
+	// Keep what is left from a previous run if it still matches
+	entries, err := os.ReadDir(pool.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, pool.prefix) && !strings.HasSuffix(name, ".tmp") {
+			pool.ready = append(pool.ready, name)
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(pool.dir, name)); err != nil {
+			return fmt.Errorf("failed to clean up warm pool: %v", err)
+		}
+	}
+	metrics.WarmPoolAvailable.Set(float64(len(pool.ready)))
+	pool.signal()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.warm = pool
+
+	return nil
+}
+
+// RunWarmPool refills the warm pool until ctx is done
+func (m *VolumeManager) RunWarmPool(ctx context.Context) {
+	m.mu.RLock()
+	pool := m.warm
+	m.mu.RUnlock()
+	if pool == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pool.refill:
+		}
+
+		for pool.missing() > 0 && ctx.Err() == nil {
+			if err := m.prewarm(pool); err != nil {
+				klog.Errorf("Failed to prepare warm volume, retrying: %v", err)
+				time.AfterFunc(time.Minute, pool.signal)
+				break
+			}
+		}
+	}
+}
+
+// prewarm prepares one volume and adds it to the pool
+func (m *VolumeManager) prewarm(pool *warmPool) error {
+	var prewarmer Prewarmer
+	if pool.cfg.Backend != "" {
+		m.mu.RLock()
+		backend, ok := m.backends[pool.cfg.Backend]
+		m.mu.RUnlock()
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrBackendUnavailable, pool.cfg.Backend)
+		}
+		prewarmer, _ = backend.(Prewarmer)
+	}
+
+	name := pool.nextName()
+	tmp := filepath.Join(pool.dir, name+".tmp")
+	if err := os.MkdirAll(filepath.Join(tmp, "volume"), defaultVolumePermissions); err != nil {
+		return err
+	}
+	if prewarmer != nil {
+		if err := prewarmer.Prewarm(tmp, pool.cfg.Size); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, filepath.Join(pool.dir, name)); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.ready = append(pool.ready, name)
+	metrics.WarmPoolAvailable.Set(float64(len(pool.ready)))
+	return nil
+}
+
+// claimWarmLocked moves a warm volume to the path of volume, if one matches.
+// It reports whether the volume was served from the pool.
+func (m *VolumeManager) claimWarmLocked(volume *Volume) bool {
+	pool := m.warm
+	if pool == nil {
+		return false
+	}
+	// Warm images are formatted without encryption
+	if volume.Size != pool.cfg.Size || volume.Backend != pool.cfg.Backend || volume.Pool != pool.cfg.Pool || IsEncrypted(volume.Attributes) {
+		metrics.WarmPoolMisses.Inc()
+		return false
+	}
+	name, ok := pool.take()
+	if !ok {
+		metrics.WarmPoolMisses.Inc()
+		return false
+	}
+	defer pool.signal()
+
+	dir := filepath.Join(pool.dir, name)
+	if err := m.claimWarm(dir, volume); err != nil {
+		klog.Warningf("Failed to claim warm volume %s for %s: %v", name, volume.ID, err)
+		os.RemoveAll(dir)
+		metrics.WarmPoolMisses.Inc()
+		return false
+	}
+	os.RemoveAll(dir)
+	metrics.WarmPoolHits.Inc()
+	klog.V(4).Infof("Claimed warm volume %s for %s", name, volume.ID)
+
+	return true
+}
+
+func (m *VolumeManager) claimWarm(dir string, volume *Volume) error {
+	if prewarmer, ok := m.backends[volume.Backend].(Prewarmer); ok {
+		if err := prewarmer.Claim(dir, volume); err != nil {
+			return err
+		}
+	}
+	return os.Rename(filepath.Join(dir, "volume"), volume.Path)
+}
+
+func (p *warmPool) take() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.ready) == 0 {
+		return "", false
+	}
+	name := p.ready[len(p.ready)-1]
+	p.ready = p.ready[:len(p.ready)-1]
+	metrics.WarmPoolAvailable.Set(float64(len(p.ready)))
+	return name, true
+}
+
+func (p *warmPool) missing() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.cfg.Count - len(p.ready)
+}
+
+func (p *warmPool) nextName() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.seq++
+	return p.prefix + strconv.FormatInt(p.seq, 10)
+}
+
+func (p *warmPool) signal() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
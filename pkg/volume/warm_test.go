@@ -0,0 +1,64 @@
+package volume
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/metrics"
+)
+
+func waitForWarmVolumes(t *testing.T, m *VolumeManager, count int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		return m.warm.missing() == m.warm.cfg.Count-count
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWarmPool(t *testing.T) {
+	m, _, _ := newOverlayManager(t)
+	require.NoError(t, m.SetWarmPool(WarmPoolConfig{Count: 2, Size: 64 << 20, Backend: OverlayBackendName}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.RunWarmPool(ctx)
+	waitForWarmVolumes(t, m, 2)
+
+	hits, misses := testutil.ToFloat64(metrics.WarmPoolHits), testutil.ToFloat64(metrics.WarmPoolMisses)
+
+	// A matching request takes a warm volume including its formatted image
+	vol, err := m.EnsureVolume("vol-1", 64<<20, map[string]string{BaseLayerParam: "dataset"})
+	require.NoError(t, err)
+	assert.DirExists(t, vol.Path)
+	assert.FileExists(t, filepath.Join(m.BaseDir(), overlayDirName, vol.ID, "upper.img"))
+	require.NoError(t, m.SetupVolume(vol.ID))
+	assert.Equal(t, hits+1, testutil.ToFloat64(metrics.WarmPoolHits))
+
+	// Other sizes and plain directories are created on demand
+	_, err = m.EnsureVolume("vol-2", 128<<20, map[string]string{BaseLayerParam: "dataset"})
+	require.NoError(t, err)
+	_, err = m.EnsureVolume("vol-3", 64<<20, nil)
+	require.NoError(t, err)
+	assert.Equal(t, misses+2, testutil.ToFloat64(metrics.WarmPoolMisses))
+
+	// The pool refills in the background and survives a restart
+	waitForWarmVolumes(t, m, 2)
+	cancel()
+	restarted, err := NewVolumeManager(m.BaseDir())
+	require.NoError(t, err)
+	require.NoError(t, restarted.SetWarmPool(WarmPoolConfig{Count: 2, Size: 64 << 20, Backend: OverlayBackendName}))
+	assert.Equal(t, 0, restarted.warm.missing())
+
+	// A changed configuration discards the old volumes
+	require.NoError(t, restarted.SetWarmPool(WarmPoolConfig{Count: 1}))
+	assert.Equal(t, 1, restarted.warm.missing())
+	entries, err := os.ReadDir(filepath.Join(m.BaseDir(), warmDirName))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
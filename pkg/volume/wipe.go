@@ -0,0 +1,426 @@
+package volume
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"k8s.io/klog/v2"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/metrics"
+)
+
+// Attributes selecting how the data of a volume is destroyed when it is
+// deleted
+const (
+	WipeParam       = "wipe"
+	WipePassesParam = "wipePasses"
+
+	maxWipePasses = 7
+)
+
+// WipeMode is how the contents of a deleted volume are destroyed before
+// they are unlinked
+type WipeMode string
+
+const (
+	// WipeNone only unlinks the files, their contents stay on the disk
+	// until the blocks are reused
+	WipeNone WipeMode = "none"
+	// WipeDiscard deallocates the blocks of images and trims the free space
+	// of the filesystem, so that the disk discards them
+	WipeDiscard WipeMode = "discard"
+	// WipeOverwrite writes over the data of every file before unlinking it
+	WipeOverwrite WipeMode = "overwrite"
+)
+
+const (
+	// wipeSuffix marks the state of the wipe of a trash entry
+	wipeSuffix = ".wipe"
+	// wipeChunk is the size of a single write while overwriting
+	wipeChunk = 1 << 20
+	// wipeCheckpointBytes is how much is overwritten between recording
+	// the progress of a wipe
+	wipeCheckpointBytes = 64 << 20
+	// wipeReportInterval is how often the progress of a wipe is logged
+	wipeReportInterval = 10 * time.Second
+
+	// Linux fallocate, lseek and ioctl values not in the syscall package
+	fallocPunchHole = 0x01 | 0x02 // FALLOC_FL_KEEP_SIZE | FALLOC_FL_PUNCH_HOLE
+	seekData        = 3
+	seekHole        = 4
+	fitrim          = 0xc0185879
+)
+
+// Wipe is the wipe policy of a volume
+type Wipe struct {
+	Mode WipeMode
+	// Passes is the number of times each file is overwritten. All but
+	// the last pass write random data, the last writes zeros.
+	Passes int
+}
+
+// ParseWipe reads the wipe policy from the attributes of a volume. Volumes
+// are not wiped by default.
+func ParseWipe(attributes map[string]string) (Wipe, error) {
+	wipe := Wipe{Mode: WipeNone, Passes: 1}
+	switch mode := WipeMode(attributes[WipeParam]); mode {
+	case "", WipeNone:
+	case WipeDiscard, WipeOverwrite:
+		wipe.Mode = mode
+	default:
+		return wipe, fmt.Errorf("invalid %s value %q, must be none, discard or overwrite", WipeParam, mode)
+	}
+
+	if value := attributes[WipePassesParam]; value != "" {
+		passes, err := strconv.Atoi(value)
+		if err != nil || passes < 1 || passes > maxWipePasses {
+			return wipe, fmt.Errorf("invalid %s value %q, must be between 1 and %d", WipePassesParam, value, maxWipePasses)
+		}
+		if wipe.Mode != WipeOverwrite {
+			return wipe, fmt.Errorf("%s requires %s: %s", WipePassesParam, WipeParam, WipeOverwrite)
+		}
+		wipe.Passes = passes
+	}
+	return wipe, nil
+}
+
+// DataLocator is implemented by backends keeping the data of a volume
+// outside the volume directory, e.g. in an image. Teardown leaves these
+// paths in place for volumes that are wiped, and the caller wipes and
+// removes them along with the volume directory.
+type DataLocator interface {
+	DataPaths(volume *Volume) []string
+}
+
+// wipeState is the progress of the wipe of a trash entry, which is kept
+// next to the entry so that an interrupted wipe resumes after a restart
+type wipeState struct {
+	Mode   WipeMode `json:"mode"`
+	Passes int      `json:"passes"`
+	// Files is the number of regular files, in walk order, that are done
+	Files int `json:"files"`
+	// Pass and Offset are the progress within the next file
+	Pass   int   `json:"pass"`
+	Offset int64 `json:"offset"`
+	// Done is set once all data is destroyed and only unlinking is left
+	Done bool `json:"done"`
+}
+
+func wipeStatePath(entry string) string {
+	return entry + wipeSuffix
+}
+
+func readWipeState(entry string) (*wipeState, error) {
+	data, err := os.ReadFile(wipeStatePath(entry))
+	if err != nil {
+		return nil, err
+	}
+	var state wipeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid wipe state of %s: %v", entry, err)
+	}
+	return &state, nil
+}
+
+func writeWipeState(entry string, state *wipeState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(wipeStatePath(entry), data, 0600)
+}
+
+// wiper destroys the data of a trash entry
+type wiper struct {
+	ctx   context.Context
+	entry string
+	state *wipeState
+
+	// total is the estimated number of bytes to write, done those written
+	// so far and checkpointed those written at the last checkpoint
+	total        int64
+	done         int64
+	checkpointed int64
+	lastReport   time.Time
+
+	// links counts the names of each inode with several links within the
+	// entry, and wiped holds those that are done
+	links map[fileID]uint64
+	wiped map[fileID]bool
+}
+
+// fileID identifies an inode
+type fileID struct {
+	dev, ino uint64
+}
+
+// linkedFile returns the inode of a file with several links, if it is one
+func linkedFile(info fs.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
+
+// countLinks counts the names within entry of every inode with several links
+func countLinks(entry string) (map[fileID]uint64, error) {
+	links := make(map[fileID]uint64)
+	err := filepath.WalkDir(entry, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if id, ok := linkedFile(info); ok {
+			links[id]++
+		}
+		return nil
+	})
+	return links, err
+}
+
+// wipeEntry destroys the data of a trash entry according to its wipe
+// state, if it has one, and returns the state. It resumes where an earlier
+// attempt stopped.
+func wipeEntry(ctx context.Context, entry string) (*wipeState, error) {
+	state, err := readWipeState(entry)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil || state.Done {
+		return state, err
+	}
+
+	links, err := countLinks(entry)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	w := &wiper{ctx: ctx, entry: entry, state: state, lastReport: time.Now(), links: links, wiped: make(map[fileID]bool)}
+	if state.Mode == WipeOverwrite {
+		usage, _ := DirUsage(entry)
+		w.total = usage * int64(state.Passes)
+	}
+
+	start := time.Now()
+	files := 0
+	err = filepath.WalkDir(entry, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Anything else, including device nodes a pod may have created,
+		// holds no data of the volume
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		files++
+		if files <= state.Files {
+			// Done before a restart, along with its other links
+			if info, err := d.Info(); err == nil {
+				if id, ok := linkedFile(info); ok {
+					w.wiped[id] = true
+				}
+			}
+			return nil
+		}
+		if err := w.wipeFile(path); err != nil {
+			return fmt.Errorf("failed to wipe %s: %w", path, err)
+		}
+		state.Files, state.Pass, state.Offset = files, 0, 0
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		// Record how far we got, the next attempt continues from there
+		if saveErr := writeWipeState(entry, state); saveErr != nil {
+			klog.Errorf("Failed to record wipe progress of %s: %v", entry, saveErr)
+		}
+		return nil, err
+	}
+
+	state.Done = true
+	if err := writeWipeState(entry, state); err != nil {
+		return nil, err
+	}
+	metrics.WipedVolumes.WithLabelValues(string(state.Mode)).Inc()
+	klog.Infof("Wiped deleted volume %s (%s) in %s", entry, state.Mode, time.Since(start).Round(time.Millisecond))
+	return state, nil
+}
+
+// wipeFile destroys the data of a regular file
+func (w *wiper) wipeFile(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	// An inode linked within the volume is wiped once. Other links may be
+	// outside the volume, e.g. from a seed cache, and then its data is not
+	// the volume's to destroy.
+	if id, ok := linkedFile(info); ok {
+		if nlink := uint64(info.Sys().(*syscall.Stat_t).Nlink); nlink > w.links[id] {
+			klog.V(4).Infof("Not wiping %s, %d of its %d links are outside the volume", path, nlink-w.links[id], nlink)
+			return nil
+		}
+		if w.wiped[id] {
+			return nil
+		}
+		w.wiped[id] = true
+	}
+	if info.Mode().Perm()&0200 == 0 {
+		if err := os.Chmod(path, info.Mode().Perm()|0200); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if w.state.Mode == WipeDiscard {
+		return discardFile(f, info.Size())
+	}
+	for ; w.state.Pass < w.state.Passes; w.state.Pass++ {
+		random := w.state.Pass < w.state.Passes-1
+		if err := w.overwrite(f, info.Size(), random); err != nil {
+			return err
+		}
+		w.state.Offset = 0
+	}
+	return nil
+}
+
+// overwrite writes zeros or random data over the data regions of f from
+// the recorded offset. Holes are skipped, writing them would only allocate
+// space that never held data.
+func (w *wiper) overwrite(f *os.File, size int64, random bool) error {
+	buf := make([]byte, wipeChunk)
+	offset := w.state.Offset
+	for offset < size {
+		start, end, err := dataRegion(f, offset, size)
+		if err != nil {
+			return err
+		}
+		if start >= size {
+			break
+		}
+		for offset = start; offset < end; {
+			if err := w.ctx.Err(); err != nil {
+				return err
+			}
+			n := int64(len(buf))
+			if end-offset < n {
+				n = end - offset
+			}
+			if random {
+				if _, err := rand.Read(buf[:n]); err != nil {
+					return err
+				}
+			} else {
+				clear(buf[:n])
+			}
+			if _, err := f.WriteAt(buf[:n], offset); err != nil {
+				return err
+			}
+			offset += n
+			w.progress(n)
+			if w.done-w.checkpointed >= wipeCheckpointBytes {
+				if err := w.checkpoint(f, offset); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	// The data must reach the disk before the file is unlinked, or the
+	// dirty pages are simply dropped
+	return f.Sync()
+}
+
+// checkpoint records the progress within the current file once what was
+// written is on disk
+func (w *wiper) checkpoint(f *os.File, offset int64) error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	w.state.Offset = offset
+	if err := writeWipeState(w.entry, w.state); err != nil {
+		return err
+	}
+	w.checkpointed = w.done
+	return nil
+}
+
+func (w *wiper) progress(n int64) {
+	w.done += n
+	metrics.WipedBytes.Add(float64(n))
+	if time.Since(w.lastReport) < wipeReportInterval {
+		return
+	}
+	w.lastReport = time.Now()
+	if w.total > 0 {
+		klog.Infof("Wiping deleted volume %s: %d%% of %d bytes", w.entry, min(100, w.done*100/w.total), w.total)
+	}
+}
+
+// dataRegion returns the next region of f at or after offset that holds
+// data. Filesystems without SEEK_DATA report the rest of the file.
+func dataRegion(f *os.File, offset, size int64) (int64, int64, error) {
+	start, err := f.Seek(offset, seekData)
+	if errors.Is(err, syscall.ENXIO) {
+		return size, size, nil
+	}
+	if errors.Is(err, syscall.EINVAL) {
+		return offset, size, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := f.Seek(start, seekHole)
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, min(end, size), nil
+}
+
+// discardFile deallocates all blocks of f, the equivalent of a BLKDISCARD
+// on the loop device of an image. Filesystems that cannot punch holes
+// leave the blocks to be discarded by the trim after unlinking.
+func discardFile(f *os.File, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(f.Fd()), fallocPunchHole, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		return nil
+	}
+	return err
+}
+
+// trimFilesystem asks the filesystem of dir to discard its free blocks
+// on the underlying device
+func trimFilesystem(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rng := struct{ start, len, minLen uint64 }{0, ^uint64(0), 0}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fitrim, uintptr(unsafe.Pointer(&rng)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
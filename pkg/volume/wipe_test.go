@@ -0,0 +1,221 @@
+package volume
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chinnareddy578/kubernetes-ephemeral-csi/pkg/metrics"
+)
+
+func TestParseWipe(t *testing.T) {
+	wipe, err := ParseWipe(nil)
+	require.NoError(t, err)
+	assert.Equal(t, Wipe{Mode: WipeNone, Passes: 1}, wipe)
+
+	wipe, err = ParseWipe(map[string]string{WipeParam: "overwrite", WipePassesParam: "3"})
+	require.NoError(t, err)
+	assert.Equal(t, Wipe{Mode: WipeOverwrite, Passes: 3}, wipe)
+
+	for _, attributes := range []map[string]string{
+		{WipeParam: "shred"},
+		{WipeParam: "overwrite", WipePassesParam: "0"},
+		{WipeParam: "overwrite", WipePassesParam: "many"},
+		{WipeParam: "discard", WipePassesParam: "2"},
+	} {
+		_, err := ParseWipe(attributes)
+		assert.Error(t, err, attributes)
+	}
+}
+
+// trashEntries returns the entries in the trash of the base directory,
+// without their wipe and archive states
+func trashEntries(t *testing.T, baseDir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(baseDir, trashDirName))
+	require.NoError(t, err)
+	var paths []string
+	for _, entry := range entries {
+		if _, ok := stateEntry(entry.Name()); !ok {
+			paths = append(paths, filepath.Join(baseDir, trashDirName, entry.Name()))
+		}
+	}
+	return paths
+}
+
+func TestOverwriteWipe(t *testing.T) {
+	baseDir := t.TempDir()
+	m, err := NewVolumeManager(baseDir)
+	require.NoError(t, err)
+
+	vol, err := m.EnsureVolume("vol-1", 0, map[string]string{WipeParam: "overwrite", WipePassesParam: "2"})
+	require.NoError(t, err)
+	secret := bytes.Repeat([]byte("secret"), 500000)
+	require.NoError(t, os.WriteFile(filepath.Join(vol.Path, "a"), secret, 0400))
+	require.NoError(t, os.MkdirAll(filepath.Join(vol.Path, "dir"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(vol.Path, "dir", "b"), secret, 0644))
+	// Data linked from outside the volume is left alone
+	shared := filepath.Join(t.TempDir(), "shared")
+	require.NoError(t, os.WriteFile(shared, secret, 0644))
+	require.NoError(t, os.Link(shared, filepath.Join(vol.Path, "linked")))
+
+	require.NoError(t, m.DeleteVolume(context.Background(), vol.ID))
+	entries := trashEntries(t, baseDir)
+	require.Len(t, entries, 1)
+	entry := entries[0]
+
+	// An interrupted wipe records its progress
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = wipeEntry(ctx, entry)
+	require.ErrorIs(t, err, context.Canceled)
+	state, err := readWipeState(entry)
+	require.NoError(t, err)
+	assert.Equal(t, wipeState{Mode: WipeOverwrite, Passes: 2}, *state)
+
+	// and resumes from it
+	state.Files = 1
+	require.NoError(t, writeWipeState(entry, state))
+	state, err = wipeEntry(context.Background(), entry)
+	require.NoError(t, err)
+	assert.True(t, state.Done)
+
+	data, err := os.ReadFile(filepath.Join(entry, "a"))
+	require.NoError(t, err)
+	assert.Equal(t, secret, data, "files before the recorded progress are done")
+	data, err = os.ReadFile(filepath.Join(entry, "dir", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, make([]byte, len(secret)), data, "the last pass writes zeros")
+	data, err = os.ReadFile(shared)
+	require.NoError(t, err)
+	assert.Equal(t, secret, data)
+
+	// Removing the entry also removes its wipe state
+	require.NoError(t, m.trash.remove(context.Background(), entry))
+	empty, err := os.ReadDir(filepath.Join(baseDir, trashDirName))
+	require.NoError(t, err)
+	assert.Empty(t, empty)
+}
+
+func TestWipeHardLinks(t *testing.T) {
+	entry := filepath.Join(t.TempDir(), "entry")
+	require.NoError(t, os.MkdirAll(filepath.Join(entry, "dir"), 0700))
+	secret := bytes.Repeat([]byte("secret"), 1000)
+	require.NoError(t, os.WriteFile(filepath.Join(entry, "a"), secret, 0644))
+	require.NoError(t, os.Link(filepath.Join(entry, "a"), filepath.Join(entry, "dir", "a")))
+	require.NoError(t, os.Link(filepath.Join(entry, "a"), filepath.Join(entry, "dir", "b")))
+	shared := filepath.Join(t.TempDir(), "shared")
+	require.NoError(t, os.WriteFile(shared, secret, 0644))
+	require.NoError(t, os.Link(shared, filepath.Join(entry, "shared")))
+	require.NoError(t, os.Link(shared, filepath.Join(entry, "dir", "shared")))
+
+	wiped := testutil.ToFloat64(metrics.WipedBytes)
+	require.NoError(t, writeWipeState(entry, &wipeState{Mode: WipeOverwrite, Passes: 2}))
+	_, err := wipeEntry(context.Background(), entry)
+	require.NoError(t, err)
+
+	// An inode linked only within the entry is wiped, once for all links
+	data, err := os.ReadFile(filepath.Join(entry, "dir", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, make([]byte, len(secret)), data)
+	assert.Equal(t, float64(2*len(secret)), testutil.ToFloat64(metrics.WipedBytes)-wiped)
+	// One linked from outside is left alone
+	data, err = os.ReadFile(shared)
+	require.NoError(t, err)
+	assert.Equal(t, secret, data)
+}
+
+func TestWipeSparseImage(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "entry", "upper.img")
+	require.NoError(t, os.MkdirAll(filepath.Dir(image), 0700))
+	require.NoError(t, createSparseFile(image, 1<<30))
+	f, err := os.OpenFile(image, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("secret"), 512<<20)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	entry := filepath.Dir(image)
+	require.NoError(t, writeWipeState(entry, &wipeState{Mode: WipeOverwrite, Passes: 1}))
+	_, err = wipeEntry(context.Background(), entry)
+	require.NoError(t, err)
+
+	// Only the data is overwritten, the holes stay unallocated
+	usage, err := DirUsage(entry)
+	require.NoError(t, err)
+	assert.Less(t, usage, int64(64<<20))
+	f, err = os.Open(image)
+	require.NoError(t, err)
+	defer f.Close()
+	data := make([]byte, 6)
+	_, err = f.ReadAt(data, 512<<20)
+	require.NoError(t, err)
+	assert.Equal(t, make([]byte, 6), data)
+}
+
+func TestDiscardWipe(t *testing.T) {
+	entry := filepath.Join(t.TempDir(), "entry")
+	require.NoError(t, os.MkdirAll(entry, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(entry, "upper.img"), bytes.Repeat([]byte("secret"), 100000), 0600))
+
+	require.NoError(t, writeWipeState(entry, &wipeState{Mode: WipeDiscard, Passes: 1}))
+	_, err := wipeEntry(context.Background(), entry)
+	require.NoError(t, err)
+
+	// The blocks are deallocated, reading returns zeros
+	data, err := os.ReadFile(filepath.Join(entry, "upper.img"))
+	require.NoError(t, err)
+	assert.Equal(t, make([]byte, 600000), data)
+}
+
+func TestWipeResumesAfterRestart(t *testing.T) {
+	m, _, _ := newOverlayManager(t)
+	baseDir := m.BaseDir()
+
+	vol, err := m.EnsureVolume("vol-1", 64<<20, map[string]string{BaseLayerParam: "dataset", WipeParam: "overwrite"})
+	require.NoError(t, err)
+	require.NoError(t, m.SetupVolume(vol.ID))
+	require.NoError(t, m.DeleteVolume(context.Background(), vol.ID))
+
+	// The upper layer goes to the trash to be wiped along with the volume
+	state := filepath.Join(baseDir, overlayDirName, vol.ID)
+	assert.NoDirExists(t, state)
+	entries := trashEntries(t, baseDir)
+	require.Len(t, entries, 2)
+	for _, entry := range entries {
+		assert.True(t, strings.HasPrefix(filepath.Base(entry), "vol-1."))
+		assert.FileExists(t, wipeStatePath(entry))
+	}
+
+	// A wipe state without its entry is dropped
+	orphan := filepath.Join(baseDir, trashDirName, "vol-2.1")
+	require.NoError(t, writeWipeState(orphan, &wipeState{Mode: WipeDiscard}))
+
+	m, err = NewVolumeManager(baseDir)
+	require.NoError(t, err)
+	pending, _ := m.trash.pending()
+	assert.Equal(t, 2, pending)
+	assert.NoFileExists(t, wipeStatePath(orphan))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.RunReaper(ctx, 1)
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		entries, err := os.ReadDir(filepath.Join(baseDir, trashDirName))
+		return err == nil && len(entries) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
+}
@@ -4,7 +4,7 @@ set -e
 
 # Build the CSI driver binary
 echo "Building CSI driver..."
-go build -o ephemeral-csi cmd/driver/main.go
+go build -o ephemeral-csi ./cmd/csi-driver
 
 # Build the container image
 echo "Building container image..."